@@ -1,6 +1,7 @@
 package api
 
 import (
+	"encoding/json"
 	"errors"
 	"math"
 	"time"
@@ -11,6 +12,22 @@ type UserInfo struct {
 	ID                string `json:"user_id"`
 	NotificationToken string `json:"notification_token"`
 	DeviceOS          string `json:"device_os"`
+	// the name of the notifier to use for this user, if this is empty then
+	// the notifier is chosen by operating system
+	Channel string `json:"channel,omitempty"`
+	// set when the push provider has rejected the notification token, the
+	// device should register again with a new token
+	NeedsReregister bool `json:"needs_reregister"`
+	// used to choose the language of notifications, such as "en" or "fr-CA"
+	Locale string `json:"locale,omitempty"`
+	// the notification sound from the user's preferences
+	Sound string `json:"-"`
+	// the user's repeating trips won't run before this local date, such as
+	// "2017-07-02"
+	PausedUntil string `json:"paused_until,omitempty"`
+	// the local dates imported from the user's holiday calendar, repeating
+	// trips won't run on these
+	Holidays []string `json:"-"`
 }
 
 // Point stores a lat and lng to indicate a location
@@ -40,9 +57,42 @@ type TripSchedule struct {
 	WaitingWindowMs int64  `json:"waiting_window_ms"`
 	TransportType   string `json:"transport_type"`
 	RepeatDays      []bool `json:"repeat_days"`
-	Enabled         bool   `json:"enabled"`
+	// local dates such as "2017-07-02" that a repeating trip won't run on
+	SkipDates []string `json:"skip_dates,omitempty"`
+	Enabled   bool     `json:"enabled"`
+	// if set then any service arriving up to this many milliseconds before
+	// the input arrival time can be chosen instead of the scheduled route
+	ArrivalWindowMs int64 `json:"arrival_window_ms"`
+	// how to choose between services that arrive within the window
+	Ranking RouteRanking `json:"ranking"`
+	// notifications sent before each departure, if this is empty then a
+	// single alert is sent based on the waiting window
+	Reminders []Reminder `json:"reminders,omitempty"`
+	// if set then the user is notified when the departure or arrival time
+	// moves by more than this many milliseconds
+	DelayThresholdMs int64 `json:"delay_threshold_ms"`
 	// timestamp the last notification for this trip was sent
 	LastNotificationSent int64 `json:"last_notification"`
+	// true if the waiting window was in the JSON the trip was decoded from,
+	// so that an explicit zero isn't replaced by the user's default
+	waitingWindowSet bool
+}
+
+// UnmarshalJSON will decode the trip and record whether the waiting window
+// was set
+func (t *TripSchedule) UnmarshalJSON(b []byte) error {
+	// the alias type stops this from calling itself
+	type tripSchedule TripSchedule
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, (*tripSchedule)(t)); err != nil {
+		return err
+	}
+	raw, ok := fields["waiting_window_ms"]
+	t.waitingWindowSet = ok && string(raw) != "null"
+	return nil
 }
 
 // UpsertUser will add this user if they aren't already added.
@@ -95,6 +145,20 @@ func IsEnabled(db DatabaseInterface, trip *TripSchedule) bool {
 
 // ScheduleTrip will add this trip to the database
 func ScheduleTrip(db DatabaseInterface, trip *TripSchedule) error {
+	if !IsValidRanking(trip.Ranking) {
+		return errors.New("Unknown ranking")
+	}
+	if err := ValidateReminders(trip.Reminders); err != nil {
+		return err
+	}
+	for _, date := range trip.SkipDates {
+		if _, err := time.Parse(dateFormat, date); err != nil {
+			return errors.New("Invalid skip date " + date)
+		}
+	}
+	if trip.DelayThresholdMs < 0 {
+		return errors.New("Delay threshold cannot be negative")
+	}
 	// store trip
 	err := db.ScheduleTrip(trip)
 	return err
@@ -106,7 +170,48 @@ func GetRoute(finder RouteFinder, trip *TripSchedule) (RouteOption, error) {
 		trip.Destination.Lat, trip.Destination.Lng,
 		trip.TransportType, GetInputArrivalTime(trip),
 		trip.Route.Name)
-	return getRouteFromDescription(trip, resp)
+	return getMatchingRoute(trip, resp)
+}
+
+// FindReplacementRoute will find the next viable service for a trip whose
+// route has been cancelled or no longer stops at the boarding stop. The
+// replacement must still arrive by the time the user originally searched
+// for. Of those routes, the one that leaves the latest is chosen
+// @param trip - scheduled trip
+// @param cancelled - the route that is no longer running
+func FindReplacementRoute(finder RouteFinder, trip *TripSchedule, cancelled RouteOption) (RouteOption, error) {
+	arrivalTime := GetInputArrivalTime(trip)
+	resp := finder.FindRoutes(trip.Origin.Lat, trip.Origin.Lng,
+		trip.Destination.Lat, trip.Destination.Lng,
+		trip.TransportType, arrivalTime, "")
+	return getReplacementRoute(time.Now(), arrivalTime, cancelled, resp)
+}
+
+func getReplacementRoute(now time.Time, arrivalTime time.Time, cancelled RouteOption, routes []RouteOption) (RouteOption, error) {
+	var choice *RouteOption
+	for i, r := range routes {
+		if r.Status != RouteScheduled {
+			continue
+		}
+		// skip the service that was cancelled
+		if r.Name == cancelled.Name && r.DepartureTime.Equal(cancelled.DepartureTime.Time) {
+			continue
+		}
+		// the user needs to have time to get there
+		if r.DepartureTime.Before(now) {
+			continue
+		}
+		if r.ArrivalTime.After(arrivalTime) {
+			continue
+		}
+		if choice == nil || r.DepartureTime.After(choice.DepartureTime.Time) {
+			choice = &routes[i]
+		}
+	}
+	if choice == nil {
+		return RouteOption{}, errors.New("No replacement routes")
+	}
+	return *choice, nil
 }
 
 // getRouteFromDescription find a route with the same description as the
@@ -186,24 +291,35 @@ func GetArrivalTime(trip *TripSchedule) time.Time {
 
 // getNextTime will return an updated timestamp using the repeated
 // days of the trip. Where the input ts is updated to the next repeating
-// day and the time of day is left intact.
+// day and the time of day is left intact. Days that the trip is skipped on
+// are passed over
 // @param trip - the trip to use to find next repeating day
 // @param ts - timestamp in milliseconds that will be returned with an
 // updated day
 // @returns a new timestamp with same time of day as input but the day
 // is the next repeating day
 func getNextTime(trip *TripSchedule, ts int64) time.Time {
-	if wasOriginalAlertSent(trip) && IsRepeating(trip) {
-		localArrival := getLocalTime(
-			trip.InputArrivalTime.String,
-			trip.InputArrivalTime.TimezoneLocation,
-			ts,
-		)
+	if !IsRepeating(trip) {
+		return UnixTimestampToTime(ts)
+	}
+	localArrival := getLocalTime(
+		trip.InputArrivalTime.String,
+		trip.InputArrivalTime.TimezoneLocation,
+		ts,
+	)
+	exceptions := TripExceptions(trip)
+	if wasOriginalAlertSent(trip) {
 		return getNextRepeatTime(trip.LastNotificationSent,
 			localArrival,
-			trip.RepeatDays)
+			trip.RepeatDays,
+			exceptions)
+	}
+	if !exceptions.Skips(localArrival) {
+		return UnixTimestampToTime(ts)
 	}
-	return UnixTimestampToTime(ts)
+	// the first occurrence is skipped so use the next repeat after it
+	return getNextRepeatTimeFromDate(localArrival.AddDate(0, 0, 1),
+		localArrival, localArrival, trip.RepeatDays, exceptions)
 }
 
 func wasOriginalAlertSent(trip *TripSchedule) bool {
@@ -234,14 +350,15 @@ func getLocalTime(dateString string, timezoneName string, ts int64) time.Time {
 // @param departureTime - the departure time of the trip
 // @param repeatDays - the days which this trip will repeat on where Monday is
 // zero index
+// @param exceptions - the dates that the trip won't run on
 // @returns a timestamp with same time of day as departureTime but the day
 // is the next repeating day
-func getNextRepeatTime(lastNotification int64, departureTime time.Time, repeatDays []bool) time.Time {
+func getNextRepeatTime(lastNotification int64, departureTime time.Time, repeatDays []bool, exceptions Exceptions) time.Time {
 	// get the current time in the trip's timezone
 	now := time.Now().In(departureTime.Location())
 	// convert to correct timezone
 	lastNotificationDate := time.Unix(lastNotification/1000, 0).In(departureTime.Location())
-	return getNextRepeatTimeFromDate(now, lastNotificationDate, departureTime, repeatDays)
+	return getNextRepeatTimeFromDate(now, lastNotificationDate, departureTime, repeatDays, exceptions)
 }
 
 // getNextRepeatTimeFromDate will return the departure time as a unix timestamp
@@ -251,9 +368,24 @@ func getNextRepeatTime(lastNotification int64, departureTime time.Time, repeatDa
 // @param departureTime - the departure time of the trip
 // @param repeatDays - the days which this trip will repeat on where Monday is
 // zero index
+// @param exceptions - the dates that the trip won't run on, the next repeat
+// after a skipped date is used instead
 // @returns a timestamp with same time of day as departureTime but the day
 // is the next repeating day
 func getNextRepeatTimeFromDate(now time.Time, lastNotification time.Time,
+	departureTime time.Time, repeatDays []bool, exceptions Exceptions) time.Time {
+	next := nextRepeatTime(now, lastNotification, departureTime, repeatDays)
+	for i := 0; i < maxSkippedOccurrences && exceptions.Skips(next); i++ {
+		// treat the skipped date as if it was notified and look from the
+		// day after it
+		next = nextRepeatTime(next.AddDate(0, 0, 1), next, departureTime, repeatDays)
+	}
+	return next
+}
+
+// nextRepeatTime returns the next repeat after the last notification,
+// ignoring any exceptions
+func nextRepeatTime(now time.Time, lastNotification time.Time,
 	departureTime time.Time, repeatDays []bool) time.Time {
 	prevDay := mondayAsZeroIndex(int(lastNotification.Weekday()), len(repeatDays))
 	// find the next repeat
@@ -11,7 +11,7 @@ func TestGetNextRepeatTime(t *testing.T) {
 	now := sundayDate.UTC()
 	departureTime := time.Unix(sundayDate.Unix()+200, 0).In(sundayDate.Location())
 	repeatDays := []bool{false, false, false, false, false, false, false}
-	result := getNextRepeatTimeFromDate(now, sundayDate, departureTime, repeatDays)
+	result := getNextRepeatTimeFromDate(now, sundayDate, departureTime, repeatDays, Exceptions{})
 	expected := departureTime
 	if !result.Equal(expected) {
 		t.Error("Expected", result, "to equal", expected)
@@ -30,7 +30,7 @@ func TestGetNextRepeatTimeRepeatingTomorrow(t *testing.T) {
 	// Should repeat tomorrow
 	// There are a few extra repeating days in here to ensure it can handle this
 	repeatDays := []bool{true, false, false, false, true, true, false}
-	result := getNextRepeatTimeFromDate(now, sundayDate, sundayDate, repeatDays)
+	result := getNextRepeatTimeFromDate(now, sundayDate, sundayDate, repeatDays, Exceptions{})
 	// create date which is 1 day later to match repeat day
 	dateWithMatchingTime := time.Date(
 		sundayDate.Year(), sundayDate.Month(), sundayDate.Day()+1,
@@ -59,7 +59,7 @@ func TestGetNextRepeatTimeRepeatingNextWeek(t *testing.T) {
 	// Repeats on Sunday and Thursday and the last notification time is Sunday,
 	// therefore Thursday is the next repeat
 	repeatDays := []bool{false, false, false, true, false, false, true}
-	result := getNextRepeatTimeFromDate(now, sundayDate, sundayDate, repeatDays)
+	result := getNextRepeatTimeFromDate(now, sundayDate, sundayDate, repeatDays, Exceptions{})
 	dateWithMatchingTime := time.Date(
 		sundayDate.Year(),
 		sundayDate.Month(),
@@ -90,7 +90,7 @@ func TestGetNextRepeatTimeOverDaylightSavings(t *testing.T) {
 	// Repeats on Saturday and Wednesday and the last notification time is Saturday,
 	// therefore Wednesday is the next repeat
 	repeatDays := []bool{false, false, true, false, false, true, false}
-	result := getNextRepeatTimeFromDate(now, saturdayDate.In(loc), saturdayDate.In(loc), repeatDays)
+	result := getNextRepeatTimeFromDate(now, saturdayDate.In(loc), saturdayDate.In(loc), repeatDays, Exceptions{})
 	// to ensure that the hour has changed (Brisbane does not do daylight savings)
 	locWithoutDaylightSavings, _ := time.LoadLocation("Australia/Brisbane")
 	dateWithMatchingTime := time.Date(
@@ -284,3 +284,61 @@ func TestGetRouteFromDescriptionOnRepeatTrip(t *testing.T) {
 		t.Error("Expected", result, "to equal", expected)
 	}
 }
+
+func TestGetReplacementRoute(t *testing.T) {
+	now := time.Now()
+	arrivalTime := now.Add(1 * time.Hour)
+	cancelled := RouteOption{
+		Name:          "300",
+		DepartureTime: UnixTime{now.Add(20 * time.Minute)},
+		ArrivalTime:   UnixTime{now.Add(40 * time.Minute)},
+		Status:        RouteCancelled,
+	}
+	expected := RouteOption{
+		Name:          "301",
+		DepartureTime: UnixTime{now.Add(25 * time.Minute)},
+		ArrivalTime:   UnixTime{now.Add(50 * time.Minute)},
+	}
+	routes := []RouteOption{
+		cancelled,
+		// already left
+		RouteOption{
+			Name:          "300",
+			DepartureTime: UnixTime{now.Add(-5 * time.Minute)},
+			ArrivalTime:   UnixTime{now.Add(15 * time.Minute)},
+		},
+		RouteOption{
+			Name:          "300",
+			DepartureTime: UnixTime{now.Add(10 * time.Minute)},
+			ArrivalTime:   UnixTime{now.Add(30 * time.Minute)},
+		},
+		expected,
+		// arrives too late
+		RouteOption{
+			Name:          "300",
+			DepartureTime: UnixTime{now.Add(50 * time.Minute)},
+			ArrivalTime:   UnixTime{now.Add(70 * time.Minute)},
+		},
+	}
+	result, err := getReplacementRoute(now, arrivalTime, cancelled, routes)
+	if err != nil {
+		t.Error("Unexpected error", err)
+	}
+	if result != expected {
+		t.Error("Expected", expected, "found", result)
+	}
+}
+
+func TestGetReplacementRouteWithNoViableRoutes(t *testing.T) {
+	now := time.Now()
+	cancelled := RouteOption{
+		Name:          "300",
+		DepartureTime: UnixTime{now.Add(20 * time.Minute)},
+		ArrivalTime:   UnixTime{now.Add(40 * time.Minute)},
+		Status:        RouteCancelled,
+	}
+	_, err := getReplacementRoute(now, now.Add(45*time.Minute), cancelled, []RouteOption{cancelled})
+	if err == nil {
+		t.Error("No error when there are no replacement routes")
+	}
+}
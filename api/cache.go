@@ -0,0 +1,88 @@
+package api
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// CachingFinder is an implementation of RouteFinder that stores search
+// results for a short time so that identical searches don't hit the
+// underlying finder again
+type CachingFinder struct {
+	RouteFinder
+	finder  RouteFinder
+	ttl     time.Duration
+	results map[string]cachedRoutes
+	mux     sync.Mutex
+}
+
+type cachedRoutes struct {
+	routes []RouteOption
+	stored time.Time
+}
+
+// NewCachingFinder will create a CachingFinder
+// @param finder - the finder to use when there isn't a cached result
+// @param ttl - how long results are kept for
+func NewCachingFinder(finder RouteFinder, ttl time.Duration) *CachingFinder {
+	return &CachingFinder{
+		finder:  finder,
+		ttl:     ttl,
+		results: make(map[string]cachedRoutes),
+	}
+}
+
+// FindRoutes will return the cached routes for this search if they haven't
+// expired, otherwise the underlying finder is used
+func (finder *CachingFinder) FindRoutes(originLat, originLng, destLat, destLng float64,
+	transportType string, arrivalTime time.Time,
+	routeName string) []RouteOption {
+	routes, _ := finder.FindRoutesWithError(originLat, originLng, destLat, destLng,
+		transportType, arrivalTime, routeName)
+	return routes
+}
+
+// MismatchReport will return the stop mismatches of the underlying finder
+func (finder *CachingFinder) MismatchReport() []StopMismatch {
+	return FinderMismatchReport(finder.finder)
+}
+
+// FindRoutesWithError is the same as FindRoutes but returns the underlying
+// finder's error
+func (finder *CachingFinder) FindRoutesWithError(originLat, originLng, destLat, destLng float64,
+	transportType string, arrivalTime time.Time,
+	routeName string) ([]RouteOption, error) {
+	key := fmt.Sprintf("%.5f,%.5f/%.5f,%.5f/%s/%d/%s", originLat, originLng,
+		destLat, destLng, transportType, arrivalTime.Unix(), routeName)
+	now := time.Now()
+	finder.mux.Lock()
+	cached, ok := finder.results[key]
+	finder.mux.Unlock()
+	if ok && now.Sub(cached.stored) < finder.ttl {
+		return copyRoutes(cached.routes), nil
+	}
+	routes, err := FindRoutesWithError(finder.finder, originLat, originLng, destLat, destLng,
+		transportType, arrivalTime, routeName)
+	// don't cache failed searches
+	if err != nil || len(routes) == 0 {
+		return routes, err
+	}
+	finder.mux.Lock()
+	defer finder.mux.Unlock()
+	// clear out expired results
+	for k, c := range finder.results {
+		if now.Sub(c.stored) >= finder.ttl {
+			delete(finder.results, k)
+		}
+	}
+	finder.results[key] = cachedRoutes{routes: copyRoutes(routes), stored: now}
+	return routes, nil
+}
+
+// copyRoutes is used since finders may modify the routes they're given
+func copyRoutes(routes []RouteOption) []RouteOption {
+	c := make([]RouteOption, len(routes))
+	copy(c, routes)
+	return c
+}
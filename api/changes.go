@@ -0,0 +1,27 @@
+package api
+
+// TripChange is sent when a trip is created, updated or deleted so that the
+// tripwatcher can react straight away instead of waiting for the next scan
+type TripChange struct {
+	TripID string
+	// true if the trip has been deleted
+	Deleted bool
+}
+
+// IsResync returns true if changes may have been missed, such as after the
+// connection to the database was lost. Every trip should be checked again
+func (c TripChange) IsResync() bool {
+	return len(c.TripID) == 0
+}
+
+// GetTrip returns the trip with this ID
+// @returns nil if the trip doesn't exist
+func GetTrip(db DatabaseInterface, tripID string) (*TripSchedule, error) {
+	return db.GetTrip(tripID)
+}
+
+// WatchTripChanges returns a channel that receives every change made to the
+// trips table. The channel is closed if the database is closed
+func WatchTripChanges(db DatabaseInterface) (<-chan TripChange, error) {
+	return db.WatchTripChanges()
+}
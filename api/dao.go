@@ -18,8 +18,17 @@ type DatabaseInterface interface {
 	DeleteTrip(tripID string, userID string) error
 	// GetAllScheduledTrips will list of trips currently persisted
 	GetAllScheduledTrips() ([]*TripSchedule, error)
+	// GetTrip will return the trip with this ID or nil if it doesn't exist
+	GetTrip(tripID string) (*TripSchedule, error)
+	// WatchTripChanges will send the ID of each trip that's created, updated
+	// or deleted
+	WatchTripChanges() (<-chan TripChange, error)
 	// IsEnabled will return true if the specified trip is enabled
 	IsEnabled(trip *TripSchedule) bool
+	// GetUser will return the user with this ID or nil if they don't exist
+	GetUser(userID string) (*UserInfo, error)
+	// GetTripHistory will return the recorded occurrences of this trip
+	GetTripHistory(tripID string, userID string) ([]TripOccurrence, error)
 	// Close the database connection
 	Close()
 }
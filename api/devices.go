@@ -0,0 +1,89 @@
+package api
+
+import "errors"
+
+// Device is a single device that the user receives notifications on
+type Device struct {
+	ID                string `json:"device_id"`
+	UserID            string `json:"user_id"`
+	NotificationToken string `json:"notification_token"`
+	DeviceOS          string `json:"device_os"`
+	// the name of the notifier to use for this device, if this is empty
+	// then the notifier is chosen by operating system
+	Channel string `json:"channel,omitempty"`
+	// set when the push provider has rejected the token
+	Invalid bool `json:"invalid"`
+}
+
+// DeviceInterface stores each user's devices so that notifications can be
+// sent to all of them
+type DeviceInterface interface {
+	TokenInterface
+	// RegisterDevice will add the device to the user, or update it if the
+	// token is already registered. A token can only belong to one user
+	RegisterDevice(device *Device) error
+	// UnregisterDevice will stop notifications being sent to this token,
+	// including when it's the token stored with the user
+	UnregisterDevice(userID string, token string) error
+	// GetDevices will return every device registered to the user, including
+	// ones with invalid tokens
+	GetDevices(userID string) ([]Device, error)
+}
+
+// RegisterDevice will add the device so that it receives the user's
+// notifications
+func RegisterDevice(db DeviceInterface, device *Device) error {
+	if len(device.UserID) == 0 {
+		return errors.New("No user ID set")
+	}
+	if len(device.NotificationToken) == 0 {
+		return errors.New("No notification token set")
+	}
+	return db.RegisterDevice(device)
+}
+
+// UnregisterDevice will remove the device from the user
+func UnregisterDevice(db DeviceInterface, userID string, token string) error {
+	return db.UnregisterDevice(userID, token)
+}
+
+// GetActiveDevices returns the user's devices that notifications should be
+// sent to. Users that registered before devices were added only have the
+// token stored with the user, so this is used as their only device
+func GetActiveDevices(db DeviceInterface, user *UserInfo) ([]Device, error) {
+	devices, err := db.GetDevices(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	if len(devices) == 0 {
+		if len(user.NotificationToken) == 0 || user.NeedsReregister {
+			return []Device{}, nil
+		}
+		return []Device{{
+			UserID:            user.ID,
+			NotificationToken: user.NotificationToken,
+			DeviceOS:          user.DeviceOS,
+			Channel:           user.Channel,
+		}}, nil
+	}
+	active := []Device{}
+	for _, device := range devices {
+		if !device.Invalid {
+			active = append(active, device)
+		}
+	}
+	return active, nil
+}
+
+// DeviceUser returns a copy of the user with the device's token and
+// operating system, this is what's given to the notifier
+func DeviceUser(user *UserInfo, device Device) *UserInfo {
+	u := *user
+	u.NotificationToken = device.NotificationToken
+	u.DeviceOS = device.DeviceOS
+	if len(device.Channel) > 0 {
+		u.Channel = device.Channel
+	}
+	u.NeedsReregister = device.Invalid
+	return &u
+}
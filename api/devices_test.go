@@ -0,0 +1,73 @@
+package api
+
+import "testing"
+
+type MockDevices struct {
+	devices []Device
+}
+
+func (m *MockDevices) InvalidateToken(userID string, token string, reason string) error {
+	return nil
+}
+
+func (m *MockDevices) RegisterDevice(device *Device) error {
+	m.devices = append(m.devices, *device)
+	return nil
+}
+
+func (m *MockDevices) UnregisterDevice(userID string, token string) error {
+	return nil
+}
+
+func (m *MockDevices) GetDevices(userID string) ([]Device, error) {
+	return m.devices, nil
+}
+
+func TestGetActiveDevicesFallsBackToUserToken(t *testing.T) {
+	db := &MockDevices{}
+	user := &UserInfo{ID: "user", NotificationToken: "token", DeviceOS: "ios"}
+	devices, _ := GetActiveDevices(db, user)
+	if len(devices) != 1 || devices[0].NotificationToken != "token" {
+		t.Error("Expected user's token to be used, found", devices)
+	}
+	user.NeedsReregister = true
+	if devices, _ := GetActiveDevices(db, user); len(devices) != 0 {
+		t.Error("Expected no devices, found", devices)
+	}
+}
+
+func TestGetActiveDevicesSkipsInvalidTokens(t *testing.T) {
+	db := &MockDevices{devices: []Device{
+		{NotificationToken: "phone"},
+		{NotificationToken: "old", Invalid: true},
+		{NotificationToken: "tablet"},
+	}}
+	devices, _ := GetActiveDevices(db, &UserInfo{ID: "user", NotificationToken: "phone"})
+	if len(devices) != 2 || devices[1].NotificationToken != "tablet" {
+		t.Error("Unexpected devices", devices)
+	}
+}
+
+func TestRegisterDeviceRequiresToken(t *testing.T) {
+	db := &MockDevices{}
+	if err := RegisterDevice(db, &Device{UserID: "user"}); err == nil {
+		t.Error("Expected error for missing token")
+	}
+	if err := RegisterDevice(db, &Device{NotificationToken: "token"}); err == nil {
+		t.Error("Expected error for missing user")
+	}
+	if err := RegisterDevice(db, &Device{UserID: "user", NotificationToken: "token"}); err != nil {
+		t.Error("Expected no error, found", err)
+	}
+}
+
+func TestDeviceUser(t *testing.T) {
+	user := &UserInfo{ID: "user", NotificationToken: "phone", DeviceOS: "ios", Channel: "push", Locale: "fr"}
+	u := DeviceUser(user, Device{NotificationToken: "tablet", DeviceOS: "android"})
+	if u.NotificationToken != "tablet" || u.DeviceOS != "android" || u.Channel != "push" || u.Locale != "fr" {
+		t.Error("Unexpected user", u)
+	}
+	if user.NotificationToken != "phone" {
+		t.Error("Expected original user to be unchanged")
+	}
+}
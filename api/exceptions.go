@@ -0,0 +1,249 @@
+package api
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strings"
+	"time"
+)
+
+// dateFormat is the format of local dates, such as skip dates and holidays
+const dateFormat = "2006-01-02"
+
+// maxSkippedOccurrences is the most occurrences in a row that can be skipped
+// before a repeating trip runs again. This stops a trip that skips every
+// occurrence from looping forever
+const maxSkippedOccurrences = 1000
+
+// Holiday is a single date imported from the user's holiday calendar
+type Holiday struct {
+	// the local date formatted as "2006-01-02"
+	Date string `json:"date"`
+	Name string `json:"name"`
+}
+
+// Exceptions are the dates that a repeating trip won't run on
+type Exceptions struct {
+	// local dates formatted as "2006-01-02"
+	Dates map[string]bool
+	// the trip won't run before this local date, this is empty if the user
+	// hasn't paused their trips
+	PausedUntil string
+}
+
+// ExceptionInterface stores the dates that each user's repeating trips are
+// skipped on
+type ExceptionInterface interface {
+	// SetSkipDates will replace the trip's skip dates
+	SetSkipDates(tripID string, userID string, dates []string) error
+	// PauseTrips will stop all of the user's repeating trips before the
+	// date. An empty date will resume them
+	PauseTrips(userID string, until string) error
+	// SetHolidays will replace the user's holidays
+	SetHolidays(userID string, holidays []Holiday) error
+	// GetHolidays will return the user's holidays in date order
+	GetHolidays(userID string) ([]Holiday, error)
+}
+
+// TripExceptions returns every date that the trip is skipped on, including
+// the user's holidays and pause
+func TripExceptions(trip *TripSchedule) Exceptions {
+	e := Exceptions{Dates: make(map[string]bool)}
+	for _, date := range trip.SkipDates {
+		e.Dates[date] = true
+	}
+	if trip.User != nil {
+		for _, date := range trip.User.Holidays {
+			e.Dates[date] = true
+		}
+		e.PausedUntil = trip.User.PausedUntil
+	}
+	return e
+}
+
+// Skips returns true if the trip shouldn't run on the local date of `t`
+func (e Exceptions) Skips(t time.Time) bool {
+	date := t.Format(dateFormat)
+	// dates in this format can be compared as strings
+	if date < e.PausedUntil {
+		return true
+	}
+	return e.Dates[date]
+}
+
+// IsSkipped returns true if the repeating trip shouldn't run on the day of
+// this departure. Trips that don't repeat are never skipped
+func IsSkipped(trip *TripSchedule, departure time.Time) bool {
+	if !IsRepeating(trip) {
+		return false
+	}
+	if trip.InputArrivalTime != nil {
+		departure = getLocalTime(trip.InputArrivalTime.String,
+			trip.InputArrivalTime.TimezoneLocation, departure.Unix()*1000)
+	}
+	return TripExceptions(trip).Skips(departure)
+}
+
+// SetSkipDates will replace the dates that the trip won't run on
+// @param dates - local dates formatted as "2006-01-02"
+func SetSkipDates(db ExceptionInterface, tripID string, userID string, dates []string) error {
+	for _, date := range dates {
+		if _, err := time.Parse(dateFormat, date); err != nil {
+			return errors.New("Invalid skip date " + date)
+		}
+	}
+	return db.SetSkipDates(tripID, userID, dates)
+}
+
+// SkipNextOccurrence will add the date of the trip's next occurrence to its
+// skip dates
+// @returns the date that was skipped
+func SkipNextOccurrence(db ExceptionInterface, trip *TripSchedule) (string, error) {
+	if !IsRepeating(trip) {
+		return "", errors.New("Only repeating trips can be skipped")
+	}
+	// the next occurrence already passes over any skipped dates
+	date := GetOccurrence(trip)
+	dates := append([]string{}, trip.SkipDates...)
+	dates = append(dates, date)
+	if err := db.SetSkipDates(trip.ID, trip.User.ID, dates); err != nil {
+		return "", err
+	}
+	return date, nil
+}
+
+// PauseTrips will stop all of the user's repeating trips until the date
+// @param until - the local date formatted as "2006-01-02" that trips will
+// run again on, or empty to resume them straight away
+func PauseTrips(db ExceptionInterface, userID string, until string) error {
+	if len(userID) == 0 {
+		return errors.New("No user ID set")
+	}
+	if len(until) > 0 {
+		if _, err := time.Parse(dateFormat, until); err != nil {
+			return errors.New("Invalid pause date")
+		}
+	}
+	return db.PauseTrips(userID, until)
+}
+
+// SetHolidays will replace the user's holidays, such as those read using
+// `ParseHolidayCalendar`
+func SetHolidays(db ExceptionInterface, userID string, holidays []Holiday) error {
+	if len(userID) == 0 {
+		return errors.New("No user ID set")
+	}
+	for _, h := range holidays {
+		if _, err := time.Parse(dateFormat, h.Date); err != nil {
+			return errors.New("Invalid holiday date " + h.Date)
+		}
+	}
+	return db.SetHolidays(userID, holidays)
+}
+
+// GetHolidays returns the user's holidays
+func GetHolidays(db ExceptionInterface, userID string) ([]Holiday, error) {
+	return db.GetHolidays(userID)
+}
+
+// ParseHolidayCalendar will read each event in an iCalendar (.ics) file as
+// a holiday. Events that last more than a day are split into a holiday for
+// each date. Only the date of each event is used, so all day events work
+// best
+func ParseHolidayCalendar(r io.Reader) ([]Holiday, error) {
+	lines, err := unfoldCalendarLines(r)
+	if err != nil {
+		return nil, err
+	}
+	holidays := []Holiday{}
+	found := make(map[string]bool)
+	inEvent := false
+	var name string
+	var start, end time.Time
+	for _, line := range lines {
+		i := strings.Index(line, ":")
+		if i < 0 {
+			continue
+		}
+		// parameters such as ";VALUE=DATE" are ignored
+		property := strings.ToUpper(strings.SplitN(line[:i], ";", 2)[0])
+		value := line[i+1:]
+		switch {
+		case property == "BEGIN" && value == "VEVENT":
+			inEvent = true
+			name = ""
+			start = time.Time{}
+			end = time.Time{}
+		case property == "END" && value == "VEVENT":
+			inEvent = false
+			if start.IsZero() {
+				return nil, errors.New("Event without a start date")
+			}
+			// the end date isn't included in the event
+			if end.IsZero() || !end.After(start) {
+				end = start.AddDate(0, 0, 1)
+			}
+			for d := start; d.Before(end); d = d.AddDate(0, 0, 1) {
+				date := d.Format(dateFormat)
+				if found[date] {
+					continue
+				}
+				found[date] = true
+				holidays = append(holidays, Holiday{Date: date, Name: name})
+			}
+		// properties outside of events are ignored
+		case !inEvent:
+		case property == "SUMMARY":
+			name = unescapeCalendarText(value)
+		case property == "DTSTART":
+			start, err = parseCalendarDate(value)
+			if err != nil {
+				return nil, err
+			}
+		case property == "DTEND":
+			end, err = parseCalendarDate(value)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if inEvent {
+		return nil, errors.New("Event was not ended")
+	}
+	return holidays, nil
+}
+
+// unfoldCalendarLines returns each line of the calendar. Long lines are
+// split by starting the next line with a space or tab
+func unfoldCalendarLines(r io.Reader) ([]string, error) {
+	lines := []string{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if len(lines) > 0 && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines, scanner.Err()
+}
+
+// parseCalendarDate reads the date from a DATE or DATE-TIME value such as
+// "20171225" or "20171225T090000Z"
+func parseCalendarDate(value string) (time.Time, error) {
+	if len(value) < 8 {
+		return time.Time{}, errors.New("Invalid calendar date " + value)
+	}
+	t, err := time.Parse("20060102", value[:8])
+	if err != nil {
+		return time.Time{}, errors.New("Invalid calendar date " + value)
+	}
+	return t, nil
+}
+
+func unescapeCalendarText(value string) string {
+	r := strings.NewReplacer(`\n`, " ", `\N`, " ", `\,`, ",", `\;`, ";", `\\`, `\`)
+	return r.Replace(value)
+}
@@ -0,0 +1,193 @@
+package api
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+type MockExceptions struct {
+	skipDates []string
+	paused    string
+	holidays  []Holiday
+}
+
+func (m *MockExceptions) SetSkipDates(tripID string, userID string, dates []string) error {
+	m.skipDates = dates
+	return nil
+}
+
+func (m *MockExceptions) PauseTrips(userID string, until string) error {
+	m.paused = until
+	return nil
+}
+
+func (m *MockExceptions) SetHolidays(userID string, holidays []Holiday) error {
+	m.holidays = holidays
+	return nil
+}
+
+func (m *MockExceptions) GetHolidays(userID string) ([]Holiday, error) {
+	return m.holidays, nil
+}
+
+// repeatingTrip returns a trip that departs on Monday 3 July 2017 at 8am and
+// repeats on Mondays and Thursdays
+func repeatingTrip() *TripSchedule {
+	departure, _ := time.Parse("2006-01-02T15:04:05-07:00 MST", "2017-07-03T08:00:00+10:00 AEST")
+	return &TripSchedule{
+		ID:   "1",
+		User: &UserInfo{ID: "user"},
+		Route: &RouteOption{
+			DepartureTime: UnixTime{departure},
+			ArrivalTime:   UnixTime{departure.Add(30 * time.Minute)},
+		},
+		InputArrivalTime: &Date{
+			String:           "2017-07-03T08:30:00+10:00 AEST",
+			Timestamp:        departure.Add(30*time.Minute).Unix() * 1000,
+			TimezoneLocation: "Australia/Sydney",
+		},
+		RepeatDays: []bool{true, false, false, true, false, false, false},
+	}
+}
+
+func TestGetNextRepeatTimeSkipsDates(t *testing.T) {
+	loc, _ := time.LoadLocation("Australia/Sydney")
+	sunday := time.Date(2017, 7, 2, 8, 0, 0, 0, loc)
+	repeatDays := []bool{true, false, false, true, false, false, false}
+	exceptions := Exceptions{Dates: map[string]bool{"2017-07-03": true}}
+	result := getNextRepeatTimeFromDate(sunday, sunday, sunday, repeatDays, exceptions)
+	expected := time.Date(2017, 7, 6, 8, 0, 0, 0, loc)
+	if !result.Equal(expected) {
+		t.Error("Expected", expected, "found", result)
+	}
+	// trips that only repeat once a week skip to the next week
+	repeatDays = []bool{true, false, false, false, false, false, false}
+	result = getNextRepeatTimeFromDate(sunday, sunday, sunday, repeatDays, exceptions)
+	expected = time.Date(2017, 7, 10, 8, 0, 0, 0, loc)
+	if !result.Equal(expected) {
+		t.Error("Expected", expected, "found", result)
+	}
+}
+
+func TestGetNextRepeatTimeWhilePaused(t *testing.T) {
+	loc, _ := time.LoadLocation("Australia/Sydney")
+	sunday := time.Date(2017, 7, 2, 8, 0, 0, 0, loc)
+	repeatDays := []bool{true, false, false, true, false, false, false}
+	exceptions := Exceptions{PausedUntil: "2017-07-10"}
+	result := getNextRepeatTimeFromDate(sunday, sunday, sunday, repeatDays, exceptions)
+	// trips run again on the pause date
+	expected := time.Date(2017, 7, 10, 8, 0, 0, 0, loc)
+	if !result.Equal(expected) {
+		t.Error("Expected", expected, "found", result)
+	}
+}
+
+func TestGetDepartureTimeSkipsFirstOccurrence(t *testing.T) {
+	loc, _ := time.LoadLocation("Australia/Sydney")
+	trip := repeatingTrip()
+	trip.User.Holidays = []string{"2017-07-03"}
+	expected := time.Date(2017, 7, 6, 8, 0, 0, 0, loc)
+	if result := GetDepartureTime(trip); !result.Equal(expected) {
+		t.Error("Expected", expected, "found", result)
+	}
+	// the arrival time uses the same day
+	expected = time.Date(2017, 7, 6, 8, 30, 0, 0, loc)
+	if result := GetArrivalTime(trip); !result.Equal(expected) {
+		t.Error("Expected", expected, "found", result)
+	}
+}
+
+func TestIsSkipped(t *testing.T) {
+	trip := repeatingTrip()
+	trip.SkipDates = []string{"2017-07-03"}
+	departure := trip.Route.DepartureTime.Time
+	// the date is checked in the trip's timezone rather than UTC
+	if !IsSkipped(trip, departure.UTC()) {
+		t.Error("Expected", departure, "to be skipped")
+	}
+	if IsSkipped(trip, departure.AddDate(0, 0, 3)) {
+		t.Error("Expected", departure.AddDate(0, 0, 3), "not to be skipped")
+	}
+	trip.RepeatDays = []bool{false, false, false, false, false, false, false}
+	if IsSkipped(trip, departure) {
+		t.Error("Expected trips that don't repeat to never be skipped")
+	}
+}
+
+func TestSkipNextOccurrence(t *testing.T) {
+	db := &MockExceptions{}
+	trip := repeatingTrip()
+	trip.SkipDates = []string{"2017-07-03"}
+	date, err := SkipNextOccurrence(db, trip)
+	if err != nil || date != "2017-07-06" {
+		t.Error("Expected", "2017-07-06", "found", date, err)
+	}
+	if len(db.skipDates) != 2 || db.skipDates[1] != "2017-07-06" {
+		t.Error("Unexpected skip dates", db.skipDates)
+	}
+	trip.RepeatDays = []bool{false, false, false, false, false, false, false}
+	if _, err := SkipNextOccurrence(db, trip); err == nil {
+		t.Error("Expected error for trip that doesn't repeat")
+	}
+}
+
+func TestPauseTrips(t *testing.T) {
+	db := &MockExceptions{}
+	if err := PauseTrips(db, "user", "10/07/2017"); err == nil {
+		t.Error("Expected error for invalid date")
+	}
+	if err := PauseTrips(db, "user", "2017-07-10"); err != nil || db.paused != "2017-07-10" {
+		t.Error("Expected trips to be paused, found", db.paused, err)
+	}
+	if err := PauseTrips(db, "user", ""); err != nil || db.paused != "" {
+		t.Error("Expected trips to be resumed, found", db.paused, err)
+	}
+}
+
+func TestParseHolidayCalendar(t *testing.T) {
+	calendar := "BEGIN:VCALENDAR\r\n" +
+		"VERSION:2.0\r\n" +
+		"SUMMARY:Ignored\r\n" +
+		"BEGIN:VEVENT\r\n" +
+		"DTSTART;VALUE=DATE:20171225\r\n" +
+		"DTEND;VALUE=DATE:20171227\r\n" +
+		"SUMMARY:Christmas Day and\r\n" +
+		"  Boxing Day\r\n" +
+		"END:VEVENT\r\n" +
+		"BEGIN:VEVENT\r\n" +
+		"DTSTART:20180126T000000Z\r\n" +
+		"SUMMARY:Australia Day\\, observed\r\n" +
+		"END:VEVENT\r\n" +
+		"END:VCALENDAR\r\n"
+	holidays, err := ParseHolidayCalendar(strings.NewReader(calendar))
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	expected := []Holiday{
+		{Date: "2017-12-25", Name: "Christmas Day and Boxing Day"},
+		{Date: "2017-12-26", Name: "Christmas Day and Boxing Day"},
+		{Date: "2018-01-26", Name: "Australia Day, observed"},
+	}
+	if len(holidays) != len(expected) {
+		t.Fatal("Expected", expected, "found", holidays)
+	}
+	for i := range expected {
+		if holidays[i] != expected[i] {
+			t.Error("Expected", expected[i], "found", holidays[i])
+		}
+	}
+}
+
+func TestParseHolidayCalendarErrors(t *testing.T) {
+	invalid := []string{
+		"BEGIN:VEVENT\nSUMMARY:No start\nEND:VEVENT\n",
+		"BEGIN:VEVENT\nDTSTART:2017\nEND:VEVENT\n",
+		"BEGIN:VEVENT\nDTSTART:20171225\n",
+	}
+	for _, calendar := range invalid {
+		if _, err := ParseHolidayCalendar(strings.NewReader(calendar)); err == nil {
+			t.Error("Expected error for", calendar)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// DefaultFailureThreshold is the number of failures in a row before a
+// provider's circuit breaker opens
+const DefaultFailureThreshold = 3
+
+// DefaultOpenDuration is how long a provider will be skipped once its
+// circuit breaker opens
+const DefaultOpenDuration = 1 * time.Minute
+
+// CircuitBreaker keeps track of failures so that a provider that is down
+// isn't called on every request. Once the breaker is open, a single request
+// will be let through after the open duration to check whether the provider
+// has recovered
+type CircuitBreaker struct {
+	failureThreshold int
+	openDuration     time.Duration
+	failures         int
+	openedAt         time.Time
+	// set when a request is checking whether the provider has recovered
+	trial bool
+	mux   sync.Mutex
+}
+
+// NewCircuitBreaker will create a closed CircuitBreaker
+// @param failureThreshold - number of failures in a row before opening
+// @param openDuration - how long to stay open before trying again
+func NewCircuitBreaker(failureThreshold int, openDuration time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		failureThreshold: failureThreshold,
+		openDuration:     openDuration,
+	}
+}
+
+// Allow returns true if a request should be made
+func (b *CircuitBreaker) Allow() bool {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	if b.failures < b.failureThreshold {
+		return true
+	}
+	// only let one request through at a time while open
+	if b.trial || time.Since(b.openedAt) < b.openDuration {
+		return false
+	}
+	b.trial = true
+	return true
+}
+
+// Success will close the breaker
+func (b *CircuitBreaker) Success() {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.failures = 0
+	b.trial = false
+}
+
+// Failure will record a failed request and open the breaker if there have
+// been too many
+func (b *CircuitBreaker) Failure() {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.failures++
+	b.trial = false
+	if b.failures >= b.failureThreshold {
+		b.openedAt = time.Now()
+	}
+}
+
+// IsOpen returns true if requests are currently being skipped
+func (b *CircuitBreaker) IsOpen() bool {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return b.failures >= b.failureThreshold
+}
+
+func init() {
+	// this is registered here since the failover finder builds its own chains
+	RegisterFinderType("failover", newFailoverFinderFromConfig)
+}
+
+// FailoverProvider is a named finder used by FailoverFinder
+type FailoverProvider struct {
+	Name    string
+	Finder  RouteFinder
+	Breaker *CircuitBreaker
+}
+
+// FailoverFinder is an implementation of RouteFinder that tries each
+// provider in priority order until one returns routes. Providers that keep
+// failing are skipped until their circuit breaker closes again. Each route
+// is labelled with the provider that found it
+type FailoverFinder struct {
+	RouteFinder
+	providers []FailoverProvider
+}
+
+// NewFailoverFinder will create a FailoverFinder
+// @param providers - finders in priority order
+func NewFailoverFinder(providers []FailoverProvider) *FailoverFinder {
+	for i := range providers {
+		if providers[i].Breaker == nil {
+			providers[i].Breaker = NewCircuitBreaker(DefaultFailureThreshold, DefaultOpenDuration)
+		}
+	}
+	return &FailoverFinder{providers: providers}
+}
+
+// FindRoutes will return the routes from the first available provider that
+// finds any. Only errors count as failures, a provider that finds no routes
+// is still working so the next provider is tried without opening its
+// breaker. Finders that can't return errors are checked with
+// `FindRoutesWithError`
+func (finder *FailoverFinder) FindRoutes(originLat, originLng, destLat, destLng float64,
+	transportType string, arrivalTime time.Time,
+	routeName string) []RouteOption {
+	for _, p := range finder.providers {
+		if !p.Breaker.Allow() {
+			continue
+		}
+		routes, err := FindRoutesWithError(p.Finder, originLat, originLng, destLat, destLng,
+			transportType, arrivalTime, routeName)
+		if err != nil {
+			log.Println("Provider", p.Name, "failed:", err)
+			p.Breaker.Failure()
+			if p.Breaker.IsOpen() {
+				log.Println("Circuit breaker open for provider", p.Name)
+			}
+			continue
+		}
+		p.Breaker.Success()
+		if len(routes) == 0 {
+			continue
+		}
+		for i := range routes {
+			if len(routes[i].Provider) == 0 {
+				routes[i].Provider = p.Name
+			}
+		}
+		return routes
+	}
+	return []RouteOption{}
+}
+
+// MismatchReport will return the stop mismatches of every provider
+func (finder *FailoverFinder) MismatchReport() []StopMismatch {
+	reports := [][]StopMismatch{}
+	for _, p := range finder.providers {
+		reports = append(reports, FinderMismatchReport(p.Finder))
+	}
+	return mergeMismatchReports(reports...)
+}
+
+func newFailoverFinderFromConfig(config ProviderConfig, next RouteFinder) (RouteFinder, error) {
+	var options struct {
+		Providers []struct {
+			Name             string           `json:"name"`
+			FailureThreshold int              `json:"failure_threshold"`
+			OpenDuration     string           `json:"open_duration"`
+			Chain            []ProviderConfig `json:"chain"`
+		} `json:"providers"`
+	}
+	if err := config.Decode(&options); err != nil {
+		return nil, err
+	}
+	if next != nil {
+		return nil, errors.New("Failover must be the last finder in a chain")
+	}
+	providers := []FailoverProvider{}
+	for _, p := range options.Providers {
+		f, err := buildFinderChain(p.Chain)
+		if err != nil {
+			return nil, fmt.Errorf("Provider %s: %v", p.Name, err)
+		}
+		threshold := p.FailureThreshold
+		if threshold <= 0 {
+			threshold = DefaultFailureThreshold
+		}
+		openDuration := DefaultOpenDuration
+		if len(p.OpenDuration) > 0 {
+			openDuration, err = time.ParseDuration(p.OpenDuration)
+			if err != nil {
+				return nil, err
+			}
+		}
+		providers = append(providers, FailoverProvider{
+			Name:    p.Name,
+			Finder:  f,
+			Breaker: NewCircuitBreaker(threshold, openDuration),
+		})
+	}
+	return NewFailoverFinder(providers), nil
+}
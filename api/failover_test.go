@@ -0,0 +1,139 @@
+package api
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+type FailingFinder struct {
+	requests int
+}
+
+func (f *FailingFinder) FindRoutes(originLat, originLng, destLat,
+	destLng float64, transportType string, arrivalTime time.Time,
+	routeName string) []RouteOption {
+	f.requests++
+	return []RouteOption{}
+}
+
+// ErrorFinder is a FallibleRouteFinder that can fail or find nothing
+type ErrorFinder struct {
+	FailingFinder
+	err error
+}
+
+func (f *ErrorFinder) FindRoutesWithError(originLat, originLng, destLat,
+	destLng float64, transportType string, arrivalTime time.Time,
+	routeName string) ([]RouteOption, error) {
+	f.requests++
+	return []RouteOption{}, f.err
+}
+
+func TestFailoverFinderUsesNextProvider(t *testing.T) {
+	failing := &FailingFinder{}
+	backup := &NamedFinder{name: "backup"}
+	finder := NewFailoverFinder([]FailoverProvider{
+		FailoverProvider{Name: "primary", Finder: failing},
+		FailoverProvider{Name: "otp", Finder: backup},
+	})
+	routes := finder.FindRoutes(1, 1, 1, 1, "transit", time.Now(), "")
+	if len(routes) != 1 {
+		t.Fatal("Expected", 1, "route, found", len(routes))
+	}
+	if routes[0].Provider != "otp" {
+		t.Error("Expected", "otp", "found", routes[0].Provider)
+	}
+}
+
+func TestFailoverFinderOpensCircuitBreaker(t *testing.T) {
+	failing := &FailingFinder{}
+	backup := &NamedFinder{name: "backup"}
+	finder := NewFailoverFinder([]FailoverProvider{
+		FailoverProvider{
+			Name:    "primary",
+			Finder:  failing,
+			Breaker: NewCircuitBreaker(2, time.Hour),
+		},
+		FailoverProvider{Name: "backup", Finder: backup},
+	})
+	for i := 0; i < 5; i++ {
+		finder.FindRoutes(1, 1, 1, 1, "transit", time.Now(), "")
+	}
+	// after two failures the primary should no longer be called
+	if failing.requests != 2 {
+		t.Error("Expected", 2, "requests, found", failing.requests)
+	}
+	if backup.requests != 5 {
+		t.Error("Expected", 5, "requests, found", backup.requests)
+	}
+}
+
+func TestCircuitBreakerAllowsTrialAfterOpenDuration(t *testing.T) {
+	breaker := NewCircuitBreaker(1, 10*time.Millisecond)
+	breaker.Failure()
+	if breaker.Allow() {
+		t.Error("Expected breaker to be open")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if !breaker.Allow() {
+		t.Error("Expected a trial request to be allowed")
+	}
+	// only one trial at a time
+	if breaker.Allow() {
+		t.Error("Expected only one trial request")
+	}
+	breaker.Success()
+	if !breaker.Allow() || breaker.IsOpen() {
+		t.Error("Expected breaker to close after success")
+	}
+}
+
+func TestFailoverFinderReturnsEmptyWhenAllFail(t *testing.T) {
+	finder := NewFailoverFinder([]FailoverProvider{
+		FailoverProvider{Name: "primary", Finder: &FailingFinder{}},
+		FailoverProvider{Name: "backup", Finder: &FailingFinder{}},
+	})
+	routes := finder.FindRoutes(1, 1, 1, 1, "transit", time.Now(), "")
+	if len(routes) != 0 {
+		t.Error("Expected no routes, found", routes)
+	}
+}
+
+func TestFailoverFinderIgnoresEmptyFilteredSearches(t *testing.T) {
+	failing := &FailingFinder{}
+	breaker := NewCircuitBreaker(1, time.Hour)
+	finder := NewFailoverFinder([]FailoverProvider{
+		FailoverProvider{Name: "primary", Finder: failing, Breaker: breaker},
+		FailoverProvider{Name: "backup", Finder: &NamedFinder{name: "backup"}},
+	})
+	// the route may not be running, which isn't a failure
+	for i := 0; i < 3; i++ {
+		finder.FindRoutes(1, 1, 1, 1, "transit", time.Now(), "610")
+	}
+	if breaker.IsOpen() || failing.requests != 3 {
+		t.Error("Expected breaker to stay closed, found", failing.requests, "requests")
+	}
+}
+
+func TestFailoverFinderOnlyCountsErrors(t *testing.T) {
+	empty := &ErrorFinder{}
+	emptyBreaker := NewCircuitBreaker(1, time.Hour)
+	broken := &ErrorFinder{err: errors.New("Timeout")}
+	brokenBreaker := NewCircuitBreaker(1, time.Hour)
+	finder := NewFailoverFinder([]FailoverProvider{
+		FailoverProvider{Name: "empty", Finder: empty, Breaker: emptyBreaker},
+		FailoverProvider{Name: "broken", Finder: broken, Breaker: brokenBreaker},
+		FailoverProvider{Name: "backup", Finder: &NamedFinder{name: "backup"}},
+	})
+	routes := finder.FindRoutes(1, 1, 1, 1, "transit", time.Now(), "")
+	if len(routes) != 1 || routes[0].Provider != "backup" {
+		t.Fatal("Expected a route from", "backup", "found", routes)
+	}
+	if emptyBreaker.IsOpen() {
+		t.Error("Expected a search with no routes not to open the breaker")
+	}
+	if !brokenBreaker.IsOpen() {
+		t.Error("Expected an error to open the breaker")
+	}
+}
@@ -0,0 +1,152 @@
+package api
+
+import (
+	"errors"
+	"googlemaps.github.io/maps"
+	"math"
+	"strings"
+	"time"
+)
+
+// MinRouteSimilarity is the lowest similarity score where a route will be
+// considered the same as the route the user scheduled
+const MinRouteSimilarity = 0.75
+
+// the weights used for each part of a transit leg when comparing
+const (
+	lineWeight          = 0.5
+	boardingStopWeight  = 0.3
+	alightingStopWeight = 0.2
+	// how much the mode sequence counts towards the similarity score
+	modeWeight = 0.2
+)
+
+// FingerprintLeg describes a single transit vehicle that the user will
+// take as part of a route
+type FingerprintLeg struct {
+	Line          string `json:"line"`
+	BoardingStop  string `json:"boarding_stop"`
+	AlightingStop string `json:"alighting_stop"`
+}
+
+// RouteFingerprint identifies a route by how it travels rather than how it
+// is described, so that it can be found again in later searches
+type RouteFingerprint struct {
+	// the sequence of travel modes such as WALKING, TRANSIT, WALKING
+	Modes   []string         `json:"modes"`
+	Transit []FingerprintLeg `json:"transit"`
+}
+
+// addMode will add the mode to the sequence, consecutive steps using the
+// same mode are merged
+func (f *RouteFingerprint) addMode(mode string) {
+	mode = strings.ToUpper(mode)
+	if len(f.Modes) > 0 && f.Modes[len(f.Modes)-1] == mode {
+		return
+	}
+	f.Modes = append(f.Modes, mode)
+}
+
+// RouteSimilarity returns how similar two routes are where 1 means they
+// are the same and 0 means nothing in common
+func RouteSimilarity(a, b *RouteFingerprint) float64 {
+	if a == nil || b == nil {
+		return 0
+	}
+	return modeWeight*modeSimilarity(a.Modes, b.Modes) +
+		(1-modeWeight)*transitSimilarity(a.Transit, b.Transit)
+}
+
+func modeSimilarity(a, b []string) float64 {
+	longest := len(a)
+	if len(b) > longest {
+		longest = len(b)
+	}
+	if longest == 0 {
+		return 1
+	}
+	matching := 0
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] == b[i] {
+			matching++
+		}
+	}
+	return float64(matching) / float64(longest)
+}
+
+// transitSimilarity compares the legs in order. A route with an extra
+// transfer will be penalised for the leg that the other route doesn't have
+func transitSimilarity(a, b []FingerprintLeg) float64 {
+	longest := len(a)
+	if len(b) > longest {
+		longest = len(b)
+	}
+	// neither route uses transit, such as when driving
+	if longest == 0 {
+		return 1
+	}
+	total := 0.0
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if strings.EqualFold(a[i].Line, b[i].Line) {
+			total += lineWeight
+		}
+		total += boardingStopWeight * stopNameSimilarity(a[i].BoardingStop, b[i].BoardingStop)
+		total += alightingStopWeight * stopNameSimilarity(a[i].AlightingStop, b[i].AlightingStop)
+	}
+	return total / float64(longest)
+}
+
+// getMatchingRoute will find the route that is the same as the scheduled
+// trip's route. Trips that were scheduled before fingerprints were stored
+// will be matched by their description instead. If multiple routes are just
+// as similar then the one closest to the trip's arrival time is chosen
+// @param trip - scheduled trip
+// @param routes - the routes to sort through
+func getMatchingRoute(trip *TripSchedule, routes []RouteOption) (RouteOption, error) {
+	if trip.Route.Fingerprint == nil {
+		return getRouteFromDescription(trip, routes)
+	}
+	if len(routes) == 0 {
+		return RouteOption{}, errors.New("No routes")
+	}
+	arrivalTime := GetArrivalTime(trip)
+	best := -1.0
+	var closest time.Duration
+	var choice RouteOption
+	for _, r := range routes {
+		score := RouteSimilarity(trip.Route.Fingerprint, r.Fingerprint)
+		if score < MinRouteSimilarity {
+			continue
+		}
+		diff := time.Duration(math.Abs(float64(r.ArrivalTime.Sub(arrivalTime))))
+		if score > best || (score == best && diff < closest) {
+			best = score
+			closest = diff
+			choice = r
+		}
+	}
+	if best < 0 {
+		return RouteOption{}, errors.New("No routes similar to the scheduled route")
+	}
+	return choice, nil
+}
+
+// getFingerprint builds the fingerprint from the steps of a Google Maps
+// route
+func getFingerprint(route maps.Route) *RouteFingerprint {
+	fingerprint := &RouteFingerprint{Modes: []string{}, Transit: []FingerprintLeg{}}
+	for _, leg := range route.Legs {
+		for _, step := range leg.Steps {
+			fingerprint.addMode(string(step.TravelMode))
+			if step.TransitDetails == nil {
+				continue
+			}
+			fingerprint.Transit = append(fingerprint.Transit, FingerprintLeg{
+				Line:          step.TransitDetails.Line.ShortName,
+				BoardingStop:  step.TransitDetails.DepartureStop.Name,
+				AlightingStop: step.TransitDetails.ArrivalStop.Name,
+			})
+		}
+	}
+	return fingerprint
+}
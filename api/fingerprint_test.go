@@ -0,0 +1,124 @@
+package api
+
+import (
+	"testing"
+)
+
+func testFingerprint(line string, boarding string) *RouteFingerprint {
+	return &RouteFingerprint{
+		Modes: []string{"WALKING", "TRANSIT", "WALKING"},
+		Transit: []FingerprintLeg{
+			FingerprintLeg{Line: line, BoardingStop: boarding, AlightingStop: "City Interchange"},
+		},
+	}
+}
+
+func TestRouteSimilarity(t *testing.T) {
+	a := testFingerprint("300", "Cameron Av after Chandler St")
+	if score := RouteSimilarity(a, a); score != 1 {
+		t.Error("Expected", 1, "found", score)
+	}
+	// a small wording change should still match
+	b := testFingerprint("300", "Cameron Ave after Chandler St")
+	if score := RouteSimilarity(a, b); score < MinRouteSimilarity {
+		t.Error("Expected similarity above", MinRouteSimilarity, "found", score)
+	}
+	// a different bus from the same stop shouldn't match
+	c := testFingerprint("31", "Cameron Av after Chandler St")
+	if score := RouteSimilarity(a, c); score >= MinRouteSimilarity {
+		t.Error("Expected similarity below", MinRouteSimilarity, "found", score)
+	}
+	if score := RouteSimilarity(a, nil); score != 0 {
+		t.Error("Expected", 0, "found", score)
+	}
+}
+
+func TestGetMatchingRoute(t *testing.T) {
+	var arrival int64 = 1500101524000
+	trip := &TripSchedule{
+		Route: &RouteOption{
+			Description: "Belconnen Way",
+			ArrivalTime: UnixTime{UnixTimestampToTime(arrival)},
+			Fingerprint: testFingerprint("300", "Cameron Av after Chandler St"),
+		},
+		RepeatDays: []bool{false, false, false, false, false, false, false},
+	}
+	expected := RouteOption{
+		Description: "Belconnen Way and Barry Dr",
+		ArrivalTime: UnixTime{UnixTimestampToTime(arrival + 60000)},
+		Fingerprint: testFingerprint("300", "Cameron Ave after Chandler St"),
+	}
+	routes := []RouteOption{
+		// the description matches but it's a different bus
+		RouteOption{
+			Description: "Belconnen Way",
+			ArrivalTime: UnixTime{UnixTimestampToTime(arrival)},
+			Fingerprint: testFingerprint("31", "Cameron Av after Chandler St"),
+		},
+		// the same bus but further from the arrival time
+		RouteOption{
+			Description: "Belconnen Way",
+			ArrivalTime: UnixTime{UnixTimestampToTime(arrival - 600000)},
+			Fingerprint: testFingerprint("300", "Cameron Ave after Chandler St"),
+		},
+		expected,
+	}
+	result, err := getMatchingRoute(trip, routes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != expected {
+		t.Error("Expected", expected, "found", result)
+	}
+}
+
+func TestGetMatchingRouteBelowThreshold(t *testing.T) {
+	var arrival int64 = 1500101524000
+	trip := &TripSchedule{
+		Route: &RouteOption{
+			Description: "Belconnen Way",
+			ArrivalTime: UnixTime{UnixTimestampToTime(arrival)},
+			Fingerprint: testFingerprint("300", "Cameron Av after Chandler St"),
+		},
+		RepeatDays: []bool{false, false, false, false, false, false, false},
+	}
+	routes := []RouteOption{
+		RouteOption{
+			Description: "Belconnen Way",
+			ArrivalTime: UnixTime{UnixTimestampToTime(arrival)},
+			Fingerprint: testFingerprint("31", "Cameron Av after Chandler St"),
+		},
+	}
+	_, err := getMatchingRoute(trip, routes)
+	if err == nil {
+		t.Error("Expected error when no routes are similar enough")
+	}
+}
+
+func TestGetMatchingRouteWithoutFingerprint(t *testing.T) {
+	// Test case: trips scheduled before fingerprints use the description
+	var arrival int64 = 1500101524000
+	trip := &TripSchedule{
+		Route: &RouteOption{
+			Description: "Belconnen Way",
+			ArrivalTime: UnixTime{UnixTimestampToTime(arrival)},
+		},
+		RepeatDays: []bool{false, false, false, false, false, false, false},
+	}
+	expected := RouteOption{
+		Description: "Belconnen Way",
+		ArrivalTime: UnixTime{UnixTimestampToTime(arrival + 600000)},
+		Fingerprint: testFingerprint("300", "Cameron Av after Chandler St"),
+	}
+	routes := []RouteOption{
+		RouteOption{
+			Description: "Barry Dr",
+			ArrivalTime: UnixTime{UnixTimestampToTime(arrival)},
+		},
+		expected,
+	}
+	result, _ := getMatchingRoute(trip, routes)
+	if result != expected {
+		t.Error("Expected", expected, "found", result)
+	}
+}
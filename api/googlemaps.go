@@ -7,6 +7,9 @@ import (
 	"time"
 )
 
+// GoogleMapsProvider is the provider name for routes found by Google Maps
+const GoogleMapsProvider = "googlemaps"
+
 // GoogleMapsFinder - an implementation of RouteFinder that searches GoogleMaps
 // for options
 type GoogleMapsFinder struct {
@@ -34,9 +37,25 @@ func NewGoogleMapsFinder(apiKey string) *GoogleMapsFinder {
 func (finder *GoogleMapsFinder) FindRoutes(originLat, originLng, destLat, destLng float64,
 	transportType string, arrivalTime time.Time,
 	routeName string) []RouteOption {
-	routes := getRoutes(finder.apiKey, originLat, originLng, destLat, destLng,
+	options, err := finder.FindRoutesWithError(originLat, originLng, destLat, destLng,
+		transportType, arrivalTime, routeName)
+	if err != nil {
+		fmt.Println("Google Maps error:", err)
+	}
+	return options
+}
+
+// FindRoutesWithError is the same as FindRoutes but returns an error if
+// the directions request failed
+func (finder *GoogleMapsFinder) FindRoutesWithError(originLat, originLng, destLat, destLng float64,
+	transportType string, arrivalTime time.Time,
+	routeName string) ([]RouteOption, error) {
+	routes, err := getRoutes(finder.apiKey, originLat, originLng, destLat, destLng,
 		transportType, arrivalTime)
 	options := []RouteOption{}
+	if err != nil {
+		return options, err
+	}
 	for _, route := range routes {
 		depart := getDepartureTime(route, arrivalTime)
 		arrive := getArrivalTime(route, arrivalTime)
@@ -46,22 +65,28 @@ func (finder *GoogleMapsFinder) FindRoutes(originLat, originLng, destLat, destLn
 			if getRouteName(route) == routeName {
 				option := NewRouteOption(depart, arrive, routeName, desc)
 				option.transitDetails = details
+				option.Provider = GoogleMapsProvider
+				option.Fingerprint = getFingerprint(route)
+				option.WalkingTimeMs = getWalkingTime(route)
 				options = append(options, option)
 			}
 		} else {
 			option := NewRouteOption(depart, arrive, getRouteName(route), desc)
 			option.transitDetails = details
+			option.Provider = GoogleMapsProvider
+			option.Fingerprint = getFingerprint(route)
+			option.WalkingTimeMs = getWalkingTime(route)
 			options = append(options, option)
 		}
 	}
-	return options
+	return options, nil
 }
 
 func getRoutes(apiKey string, originLat float64, originLng float64, destLat float64,
-	destLng float64, transportType string, arrivalTime time.Time) []maps.Route {
+	destLng float64, transportType string, arrivalTime time.Time) ([]maps.Route, error) {
 	c, err := maps.NewClient(maps.WithAPIKey(apiKey))
 	if err != nil {
-		fmt.Println("fatal error:", err)
+		return nil, err
 	}
 	r := &maps.DirectionsRequest{
 		Alternatives: true,
@@ -71,10 +96,7 @@ func getRoutes(apiKey string, originLat float64, originLng float64, destLat floa
 		ArrivalTime:  fmt.Sprintf("%d", arrivalTime.UnixNano()/1e9),
 	}
 	resp, _, err := c.Directions(context.Background(), r)
-	if err != nil {
-		fmt.Println("fatal error:", err)
-	}
-	return resp
+	return resp, err
 }
 
 func getRouteName(route maps.Route) string {
@@ -119,6 +141,19 @@ func getTransitDetails(route maps.Route) *maps.TransitDetails {
 	return nil
 }
 
+// getWalkingTime returns the total walking duration in milliseconds
+func getWalkingTime(route maps.Route) int64 {
+	var walking time.Duration
+	for _, leg := range route.Legs {
+		for _, step := range leg.Steps {
+			if step.TravelMode == "WALKING" {
+				walking += step.Duration
+			}
+		}
+	}
+	return int64(walking / time.Millisecond)
+}
+
 func getDescription(route maps.Route) string {
 	return route.Summary
 }
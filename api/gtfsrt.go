@@ -0,0 +1,267 @@
+package api
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"github.com/MobilityData/gtfs-realtime-bindings/golang/gtfs"
+	"github.com/golang/protobuf/proto"
+	"github.com/oliveroneill/nxtbus-go"
+	"googlemaps.github.io/maps"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GTFSFeedInterval is how long a downloaded GTFS-RT feed is used for before
+// it's fetched again. The feed covers every stop so it's shared by all trips
+const GTFSFeedInterval = 30 * time.Second
+
+// gtfsTimeout is how long to wait for the feed to download
+const gtfsTimeout = 10 * time.Second
+
+// visitDateFormat is the date format used in stop visits, this is the same
+// format that NXTBUS uses so that `nxtbus.ParseDate` can read it
+const visitDateFormat = "2006-01-02T15:04:05-07:00"
+
+// GTFSRealTimeAPI is an implementation of RealTimeAPI and CancellationAPI
+// using a GTFS-RT trip updates feed. Stops are found using the agency's GTFS
+// stops.txt and each update is converted into a stop visit so that it's
+// handled the same way as NXTBUS data
+type GTFSRealTimeAPI struct {
+	RealTimeAPI
+	feedURL string
+	// sent with each feed request, such as an API key
+	headers  map[string]string
+	resolver *StopResolver
+	// route short names keyed by GTFS route ID, these are compared with
+	// the route names from Google Maps. If a route isn't here then its ID
+	// is used
+	routeNames map[string]string
+	client     *http.Client
+	feed       *gtfs.FeedMessage
+	fetched    time.Time
+	mux        sync.Mutex
+}
+
+// NewGTFSRealTimeAPI will create a GTFSRealTimeAPI
+// @param feedURL - the URL of the GTFS-RT trip updates feed
+// @param headers - optional headers to send with each request
+// @param resolver - used to find the GTFS stop ID of Google Maps stops
+// @param routeNames - optional route short names keyed by route ID
+func NewGTFSRealTimeAPI(feedURL string, headers map[string]string, resolver *StopResolver, routeNames map[string]string) *GTFSRealTimeAPI {
+	if routeNames == nil {
+		routeNames = make(map[string]string)
+	}
+	return &GTFSRealTimeAPI{
+		feedURL:    feedURL,
+		headers:    headers,
+		resolver:   resolver,
+		routeNames: routeNames,
+		client:     &http.Client{Timeout: gtfsTimeout},
+	}
+}
+
+// GetVisits will return the updates for every trip stopping at the stop
+func (api *GTFSRealTimeAPI) GetVisits(stop maps.TransitStop) ([]nxtbus.MonitoredStopVisit, error) {
+	visits, _, err := api.stopVisits(stop)
+	return visits, err
+}
+
+// GetCancelledVisits will return the trips at the stop that the feed has
+// marked as cancelled
+func (api *GTFSRealTimeAPI) GetCancelledVisits(stop maps.TransitStop) ([]nxtbus.MonitoredStopVisit, error) {
+	_, cancelled, err := api.stopVisits(stop)
+	return cancelled, err
+}
+
+// MismatchReport will return the stops that couldn't be matched exactly by
+// name
+func (api *GTFSRealTimeAPI) MismatchReport() []StopMismatch {
+	return api.resolver.MismatchReport()
+}
+
+func (api *GTFSRealTimeAPI) stopVisits(stop maps.TransitStop) ([]nxtbus.MonitoredStopVisit, []nxtbus.MonitoredStopVisit, error) {
+	resolved, err := api.resolver.Resolve(stop)
+	if err != nil {
+		return nil, nil, err
+	}
+	feed, err := api.getFeed()
+	if err != nil {
+		return nil, nil, err
+	}
+	visits, cancelled := gtfsStopVisits(feed, resolved.ID, api.routeNames)
+	return visits, cancelled, nil
+}
+
+// getFeed returns the latest feed, downloading it if it's older than
+// `GTFSFeedInterval`
+func (api *GTFSRealTimeAPI) getFeed() (*gtfs.FeedMessage, error) {
+	api.mux.Lock()
+	defer api.mux.Unlock()
+	if api.feed != nil && time.Since(api.fetched) < GTFSFeedInterval {
+		return api.feed, nil
+	}
+	req, err := http.NewRequest("GET", api.feedURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range api.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := api.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GTFS-RT feed returned status %d", resp.StatusCode)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	feed := &gtfs.FeedMessage{}
+	if err := proto.Unmarshal(b, feed); err != nil {
+		return nil, err
+	}
+	api.feed = feed
+	api.fetched = time.Now()
+	return feed, nil
+}
+
+// gtfsStopVisits converts the feed's updates for the stop into stop visits.
+// Skipped stops have an expected arrival but no expected departure, the same
+// as NXTBUS. Updates without an absolute time are left out since the
+// scheduled time can't be worked out without the static timetable, so a
+// cancelled trip is only returned if the feed still includes its time at
+// this stop
+// @param routeNames - route short names keyed by route ID
+// @returns the visits for running trips and the visits for cancelled trips
+func gtfsStopVisits(feed *gtfs.FeedMessage, stopID string, routeNames map[string]string) ([]nxtbus.MonitoredStopVisit, []nxtbus.MonitoredStopVisit) {
+	visits := []nxtbus.MonitoredStopVisit{}
+	cancelled := []nxtbus.MonitoredStopVisit{}
+	for _, entity := range feed.GetEntity() {
+		update := entity.GetTripUpdate()
+		if update == nil {
+			continue
+		}
+		trip := update.GetTrip()
+		name, ok := routeNames[trip.GetRouteId()]
+		if !ok {
+			name = trip.GetRouteId()
+		}
+		for _, stopUpdate := range update.GetStopTimeUpdate() {
+			if stopUpdate.GetStopId() != stopID {
+				continue
+			}
+			event := stopUpdate.GetDeparture()
+			if event == nil {
+				event = stopUpdate.GetArrival()
+			}
+			if event == nil || event.Time == nil {
+				continue
+			}
+			expected := time.Unix(event.GetTime(), 0)
+			// the delay is how far behind the schedule the trip is
+			aimed := expected.Add(-time.Duration(event.GetDelay()) * time.Second)
+			visit := nxtbus.MonitoredStopVisit{
+				LineName:           name,
+				AimedDepartureTime: aimed.Format(visitDateFormat),
+				AimedArrivalTime:   aimed.Format(visitDateFormat),
+			}
+			if trip.GetScheduleRelationship() == gtfs.TripDescriptor_CANCELED {
+				cancelled = append(cancelled, visit)
+				continue
+			}
+			if stopUpdate.GetScheduleRelationship() == gtfs.TripUpdate_StopTimeUpdate_SKIPPED {
+				visit.ExpectedArrivalTime = expected.Format(visitDateFormat)
+			} else {
+				visit.ExpectedDepartureTime = expected.Format(visitDateFormat)
+			}
+			visits = append(visits, visit)
+		}
+	}
+	return visits, cancelled
+}
+
+// loadGTFSRouteNames will read the short name of each route from a GTFS
+// routes.txt file, falling back to the long name for routes without one
+// @returns route names keyed by route ID
+func loadGTFSRouteNames(r io.Reader) (map[string]string, error) {
+	reader := csv.NewReader(r)
+	header, err := reader.Read()
+	if err != nil {
+		return nil, err
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		// some files start with a byte order mark
+		columns[strings.TrimPrefix(strings.TrimSpace(name), "\ufeff")] = i
+	}
+	if _, ok := columns["route_id"]; !ok {
+		return nil, errors.New("Routes file is missing column route_id")
+	}
+	names := make(map[string]string)
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		name := gtfsColumn(record, columns, "route_short_name")
+		if len(name) == 0 {
+			name = gtfsColumn(record, columns, "route_long_name")
+		}
+		if len(name) > 0 {
+			names[record[columns["route_id"]]] = name
+		}
+	}
+	return names, nil
+}
+
+func gtfsColumn(record []string, columns map[string]int, name string) string {
+	i, ok := columns[name]
+	if !ok || i >= len(record) {
+		return ""
+	}
+	return record[i]
+}
+
+func newGTFSRealTimeAPIFromConfig(config RealTimeProviderConfig) (RealTimeAPI, error) {
+	if len(config.URL) == 0 {
+		return nil, errors.New("GTFS-RT provider needs a url")
+	}
+	if len(config.StopsFile) == 0 {
+		return nil, errors.New("GTFS-RT provider needs a stops_file")
+	}
+	// there's no default agency like there is for NXTBUS
+	if len(config.Agencies) == 0 {
+		return nil, errors.New("GTFS-RT provider needs agencies")
+	}
+	resolver, err := NewStopResolver(config.StopsFile, config.CacheDir)
+	if err != nil {
+		return nil, err
+	}
+	// stops can only be found in the GTFS stops, not using NXTBUS
+	resolver.lookupByName = nil
+	var routeNames map[string]string
+	if len(config.RoutesFile) > 0 {
+		f, err := os.Open(config.RoutesFile)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		routeNames, err = loadGTFSRouteNames(f)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return NewGTFSRealTimeAPI(config.URL, config.Headers, resolver, routeNames), nil
+}
@@ -0,0 +1,178 @@
+package api
+
+import (
+	"github.com/MobilityData/gtfs-realtime-bindings/golang/gtfs"
+	"github.com/golang/protobuf/proto"
+	"googlemaps.github.io/maps"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestTripUpdate(routeID string, relationship gtfs.TripDescriptor_ScheduleRelationship, updates ...*gtfs.TripUpdate_StopTimeUpdate) *gtfs.FeedEntity {
+	return &gtfs.FeedEntity{
+		Id: proto.String(routeID),
+		TripUpdate: &gtfs.TripUpdate{
+			Trip: &gtfs.TripDescriptor{
+				RouteId:              proto.String(routeID),
+				ScheduleRelationship: relationship.Enum(),
+			},
+			StopTimeUpdate: updates,
+		},
+	}
+}
+
+func newTestStopTimeUpdate(stopID string, t time.Time, delay int32) *gtfs.TripUpdate_StopTimeUpdate {
+	return &gtfs.TripUpdate_StopTimeUpdate{
+		StopId: proto.String(stopID),
+		Departure: &gtfs.TripUpdate_StopTimeEvent{
+			Time:  proto.Int64(t.Unix()),
+			Delay: proto.Int32(delay),
+		},
+	}
+}
+
+func TestGTFSStopVisits(t *testing.T) {
+	expected := time.Date(2017, 8, 1, 9, 5, 0, 0, time.Local)
+	skipped := newTestStopTimeUpdate("3412", expected, 0)
+	skipped.ScheduleRelationship = gtfs.TripUpdate_StopTimeUpdate_SKIPPED.Enum()
+	feed := &gtfs.FeedMessage{
+		Entity: []*gtfs.FeedEntity{
+			newTestTripUpdate("R1", gtfs.TripDescriptor_SCHEDULED,
+				newTestStopTimeUpdate("5501", expected, 0),
+				newTestStopTimeUpdate("3412", expected, 300),
+			),
+			newTestTripUpdate("R2", gtfs.TripDescriptor_SCHEDULED, skipped),
+			newTestTripUpdate("R3", gtfs.TripDescriptor_CANCELED,
+				newTestStopTimeUpdate("3412", expected, 0),
+			),
+		},
+	}
+	visits, cancelled := gtfsStopVisits(feed, "3412", map[string]string{"R1": "300"})
+	if len(visits) != 2 {
+		t.Fatal("Expected", 2, "found", len(visits))
+	}
+	if len(cancelled) != 1 || cancelled[0].LineName != "R3" {
+		t.Error("Expected cancelled trip R3, found", cancelled)
+	}
+	if visits[0].LineName != "300" {
+		t.Error("Expected", "300", "found", visits[0].LineName)
+	}
+	if visits[0].ExpectedDepartureTime != expected.Format(visitDateFormat) {
+		t.Error("Expected", expected.Format(visitDateFormat), "found", visits[0].ExpectedDepartureTime)
+	}
+	aimed := expected.Add(-5 * time.Minute).Format(visitDateFormat)
+	if visits[0].AimedDepartureTime != aimed {
+		t.Error("Expected", aimed, "found", visits[0].AimedDepartureTime)
+	}
+	// routes without a name use their ID
+	if visits[1].LineName != "R2" {
+		t.Error("Expected", "R2", "found", visits[1].LineName)
+	}
+	// skipped stops only have an expected arrival, like NXTBUS
+	if visits[1].ExpectedDepartureTime != "" {
+		t.Error("Expected no departure time, found", visits[1].ExpectedDepartureTime)
+	}
+	if visits[1].ExpectedArrivalTime != expected.Format(visitDateFormat) {
+		t.Error("Expected", expected.Format(visitDateFormat), "found", visits[1].ExpectedArrivalTime)
+	}
+}
+
+func TestGTFSStopVisitsFallsBackToArrival(t *testing.T) {
+	expected := time.Date(2017, 8, 1, 9, 5, 0, 0, time.Local)
+	update := &gtfs.TripUpdate_StopTimeUpdate{
+		StopId:  proto.String("3412"),
+		Arrival: &gtfs.TripUpdate_StopTimeEvent{Time: proto.Int64(expected.Unix())},
+	}
+	// updates with only a delay can't be used without the timetable
+	delayOnly := &gtfs.TripUpdate_StopTimeUpdate{
+		StopId:    proto.String("3412"),
+		Departure: &gtfs.TripUpdate_StopTimeEvent{Delay: proto.Int32(60)},
+	}
+	feed := &gtfs.FeedMessage{
+		Entity: []*gtfs.FeedEntity{
+			newTestTripUpdate("R1", gtfs.TripDescriptor_SCHEDULED, update, delayOnly),
+		},
+	}
+	visits, _ := gtfsStopVisits(feed, "3412", nil)
+	if len(visits) != 1 {
+		t.Fatal("Expected", 1, "found", len(visits))
+	}
+	if visits[0].ExpectedDepartureTime != expected.Format(visitDateFormat) {
+		t.Error("Expected", expected.Format(visitDateFormat), "found", visits[0].ExpectedDepartureTime)
+	}
+}
+
+func TestGTFSRealTimeAPIGetVisits(t *testing.T) {
+	expected := time.Date(2017, 8, 1, 9, 5, 0, 0, time.Local)
+	feed := &gtfs.FeedMessage{
+		Entity: []*gtfs.FeedEntity{
+			newTestTripUpdate("R1", gtfs.TripDescriptor_SCHEDULED,
+				newTestStopTimeUpdate("3412", expected, 0),
+			),
+		},
+	}
+	b, err := proto.Marshal(feed)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("Authorization") != "apikey test" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write(b)
+	}))
+	defer server.Close()
+	api := NewGTFSRealTimeAPI(server.URL, map[string]string{"Authorization": "apikey test"}, newTestStopResolver(t, ""), map[string]string{"R1": "300"})
+	stop := maps.TransitStop{
+		Name:     "Northbourne Ave Plt 2",
+		Location: maps.LatLng{Lat: -35.27792, Lng: 149.12980},
+	}
+	for i := 0; i < 2; i++ {
+		visits, err := api.GetVisits(stop)
+		if err != nil {
+			t.Fatal("Unexpected error", err)
+		}
+		if len(visits) != 1 || visits[0].LineName != "300" {
+			t.Error("Expected", "300", "found", visits)
+		}
+	}
+	// the feed should be reused for the second request
+	if requests != 1 {
+		t.Error("Expected", 1, "found", requests)
+	}
+}
+
+func TestLoadGTFSRouteNames(t *testing.T) {
+	routes := "route_id,agency_id,route_short_name,route_long_name\n" +
+		"R1,TC,300,Belconnen to Tuggeranong\n" +
+		"R2,TC,,Light Rail\n"
+	names, err := loadGTFSRouteNames(strings.NewReader(routes))
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if names["R1"] != "300" {
+		t.Error("Expected", "300", "found", names["R1"])
+	}
+	if names["R2"] != "Light Rail" {
+		t.Error("Expected", "Light Rail", "found", names["R2"])
+	}
+}
+
+func TestGTFSRealTimeAPIConfigErrors(t *testing.T) {
+	configs := []RealTimeProviderConfig{
+		RealTimeProviderConfig{Type: "gtfsrt", StopsFile: "stops.txt", Agencies: []string{"Metro"}},
+		RealTimeProviderConfig{Type: "gtfsrt", URL: "http://feed", Agencies: []string{"Metro"}},
+		RealTimeProviderConfig{Type: "gtfsrt", URL: "http://feed", StopsFile: "stops.txt"},
+	}
+	for _, config := range configs {
+		if _, err := newGTFSRealTimeAPIFromConfig(config); err == nil {
+			t.Error("Expected error for config", config)
+		}
+	}
+}
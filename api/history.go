@@ -0,0 +1,56 @@
+package api
+
+// OccurrenceOutcome is what happened for a single occurrence of a trip
+type OccurrenceOutcome string
+
+const (
+	// OccurrenceNotified is used when the alert was sent on time
+	OccurrenceNotified OccurrenceOutcome = "notified"
+	// OccurrenceLate is used when the notification time passed while
+	// tripwatcher wasn't running but there was still time to leave
+	OccurrenceLate OccurrenceOutcome = "late"
+	// OccurrenceMissed is used when the departure passed while tripwatcher
+	// wasn't running, so no alert was sent
+	OccurrenceMissed OccurrenceOutcome = "missed"
+	// OccurrenceDisabled is used when the trip was disabled at notification
+	// time
+	OccurrenceDisabled OccurrenceOutcome = "disabled"
+	// OccurrenceSkipped is used when the occurrence fell on one of the trip's
+	// skip dates, a holiday or while the user's trips were paused
+	OccurrenceSkipped OccurrenceOutcome = "skipped"
+)
+
+// TripOccurrence is a record of a single occurrence of a trip
+type TripOccurrence struct {
+	TripID string `json:"trip_id"`
+	UserID string `json:"user_id"`
+	// the local date of the occurrence
+	Occurrence    string            `json:"occurrence"`
+	Outcome       OccurrenceOutcome `json:"outcome"`
+	DepartureTime UnixTime          `json:"departure_time"`
+	// when the occurrence was completed
+	Recorded UnixTime `json:"recorded"`
+}
+
+// NewTripOccurrence will create a record for the trip's current occurrence
+// @param route - the route that was used for the alert
+// @param recorded - the time that the occurrence was completed
+func NewTripOccurrence(trip *TripSchedule, outcome OccurrenceOutcome, route *RouteOption, recorded UnixTime) TripOccurrence {
+	return TripOccurrence{
+		TripID:        trip.ID,
+		UserID:        trip.User.ID,
+		Occurrence:    GetOccurrence(trip),
+		Outcome:       outcome,
+		DepartureTime: route.DepartureTime,
+		Recorded:      recorded,
+	}
+}
+
+// GetTripHistory returns every recorded occurrence of the trip, most recent
+// first
+// @param tripID - the trip to get history for
+// @param userID - this is used to ensure that the user requesting the history
+// actually scheduled the trip
+func GetTripHistory(db DatabaseInterface, tripID string, userID string) ([]TripOccurrence, error) {
+	return db.GetTripHistory(tripID, userID)
+}
@@ -0,0 +1,153 @@
+package api
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+// LeaseDuration is how long a tripwatcher owns a trip for without renewing
+// it. If a tripwatcher stops, its trips will be picked up by the others
+// once their leases expire
+const LeaseDuration = 3 * time.Minute
+
+// InstanceExpiry is how long a tripwatcher is counted as running after its
+// last heartbeat
+const InstanceExpiry = 3 * time.Minute
+
+// LeaseInterface is used to split trips between multiple tripwatchers so
+// that each trip is only watched by one of them
+type LeaseInterface interface {
+	// Heartbeat records that this tripwatcher is still running
+	Heartbeat(instanceID string) error
+	// LiveInstances returns the number of tripwatchers that have sent a
+	// heartbeat within the expiry
+	LiveInstances(expiry time.Duration) (int, error)
+	// ClaimTrips will renew this tripwatcher's leases and claim unowned or
+	// expired trips until it owns up to limit trips. Leases over the limit
+	// are kept, `ReleaseTrips` is used to choose which ones to give back
+	// @returns the IDs of every trip this tripwatcher owns
+	ClaimTrips(instanceID string, limit int, ttl time.Duration) ([]string, error)
+	// ReleaseTrips will give up this tripwatcher's leases on the trips so
+	// that they can be picked up by other instances
+	ReleaseTrips(instanceID string, tripIDs []string) error
+	// RenewLease will extend the lease if this tripwatcher still owns it
+	// @returns false if the lease has expired or is owned by another
+	// tripwatcher
+	RenewLease(instanceID string, tripID string, ttl time.Duration) (bool, error)
+	// ClaimTrip will claim a single trip if it's unowned or its lease has
+	// expired. The lease is renewed if this tripwatcher already owns it
+	// @returns false if another tripwatcher owns the trip
+	ClaimTrip(instanceID string, tripID string, ttl time.Duration) (bool, error)
+}
+
+// WatchedTrip is the state of a trip that a tripwatcher is watching, used
+// to choose which trips to give back when it owns too many
+type WatchedTrip struct {
+	ID string
+	// when the trip's next reminder will be sent
+	NotificationTime time.Time
+	// set once the final alert has started
+	Alerting bool
+}
+
+// ClaimFairShare will record a heartbeat for this tripwatcher and claim its
+// share of the trips, split evenly between every running tripwatcher. If it
+// owns more than its share, such as when another tripwatcher has started,
+// then the trips that aren't due for the longest are released. Trips that
+// are alerting are never released
+// @param instanceID - unique name for this tripwatcher
+// @param totalTrips - the number of scheduled trips
+// @param watched - the trips this tripwatcher is currently watching
+// @returns the set of trip IDs that this tripwatcher should watch
+func ClaimFairShare(db LeaseInterface, instanceID string, totalTrips int, watched []WatchedTrip) (map[string]bool, error) {
+	if err := db.Heartbeat(instanceID); err != nil {
+		return nil, err
+	}
+	live, err := db.LiveInstances(InstanceExpiry)
+	if err != nil {
+		return nil, err
+	}
+	limit := fairShare(totalTrips, live)
+	ids, err := db.ClaimTrips(instanceID, limit, LeaseDuration)
+	if err != nil {
+		return nil, err
+	}
+	owned := make(map[string]bool)
+	for _, id := range ids {
+		owned[id] = true
+	}
+	release := tripsToRelease(ids, limit, watched)
+	if len(release) == 0 {
+		return owned, nil
+	}
+	if err := db.ReleaseTrips(instanceID, release); err != nil {
+		return nil, err
+	}
+	for _, id := range release {
+		delete(owned, id)
+	}
+	return owned, nil
+}
+
+// tripsToRelease returns the owned trips over the limit that should be
+// given back. Trips that aren't being watched go first since releasing them
+// loses nothing, followed by the trips whose notification time is furthest
+// away. Alerting trips are never chosen, so fewer trips may be returned
+func tripsToRelease(owned []string, limit int, watched []WatchedTrip) []string {
+	if len(owned) <= limit {
+		return nil
+	}
+	state := make(map[string]WatchedTrip)
+	for _, w := range watched {
+		state[w.ID] = w
+	}
+	candidates := []string{}
+	for _, id := range owned {
+		if !state[id].Alerting {
+			candidates = append(candidates, id)
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, aWatched := state[candidates[i]]
+		b, bWatched := state[candidates[j]]
+		if aWatched != bWatched {
+			return !aWatched
+		}
+		return a.NotificationTime.After(b.NotificationTime)
+	})
+	count := len(owned) - limit
+	if count > len(candidates) {
+		count = len(candidates)
+	}
+	return candidates[:count]
+}
+
+// fairShare returns the number of trips each instance should own, rounding
+// up so that every trip is owned
+func fairShare(totalTrips int, instances int) int {
+	// this instance has just sent a heartbeat so it should be counted
+	if instances < 1 {
+		instances = 1
+	}
+	return (totalTrips + instances - 1) / instances
+}
+
+// HasLease will check that this tripwatcher still owns the trip. This should
+// be checked before sending a notification. The lease is extended so that it
+// won't expire while the notification is sent
+func HasLease(db LeaseInterface, instanceID string, trip *TripSchedule) (bool, error) {
+	if len(trip.ID) == 0 {
+		return false, errors.New("Trip has no ID")
+	}
+	return db.RenewLease(instanceID, trip.ID, LeaseDuration)
+}
+
+// ClaimTrip will take ownership of a trip that has just been created or
+// changed, unless another tripwatcher is already watching it
+func ClaimTrip(db LeaseInterface, instanceID string, tripID string) (bool, error) {
+	if len(tripID) == 0 {
+		return false, errors.New("Trip has no ID")
+	}
+	return db.ClaimTrip(instanceID, tripID, LeaseDuration)
+}
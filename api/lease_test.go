@@ -0,0 +1,130 @@
+package api
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+type MockLeases struct {
+	instances  int
+	heartbeats int
+	limit      int
+	owned      []string
+	released   []string
+}
+
+func (m *MockLeases) Heartbeat(instanceID string) error {
+	m.heartbeats++
+	return nil
+}
+
+func (m *MockLeases) LiveInstances(expiry time.Duration) (int, error) {
+	return m.instances, nil
+}
+
+func (m *MockLeases) ClaimTrips(instanceID string, limit int, ttl time.Duration) ([]string, error) {
+	m.limit = limit
+	return m.owned, nil
+}
+
+func (m *MockLeases) ReleaseTrips(instanceID string, tripIDs []string) error {
+	m.released = append(m.released, tripIDs...)
+	return nil
+}
+
+func (m *MockLeases) RenewLease(instanceID string, tripID string, ttl time.Duration) (bool, error) {
+	for _, id := range m.owned {
+		if id == tripID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (m *MockLeases) ClaimTrip(instanceID string, tripID string, ttl time.Duration) (bool, error) {
+	m.owned = append(m.owned, tripID)
+	return true, nil
+}
+
+func TestClaimFairShare(t *testing.T) {
+	leases := &MockLeases{instances: 3, owned: []string{"1", "4"}}
+	owned, err := ClaimFairShare(leases, "watcher-1", 10, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leases.heartbeats != 1 {
+		t.Error("Expected", 1, "heartbeat, found", leases.heartbeats)
+	}
+	// ten trips split between three instances rounds up to four each
+	if leases.limit != 4 {
+		t.Error("Expected", 4, "found", leases.limit)
+	}
+	if len(owned) != 2 || !owned["1"] || !owned["4"] {
+		t.Error("Unexpected owned trips", owned)
+	}
+}
+
+func TestClaimFairShareReleasesFurthestTrips(t *testing.T) {
+	now := time.Now()
+	leases := &MockLeases{instances: 2, owned: []string{"1", "2", "3", "4", "5", "6"}}
+	watched := []WatchedTrip{
+		{ID: "1", NotificationTime: now.Add(3 * time.Hour), Alerting: true},
+		{ID: "2", NotificationTime: now.Add(2 * time.Hour)},
+		{ID: "3", NotificationTime: now.Add(time.Minute)},
+		{ID: "4", NotificationTime: now.Add(time.Hour)},
+		{ID: "5", NotificationTime: now.Add(10 * time.Minute)},
+	}
+	// six trips between two instances is three each, the unwatched trip
+	// goes first then the furthest away that isn't alerting
+	owned, err := ClaimFairShare(leases, "watcher-1", 6, watched)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"6", "2", "4"}
+	if !reflect.DeepEqual(leases.released, expected) {
+		t.Error("Expected", expected, "found", leases.released)
+	}
+	if len(owned) != 3 || !owned["1"] || !owned["3"] || !owned["5"] {
+		t.Error("Unexpected owned trips", owned)
+	}
+}
+
+func TestTripsToReleaseKeepsAlertingTrips(t *testing.T) {
+	watched := []WatchedTrip{
+		{ID: "1", Alerting: true},
+		{ID: "2", Alerting: true},
+		{ID: "3", NotificationTime: time.Now()},
+	}
+	release := tripsToRelease([]string{"1", "2", "3"}, 1, watched)
+	if !reflect.DeepEqual(release, []string{"3"}) {
+		t.Error("Expected only", "3", "to be released, found", release)
+	}
+	if release := tripsToRelease([]string{"1", "2"}, 2, watched); len(release) != 0 {
+		t.Error("Expected nothing to be released, found", release)
+	}
+}
+
+func TestFairShare(t *testing.T) {
+	if share := fairShare(10, 0); share != 10 {
+		t.Error("Expected", 10, "found", share)
+	}
+	if share := fairShare(10, 2); share != 5 {
+		t.Error("Expected", 5, "found", share)
+	}
+	if share := fairShare(0, 2); share != 0 {
+		t.Error("Expected", 0, "found", share)
+	}
+}
+
+func TestHasLease(t *testing.T) {
+	leases := &MockLeases{owned: []string{"1"}}
+	owned, err := HasLease(leases, "watcher-1", &TripSchedule{ID: "1"})
+	if err != nil || !owned {
+		t.Error("Expected lease to be owned", err)
+	}
+	owned, _ = HasLease(leases, "watcher-1", &TripSchedule{ID: "2"})
+	if owned {
+		t.Error("Expected lease to be owned by another tripwatcher")
+	}
+}
@@ -0,0 +1,135 @@
+package api
+
+import (
+	"errors"
+	"time"
+)
+
+// DeliveryResult is the result of a single attempt to deliver a notification
+type DeliveryResult string
+
+const (
+	// DeliverySent is used when the provider accepted the notification
+	DeliverySent DeliveryResult = "sent"
+	// DeliveryFailed is used when delivery failed and may be retried
+	DeliveryFailed DeliveryResult = "failed"
+	// DeliveryRejected is used when the provider rejected the user's token
+	DeliveryRejected DeliveryResult = "rejected"
+	// DeliveryExpired is used when the notification wasn't sent because the
+	// service had already departed
+	DeliveryExpired DeliveryResult = "expired"
+	// DeliverySuppressed is used when the notification wasn't queued because
+	// of the user's preferences, such as quiet hours
+	DeliverySuppressed DeliveryResult = "suppressed"
+)
+
+// userNotificationLimit is the number of entries returned to users
+const userNotificationLimit = 100
+
+// maxNotificationLogLimit is the most entries returned by a single query
+const maxNotificationLogLimit = 1000
+
+// NotificationLogEntry is a record of a single attempt to deliver a
+// notification
+type NotificationLogEntry struct {
+	// this is empty for suppressed notifications since they're never queued
+	NotificationID string           `json:"notification_id"`
+	TripID         string           `json:"trip_id"`
+	UserID         string           `json:"user_id"`
+	Kind           NotificationKind `json:"kind"`
+	// the local date of the trip occurrence
+	Occurrence string `json:"occurrence"`
+	Message    string `json:"message"`
+	// the route that the notification was sent for, this can be nil
+	Route *RouteOption `json:"route,omitempty"`
+	// the device the notification was sent to, this is empty for users
+	// without any devices registered
+	DeviceID string `json:"device_id,omitempty"`
+	// the name of the notifier used
+	Provider string         `json:"provider"`
+	Result   DeliveryResult `json:"result"`
+	Error    string         `json:"error,omitempty"`
+	// the attempt number, starting at one
+	Attempt int `json:"attempt"`
+	// when the notification should have been sent
+	Scheduled UnixTime `json:"scheduled"`
+	// when delivery was attempted
+	Attempted UnixTime `json:"attempted"`
+}
+
+// NotificationLogFilter chooses which entries to return from the log. Empty
+// fields aren't filtered on
+type NotificationLogFilter struct {
+	UserID string
+	TripID string
+	// only entries attempted at or after this time
+	From time.Time
+	// only entries attempted before this time
+	To    time.Time
+	Limit int
+}
+
+// NotificationLogInterface stores every delivery attempt so that missing
+// notifications can be investigated
+type NotificationLogInterface interface {
+	// LogDelivery will store the delivery attempt
+	LogDelivery(entry NotificationLogEntry) error
+	// GetNotificationLog will return entries matching the filter, most recent
+	// first
+	GetNotificationLog(filter NotificationLogFilter) ([]NotificationLogEntry, error)
+}
+
+// NewNotificationLogEntry will create a log entry for this attempt
+// @param provider - the name of the notifier used, this can be empty if the
+// notification wasn't sent
+// @param err - the delivery error or nil if it was sent
+func NewNotificationLogEntry(n *Notification, provider string, result DeliveryResult, err error, attempted time.Time) NotificationLogEntry {
+	entry := NotificationLogEntry{
+		NotificationID: n.ID,
+		TripID:         n.TripID,
+		Kind:           n.Kind,
+		Occurrence:     n.Occurrence,
+		Message:        n.Message,
+		Route:          n.Route,
+		Provider:       provider,
+		Result:         result,
+		Attempt:        n.Attempts,
+		Scheduled:      UnixTime{n.Scheduled},
+		Attempted:      UnixTime{attempted},
+	}
+	if n.User != nil {
+		entry.UserID = n.User.ID
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	return entry
+}
+
+// LogDelivery will store the delivery attempt in the notification log
+func LogDelivery(db NotificationLogInterface, entry NotificationLogEntry) error {
+	return db.LogDelivery(entry)
+}
+
+// GetNotifications returns the user's most recent delivery attempts
+func GetNotifications(db NotificationLogInterface, userID string) ([]NotificationLogEntry, error) {
+	if len(userID) == 0 {
+		return nil, errors.New("No user ID set")
+	}
+	return db.GetNotificationLog(NotificationLogFilter{
+		UserID: userID,
+		Limit:  userNotificationLimit,
+	})
+}
+
+// QueryNotificationLog returns delivery attempts for any user. This should
+// only be exposed to admins
+func QueryNotificationLog(db NotificationLogInterface, filter NotificationLogFilter) ([]NotificationLogEntry, error) {
+	if !filter.From.IsZero() && !filter.To.IsZero() && filter.To.Before(filter.From) {
+		return nil, errors.New("Invalid time range")
+	}
+	if filter.Limit <= 0 || filter.Limit > maxNotificationLogLimit {
+		filter.Limit = maxNotificationLogLimit
+	}
+	return db.GetNotificationLog(filter)
+}
@@ -0,0 +1,56 @@
+package api
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+type MockNotificationLog struct {
+	filter NotificationLogFilter
+}
+
+func (m *MockNotificationLog) LogDelivery(entry NotificationLogEntry) error {
+	return nil
+}
+
+func (m *MockNotificationLog) GetNotificationLog(filter NotificationLogFilter) ([]NotificationLogEntry, error) {
+	m.filter = filter
+	return []NotificationLogEntry{}, nil
+}
+
+func TestGetNotificationsFiltersByUser(t *testing.T) {
+	db := &MockNotificationLog{}
+	if _, err := GetNotifications(db, ""); err == nil {
+		t.Error("Expected error for missing user ID")
+	}
+	GetNotifications(db, "user")
+	if db.filter.UserID != "user" || db.filter.Limit != userNotificationLimit {
+		t.Error("Unexpected filter", db.filter)
+	}
+}
+
+func TestQueryNotificationLog(t *testing.T) {
+	db := &MockNotificationLog{}
+	now := time.Now()
+	filter := NotificationLogFilter{From: now, To: now.Add(-time.Hour)}
+	if _, err := QueryNotificationLog(db, filter); err == nil {
+		t.Error("Expected error for invalid time range")
+	}
+	QueryNotificationLog(db, NotificationLogFilter{TripID: "1", Limit: 5000})
+	if db.filter.Limit != maxNotificationLogLimit || db.filter.TripID != "1" {
+		t.Error("Unexpected filter", db.filter)
+	}
+}
+
+func TestNewNotificationLogEntry(t *testing.T) {
+	n := &Notification{ID: "1", TripID: "2", User: &UserInfo{ID: "user"}, Attempts: 3}
+	entry := NewNotificationLogEntry(n, "push", DeliveryFailed, errors.New("Push failed"), time.Now())
+	if entry.UserID != "user" || entry.Attempt != 3 || entry.Error != "Push failed" {
+		t.Error("Unexpected entry", entry)
+	}
+	entry = NewNotificationLogEntry(n, "push", DeliverySent, nil, time.Now())
+	if len(entry.Error) > 0 {
+		t.Error("Expected no error, found", entry.Error)
+	}
+}
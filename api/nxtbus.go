@@ -2,63 +2,47 @@ package api
 
 import (
 	"github.com/oliveroneill/nxtbus-go"
-	"math"
-	"time"
+	"googlemaps.github.io/maps"
 )
 
-// NxtBusThreshold is used so that NXTBUS will track 90 minutes ahead
-const NxtBusThreshold = 90 * time.Minute
-
 // TransportCanberraName is the name stored in NXTBUS API response
 const TransportCanberraName = "Transport Canberra"
 
-// StopTimeThreshold is a threshold to determine whether a stop date from
-// Google Maps is close enough to the NXTBUS date to be the same route
-const StopTimeThreshold = 2 * time.Minute
-
-// NxtBusFinder - an implementation of RouteFinder that uses GoogleMaps
-// and NXTBUS for accurate departure times in Canberra
-type NxtBusFinder struct {
-	RouteFinder
-	nxtBusAPI RealTimeAPI
-	// this should always be a GoogleMapsFinder since we will
-	// use the information that it provides, but for testing
-	// purposes its easiest to use the interface
-	finder RouteFinder
-}
-
-// NewNxtBusFinder - create a NxtBusFinder with api key
-func NewNxtBusFinder(apiKey string, mapsFinder *GoogleMapsFinder) *NxtBusFinder {
-	finder := new(NxtBusFinder)
-	finder.nxtBusAPI = NewNxtBusAPI(apiKey)
-	finder.finder = mapsFinder
+// NewNxtBusFinder - create a RealTimeFinder that uses GoogleMaps and NXTBUS
+// for accurate departure times in Canberra
+// @param resolver - used to find NXTBUS stops from Google Maps stops. If nil
+// then stops will be looked up by name
+func NewNxtBusFinder(apiKey string, mapsFinder *GoogleMapsFinder, resolver *StopResolver) *RealTimeFinder {
+	finder := NewRealTimeFinder(mapsFinder)
+	// share stop requests between trips so that we don't make a request
+	// per trip
+	nxtBusAPI := NewStopPoller(NewNxtBusAPI(apiKey, resolver),
+		StopPollInterval, NxtBusRequestsPerSecond)
+	finder.RegisterProvider(TransportCanberraName, nxtBusAPI)
 	return finder
 }
 
-// RealTimeAPI is an interface for finding routes at a specific transit stop
-// Currently this is only used for NXTBUS, and will return nxtbus API
-// types
-type RealTimeAPI interface {
-	GetVisits(stopName string) ([]nxtbus.MonitoredStopVisit, error)
-}
-
 // NxtBusAPI is an implementation of RealTimeAPI using NXTBUS
 type NxtBusAPI struct {
 	RealTimeAPI
-	apiKey string
+	apiKey   string
+	resolver *StopResolver
 }
 
 // NewNxtBusAPI will create a new NxtBusAPI with the specified NXTBUS
 // API key
-func NewNxtBusAPI(apiKey string) *NxtBusAPI {
+// @param resolver - used to find NXTBUS stops, if nil then stops will be
+// looked up by name
+func NewNxtBusAPI(apiKey string, resolver *StopResolver) *NxtBusAPI {
 	i := new(NxtBusAPI)
 	i.apiKey = apiKey
+	i.resolver = resolver
 	return i
 }
 
-// GetVisits will return all routes going through the specified stop name
-func (api *NxtBusAPI) GetVisits(stopName string) ([]nxtbus.MonitoredStopVisit, error) {
-	id, err := nxtbus.StopNameToID(stopName)
+// GetVisits will return all routes going through the specified stop
+func (api *NxtBusAPI) GetVisits(stop maps.TransitStop) ([]nxtbus.MonitoredStopVisit, error) {
+	id, err := api.stopID(stop)
 	if err != nil {
 		return nil, err
 	}
@@ -75,79 +59,22 @@ func (api *NxtBusAPI) GetVisits(stopName string) ([]nxtbus.MonitoredStopVisit, e
 	return resp.StopMonitoringDelivery.MonitoredStopVisits, nil
 }
 
-// FindRoutes will return real-time transit data and fallback to standard
-// Google Maps data when this data is unavailable or irrelevant
-func (finder *NxtBusFinder) FindRoutes(originLat, originLng, destLat,
-	destLng float64, transportType string, arrivalTime time.Time,
-	routeName string) []RouteOption {
-	options := finder.finder.FindRoutes(originLat, originLng, destLat, destLng, transportType, arrivalTime, routeName)
-	if transportType != "transit" {
-		return options
-	}
-	for i, option := range options {
-		now := time.Now()
-		// if its more than 90 minutes then skip
-		if option.DepartureTime.Sub(now) >= NxtBusThreshold {
-			continue
-		}
-		if option.transitDetails == nil {
-			continue
-		}
-		details := option.transitDetails
-		// if the transitDetails indicate not Transport Canberra then skip
-		if details.Line.Agencies[0].Name != TransportCanberraName {
-			continue
-		}
-		finder.updateUsingRealTimeData(&options[i])
+// MismatchReport will return the stops that couldn't be matched exactly by
+// name, this is empty if stops are only looked up by name
+func (api *NxtBusAPI) MismatchReport() []StopMismatch {
+	if api.resolver == nil {
+		return []StopMismatch{}
 	}
-	return options
+	return api.resolver.MismatchReport()
 }
 
-// NOTE: This will modify the option passed in without copying
-func (finder *NxtBusFinder) updateUsingRealTimeData(option *RouteOption) {
-	visits, err := finder.nxtBusAPI.GetVisits(option.transitDetails.DepartureStop.Name)
-	if err != nil {
-		return
-	}
-	// use the transit details departure time, since there may be other legs
-	// on the trip
-	mapsDeparture := option.transitDetails.DepartureTime
-	var closest float64 = -1
-	var bestChoice *nxtbus.MonitoredStopVisit
-	// find MonitoredStopVisit with closest scheduled departure to option's departure time
-	for i, data := range visits {
-		if data.LineName != option.Name {
-			continue
-		}
-		date, err := nxtbus.ParseDate(data.AimedDepartureTime)
-		// some responses seem to be missing data
-		if err != nil {
-			continue
-		}
-		aimedDeparture := date
-		diff := math.Abs(float64(mapsDeparture.Sub(aimedDeparture)))
-		// make sure the times aren't too far apart
-		if time.Duration(diff) > StopTimeThreshold {
-			continue
-		}
-		if bestChoice == nil || diff < closest {
-			closest = diff
-			bestChoice = &visits[i]
-		}
-	}
-	if bestChoice == nil {
-		return
+func (api *NxtBusAPI) stopID(stop maps.TransitStop) (string, error) {
+	if api.resolver == nil {
+		return nxtbus.StopNameToID(stop.Name)
 	}
-	expectedDeparture, err := nxtbus.ParseDate(bestChoice.ExpectedDepartureTime)
-	// ensure we aren't missing data
+	resolved, err := api.resolver.Resolve(stop)
 	if err != nil {
-		return
+		return "", err
 	}
-	// Figure out how much time we've gained or lost compared to the schedule.
-	// We use the Google Maps departure time to compensate if it has
-	// an incorrect transit departure time
-	diff := mapsDeparture.Sub(expectedDeparture)
-	// move the trip start and end accordingly
-	option.DepartureTime = UnixTime{option.DepartureTime.Add(-diff)}
-	option.ArrivalTime = UnixTime{option.ArrivalTime.Add(-diff)}
+	return resolved.ID, nil
 }
@@ -26,6 +26,12 @@ func (finder *MockMapsFinder) FindRoutes(originLat, originLng, destLat,
 	return finder.options
 }
 
+func (finder *MockMapsFinder) FindRoutesWithError(originLat, originLng, destLat,
+	destLng float64, transportType string, arrivalTime time.Time,
+	routeName string) ([]RouteOption, error) {
+	return finder.options, nil
+}
+
 type MockNxtBusFinder struct {
 	visits []nxtbus.MonitoredStopVisit
 }
@@ -36,7 +42,7 @@ func NewMockNxtBusFinder(visits []nxtbus.MonitoredStopVisit) *MockNxtBusFinder {
 	return finder
 }
 
-func (f *MockNxtBusFinder) GetVisits(stopName string) ([]nxtbus.MonitoredStopVisit, error) {
+func (f *MockNxtBusFinder) GetVisits(stop maps.TransitStop) ([]nxtbus.MonitoredStopVisit, error) {
 	if f.visits == nil {
 		return nil, errors.New("No data")
 	}
@@ -114,8 +120,8 @@ func TestFindRoutesRealTimeThreshold(t *testing.T) {
 	visits := generateStopVisitInfo(
 		now, "", departure, realTimeDeparture,
 	)
-	finder := new(NxtBusFinder)
-	finder.nxtBusAPI = NewMockNxtBusFinder(visits)
+	finder := new(RealTimeFinder)
+	finder.RegisterProvider(TransportCanberraName, NewMockNxtBusFinder(visits))
 	// make a copy of the options since real time finder will modify
 	// without copying
 	tmp := make([]RouteOption, len(options))
@@ -145,8 +151,8 @@ func TestFindRoutesUsesRealTimeData(t *testing.T) {
 	visits := generateStopVisitInfo(
 		now, name, departure, realTimeDeparture,
 	)
-	finder := new(NxtBusFinder)
-	finder.nxtBusAPI = NewMockNxtBusFinder(visits)
+	finder := new(RealTimeFinder)
+	finder.RegisterProvider(TransportCanberraName, NewMockNxtBusFinder(visits))
 	// Expected route option after real time update
 	arrival := scheduledArrival.Add(-(departure.Sub(realTimeDeparture)))
 	expected := RouteOption{
@@ -184,9 +190,9 @@ func TestFindRoutesFallsBackWhenMissingStopInfo(t *testing.T) {
 		transitDetails: generateValidTransitDetails(departure),
 	}
 	options := []RouteOption{route}
-	finder := new(NxtBusFinder)
+	finder := new(RealTimeFinder)
 	// the stop info will be nil
-	finder.nxtBusAPI = NewMockNxtBusFinder(nil)
+	finder.RegisterProvider(TransportCanberraName, NewMockNxtBusFinder(nil))
 	// make a copy of the options since real time finder will modify
 	// without copying
 	tmp := make([]RouteOption, len(options))
@@ -220,8 +226,8 @@ func TestFindRoutesFallsBackWhenMissingExpectedDates(t *testing.T) {
 		visits[i].ExpectedDepartureTime = ""
 		visits[i].ExpectedArrivalTime = ""
 	}
-	finder := new(NxtBusFinder)
-	finder.nxtBusAPI = NewMockNxtBusFinder(visits)
+	finder := new(RealTimeFinder)
+	finder.RegisterProvider(TransportCanberraName, NewMockNxtBusFinder(visits))
 	// make a copy of the options since real time finder will modify
 	// without copying
 	tmp := make([]RouteOption, len(options))
@@ -251,8 +257,8 @@ func TestFindRoutesFallsBackWhenDifferentBusCompany(t *testing.T) {
 	visits := generateStopVisitInfo(
 		now, name, departure, realTimeDeparture,
 	)
-	finder := new(NxtBusFinder)
-	finder.nxtBusAPI = NewMockNxtBusFinder(visits)
+	finder := new(RealTimeFinder)
+	finder.RegisterProvider(TransportCanberraName, NewMockNxtBusFinder(visits))
 	// make a copy of the options since real time finder will modify
 	// without copying
 	tmp := make([]RouteOption, len(options))
@@ -281,8 +287,8 @@ func TestFindRoutesFallsBackWhenNotTransit(t *testing.T) {
 	visits := generateStopVisitInfo(
 		now, name, departure, realTimeDeparture,
 	)
-	finder := new(NxtBusFinder)
-	finder.nxtBusAPI = NewMockNxtBusFinder(visits)
+	finder := new(RealTimeFinder)
+	finder.RegisterProvider(TransportCanberraName, NewMockNxtBusFinder(visits))
 	// make a copy of the options since real time finder will modify
 	// without copying
 	tmp := make([]RouteOption, len(options))
@@ -315,8 +321,8 @@ func TestFindRoutesFallsBackWhenOutOfThreshold(t *testing.T) {
 	visits := generateStopVisitInfo(
 		now, name, aimedDeparture, realTimeDeparture,
 	)
-	finder := new(NxtBusFinder)
-	finder.nxtBusAPI = NewMockNxtBusFinder(visits)
+	finder := new(RealTimeFinder)
+	finder.RegisterProvider(TransportCanberraName, NewMockNxtBusFinder(visits))
 	// make a copy of the options since real time finder will modify
 	// without copying
 	tmp := make([]RouteOption, len(options))
@@ -328,3 +334,155 @@ func TestFindRoutesFallsBackWhenOutOfThreshold(t *testing.T) {
 		t.Error("Expected", route, "found", routes[0])
 	}
 }
+
+func TestFindRoutesMarksDisappearedServiceCancelled(t *testing.T) {
+	name := "729"
+	now := time.Now()
+	scheduledArrival := now.Add(11 * time.Minute)
+	departure := now.Add(10 * time.Minute)
+	route := RouteOption{
+		DepartureTime:  UnixTime{departure},
+		ArrivalTime:    UnixTime{scheduledArrival},
+		Name:           name,
+		Description:    "",
+		transitDetails: generateValidTransitDetails(departure),
+	}
+	visits := generateStopVisitInfo(
+		now, name, departure, now.Add(12*time.Minute),
+	)
+	mockAPI := NewMockNxtBusFinder(visits)
+	finder := new(RealTimeFinder)
+	finder.RegisterProvider(TransportCanberraName, mockAPI)
+	finder.finder = NewMockMapsFinder([]RouteOption{route})
+	routes := finder.FindRoutes(1, 1, 1, 1, "transit", now, "")
+	if routes[0].Status != RouteScheduled {
+		t.Error("Expected", RouteScheduled, "found", routes[0].Status)
+	}
+	// the service disappears from the feed
+	mockAPI.visits = []nxtbus.MonitoredStopVisit{}
+	finder.finder = NewMockMapsFinder([]RouteOption{route})
+	routes = finder.FindRoutes(1, 1, 1, 1, "transit", now, "")
+	if routes[0].Status != RouteCancelled {
+		t.Error("Expected", RouteCancelled, "found", routes[0].Status)
+	}
+}
+
+type MockCancellingFinder struct {
+	MockNxtBusFinder
+	cancelled []nxtbus.MonitoredStopVisit
+}
+
+func (f *MockCancellingFinder) GetCancelledVisits(stop maps.TransitStop) ([]nxtbus.MonitoredStopVisit, error) {
+	return f.cancelled, nil
+}
+
+func TestFindRoutesMarksFeedCancellations(t *testing.T) {
+	name := "729"
+	now := time.Now()
+	departure := now.Add(10 * time.Minute)
+	route := RouteOption{
+		DepartureTime:  UnixTime{departure},
+		ArrivalTime:    UnixTime{now.Add(11 * time.Minute)},
+		Name:           name,
+		transitDetails: generateValidTransitDetails(departure),
+	}
+	mockAPI := &MockCancellingFinder{
+		MockNxtBusFinder: MockNxtBusFinder{visits: []nxtbus.MonitoredStopVisit{}},
+		cancelled: []nxtbus.MonitoredStopVisit{
+			nxtbus.MonitoredStopVisit{
+				LineName:           name,
+				AimedDepartureTime: dateToNxtbusString(departure),
+			},
+		},
+	}
+	// a new finder hasn't seen the service before, such as after a restart
+	finder := new(RealTimeFinder)
+	finder.RegisterProvider(TransportCanberraName, mockAPI)
+	finder.finder = NewMockMapsFinder([]RouteOption{route})
+	routes := finder.FindRoutes(1, 1, 1, 1, "transit", now, "")
+	if routes[0].Status != RouteCancelled {
+		t.Error("Expected", RouteCancelled, "found", routes[0].Status)
+	}
+}
+
+func TestFindRoutesMarksStopSkipped(t *testing.T) {
+	name := "729"
+	now := time.Now()
+	scheduledArrival := now.Add(11 * time.Minute)
+	departure := now.Add(10 * time.Minute)
+	route := RouteOption{
+		DepartureTime:  UnixTime{departure},
+		ArrivalTime:    UnixTime{scheduledArrival},
+		Name:           name,
+		Description:    "",
+		transitDetails: generateValidTransitDetails(departure),
+	}
+	visits := generateStopVisitInfo(
+		now, name, departure, now.Add(12*time.Minute),
+	)
+	mockAPI := NewMockNxtBusFinder(visits)
+	finder := new(RealTimeFinder)
+	finder.RegisterProvider(TransportCanberraName, mockAPI)
+	finder.finder = NewMockMapsFinder([]RouteOption{route})
+	finder.FindRoutes(1, 1, 1, 1, "transit", now, "")
+	// the service will now only set down passengers at this stop
+	for i := range visits {
+		visits[i].ExpectedArrivalTime = visits[i].ExpectedDepartureTime
+		visits[i].ExpectedDepartureTime = ""
+	}
+	finder.finder = NewMockMapsFinder([]RouteOption{route})
+	routes := finder.FindRoutes(1, 1, 1, 1, "transit", now, "")
+	if routes[0].Status != RouteStopSkipped {
+		t.Error("Expected", RouteStopSkipped, "found", routes[0].Status)
+	}
+}
+
+func TestFindRoutesWithEmptyAgencies(t *testing.T) {
+	now := time.Now()
+	departure := now.Add(10 * time.Minute)
+	details := generateValidTransitDetails(departure)
+	details.Line.Agencies = []*maps.TransitAgency{}
+	route := RouteOption{
+		DepartureTime:  UnixTime{departure},
+		ArrivalTime:    UnixTime{now.Add(11 * time.Minute)},
+		Name:           "729",
+		transitDetails: details,
+	}
+	finder := NewRealTimeFinder(NewMockMapsFinder([]RouteOption{route}))
+	finder.RegisterProvider(TransportCanberraName, NewMockNxtBusFinder(nil))
+	routes := finder.FindRoutes(1, 1, 1, 1, "transit", now, "")
+	if !reflect.DeepEqual(routes[0], route) {
+		t.Error("Expected", route, "found", routes[0])
+	}
+}
+
+func TestFindRoutesUsesProviderForEachAgency(t *testing.T) {
+	name := "729"
+	now := time.Now()
+	departure := now.Add(10 * time.Minute)
+	realTimeDeparture := now.Add(12 * time.Minute)
+	// the line is run by two operators and only the second has real time data
+	details := generateInvalidTransitDetails(departure)
+	details.Line.Agencies = append(details.Line.Agencies, &maps.TransitAgency{
+		Name: "Second Bus Company",
+	})
+	route := RouteOption{
+		DepartureTime:  UnixTime{departure},
+		ArrivalTime:    UnixTime{now.Add(11 * time.Minute)},
+		Name:           name,
+		transitDetails: details,
+	}
+	finder := NewRealTimeFinder(NewMockMapsFinder([]RouteOption{route}))
+	// Transport Canberra data should not be used for this route
+	finder.RegisterProvider(TransportCanberraName, NewMockNxtBusFinder(
+		generateStopVisitInfo(now, name, departure, now.Add(20*time.Minute)),
+	))
+	finder.RegisterProvider("second bus company", NewMockNxtBusFinder(
+		generateStopVisitInfo(now, name, departure, realTimeDeparture),
+	))
+	routes := finder.FindRoutes(1, 1, 1, 1, "transit", now, "")
+	expected := realTimeDeparture.Truncate(time.Second)
+	if !routes[0].DepartureTime.Equal(expected) {
+		t.Error("Expected", expected, "found", routes[0].DepartureTime)
+	}
+}
@@ -0,0 +1,322 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"googlemaps.github.io/maps"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// OTPProvider is the provider name for routes found by OpenTripPlanner
+const OTPProvider = "otp"
+
+// otpTimeout is how long to wait for OpenTripPlanner to respond
+const otpTimeout = 10 * time.Second
+
+// OTPFinder - an implementation of RouteFinder that searches an
+// OpenTripPlanner instance for options
+type OTPFinder struct {
+	RouteFinder
+	baseURL string
+	router  string
+	// the timezone that the OpenTripPlanner router uses for dates
+	location *time.Location
+	client   *http.Client
+}
+
+// NewOTPFinder - create an OTPFinder
+// @param baseURL - the OpenTripPlanner server such as http://otp:8080
+// @param router - the router ID, this is usually "default"
+// @param location - the timezone of the router, if nil then the timezone of
+// the arrival time will be used
+func NewOTPFinder(baseURL string, router string, location *time.Location) *OTPFinder {
+	if len(router) == 0 {
+		router = "default"
+	}
+	return &OTPFinder{
+		baseURL:  strings.TrimRight(baseURL, "/"),
+		router:   router,
+		location: location,
+		client:   &http.Client{Timeout: otpTimeout},
+	}
+}
+
+type otpPlace struct {
+	Name   string  `json:"name"`
+	Lat    float64 `json:"lat"`
+	Lon    float64 `json:"lon"`
+	StopID string  `json:"stopId"`
+}
+
+type otpLeg struct {
+	Mode           string   `json:"mode"`
+	StartTime      int64    `json:"startTime"`
+	EndTime        int64    `json:"endTime"`
+	Duration       float64  `json:"duration"`
+	TransitLeg     bool     `json:"transitLeg"`
+	Route          string   `json:"route"`
+	RouteShortName string   `json:"routeShortName"`
+	RouteLongName  string   `json:"routeLongName"`
+	AgencyName     string   `json:"agencyName"`
+	AgencyID       string   `json:"agencyId"`
+	AgencyURL      string   `json:"agencyUrl"`
+	Headsign       string   `json:"headsign"`
+	From           otpPlace `json:"from"`
+	To             otpPlace `json:"to"`
+}
+
+type otpItinerary struct {
+	StartTime int64    `json:"startTime"`
+	EndTime   int64    `json:"endTime"`
+	WalkTime  int64    `json:"walkTime"`
+	Transfers int      `json:"transfers"`
+	Legs      []otpLeg `json:"legs"`
+}
+
+type otpResponse struct {
+	Plan *struct {
+		Itineraries []otpItinerary `json:"itineraries"`
+	} `json:"plan"`
+	Error *struct {
+		ID  int    `json:"id"`
+		Msg string `json:"msg"`
+	} `json:"error"`
+}
+
+// FindRoutes will use the OpenTripPlanner plan API to search for routes
+// that arrive by the input arrival time
+// @param originLat - the starting position latitude
+// @param originLng - the starting position longitude
+// @param destLat - the destination latitude
+// @param destLng - the destination longitude
+// @param transportType - transit, driving, walking etc.
+// @param arrivalTime - the time of arrival to the destination
+// @param routeName - optionally specify the route name. This could be the bus
+// number for example
+func (finder *OTPFinder) FindRoutes(originLat, originLng, destLat, destLng float64,
+	transportType string, arrivalTime time.Time,
+	routeName string) []RouteOption {
+	options, err := finder.FindRoutesWithError(originLat, originLng, destLat, destLng,
+		transportType, arrivalTime, routeName)
+	if err != nil {
+		log.Println("OpenTripPlanner error:", err)
+	}
+	return options
+}
+
+// FindRoutesWithError is the same as FindRoutes but returns an error if
+// OpenTripPlanner couldn't be reached or couldn't plan the trip
+func (finder *OTPFinder) FindRoutesWithError(originLat, originLng, destLat, destLng float64,
+	transportType string, arrivalTime time.Time,
+	routeName string) ([]RouteOption, error) {
+	itineraries, err := finder.plan(originLat, originLng, destLat, destLng,
+		transportType, arrivalTime)
+	if err != nil {
+		return []RouteOption{}, err
+	}
+	options := []RouteOption{}
+	for _, itinerary := range itineraries {
+		name := getOTPRouteName(itinerary)
+		if len(routeName) > 0 && name != routeName {
+			continue
+		}
+		option := NewRouteOption(UnixTimestampToTime(itinerary.StartTime),
+			UnixTimestampToTime(itinerary.EndTime), name,
+			getOTPDescription(itinerary))
+		option.transitDetails = getOTPTransitDetails(itinerary)
+		option.Provider = OTPProvider
+		option.Fingerprint = getOTPFingerprint(itinerary)
+		// walk time is in seconds
+		option.WalkingTimeMs = itinerary.WalkTime * 1000
+		options = append(options, option)
+	}
+	return options, nil
+}
+
+func (finder *OTPFinder) plan(originLat, originLng, destLat, destLng float64,
+	transportType string, arrivalTime time.Time) ([]otpItinerary, error) {
+	loc := finder.location
+	if loc == nil {
+		loc = arrivalTime.Location()
+	}
+	local := arrivalTime.In(loc)
+	params := url.Values{}
+	params.Set("fromPlace", fmt.Sprintf("%f,%f", originLat, originLng))
+	params.Set("toPlace", fmt.Sprintf("%f,%f", destLat, destLng))
+	params.Set("date", local.Format("01-02-2006"))
+	params.Set("time", local.Format("3:04pm"))
+	params.Set("arriveBy", "true")
+	params.Set("mode", otpMode(transportType))
+	params.Set("numItineraries", "5")
+	u := fmt.Sprintf("%s/otp/routers/%s/plan?%s", finder.baseURL,
+		url.PathEscape(finder.router), params.Encode())
+	resp, err := finder.client.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Unexpected status %d", resp.StatusCode)
+	}
+	var result otpResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	if result.Error != nil {
+		return nil, errors.New(result.Error.Msg)
+	}
+	if result.Plan == nil {
+		return []otpItinerary{}, nil
+	}
+	return result.Plan.Itineraries, nil
+}
+
+// otpMode converts Google Maps travel modes into OpenTripPlanner modes
+func otpMode(transportType string) string {
+	switch transportType {
+	case "transit":
+		return "TRANSIT,WALK"
+	case "driving":
+		return "CAR"
+	case "walking":
+		return "WALK"
+	case "bicycling":
+		return "BICYCLE"
+	}
+	return strings.ToUpper(transportType)
+}
+
+func getOTPLegName(leg otpLeg) string {
+	if len(leg.RouteShortName) > 0 {
+		return leg.RouteShortName
+	}
+	if len(leg.Route) > 0 {
+		return leg.Route
+	}
+	return leg.RouteLongName
+}
+
+// getOTPRouteName returns the first transit line name in the same way that
+// Google Maps routes are named
+func getOTPRouteName(itinerary otpItinerary) string {
+	for _, leg := range itinerary.Legs {
+		if leg.TransitLeg {
+			return getOTPLegName(leg)
+		}
+	}
+	return "Unknown"
+}
+
+// getOTPDescription will describe the itinerary by the lines it uses. This
+// needs to stay the same between searches so that getRouteFromDescription
+// can match it
+func getOTPDescription(itinerary otpItinerary) string {
+	parts := []string{}
+	for _, leg := range itinerary.Legs {
+		if leg.TransitLeg {
+			parts = append(parts, fmt.Sprintf("%s from %s", getOTPLegName(leg), leg.From.Name))
+		}
+	}
+	if len(parts) == 0 && len(itinerary.Legs) > 0 {
+		mode := strings.ToLower(itinerary.Legs[0].Mode)
+		return fmt.Sprintf("%s to %s", strings.Title(mode), itinerary.Legs[len(itinerary.Legs)-1].To.Name)
+	}
+	return strings.Join(parts, ", then ")
+}
+
+// getOTPTransitDetails converts the first transit leg into the same format
+// as Google Maps so that real-time data can be used for OpenTripPlanner
+// routes
+func getOTPTransitDetails(itinerary otpItinerary) *maps.TransitDetails {
+	for _, leg := range itinerary.Legs {
+		if !leg.TransitLeg {
+			continue
+		}
+		agency := &maps.TransitAgency{Name: leg.AgencyName}
+		if u, err := url.Parse(leg.AgencyURL); err == nil && len(leg.AgencyURL) > 0 {
+			agency.URL = u
+		}
+		return &maps.TransitDetails{
+			DepartureStop: maps.TransitStop{
+				Name:     leg.From.Name,
+				Location: maps.LatLng{Lat: leg.From.Lat, Lng: leg.From.Lon},
+			},
+			ArrivalStop: maps.TransitStop{
+				Name:     leg.To.Name,
+				Location: maps.LatLng{Lat: leg.To.Lat, Lng: leg.To.Lon},
+			},
+			DepartureTime: UnixTimestampToTime(leg.StartTime),
+			ArrivalTime:   UnixTimestampToTime(leg.EndTime),
+			Headsign:      leg.Headsign,
+			Line: maps.TransitLine{
+				Name:      leg.RouteLongName,
+				ShortName: getOTPLegName(leg),
+				Agencies:  []*maps.TransitAgency{agency},
+			},
+		}
+	}
+	return nil
+}
+
+// getOTPFingerprint uses the same mode names as Google Maps so that
+// fingerprints can be compared between providers
+func getOTPFingerprint(itinerary otpItinerary) *RouteFingerprint {
+	fingerprint := &RouteFingerprint{Modes: []string{}, Transit: []FingerprintLeg{}}
+	for _, leg := range itinerary.Legs {
+		if !leg.TransitLeg {
+			fingerprint.addMode(otpModeToTravelMode(leg.Mode))
+			continue
+		}
+		fingerprint.addMode("TRANSIT")
+		fingerprint.Transit = append(fingerprint.Transit, FingerprintLeg{
+			Line:          getOTPLegName(leg),
+			BoardingStop:  leg.From.Name,
+			AlightingStop: leg.To.Name,
+		})
+	}
+	return fingerprint
+}
+
+func otpModeToTravelMode(mode string) string {
+	switch mode {
+	case "WALK":
+		return "WALKING"
+	case "CAR":
+		return "DRIVING"
+	case "BICYCLE":
+		return "BICYCLING"
+	}
+	return mode
+}
+
+func init() {
+	RegisterFinderType("otp", newOTPFinderFromConfig)
+}
+
+func newOTPFinderFromConfig(config ProviderConfig, next RouteFinder) (RouteFinder, error) {
+	var options struct {
+		URL      string `json:"url"`
+		Router   string `json:"router"`
+		Timezone string `json:"timezone"`
+	}
+	if err := config.Decode(&options); err != nil {
+		return nil, err
+	}
+	if len(options.URL) == 0 {
+		return nil, errors.New("No url set")
+	}
+	var loc *time.Location
+	if len(options.Timezone) > 0 {
+		var err error
+		loc, err = time.LoadLocation(options.Timezone)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return NewOTPFinder(options.URL, options.Router, loc), nil
+}
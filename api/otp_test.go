@@ -0,0 +1,156 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+const testOTPResponse = `{
+	"plan": {
+		"itineraries": [
+			{
+				"startTime": 1500101224000,
+				"endTime": 1500102524000,
+				"walkTime": 300,
+				"transfers": 0,
+				"legs": [
+					{
+						"mode": "WALK", "transitLeg": false,
+						"startTime": 1500101224000, "endTime": 1500101524000,
+						"from": {"name": "Origin", "lat": -35.2, "lon": 149.1},
+						"to": {"name": "City Interchange Plt 3", "lat": -35.278, "lon": 149.131}
+					},
+					{
+						"mode": "BUS", "transitLeg": true,
+						"startTime": 1500101524000, "endTime": 1500102524000,
+						"route": "300", "routeShortName": "300", "routeLongName": "Blue Rapid",
+						"agencyName": "Transport Canberra", "agencyUrl": "https://www.transport.act.gov.au",
+						"headsign": "Belconnen",
+						"from": {"name": "City Interchange Plt 3", "lat": -35.278, "lon": 149.131},
+						"to": {"name": "Belconnen Community Bus Station", "lat": -35.239, "lon": 149.065}
+					}
+				]
+			},
+			{
+				"startTime": 1500100224000,
+				"endTime": 1500102224000,
+				"legs": [
+					{
+						"mode": "WALK", "transitLeg": false,
+						"from": {"name": "Origin"},
+						"to": {"name": "Destination"}
+					}
+				]
+			}
+		]
+	}
+}`
+
+func newMockOTPServer(t *testing.T, response string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/otp/routers/default/plan" {
+			t.Error("Unexpected path", r.URL.Path)
+		}
+		params := r.URL.Query()
+		if params.Get("arriveBy") != "true" {
+			t.Error("Expected arriveBy to be set, found", params.Get("arriveBy"))
+		}
+		if params.Get("mode") != "TRANSIT,WALK" {
+			t.Error("Expected", "TRANSIT,WALK", "found", params.Get("mode"))
+		}
+		if params.Get("date") != "07-15-2017" || params.Get("time") != "5:35pm" {
+			t.Error("Unexpected date", params.Get("date"), params.Get("time"))
+		}
+		fmt.Fprint(w, response)
+	}))
+}
+
+func TestOTPFinderFindRoutes(t *testing.T) {
+	server := newMockOTPServer(t, testOTPResponse)
+	defer server.Close()
+	loc, _ := time.LoadLocation("Australia/Sydney")
+	finder := NewOTPFinder(server.URL, "", loc)
+	arrival := time.Date(2017, 7, 15, 17, 35, 0, 0, loc)
+	routes := finder.FindRoutes(-35.2, 149.1, -35.239, 149.065, "transit", arrival, "")
+	if len(routes) != 2 {
+		t.Fatal("Expected", 2, "routes, found", len(routes))
+	}
+	route := routes[0]
+	if route.Name != "300" {
+		t.Error("Expected", "300", "found", route.Name)
+	}
+	if route.Description != "300 from City Interchange Plt 3" {
+		t.Error("Unexpected description", route.Description)
+	}
+	if TimeToUnixTimestamp(route.DepartureTime) != 1500101224000 {
+		t.Error("Unexpected departure time", route.DepartureTime)
+	}
+	if route.Provider != OTPProvider {
+		t.Error("Expected", OTPProvider, "found", route.Provider)
+	}
+	details := route.transitDetails
+	if details == nil || details.DepartureStop.Name != "City Interchange Plt 3" {
+		t.Fatal("Expected transit details, found", details)
+	}
+	if details.Line.Agencies[0].Name != TransportCanberraName {
+		t.Error("Expected", TransportCanberraName, "found", details.Line.Agencies[0].Name)
+	}
+	fingerprint := route.Fingerprint
+	if fingerprint == nil || len(fingerprint.Modes) != 2 || fingerprint.Modes[0] != "WALKING" {
+		t.Fatal("Unexpected fingerprint", fingerprint)
+	}
+	if fingerprint.Transit[0].Line != "300" || fingerprint.Transit[0].AlightingStop != "Belconnen Community Bus Station" {
+		t.Error("Unexpected transit legs", fingerprint.Transit)
+	}
+	walk := routes[1]
+	if walk.Name != "Unknown" || walk.Description != "Walk to Destination" {
+		t.Error("Unexpected walking route", walk)
+	}
+}
+
+func TestOTPFinderFiltersByRouteName(t *testing.T) {
+	server := newMockOTPServer(t, testOTPResponse)
+	defer server.Close()
+	loc, _ := time.LoadLocation("Australia/Sydney")
+	finder := NewOTPFinder(server.URL, "default", loc)
+	arrival := time.Date(2017, 7, 15, 17, 35, 0, 0, loc)
+	routes := finder.FindRoutes(-35.2, 149.1, -35.239, 149.065, "transit", arrival, "300")
+	if len(routes) != 1 || routes[0].Name != "300" {
+		t.Error("Expected only route 300, found", routes)
+	}
+}
+
+func TestOTPFinderMatchesByDescription(t *testing.T) {
+	server := newMockOTPServer(t, testOTPResponse)
+	defer server.Close()
+	loc, _ := time.LoadLocation("Australia/Sydney")
+	finder := NewOTPFinder(server.URL, "default", loc)
+	arrival := time.Date(2017, 7, 15, 17, 35, 0, 0, loc)
+	routes := finder.FindRoutes(-35.2, 149.1, -35.239, 149.065, "transit", arrival, "")
+	trip := &TripSchedule{
+		Route:      &routes[0],
+		RepeatDays: []bool{false, false, false, false, false, false, false},
+	}
+	result, err := getRouteFromDescription(trip, routes)
+	if err != nil {
+		t.Error("Unexpected error", err)
+	}
+	if result != routes[0] {
+		t.Error("Expected", routes[0], "found", result)
+	}
+}
+
+func TestOTPFinderReturnsNothingOnError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"error": {"id": 404, "msg": "No trip found"}}`)
+	}))
+	defer server.Close()
+	finder := NewOTPFinder(server.URL, "default", nil)
+	routes := finder.FindRoutes(1, 1, 1, 1, "transit", time.Now(), "")
+	if len(routes) != 0 {
+		t.Error("Expected no routes, found", routes)
+	}
+}
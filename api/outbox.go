@@ -0,0 +1,164 @@
+package api
+
+import (
+	"fmt"
+	"time"
+)
+
+// NotificationKind is the reason a notification was sent
+type NotificationKind string
+
+const (
+	// LeaveNotification tells the user it's time to leave
+	LeaveNotification NotificationKind = "leave"
+	// CancellationNotification tells the user that their service is no
+	// longer running
+	CancellationNotification NotificationKind = "cancellation"
+	// DelayNotification tells the user that their departure or arrival
+	// time has changed
+	DelayNotification NotificationKind = "delay"
+)
+
+// Notification is a message stored in the outbox until it is delivered
+type Notification struct {
+	ID     string
+	TripID string
+	User   *UserInfo
+	Kind   NotificationKind
+	// the local date of the trip occurrence this notification is for
+	Occurrence string
+	// a snapshot of the message at the time it was queued
+	Message string
+	// the route the notification is for, this can be nil
+	Route *RouteOption
+	// when the notification should be sent, used to check how late
+	// delivery was
+	Scheduled time.Time
+	// used to ensure that each notification is only queued once
+	DedupeKey string
+	// the number of times delivery has been attempted
+	Attempts int
+	// the tokens of devices that have already received the notification,
+	// retries are only sent to the other devices
+	SentTokens []string
+	// delivery is given up after this time, which is normally when the
+	// service departs. If this is zero then it doesn't expire
+	Expires time.Time
+	// urgent notifications, which tell the user to leave now, are still
+	// sent during quiet hours. This isn't stored in the outbox since
+	// it's only checked when the notification is queued
+	Urgent bool
+}
+
+// OutboxInterface stores notifications until they are delivered. Queueing a
+// notification happens in the same transaction as updating the trip so that
+// a crash can't cause an alert to be lost or queued twice. A crash between
+// sending to a device and calling `MarkDeviceSent` will cause it to be sent
+// to that device again, which providers collapse using the dedupe key
+type OutboxInterface interface {
+	// CompleteOccurrence will queue the notification and record that this
+	// occurrence of the trip is finished in the trip's history. Repeating
+	// trips will have their last notification time set to when the record
+	// was made and other trips are deleted. The notification can be nil if
+	// no alert should be sent. If the occurrence was already completed, such
+	// as by another watcher after a lease handover, then nothing is changed
+	// @returns false if the notification had already been queued or the
+	// occurrence was already completed
+	CompleteOccurrence(trip *TripSchedule, record TripOccurrence, notification *Notification) (bool, error)
+	// QueueNotification will store the notification unless it has already
+	// been queued
+	QueueNotification(notification *Notification) (bool, error)
+	// ClaimNotifications will return notifications that are ready to be
+	// delivered. They won't be returned again until the lease has expired
+	// so that multiple dispatchers can run at once
+	ClaimNotifications(limit int, lease time.Duration) ([]*Notification, error)
+	// RenewNotificationLease will extend the lease on a claimed notification
+	// @param attempt - the notification's attempt number when it was claimed
+	// @returns false if the notification has been claimed again since or
+	// is no longer waiting to be sent
+	RenewNotificationLease(id string, attempt int, lease time.Duration) (bool, error)
+	// MarkDeviceSent records that the notification was delivered to the
+	// device with this token, so that it isn't sent there again when the
+	// notification is retried
+	MarkDeviceSent(id string, token string) error
+	// MarkNotificationSent records that the notification was delivered to
+	// every device
+	MarkNotificationSent(id string) error
+	// MarkNotificationFailed records the delivery error. If retry is false
+	// then delivery won't be attempted again and the notification is copied
+	// to the dead letter table along with the error
+	MarkNotificationFailed(id string, reason string, retry bool, retryAt time.Time) error
+}
+
+// NewNotification will create a notification for this occurrence of the
+// trip
+// @param detail - optionally used to send more than one notification of the
+// same kind for an occurrence, such as one for each cancelled service
+func NewNotification(trip *TripSchedule, kind NotificationKind, message string, detail string) *Notification {
+	occurrence := GetOccurrence(trip)
+	key := fmt.Sprintf("%s/%s/%s", trip.ID, occurrence, kind)
+	if len(detail) > 0 {
+		key = fmt.Sprintf("%s/%s", key, detail)
+	}
+	return &Notification{
+		TripID:     trip.ID,
+		User:       trip.User,
+		Kind:       kind,
+		Occurrence: occurrence,
+		Message:    message,
+		DedupeKey:  key,
+		Scheduled:  time.Now(),
+		Expires:    GetDepartureTime(trip),
+	}
+}
+
+// NotificationData returns the structured data sent with the notification so
+// that the app can open the trip. Values are strings since that's all FCM
+// allows
+func NotificationData(n *Notification) map[string]string {
+	data := map[string]string{
+		"trip_id":    n.TripID,
+		"kind":       string(n.Kind),
+		"occurrence": n.Occurrence,
+		// the same for every attempt so that providers and apps can drop
+		// duplicates
+		"dedupe_key": n.DedupeKey,
+	}
+	if n.Route == nil {
+		return data
+	}
+	data["route_name"] = n.Route.Name
+	data["route_description"] = n.Route.Description
+	data["departure_time"] = fmt.Sprintf("%d", TimeToUnixTimestamp(n.Route.DepartureTime))
+	data["arrival_time"] = fmt.Sprintf("%d", TimeToUnixTimestamp(n.Route.ArrivalTime))
+	if n.Route.Fingerprint != nil && len(n.Route.Fingerprint.Transit) > 0 {
+		data["line"] = n.Route.Fingerprint.Transit[0].Line
+		data["boarding_stop"] = n.Route.Fingerprint.Transit[0].BoardingStop
+	}
+	return data
+}
+
+// GetOccurrence returns the local date of the trip's next departure. This
+// identifies each occurrence of a repeating trip
+func GetOccurrence(trip *TripSchedule) string {
+	departure := GetDepartureTime(trip)
+	if trip.InputArrivalTime != nil {
+		loc, err := time.LoadLocation(trip.InputArrivalTime.TimezoneLocation)
+		if err == nil {
+			departure = departure.In(loc)
+		}
+	}
+	return departure.Format("2006-01-02")
+}
+
+// CompleteOccurrence will queue the notification and update the trip so that
+// this occurrence isn't watched again
+func CompleteOccurrence(db OutboxInterface, trip *TripSchedule, record TripOccurrence, notification *Notification) (bool, error) {
+	return db.CompleteOccurrence(trip, record, notification)
+}
+
+// QueueNotification will store the notification in the outbox to be
+// delivered
+func QueueNotification(db OutboxInterface, notification *Notification) (bool, error) {
+	return db.QueueNotification(notification)
+}
@@ -0,0 +1,34 @@
+package api
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNewNotification(t *testing.T) {
+	loc, _ := time.LoadLocation("Australia/Sydney")
+	departure := time.Date(2017, 7, 15, 8, 30, 0, 0, loc)
+	trip := &TripSchedule{
+		ID:   "12",
+		User: &UserInfo{ID: "user"},
+		Route: &RouteOption{
+			DepartureTime: UnixTime{departure},
+		},
+		InputArrivalTime: &Date{TimezoneLocation: "Australia/Sydney"},
+		RepeatDays:       []bool{false, false, false, false, false, false, false},
+	}
+	n := NewNotification(trip, LeaveNotification, "Time to leave", "")
+	if n.Occurrence != "2017-07-15" {
+		t.Error("Expected", "2017-07-15", "found", n.Occurrence)
+	}
+	if n.DedupeKey != "12/2017-07-15/leave" {
+		t.Error("Expected", "12/2017-07-15/leave", "found", n.DedupeKey)
+	}
+	if n.User.ID != "user" || n.Message != "Time to leave" {
+		t.Error("Unexpected notification", n)
+	}
+	n = NewNotification(trip, CancellationNotification, "Cancelled", "1500071400")
+	if n.DedupeKey != "12/2017-07-15/cancellation/1500071400" {
+		t.Error("Expected", "12/2017-07-15/cancellation/1500071400", "found", n.DedupeKey)
+	}
+}
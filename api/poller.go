@@ -0,0 +1,146 @@
+package api
+
+import (
+	"github.com/oliveroneill/nxtbus-go"
+	"googlemaps.github.io/maps"
+	"sync"
+	"time"
+)
+
+// StopPollInterval is how long a stop's real-time data will be shared
+// between trips before it's requested again
+const StopPollInterval = 30 * time.Second
+
+// NxtBusRequestsPerSecond is the most stop monitoring requests that will
+// be made to NXTBUS each second
+const NxtBusRequestsPerSecond = 2
+
+// stopPollExpiry is how long a stop is remembered after it was last fetched
+const stopPollExpiry = 10 * time.Minute
+
+// StopPoller is an implementation of RealTimeAPI that shares requests for
+// the same stop. Each stop is fetched at most once per interval and the
+// result is given to every trip that asks for it during that time. Requests
+// to the underlying API are rate limited, if a request can't be made in time
+// then the last known data for the stop is used instead
+type StopPoller struct {
+	RealTimeAPI
+	api      RealTimeAPI
+	interval time.Duration
+	// the minimum time between requests to api
+	requestGap time.Duration
+	// the earliest time that the next request can be made
+	nextRequest time.Time
+	stops       map[string]*polledStop
+	mux         sync.Mutex
+}
+
+type polledStop struct {
+	visits  []nxtbus.MonitoredStopVisit
+	err     error
+	fetched time.Time
+	// this is closed when the in-flight request finishes, it will be nil
+	// when there's no request in-flight
+	pending chan struct{}
+}
+
+// NewStopPoller will create a StopPoller
+// @param api - the real-time API to poll
+// @param interval - how long results for a stop are shared for
+// @param requestsPerSecond - the rate limit for the real-time API
+func NewStopPoller(api RealTimeAPI, interval time.Duration, requestsPerSecond int) *StopPoller {
+	return &StopPoller{
+		api:        api,
+		interval:   interval,
+		requestGap: time.Second / time.Duration(requestsPerSecond),
+		stops:      make(map[string]*polledStop),
+	}
+}
+
+// MismatchReport will return the mismatch report of the polled API
+func (p *StopPoller) MismatchReport() []StopMismatch {
+	return FinderMismatchReport(p.api)
+}
+
+// GetVisits will return all routes going through the specified stop. If
+// the stop was fetched within the interval or is currently being fetched
+// then that result will be used
+func (p *StopPoller) GetVisits(stop maps.TransitStop) ([]nxtbus.MonitoredStopVisit, error) {
+	key := stopCacheKey(stop)
+	p.mux.Lock()
+	now := time.Now()
+	p.prune(now)
+	polled, ok := p.stops[key]
+	if !ok {
+		polled = &polledStop{}
+		p.stops[key] = polled
+	}
+	// another trip is already fetching this stop so we'll share its result
+	if polled.pending != nil {
+		pending := polled.pending
+		p.mux.Unlock()
+		<-pending
+		return p.result(key)
+	}
+	hasData := !polled.fetched.IsZero()
+	if hasData && now.Sub(polled.fetched) < p.interval {
+		p.mux.Unlock()
+		return p.result(key)
+	}
+	// if we'd need to wait longer than an interval to make the request then
+	// use what we have rather than holding up the trip
+	wait := p.nextRequest.Sub(now)
+	if hasData && wait > p.interval {
+		p.mux.Unlock()
+		return p.result(key)
+	}
+	if wait < 0 {
+		wait = 0
+	}
+	p.nextRequest = now.Add(wait + p.requestGap)
+	pending := make(chan struct{})
+	polled.pending = pending
+	p.mux.Unlock()
+
+	time.Sleep(wait)
+	visits, err := p.api.GetVisits(stop)
+
+	p.mux.Lock()
+	// keep the last known visits if this request failed
+	if err == nil || !hasData {
+		polled.visits = visits
+		polled.err = err
+	}
+	polled.fetched = time.Now()
+	polled.pending = nil
+	p.mux.Unlock()
+	close(pending)
+	return p.result(key)
+}
+
+// result returns a copy of the stored visits for the stop so that callers
+// can't modify each others data
+func (p *StopPoller) result(key string) ([]nxtbus.MonitoredStopVisit, error) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	polled, ok := p.stops[key]
+	if !ok || polled.visits == nil {
+		if ok && polled.err != nil {
+			return nil, polled.err
+		}
+		return []nxtbus.MonitoredStopVisit{}, nil
+	}
+	visits := make([]nxtbus.MonitoredStopVisit, len(polled.visits))
+	copy(visits, polled.visits)
+	return visits, polled.err
+}
+
+// prune will remove stops that no trips have asked for in a while. This
+// should be called while holding the lock
+func (p *StopPoller) prune(now time.Time) {
+	for key, polled := range p.stops {
+		if polled.pending == nil && !polled.fetched.IsZero() && now.Sub(polled.fetched) > stopPollExpiry {
+			delete(p.stops, key)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package api
+
+import (
+	"errors"
+	"github.com/oliveroneill/nxtbus-go"
+	"googlemaps.github.io/maps"
+	"sync"
+	"testing"
+	"time"
+)
+
+type CountingRealTimeAPI struct {
+	visits   []nxtbus.MonitoredStopVisit
+	err      error
+	delay    time.Duration
+	requests int
+	mux      sync.Mutex
+}
+
+func (c *CountingRealTimeAPI) GetVisits(stop maps.TransitStop) ([]nxtbus.MonitoredStopVisit, error) {
+	c.mux.Lock()
+	c.requests++
+	c.mux.Unlock()
+	time.Sleep(c.delay)
+	return c.visits, c.err
+}
+
+func (c *CountingRealTimeAPI) count() int {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.requests
+}
+
+func TestStopPollerSharesConcurrentRequests(t *testing.T) {
+	mock := &CountingRealTimeAPI{
+		visits: []nxtbus.MonitoredStopVisit{nxtbus.MonitoredStopVisit{LineName: "300"}},
+		delay:  20 * time.Millisecond,
+	}
+	poller := NewStopPoller(mock, time.Minute, 100)
+	stop := maps.TransitStop{Name: "City Interchange"}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			visits, err := poller.GetVisits(stop)
+			if err != nil || len(visits) != 1 {
+				t.Error("Expected one visit, found", visits, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if mock.count() != 1 {
+		t.Error("Expected", 1, "request, found", mock.count())
+	}
+}
+
+func TestStopPollerRequestsAgainAfterInterval(t *testing.T) {
+	mock := &CountingRealTimeAPI{visits: []nxtbus.MonitoredStopVisit{}}
+	poller := NewStopPoller(mock, 10*time.Millisecond, 1000)
+	stop := maps.TransitStop{Name: "City Interchange"}
+	poller.GetVisits(stop)
+	poller.GetVisits(stop)
+	if mock.count() != 1 {
+		t.Error("Expected", 1, "request, found", mock.count())
+	}
+	time.Sleep(20 * time.Millisecond)
+	poller.GetVisits(stop)
+	if mock.count() != 2 {
+		t.Error("Expected", 2, "requests, found", mock.count())
+	}
+}
+
+func TestStopPollerUsesStaleDataWhenRateLimited(t *testing.T) {
+	mock := &CountingRealTimeAPI{
+		visits: []nxtbus.MonitoredStopVisit{nxtbus.MonitoredStopVisit{LineName: "300"}},
+	}
+	// only one request every 10 seconds
+	poller := NewStopPoller(mock, time.Millisecond, 1)
+	poller.requestGap = 10 * time.Second
+	stop := maps.TransitStop{Name: "City Interchange"}
+	poller.GetVisits(stop)
+	time.Sleep(5 * time.Millisecond)
+	start := time.Now()
+	visits, err := poller.GetVisits(stop)
+	if time.Since(start) > time.Second {
+		t.Error("Expected stale data to be returned without waiting")
+	}
+	if err != nil || len(visits) != 1 {
+		t.Error("Expected one visit, found", visits, err)
+	}
+	if mock.count() != 1 {
+		t.Error("Expected", 1, "request, found", mock.count())
+	}
+}
+
+func TestStopPollerKeepsDataWhenRequestFails(t *testing.T) {
+	mock := &CountingRealTimeAPI{
+		visits: []nxtbus.MonitoredStopVisit{nxtbus.MonitoredStopVisit{LineName: "300"}},
+	}
+	poller := NewStopPoller(mock, time.Millisecond, 1000)
+	stop := maps.TransitStop{Name: "City Interchange"}
+	poller.GetVisits(stop)
+	time.Sleep(5 * time.Millisecond)
+	mock.visits = nil
+	mock.err = errors.New("Unavailable")
+	visits, err := poller.GetVisits(stop)
+	if err != nil || len(visits) != 1 {
+		t.Error("Expected one visit, found", visits, err)
+	}
+}
@@ -2,24 +2,38 @@ package api
 
 import (
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"github.com/lib/pq"
 	"log"
+	"time"
 )
 
 // DaysAWeek is the number of days in a week
 const DaysAWeek = 7
 
+// postgresConnection is used to connect to the database
+const postgresConnection = "host=postgres user=docker dbname=docker sslmode=disable"
+
+// tripChangesChannel is the channel that the trips table trigger sends
+// notifications on
+const tripChangesChannel = "trip_changes"
+
+// listenerPingInterval is how often the listener connection is checked
+// when there haven't been any notifications
+const listenerPingInterval = 90 * time.Second
+
 // PostgresInterface - a mongodb implementation of `DatabaseInterface`
 type PostgresInterface struct {
 	DatabaseInterface
-	conn *sql.DB
+	conn     *sql.DB
+	listener *pq.Listener
 }
 
 // NewPostgresInterface - use to create a new mongo connection
 func NewPostgresInterface() *PostgresInterface {
 	db := new(PostgresInterface)
-	conn, err := sql.Open("postgres", "host=postgres user=docker dbname=docker sslmode=disable")
+	conn, err := sql.Open("postgres", postgresConnection)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -34,9 +48,18 @@ func (db *PostgresInterface) ScheduleTrip(trip *TripSchedule) error {
 		INSERT INTO trips
 		(user_id, description, origin, dest, input_arrival_time, input_arrival_local_date,
 		route_arrival_time, route_departure_time, waiting_window, transport_type,
-		route_name, repeat_days, enabled, last_notification_sent, timezone_location)
-		VALUES ($1, $2, point($3, $4), point($5, $6), $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17)`
-	_, err := db.conn.Exec(sqlStatement, trip.User.ID, trip.Route.Description,
+		route_name, repeat_days, enabled, last_notification_sent, timezone_location,
+		fingerprint, arrival_window, ranking, reminders, delay_threshold, skip_dates)
+		VALUES ($1, $2, point($3, $4), point($5, $6), $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22, $23)`
+	fingerprint, err := encodeFingerprint(trip.Route.Fingerprint)
+	if err != nil {
+		return err
+	}
+	reminders, err := encodeReminders(trip.Reminders)
+	if err != nil {
+		return err
+	}
+	_, err = db.conn.Exec(sqlStatement, trip.User.ID, trip.Route.Description,
 		trip.Origin.Lat, trip.Origin.Lng,
 		trip.Destination.Lat, trip.Destination.Lng,
 		trip.InputArrivalTime.Timestamp, trip.InputArrivalTime.String,
@@ -44,75 +67,284 @@ func (db *PostgresInterface) ScheduleTrip(trip *TripSchedule) error {
 		TimeToUnixTimestamp(trip.Route.DepartureTime),
 		trip.WaitingWindowMs, trip.TransportType,
 		trip.Route.Name, pq.Array(trip.RepeatDays),
-		trip.Enabled, trip.LastNotificationSent, trip.InputArrivalTime.TimezoneLocation)
+		trip.Enabled, trip.LastNotificationSent, trip.InputArrivalTime.TimezoneLocation,
+		fingerprint, trip.ArrivalWindowMs, string(trip.Ranking), reminders,
+		trip.DelayThresholdMs, pq.Array(trip.SkipDates))
 	return err
 }
 
+// needsReregisterColumn is true when none of the user's devices have a
+// working token. Users without any devices use the token stored with the
+// user
+const needsReregisterColumn = `COALESCE(
+	(SELECT bool_and(COALESCE(devices.invalid, false)) FROM devices WHERE devices.user_id = users.user_id),
+	users.token_invalid, false)`
+
+// execer is implemented by both `sql.DB` and `sql.Tx`
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
 // UpsertUser will insert this user if they don't exist, otherwise it will
-// update the user with this notification token
+// update the user with this notification token. The token is also
+// registered as one of the user's devices
 func (db *PostgresInterface) UpsertUser(user *UserInfo) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	sqlStatement := `
+		INSERT INTO users (user_id, notification_token, os, channel, locale)
+		VALUES ($1, $2, $3, $4, $5) ON CONFLICT (user_id) DO UPDATE
+		SET notification_token=EXCLUDED.notification_token, channel=EXCLUDED.channel,
+		locale=EXCLUDED.locale,
+		token_invalid = users.token_invalid AND users.notification_token = EXCLUDED.notification_token`
+	_, err = tx.Exec(sqlStatement, user.ID, user.NotificationToken, user.DeviceOS, user.Channel,
+		user.Locale)
+	if err != nil {
+		return err
+	}
+	if len(user.NotificationToken) > 0 {
+		err = registerDevice(tx, &Device{
+			UserID:            user.ID,
+			NotificationToken: user.NotificationToken,
+			DeviceOS:          user.DeviceOS,
+			Channel:           user.Channel,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// RegisterDevice will add the device to the user, creating the user if they
+// don't exist
+func (db *PostgresInterface) RegisterDevice(device *Device) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
 	sqlStatement := `
 		INSERT INTO users (user_id, notification_token, os)
-		VALUES ($1, $2, $3) ON CONFLICT (user_id) DO UPDATE SET notification_token=EXCLUDED.notification_token`
-	_, err := db.conn.Exec(sqlStatement, user.ID, user.NotificationToken, user.DeviceOS)
+		VALUES ($1, $2, $3) ON CONFLICT (user_id) DO NOTHING`
+	_, err = tx.Exec(sqlStatement, device.UserID, device.NotificationToken, device.DeviceOS)
 	if err != nil {
 		return err
 	}
-	return nil
+	if err := registerDevice(tx, device); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
-// GetTrips will return all trips scheduled for this user
-func (db *PostgresInterface) GetTrips(userID string) ([]TripSchedule, error) {
+// registerDevice will store the device. If the token was registered to
+// another user then it's moved to this one. The token stays invalid if it
+// was rejected and is registered again by the same user
+func registerDevice(tx execer, device *Device) error {
+	sqlStatement := `
+		INSERT INTO devices (token, user_id, os, channel)
+		VALUES ($1, $2, $3, $4) ON CONFLICT (token) DO UPDATE
+		SET user_id = EXCLUDED.user_id, os = EXCLUDED.os, channel = EXCLUDED.channel,
+		registered = now(), invalid = devices.invalid AND devices.user_id = EXCLUDED.user_id`
+	_, err := tx.Exec(sqlStatement, device.NotificationToken, device.UserID, device.DeviceOS,
+		device.Channel)
+	return err
+}
+
+// UnregisterDevice will delete the device if it belongs to this user. The
+// token is also cleared from the user, otherwise it would be used as the
+// user's only device once they have none left
+func (db *PostgresInterface) UnregisterDevice(userID string, token string) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	sqlStatement := `DELETE FROM devices WHERE user_id = $1 AND token = $2`
+	if _, err := tx.Exec(sqlStatement, userID, token); err != nil {
+		return err
+	}
+	sqlStatement = `
+		UPDATE users SET notification_token = ''
+		WHERE user_id = $1 AND notification_token = $2`
+	if _, err := tx.Exec(sqlStatement, userID, token); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetDevices returns every device registered to the user
+func (db *PostgresInterface) GetDevices(userID string) ([]Device, error) {
 	sqlStatement := `
-		SELECT
-		trips.id, users.user_id, users.notification_token, users.os, trips.description,
-		trips.origin, trips.dest, trips.input_arrival_time, trips.input_arrival_local_date,
-		trips.route_arrival_time, trips.route_departure_time,
-		trips.waiting_window, trips.transport_type, trips.route_name, trips.repeat_days,
-		trips.enabled, trips.last_notification_sent, trips.timezone_location
-		FROM users, trips
-		WHERE trips.user_id = users.user_id AND trips.user_id=$1`
+		SELECT id, user_id, token, COALESCE(os, ''), COALESCE(channel, ''),
+		COALESCE(invalid, false)
+		FROM devices WHERE user_id = $1 ORDER BY id`
 	rows, err := db.conn.Query(sqlStatement, userID)
 	if err != nil {
 		return nil, err
 	}
-	trips := []TripSchedule{}
+	defer rows.Close()
+	devices := []Device{}
 	for rows.Next() {
-		var t TripSchedule
-		t.Route = &RouteOption{}
-		t.User = &UserInfo{}
-		t.InputArrivalTime = &Date{}
-		var origin string
-		var dest string
-		var departureTime int64
-		var arrivalTime int64
-		err = rows.Scan(&t.ID, &t.User.ID, &t.User.NotificationToken, &t.User.DeviceOS,
-			&t.Route.Description,
-			&origin, &dest,
-			&t.InputArrivalTime.Timestamp, &t.InputArrivalTime.String,
-			&arrivalTime,
-			&departureTime, &t.WaitingWindowMs,
-			&t.TransportType, &t.Route.Name,
-			pq.Array(&t.RepeatDays), &t.Enabled, &t.LastNotificationSent,
-			&t.InputArrivalTime.TimezoneLocation)
+		var d Device
+		err = rows.Scan(&d.ID, &d.UserID, &d.NotificationToken, &d.DeviceOS,
+			&d.Channel, &d.Invalid)
 		if err != nil {
+			fmt.Println(err)
 			continue
 		}
-		_, err = fmt.Sscanf(origin, "(%f,%f)", &t.Origin.Lat, &t.Origin.Lng)
-		if err != nil {
-			continue
+		devices = append(devices, d)
+	}
+	return devices, rows.Err()
+}
+
+// GetUser will return the user with this ID or nil if they don't exist
+func (db *PostgresInterface) GetUser(userID string) (*UserInfo, error) {
+	sqlStatement := `
+		SELECT user_id, notification_token, os, COALESCE(channel, ''),
+		` + needsReregisterColumn + `, COALESCE(locale, ''),
+		COALESCE(to_char(paused_until, 'YYYY-MM-DD'), '')
+		FROM users WHERE user_id = $1`
+	user := &UserInfo{}
+	err := db.conn.QueryRow(sqlStatement, userID).Scan(&user.ID,
+		&user.NotificationToken, &user.DeviceOS, &user.Channel,
+		&user.NeedsReregister, &user.Locale, &user.PausedUntil)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// InvalidateToken will mark the device's token as invalid if it still
+// belongs to the user. The token stored with the user is also marked if it
+// hasn't been changed since the notification was sent
+func (db *PostgresInterface) InvalidateToken(userID string, token string, reason string) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	sqlStatement := `
+		UPDATE devices SET invalid = true, token_error = $3
+		WHERE user_id = $1 AND token = $2`
+	if _, err := tx.Exec(sqlStatement, userID, token, reason); err != nil {
+		return err
+	}
+	sqlStatement = `
+		UPDATE users SET token_invalid = true, token_error = $3
+		WHERE user_id = $1 AND notification_token = $2`
+	if _, err := tx.Exec(sqlStatement, userID, token, reason); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// tripQuery selects every column needed by `scanTrip`
+const tripQuery = `
+	SELECT
+	trips.id, users.user_id, users.notification_token, users.os, COALESCE(users.channel, ''),
+	` + needsReregisterColumn + `, COALESCE(users.locale, ''), trips.description,
+	trips.origin, trips.dest, trips.input_arrival_time, trips.input_arrival_local_date,
+	trips.route_arrival_time, trips.route_departure_time,
+	trips.waiting_window, trips.transport_type, trips.route_name, trips.repeat_days,
+	trips.enabled, trips.last_notification_sent, trips.timezone_location,
+	trips.fingerprint, COALESCE(trips.arrival_window, 0), COALESCE(trips.ranking, ''),
+	trips.reminders, COALESCE(trips.delay_threshold, 0), COALESCE(trips.skip_dates, '{}'),
+	COALESCE(to_char(users.paused_until, 'YYYY-MM-DD'), ''),
+	ARRAY(SELECT to_char(holidays.date, 'YYYY-MM-DD') FROM holidays WHERE holidays.user_id = users.user_id)
+	FROM users, trips
+	WHERE trips.user_id = users.user_id`
+
+// rowScanner is implemented by both `sql.Row` and `sql.Rows`
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanTrip will read a trip from a row selected using `tripQuery`
+func scanTrip(row rowScanner) (*TripSchedule, error) {
+	var t TripSchedule
+	t.Route = &RouteOption{}
+	t.User = &UserInfo{}
+	t.InputArrivalTime = &Date{}
+	var origin string
+	var dest string
+	var departureTime int64
+	var arrivalTime int64
+	var fingerprint []byte
+	var reminders []byte
+	err := row.Scan(&t.ID, &t.User.ID, &t.User.NotificationToken, &t.User.DeviceOS, &t.User.Channel,
+		&t.User.NeedsReregister, &t.User.Locale,
+		&t.Route.Description,
+		&origin, &dest,
+		&t.InputArrivalTime.Timestamp, &t.InputArrivalTime.String,
+		&arrivalTime,
+		&departureTime, &t.WaitingWindowMs,
+		&t.TransportType, &t.Route.Name,
+		pq.Array(&t.RepeatDays), &t.Enabled, &t.LastNotificationSent,
+		&t.InputArrivalTime.TimezoneLocation, &fingerprint,
+		&t.ArrivalWindowMs, &t.Ranking, &reminders,
+		&t.DelayThresholdMs, pq.Array(&t.SkipDates), &t.User.PausedUntil,
+		pq.Array(&t.User.Holidays))
+	if err != nil {
+		return nil, err
+	}
+	_, err = fmt.Sscanf(origin, "(%f,%f)", &t.Origin.Lat, &t.Origin.Lng)
+	if err != nil {
+		return nil, err
+	}
+	_, err = fmt.Sscanf(dest, "(%f,%f)", &t.Destination.Lat, &t.Destination.Lng)
+	if err != nil {
+		return nil, err
+	}
+	t.Route.DepartureTime = UnixTime{UnixTimestampToTime(departureTime)}
+	t.Route.ArrivalTime = UnixTime{UnixTimestampToTime(arrivalTime)}
+	t.Route.Fingerprint, err = decodeFingerprint(fingerprint)
+	if err != nil {
+		return nil, err
+	}
+	if len(reminders) > 0 {
+		if err := json.Unmarshal(reminders, &t.Reminders); err != nil {
+			return nil, err
 		}
-		_, err = fmt.Sscanf(dest, "(%f,%f)", &t.Destination.Lat, &t.Destination.Lng)
+	}
+	return &t, nil
+}
+
+// GetTrips will return all trips scheduled for this user
+func (db *PostgresInterface) GetTrips(userID string) ([]TripSchedule, error) {
+	rows, err := db.conn.Query(tripQuery+" AND trips.user_id=$1", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	trips := []TripSchedule{}
+	for rows.Next() {
+		t, err := scanTrip(rows)
 		if err != nil {
 			continue
 		}
-		t.Route.DepartureTime = UnixTime{UnixTimestampToTime(departureTime)}
-		t.Route.ArrivalTime = UnixTime{UnixTimestampToTime(arrivalTime)}
-		trips = append(trips, t)
+		trips = append(trips, *t)
 	}
 	return trips, nil
 }
 
+// GetTrip will return the trip with this ID
+// @returns nil if the trip doesn't exist
+func (db *PostgresInterface) GetTrip(tripID string) (*TripSchedule, error) {
+	row := db.conn.QueryRow(tripQuery+" AND trips.id=$1", tripID)
+	t, err := scanTrip(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return t, err
+}
+
 // SetLastNotificationTime will store the time of the last notification
 func (db *PostgresInterface) SetLastNotificationTime(trip *TripSchedule, timestamp int64) error {
 	sqlStatement := `UPDATE trips SET last_notification_sent = $1 WHERE id = $2`
@@ -155,60 +387,673 @@ func (db *PostgresInterface) DeleteTrip(tripID string, userID string) error {
 
 // Close will close the current postgres connection
 func (db *PostgresInterface) Close() {
+	if db.listener != nil {
+		db.listener.Close()
+	}
 	db.conn.Close()
 }
 
+// WatchTripChanges will listen for notifications sent by the trips table
+// trigger
+func (db *PostgresInterface) WatchTripChanges() (<-chan TripChange, error) {
+	listener := pq.NewListener(postgresConnection, 10*time.Second, time.Minute,
+		func(event pq.ListenerEventType, err error) {
+			if err != nil {
+				fmt.Println(err)
+			}
+		})
+	if err := listener.Listen(tripChangesChannel); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	db.listener = listener
+	changes := make(chan TripChange, 100)
+	go func() {
+		defer close(changes)
+		for {
+			select {
+			case n, ok := <-listener.Notify:
+				if !ok {
+					return
+				}
+				// nil is sent once the connection is re-established, any
+				// changes made while it was down will have been missed
+				if n == nil {
+					changes <- TripChange{}
+					continue
+				}
+				var payload struct {
+					TripID    string `json:"trip_id"`
+					Operation string `json:"operation"`
+				}
+				if err := json.Unmarshal([]byte(n.Extra), &payload); err != nil {
+					fmt.Println(err)
+					continue
+				}
+				changes <- TripChange{
+					TripID:  payload.TripID,
+					Deleted: payload.Operation == "DELETE",
+				}
+			case <-time.After(listenerPingInterval):
+				go listener.Ping()
+			}
+		}
+	}()
+	return changes, nil
+}
+
 // GetAllScheduledTrips will list of trips stored in the trips table
 func (db *PostgresInterface) GetAllScheduledTrips() ([]*TripSchedule, error) {
-	sqlStatement := `
-		SELECT
-		trips.id, users.user_id, users.notification_token, users.os, trips.description,
-		trips.origin, trips.dest, trips.input_arrival_time, trips.input_arrival_local_date,
-		trips.route_arrival_time, trips.route_departure_time,
-		trips.waiting_window, trips.transport_type, trips.route_name, trips.repeat_days,
-		trips.enabled, trips.last_notification_sent, trips.timezone_location
-		FROM users, trips
-		WHERE trips.user_id = users.user_id`
-	rows, err := db.conn.Query(sqlStatement)
+	rows, err := db.conn.Query(tripQuery)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 	trips := []*TripSchedule{}
 	for rows.Next() {
-		var t TripSchedule
-		t.Route = &RouteOption{}
-		t.User = &UserInfo{}
-		t.InputArrivalTime = &Date{}
-		var origin string
-		var dest string
-		var departureTime int64
-		var arrivalTime int64
-		err = rows.Scan(&t.ID, &t.User.ID, &t.User.NotificationToken, &t.User.DeviceOS,
-			&t.Route.Description,
-			&origin, &dest,
-			&t.InputArrivalTime.Timestamp, &t.InputArrivalTime.String,
-			&arrivalTime,
-			&departureTime, &t.WaitingWindowMs,
-			&t.TransportType, &t.Route.Name,
-			pq.Array(&t.RepeatDays), &t.Enabled, &t.LastNotificationSent,
-			&t.InputArrivalTime.TimezoneLocation)
+		t, err := scanTrip(rows)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		trips = append(trips, t)
+	}
+	return trips, nil
+}
+
+// encodeFingerprint will convert the fingerprint to JSON, trips without a
+// fingerprint are stored as NULL
+func encodeFingerprint(fingerprint *RouteFingerprint) (interface{}, error) {
+	if fingerprint == nil {
+		return nil, nil
+	}
+	b, err := json.Marshal(fingerprint)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+// encodeReminders will convert the reminders to JSON, trips without
+// reminders are stored as NULL
+func encodeReminders(reminders []Reminder) (interface{}, error) {
+	if len(reminders) == 0 {
+		return nil, nil
+	}
+	b, err := json.Marshal(reminders)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+// encodeRoute will convert the route to JSON, a nil route is stored as NULL
+func encodeRoute(route *RouteOption) (interface{}, error) {
+	if route == nil {
+		return nil, nil
+	}
+	b, err := json.Marshal(route)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+// decodeRoute will return nil if no route was stored
+func decodeRoute(b []byte) (*RouteOption, error) {
+	if len(b) == 0 {
+		return nil, nil
+	}
+	var route RouteOption
+	if err := json.Unmarshal(b, &route); err != nil {
+		return nil, err
+	}
+	return &route, nil
+}
+
+// decodeFingerprint will return nil for trips that were scheduled before
+// fingerprints were stored
+func decodeFingerprint(b []byte) (*RouteFingerprint, error) {
+	if len(b) == 0 {
+		return nil, nil
+	}
+	fingerprint := new(RouteFingerprint)
+	if err := json.Unmarshal(b, fingerprint); err != nil {
+		return nil, err
+	}
+	return fingerprint, nil
+}
+
+// Heartbeat records that this tripwatcher is still running
+func (db *PostgresInterface) Heartbeat(instanceID string) error {
+	sqlStatement := `
+		INSERT INTO watcher_instances (instance_id, heartbeat) VALUES ($1, now())
+		ON CONFLICT (instance_id) DO UPDATE SET heartbeat = EXCLUDED.heartbeat`
+	_, err := db.conn.Exec(sqlStatement, instanceID)
+	return err
+}
+
+// LiveInstances returns the number of tripwatchers that have sent a
+// heartbeat within the expiry
+func (db *PostgresInterface) LiveInstances(expiry time.Duration) (int, error) {
+	sqlStatement := `
+		SELECT count(*) FROM watcher_instances
+		WHERE heartbeat > now() - $1 * interval '1 second'`
+	var count int
+	err := db.conn.QueryRow(sqlStatement, expiry.Seconds()).Scan(&count)
+	return count, err
+}
+
+// ClaimTrips will renew this tripwatcher's leases and claim unowned or
+// expired trips so that it owns up to limit trips
+func (db *PostgresInterface) ClaimTrips(instanceID string, limit int, ttl time.Duration) ([]string, error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	renewStatement := `
+		UPDATE trip_leases SET expires = now() + $2 * interval '1 second'
+		WHERE instance_id = $1 RETURNING trip_id`
+	owned, err := queryTripIDs(tx, renewStatement, instanceID, ttl.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	// leases over the limit are released separately using ReleaseTrips so
+	// that the caller can choose which trips to give back
+	if len(owned) < limit {
+		// the conflict check ensures that two tripwatchers can't both
+		// claim the same trip
+		claimStatement := `
+			INSERT INTO trip_leases (trip_id, instance_id, expires)
+			SELECT trips.id, $1, now() + $2 * interval '1 second'
+			FROM trips LEFT JOIN trip_leases l ON l.trip_id = trips.id
+			WHERE l.trip_id IS NULL OR l.expires < now()
+			ORDER BY random() LIMIT $3
+			ON CONFLICT (trip_id) DO UPDATE
+			SET instance_id = EXCLUDED.instance_id, expires = EXCLUDED.expires
+			WHERE trip_leases.expires < now()
+			RETURNING trip_id`
+		claimed, err := queryTripIDs(tx, claimStatement, instanceID, ttl.Seconds(), limit-len(owned))
+		if err != nil {
+			return nil, err
+		}
+		owned = append(owned, claimed...)
+	}
+	return owned, tx.Commit()
+}
+
+// ReleaseTrips will delete this tripwatcher's leases on the trips
+func (db *PostgresInterface) ReleaseTrips(instanceID string, tripIDs []string) error {
+	sqlStatement := `DELETE FROM trip_leases WHERE instance_id = $1 AND trip_id = ANY($2::int[])`
+	_, err := db.conn.Exec(sqlStatement, instanceID, pq.Array(tripIDs))
+	return err
+}
+
+// ClaimTrip will claim the trip if it's unowned or its lease has expired. If
+// this tripwatcher already owns the trip then its lease is renewed
+func (db *PostgresInterface) ClaimTrip(instanceID string, tripID string, ttl time.Duration) (bool, error) {
+	sqlStatement := `
+		INSERT INTO trip_leases (trip_id, instance_id, expires)
+		VALUES ($1, $2, now() + $3 * interval '1 second')
+		ON CONFLICT (trip_id) DO UPDATE
+		SET instance_id = EXCLUDED.instance_id, expires = EXCLUDED.expires
+		WHERE trip_leases.expires < now() OR trip_leases.instance_id = EXCLUDED.instance_id`
+	result, err := db.conn.Exec(sqlStatement, tripID, instanceID, ttl.Seconds())
+	if err != nil {
+		return false, err
+	}
+	count, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return count == 1, nil
+}
+
+func queryTripIDs(tx *sql.Tx, sqlStatement string, args ...interface{}) ([]string, error) {
+	rows, err := tx.Query(sqlStatement, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ids := []string{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// RenewLease will extend the lease if this tripwatcher still owns it
+func (db *PostgresInterface) RenewLease(instanceID string, tripID string, ttl time.Duration) (bool, error) {
+	sqlStatement := `
+		UPDATE trip_leases SET expires = now() + $3 * interval '1 second'
+		WHERE trip_id = $1 AND instance_id = $2 AND expires > now()`
+	result, err := db.conn.Exec(sqlStatement, tripID, instanceID, ttl.Seconds())
+	if err != nil {
+		return false, err
+	}
+	count, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return count == 1, nil
+}
+
+// CompleteOccurrence will queue the notification, record the trip's history
+// and update the trip in a single transaction. Nothing is changed if the
+// notification was already queued or the occurrence is already in the history
+func (db *PostgresInterface) CompleteOccurrence(trip *TripSchedule, record TripOccurrence, notification *Notification) (bool, error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	queued := false
+	if notification != nil {
+		queued, err = queueNotification(tx, notification)
+		if err != nil {
+			return false, err
+		}
+		// this occurrence has already been completed
+		if !queued {
+			return false, nil
+		}
+	}
+	historyStatement := `
+		INSERT INTO trip_history (trip_id, user_id, occurrence, outcome, departure_time, recorded)
+		VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT (trip_id, occurrence) DO NOTHING`
+	result, err := tx.Exec(historyStatement, record.TripID, record.UserID, record.Occurrence,
+		string(record.Outcome), TimeToUnixTimestamp(record.DepartureTime),
+		TimeToUnixTimestamp(record.Recorded))
+	if err != nil {
+		return false, err
+	}
+	count, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	// occurrences without a notification can also be completed twice
+	if count == 0 {
+		return false, nil
+	}
+	if IsRepeating(trip) {
+		_, err = tx.Exec(`UPDATE trips SET last_notification_sent = $1 WHERE id = $2`,
+			TimeToUnixTimestamp(record.Recorded), trip.ID)
+	} else {
+		_, err = tx.Exec(`DELETE FROM trips WHERE id = $1`, trip.ID)
+	}
+	if err != nil {
+		return false, err
+	}
+	return queued, tx.Commit()
+}
+
+// QueueNotification will store the notification unless it has already been
+// queued
+func (db *PostgresInterface) QueueNotification(notification *Notification) (bool, error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	queued, err := queueNotification(tx, notification)
+	if err != nil {
+		return false, err
+	}
+	return queued, tx.Commit()
+}
+
+func queueNotification(tx *sql.Tx, notification *Notification) (bool, error) {
+	sqlStatement := `
+		INSERT INTO notifications (dedupe_key, trip_id, user_id, kind, occurrence, message, expires, route, scheduled)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) ON CONFLICT (dedupe_key) DO NOTHING`
+	var expires interface{}
+	if !notification.Expires.IsZero() {
+		expires = notification.Expires
+	}
+	route, err := encodeRoute(notification.Route)
+	if err != nil {
+		return false, err
+	}
+	scheduled := notification.Scheduled
+	if scheduled.IsZero() {
+		scheduled = time.Now()
+	}
+	result, err := tx.Exec(sqlStatement, notification.DedupeKey, notification.TripID,
+		notification.User.ID, string(notification.Kind), notification.Occurrence,
+		notification.Message, expires, route, scheduled)
+	if err != nil {
+		return false, err
+	}
+	count, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return count == 1, nil
+}
+
+// ClaimNotifications will return notifications that are ready to be
+// delivered. Rows locked by another dispatcher are skipped
+func (db *PostgresInterface) ClaimNotifications(limit int, lease time.Duration) ([]*Notification, error) {
+	sqlStatement := `
+		WITH claimed AS (
+			UPDATE notifications
+			SET next_attempt = now() + $2 * interval '1 second', attempts = attempts + 1
+			WHERE id IN (
+				SELECT id FROM notifications
+				WHERE sent IS NULL AND next_attempt <= now()
+				ORDER BY next_attempt LIMIT $1
+				FOR UPDATE SKIP LOCKED
+			)
+			RETURNING id, trip_id, user_id, kind, occurrence, message, dedupe_key, attempts, expires,
+			route, COALESCE(scheduled, created) AS scheduled, COALESCE(sent_tokens, '{}') AS sent_tokens
+		)
+		SELECT claimed.id, claimed.trip_id, claimed.user_id, users.notification_token, users.os,
+		COALESCE(users.channel, ''), ` + needsReregisterColumn + `, claimed.kind, claimed.occurrence, claimed.message,
+		claimed.dedupe_key, claimed.attempts, claimed.expires, claimed.route, claimed.scheduled,
+		COALESCE(preferences.sound, ''), claimed.sent_tokens
+		FROM claimed JOIN users ON claimed.user_id = users.user_id
+		LEFT JOIN preferences ON claimed.user_id = preferences.user_id`
+	rows, err := db.conn.Query(sqlStatement, limit, lease.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	notifications := []*Notification{}
+	for rows.Next() {
+		n := &Notification{User: &UserInfo{}}
+		var expires pq.NullTime
+		var route []byte
+		err = rows.Scan(&n.ID, &n.TripID, &n.User.ID, &n.User.NotificationToken,
+			&n.User.DeviceOS, &n.User.Channel, &n.User.NeedsReregister, &n.Kind, &n.Occurrence, &n.Message, &n.DedupeKey,
+			&n.Attempts, &expires, &route, &n.Scheduled, &n.User.Sound, pq.Array(&n.SentTokens))
 		if err != nil {
 			fmt.Println(err)
 			continue
 		}
-		_, err = fmt.Sscanf(origin, "(%f,%f)", &t.Origin.Lat, &t.Origin.Lng)
+		n.Route, err = decodeRoute(route)
+		if err != nil {
+			fmt.Println(err)
+		}
+		if expires.Valid {
+			n.Expires = expires.Time
+		}
+		notifications = append(notifications, n)
+	}
+	return notifications, rows.Err()
+}
+
+// RenewNotificationLease will extend the lease as long as the notification
+// hasn't been claimed again, which would have increased its attempts
+func (db *PostgresInterface) RenewNotificationLease(id string, attempt int, lease time.Duration) (bool, error) {
+	sqlStatement := `
+		UPDATE notifications SET next_attempt = now() + $3 * interval '1 second'
+		WHERE id = $1 AND attempts = $2 AND sent IS NULL AND next_attempt IS NOT NULL`
+	result, err := db.conn.Exec(sqlStatement, id, attempt, lease.Seconds())
+	if err != nil {
+		return false, err
+	}
+	count, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// MarkDeviceSent adds the token to the notification's sent tokens
+func (db *PostgresInterface) MarkDeviceSent(id string, token string) error {
+	sqlStatement := `
+		UPDATE notifications SET sent_tokens = array_append(COALESCE(sent_tokens, '{}'), $2)
+		WHERE id = $1 AND NOT ($2 = ANY(COALESCE(sent_tokens, '{}')))`
+	_, err := db.conn.Exec(sqlStatement, id, token)
+	return err
+}
+
+// MarkNotificationSent records that the notification was delivered
+func (db *PostgresInterface) MarkNotificationSent(id string) error {
+	sqlStatement := `UPDATE notifications SET sent = now(), last_error = NULL WHERE id = $1`
+	_, err := db.conn.Exec(sqlStatement, id)
+	return err
+}
+
+// MarkNotificationFailed records the delivery error and when to try again.
+// Notifications that won't be retried have no next attempt
+func (db *PostgresInterface) MarkNotificationFailed(id string, reason string, retry bool, retryAt time.Time) error {
+	if retry {
+		sqlStatement := `UPDATE notifications SET last_error = $2, next_attempt = $3 WHERE id = $1`
+		_, err := db.conn.Exec(sqlStatement, id, reason, retryAt)
+		return err
+	}
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	sqlStatement := `UPDATE notifications SET last_error = $2, next_attempt = NULL WHERE id = $1`
+	if _, err := tx.Exec(sqlStatement, id, reason); err != nil {
+		return err
+	}
+	deadLetterStatement := `
+		INSERT INTO dead_letters
+		(notification_id, dedupe_key, trip_id, user_id, kind, occurrence, message, attempts, error)
+		SELECT id, dedupe_key, trip_id, user_id, kind, occurrence, message, attempts, $2
+		FROM notifications WHERE id = $1`
+	if _, err := tx.Exec(deadLetterStatement, id, reason); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetTripHistory returns every recorded occurrence of the trip, most recent
+// first
+func (db *PostgresInterface) GetTripHistory(tripID string, userID string) ([]TripOccurrence, error) {
+	sqlStatement := `
+		SELECT trip_id, user_id, occurrence, outcome, departure_time, recorded
+		FROM trip_history WHERE trip_id = $1 AND user_id = $2
+		ORDER BY recorded DESC`
+	rows, err := db.conn.Query(sqlStatement, tripID, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	history := []TripOccurrence{}
+	for rows.Next() {
+		var o TripOccurrence
+		var departureTime int64
+		var recorded int64
+		err = rows.Scan(&o.TripID, &o.UserID, &o.Occurrence, &o.Outcome,
+			&departureTime, &recorded)
 		if err != nil {
 			fmt.Println(err)
 			continue
 		}
-		_, err = fmt.Sscanf(dest, "(%f,%f)", &t.Destination.Lat, &t.Destination.Lng)
+		o.DepartureTime = UnixTime{UnixTimestampToTime(departureTime)}
+		o.Recorded = UnixTime{UnixTimestampToTime(recorded)}
+		history = append(history, o)
+	}
+	return history, rows.Err()
+}
+
+// LogDelivery will store the delivery attempt in the notification log
+func (db *PostgresInterface) LogDelivery(entry NotificationLogEntry) error {
+	sqlStatement := `
+		INSERT INTO notification_log
+		(notification_id, trip_id, user_id, kind, occurrence, message, route, provider,
+		result, error, attempt, scheduled, attempted, device_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)`
+	route, err := encodeRoute(entry.Route)
+	if err != nil {
+		return err
+	}
+	var scheduled interface{}
+	if !entry.Scheduled.IsZero() {
+		scheduled = entry.Scheduled.Time
+	}
+	var notificationID interface{}
+	if len(entry.NotificationID) > 0 {
+		notificationID = entry.NotificationID
+	}
+	var deviceID interface{}
+	if len(entry.DeviceID) > 0 {
+		deviceID = entry.DeviceID
+	}
+	_, err = db.conn.Exec(sqlStatement, notificationID, entry.TripID, entry.UserID,
+		string(entry.Kind), entry.Occurrence, entry.Message, route, entry.Provider,
+		string(entry.Result), entry.Error, entry.Attempt, scheduled, entry.Attempted.Time, deviceID)
+	return err
+}
+
+// GetNotificationLog returns entries matching the filter, most recent first.
+// Empty filter fields match every entry
+func (db *PostgresInterface) GetNotificationLog(filter NotificationLogFilter) ([]NotificationLogEntry, error) {
+	sqlStatement := `
+		SELECT COALESCE(notification_id::text, ''), trip_id, user_id, kind, occurrence, message, route,
+		COALESCE(provider, ''), result, COALESCE(error, ''), attempt, scheduled, attempted,
+		COALESCE(device_id::text, '')
+		FROM notification_log
+		WHERE ($1 = '' OR user_id = $1)
+		AND ($2 = '' OR trip_id::text = $2)
+		AND ($3::timestamptz IS NULL OR attempted >= $3)
+		AND ($4::timestamptz IS NULL OR attempted < $4)
+		ORDER BY attempted DESC LIMIT $5`
+	var from, to interface{}
+	if !filter.From.IsZero() {
+		from = filter.From
+	}
+	if !filter.To.IsZero() {
+		to = filter.To
+	}
+	rows, err := db.conn.Query(sqlStatement, filter.UserID, filter.TripID, from, to, filter.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	entries := []NotificationLogEntry{}
+	for rows.Next() {
+		var e NotificationLogEntry
+		var route []byte
+		var scheduled pq.NullTime
+		err = rows.Scan(&e.NotificationID, &e.TripID, &e.UserID, &e.Kind, &e.Occurrence,
+			&e.Message, &route, &e.Provider, &e.Result, &e.Error, &e.Attempt,
+			&scheduled, &e.Attempted.Time, &e.DeviceID)
 		if err != nil {
 			fmt.Println(err)
 			continue
 		}
-		t.Route.DepartureTime = UnixTime{UnixTimestampToTime(departureTime)}
-		t.Route.ArrivalTime = UnixTime{UnixTimestampToTime(arrivalTime)}
-		trips = append(trips, &t)
+		if scheduled.Valid {
+			e.Scheduled = UnixTime{scheduled.Time}
+		}
+		e.Route, err = decodeRoute(route)
+		if err != nil {
+			fmt.Println(err)
+		}
+		entries = append(entries, e)
 	}
-	return trips, nil
+	return entries, rows.Err()
+}
+
+// GetPreferences returns the user's preferences or nil if they haven't set
+// any
+func (db *PostgresInterface) GetPreferences(userID string) (*Preferences, error) {
+	sqlStatement := `
+		SELECT user_id, COALESCE(quiet_hours_start, ''), COALESCE(quiet_hours_end, ''),
+		COALESCE(timezone, ''), COALESCE(default_waiting_window, 0),
+		COALESCE(default_transport_type, ''), COALESCE(sound, ''),
+		COALESCE(warnings_enabled, true), COALESCE(delay_updates_enabled, true)
+		FROM preferences WHERE user_id = $1`
+	p := &Preferences{}
+	err := db.conn.QueryRow(sqlStatement, userID).Scan(&p.UserID, &p.QuietHoursStart,
+		&p.QuietHoursEnd, &p.Timezone, &p.DefaultWaitingWindowMs, &p.DefaultTransportType,
+		&p.Sound, &p.WarningsEnabled, &p.DelayUpdatesEnabled)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// SetPreferences will insert or replace the user's preferences
+func (db *PostgresInterface) SetPreferences(p *Preferences) error {
+	sqlStatement := `
+		INSERT INTO preferences (user_id, quiet_hours_start, quiet_hours_end, timezone,
+		default_waiting_window, default_transport_type, sound, warnings_enabled,
+		delay_updates_enabled)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) ON CONFLICT (user_id) DO UPDATE
+		SET quiet_hours_start = EXCLUDED.quiet_hours_start,
+		quiet_hours_end = EXCLUDED.quiet_hours_end, timezone = EXCLUDED.timezone,
+		default_waiting_window = EXCLUDED.default_waiting_window,
+		default_transport_type = EXCLUDED.default_transport_type, sound = EXCLUDED.sound,
+		warnings_enabled = EXCLUDED.warnings_enabled,
+		delay_updates_enabled = EXCLUDED.delay_updates_enabled`
+	_, err := db.conn.Exec(sqlStatement, p.UserID, p.QuietHoursStart, p.QuietHoursEnd,
+		p.Timezone, p.DefaultWaitingWindowMs, p.DefaultTransportType, p.Sound,
+		p.WarningsEnabled, p.DelayUpdatesEnabled)
+	return err
+}
+
+// SetSkipDates will replace the dates that the trip won't run on
+func (db *PostgresInterface) SetSkipDates(tripID string, userID string, dates []string) error {
+	sqlStatement := `
+		UPDATE trips SET skip_dates = $3
+		WHERE id = $1 AND user_id = $2`
+	_, err := db.conn.Exec(sqlStatement, tripID, userID, pq.Array(dates))
+	return err
+}
+
+// PauseTrips will stop the user's repeating trips before the date, an empty
+// date will resume them
+func (db *PostgresInterface) PauseTrips(userID string, until string) error {
+	sqlStatement := `
+		UPDATE users SET paused_until = NULLIF($2, '')::date
+		WHERE user_id = $1`
+	_, err := db.conn.Exec(sqlStatement, userID, until)
+	return err
+}
+
+// SetHolidays will replace the user's holidays
+func (db *PostgresInterface) SetHolidays(userID string, holidays []Holiday) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM holidays WHERE user_id = $1", userID); err != nil {
+		return err
+	}
+	sqlStatement := `
+		INSERT INTO holidays (user_id, date, name) VALUES ($1, $2, $3)
+		ON CONFLICT DO NOTHING`
+	for _, h := range holidays {
+		if _, err := tx.Exec(sqlStatement, userID, h.Date, h.Name); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// GetHolidays will return the user's holidays in date order
+func (db *PostgresInterface) GetHolidays(userID string) ([]Holiday, error) {
+	sqlStatement := `
+		SELECT to_char(date, 'YYYY-MM-DD'), COALESCE(name, '')
+		FROM holidays WHERE user_id = $1 ORDER BY date`
+	rows, err := db.conn.Query(sqlStatement, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	holidays := []Holiday{}
+	for rows.Next() {
+		var h Holiday
+		if err := rows.Scan(&h.Date, &h.Name); err != nil {
+			return nil, err
+		}
+		holidays = append(holidays, h)
+	}
+	return holidays, rows.Err()
 }
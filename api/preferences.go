@@ -0,0 +1,166 @@
+package api
+
+import (
+	"errors"
+	"time"
+)
+
+// SilentSound is the sound preference used for notifications that shouldn't
+// play a sound
+const SilentSound = "none"
+
+// quietHoursFormat is the format of the quiet hours start and end times
+const quietHoursFormat = "15:04"
+
+// Preferences are the user's notification settings
+type Preferences struct {
+	UserID string `json:"user_id"`
+	// the local time of day that quiet hours start and end, such as "22:00"
+	// and "07:00". Only the final alert for a trip and urgent notifications
+	// are sent during quiet hours
+	QuietHoursStart string `json:"quiet_hours_start,omitempty"`
+	QuietHoursEnd   string `json:"quiet_hours_end,omitempty"`
+	// the timezone that quiet hours are in, this is required if quiet hours
+	// are set
+	Timezone string `json:"timezone,omitempty"`
+	// used for trips that are scheduled without a waiting window
+	DefaultWaitingWindowMs int64 `json:"default_waiting_window_ms,omitempty"`
+	// used for trips that are scheduled without a transport type
+	DefaultTransportType string `json:"default_transport_type,omitempty"`
+	// the notification sound, if this is empty then the default sound is
+	// used. Use `SilentSound` for no sound
+	Sound string `json:"sound,omitempty"`
+	// whether the user is told when their service is cancelled
+	WarningsEnabled bool `json:"warnings_enabled"`
+	// whether the user is told when their trip's times change
+	DelayUpdatesEnabled bool `json:"delay_updates_enabled"`
+}
+
+// PreferencesInterface stores each user's preferences
+type PreferencesInterface interface {
+	// GetPreferences will return nil if the user hasn't set any
+	GetPreferences(userID string) (*Preferences, error)
+	// SetPreferences will replace the user's preferences
+	SetPreferences(preferences *Preferences) error
+}
+
+// DefaultPreferences returns the preferences used for users that haven't set
+// any
+func DefaultPreferences(userID string) *Preferences {
+	return &Preferences{
+		UserID:              userID,
+		WarningsEnabled:     true,
+		DelayUpdatesEnabled: true,
+	}
+}
+
+// GetPreferences returns the user's preferences, or the defaults if they
+// haven't set any
+func GetPreferences(db PreferencesInterface, userID string) (*Preferences, error) {
+	preferences, err := db.GetPreferences(userID)
+	if err != nil {
+		return nil, err
+	}
+	if preferences == nil {
+		return DefaultPreferences(userID), nil
+	}
+	return preferences, nil
+}
+
+// SetPreferences will store the user's preferences if they're valid
+func SetPreferences(db PreferencesInterface, preferences *Preferences) error {
+	if err := ValidatePreferences(preferences); err != nil {
+		return err
+	}
+	return db.SetPreferences(preferences)
+}
+
+// ValidatePreferences returns an error if the preferences can't be used
+func ValidatePreferences(p *Preferences) error {
+	if len(p.UserID) == 0 {
+		return errors.New("No user ID set")
+	}
+	if p.DefaultWaitingWindowMs < 0 {
+		return errors.New("Default waiting window can't be negative")
+	}
+	if !p.hasQuietHours() {
+		if len(p.QuietHoursStart) > 0 || len(p.QuietHoursEnd) > 0 {
+			return errors.New("Quiet hours need a start and end")
+		}
+		return nil
+	}
+	if _, err := time.Parse(quietHoursFormat, p.QuietHoursStart); err != nil {
+		return errors.New("Invalid quiet hours start")
+	}
+	if _, err := time.Parse(quietHoursFormat, p.QuietHoursEnd); err != nil {
+		return errors.New("Invalid quiet hours end")
+	}
+	if len(p.Timezone) == 0 {
+		return errors.New("Quiet hours need a timezone")
+	}
+	if _, err := time.LoadLocation(p.Timezone); err != nil {
+		return errors.New("Invalid timezone")
+	}
+	return nil
+}
+
+func (p *Preferences) hasQuietHours() bool {
+	return len(p.QuietHoursStart) > 0 && len(p.QuietHoursEnd) > 0
+}
+
+// InQuietHours returns true if the time is within the user's quiet hours.
+// Quiet hours can cross midnight, such as from 22:00 to 07:00
+func (p *Preferences) InQuietHours(t time.Time) bool {
+	if !p.hasQuietHours() {
+		return false
+	}
+	start, err := time.Parse(quietHoursFormat, p.QuietHoursStart)
+	if err != nil {
+		return false
+	}
+	end, err := time.Parse(quietHoursFormat, p.QuietHoursEnd)
+	if err != nil {
+		return false
+	}
+	loc, err := time.LoadLocation(p.Timezone)
+	if err != nil {
+		return false
+	}
+	local := t.In(loc)
+	minutes := local.Hour()*60 + local.Minute()
+	startMinutes := start.Hour()*60 + start.Minute()
+	endMinutes := end.Hour()*60 + end.Minute()
+	if startMinutes <= endMinutes {
+		return minutes >= startMinutes && minutes < endMinutes
+	}
+	return minutes >= startMinutes || minutes < endMinutes
+}
+
+// AllowsNotification returns true if the notification should be sent at
+// this time. This is only used for updates and earlier reminders, the final
+// alert for a trip is always sent. Urgent notifications ignore quiet hours
+// but can still be turned off by kind
+func (p *Preferences) AllowsNotification(n *Notification, t time.Time) bool {
+	if !n.Urgent && p.InQuietHours(t) {
+		return false
+	}
+	switch n.Kind {
+	case CancellationNotification:
+		return p.WarningsEnabled
+	case DelayNotification:
+		return p.DelayUpdatesEnabled
+	}
+	return true
+}
+
+// ApplyPreferences will use the user's defaults for anything that wasn't set
+// when the trip was scheduled. A waiting window of zero is kept if it was
+// set in the trip's JSON
+func ApplyPreferences(trip *TripSchedule, p *Preferences) {
+	if trip.WaitingWindowMs == 0 && !trip.waitingWindowSet {
+		trip.WaitingWindowMs = p.DefaultWaitingWindowMs
+	}
+	if len(trip.TransportType) == 0 {
+		trip.TransportType = p.DefaultTransportType
+	}
+}
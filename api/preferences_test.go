@@ -0,0 +1,120 @@
+package api
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestInQuietHours(t *testing.T) {
+	p := DefaultPreferences("user")
+	p.QuietHoursStart = "22:00"
+	p.QuietHoursEnd = "07:00"
+	p.Timezone = "Australia/Sydney"
+	loc, _ := time.LoadLocation("Australia/Sydney")
+	tests := map[int]bool{21: false, 22: true, 23: true, 0: true, 6: true, 7: false, 12: false}
+	for hour, expected := range tests {
+		now := time.Date(2017, 7, 15, hour, 30, 0, 0, loc)
+		if result := p.InQuietHours(now.UTC()); result != expected {
+			t.Error("Expected", expected, "at", hour, "found", result)
+		}
+	}
+	p.QuietHoursStart = "09:00"
+	p.QuietHoursEnd = "17:00"
+	if !p.InQuietHours(time.Date(2017, 7, 15, 12, 0, 0, 0, loc)) {
+		t.Error("Expected midday to be within quiet hours")
+	}
+	if p.InQuietHours(time.Date(2017, 7, 15, 18, 0, 0, 0, loc)) {
+		t.Error("Expected evening to be outside quiet hours")
+	}
+}
+
+func TestAllowsNotification(t *testing.T) {
+	now := time.Now()
+	p := DefaultPreferences("user")
+	delay := &Notification{Kind: DelayNotification}
+	cancellation := &Notification{Kind: CancellationNotification}
+	leave := &Notification{Kind: LeaveNotification}
+	if !p.AllowsNotification(delay, now) || !p.AllowsNotification(cancellation, now) {
+		t.Error("Expected updates to be allowed by default")
+	}
+	p.WarningsEnabled = false
+	if p.AllowsNotification(cancellation, now) || !p.AllowsNotification(leave, now) {
+		t.Error("Expected only cancellations to be turned off")
+	}
+}
+
+func TestAllowsUrgentNotificationsDuringQuietHours(t *testing.T) {
+	now := time.Now().UTC()
+	p := DefaultPreferences("user")
+	p.QuietHoursStart = now.Add(-time.Hour).Format("15:04")
+	p.QuietHoursEnd = now.Add(time.Hour).Format("15:04")
+	p.Timezone = "UTC"
+	if p.AllowsNotification(&Notification{Kind: LeaveNotification}, now) {
+		t.Error("Expected reminder to be dropped during quiet hours")
+	}
+	if !p.AllowsNotification(&Notification{Kind: LeaveNotification, Urgent: true}, now) {
+		t.Error("Expected urgent reminder to be sent during quiet hours")
+	}
+	// urgent notifications can still be turned off
+	p.WarningsEnabled = false
+	if p.AllowsNotification(&Notification{Kind: CancellationNotification, Urgent: true}, now) {
+		t.Error("Expected cancellations to be turned off")
+	}
+}
+
+func TestValidatePreferences(t *testing.T) {
+	invalid := []Preferences{
+		{},
+		{UserID: "user", DefaultWaitingWindowMs: -1},
+		{UserID: "user", QuietHoursStart: "22:00"},
+		{UserID: "user", QuietHoursStart: "22:00", QuietHoursEnd: "7am", Timezone: "UTC"},
+		{UserID: "user", QuietHoursStart: "22:00", QuietHoursEnd: "07:00"},
+		{UserID: "user", QuietHoursStart: "22:00", QuietHoursEnd: "07:00", Timezone: "Nowhere"},
+	}
+	for _, p := range invalid {
+		if err := ValidatePreferences(&p); err == nil {
+			t.Error("Expected error for", p)
+		}
+	}
+	p := Preferences{UserID: "user", QuietHoursStart: "22:00", QuietHoursEnd: "07:00", Timezone: "UTC"}
+	if err := ValidatePreferences(&p); err != nil {
+		t.Error("Expected no error, found", err)
+	}
+}
+
+func TestApplyPreferences(t *testing.T) {
+	p := DefaultPreferences("user")
+	p.DefaultWaitingWindowMs = 5 * 60 * 1000
+	p.DefaultTransportType = "bus"
+	trip := &TripSchedule{}
+	ApplyPreferences(trip, p)
+	if trip.WaitingWindowMs != p.DefaultWaitingWindowMs || trip.TransportType != "bus" {
+		t.Error("Expected defaults to be applied, found", trip.WaitingWindowMs, trip.TransportType)
+	}
+	trip = &TripSchedule{WaitingWindowMs: 1000, TransportType: "train"}
+	ApplyPreferences(trip, p)
+	if trip.WaitingWindowMs != 1000 || trip.TransportType != "train" {
+		t.Error("Expected trip's own settings to be kept")
+	}
+}
+
+func TestApplyPreferencesKeepsZeroWaitingWindow(t *testing.T) {
+	p := DefaultPreferences("user")
+	p.DefaultWaitingWindowMs = 5 * 60 * 1000
+	tests := map[string]int64{
+		`{"trip_id": "1", "waiting_window_ms": 0}`:    0,
+		`{"trip_id": "1"}`:                            p.DefaultWaitingWindowMs,
+		`{"trip_id": "1", "waiting_window_ms": null}`: p.DefaultWaitingWindowMs,
+	}
+	for body, expected := range tests {
+		var trip *TripSchedule
+		if err := json.Unmarshal([]byte(body), &trip); err != nil {
+			t.Fatal("Unexpected error", err)
+		}
+		ApplyPreferences(trip, p)
+		if trip.ID != "1" || trip.WaitingWindowMs != expected {
+			t.Error("Expected", expected, "for", body, "found", trip.WaitingWindowMs)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package api
+
+import (
+	"errors"
+	"time"
+)
+
+// RouteRanking decides which service is chosen for trips with an arrival
+// window
+type RouteRanking string
+
+const (
+	// RankLatestDeparture chooses the service that leaves the latest. This is
+	// the default
+	RankLatestDeparture RouteRanking = "latest_departure"
+	// RankFewestTransfers chooses the service with the least changes
+	RankFewestTransfers RouteRanking = "fewest_transfers"
+	// RankLeastWalking chooses the service with the least time spent walking
+	RankLeastWalking RouteRanking = "least_walking"
+)
+
+// IsValidRanking returns true if the ranking is empty or is a known ranking
+func IsValidRanking(ranking RouteRanking) bool {
+	switch ranking {
+	case "", RankLatestDeparture, RankFewestTransfers, RankLeastWalking:
+		return true
+	}
+	return false
+}
+
+// HasArrivalWindow returns true if any service arriving within the trip's
+// window can be chosen instead of the scheduled route
+func HasArrivalWindow(trip *TripSchedule) bool {
+	return trip.ArrivalWindowMs > 0
+}
+
+// GetBestRoute will find the best service for the trip right now. For trips
+// with an arrival window, every service arriving within the window is
+// ranked using the trip's ranking. Otherwise this will find the route that
+// the user scheduled
+// @param trip - scheduled trip
+func GetBestRoute(finder RouteFinder, trip *TripSchedule) (RouteOption, error) {
+	if !HasArrivalWindow(trip) {
+		return GetRoute(finder, trip)
+	}
+	arrivalTime := GetInputArrivalTime(trip)
+	resp := finder.FindRoutes(trip.Origin.Lat, trip.Origin.Lng,
+		trip.Destination.Lat, trip.Destination.Lng,
+		trip.TransportType, arrivalTime, "")
+	windowStart := arrivalTime.Add(-time.Duration(trip.ArrivalWindowMs) * time.Millisecond)
+	return chooseBestRoute(time.Now(), windowStart, arrivalTime, trip.Ranking, resp)
+}
+
+// chooseBestRoute will rank the routes that are still running and arrive
+// within the window. Ties are broken by the latest departure
+func chooseBestRoute(now time.Time, windowStart time.Time, windowEnd time.Time,
+	ranking RouteRanking, routes []RouteOption) (RouteOption, error) {
+	var choice *RouteOption
+	for i, r := range routes {
+		if r.Status != RouteScheduled {
+			continue
+		}
+		if r.DepartureTime.Before(now) {
+			continue
+		}
+		if r.ArrivalTime.Before(windowStart) || r.ArrivalTime.After(windowEnd) {
+			continue
+		}
+		if choice == nil || isBetterRoute(ranking, r, *choice) {
+			choice = &routes[i]
+		}
+	}
+	if choice == nil {
+		return RouteOption{}, errors.New("No routes arrive within the window")
+	}
+	return *choice, nil
+}
+
+// isBetterRoute returns true if a should be chosen over b
+func isBetterRoute(ranking RouteRanking, a RouteOption, b RouteOption) bool {
+	switch ranking {
+	case RankFewestTransfers:
+		if transfers(a) != transfers(b) {
+			return transfers(a) < transfers(b)
+		}
+	case RankLeastWalking:
+		if a.WalkingTimeMs != b.WalkingTimeMs {
+			return a.WalkingTimeMs < b.WalkingTimeMs
+		}
+	}
+	return a.DepartureTime.After(b.DepartureTime.Time)
+}
+
+// transfers returns the number of times the user will change services
+func transfers(route RouteOption) int {
+	if route.Fingerprint == nil || len(route.Fingerprint.Transit) == 0 {
+		return 0
+	}
+	return len(route.Fingerprint.Transit) - 1
+}
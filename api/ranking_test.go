@@ -0,0 +1,94 @@
+package api
+
+import (
+	"testing"
+	"time"
+)
+
+func testWindowRoutes(now time.Time) []RouteOption {
+	return []RouteOption{
+		// arrives before the window
+		RouteOption{
+			Name:          "300",
+			DepartureTime: UnixTime{now.Add(5 * time.Minute)},
+			ArrivalTime:   UnixTime{now.Add(30 * time.Minute)},
+		},
+		RouteOption{
+			Name:          "300",
+			DepartureTime: UnixTime{now.Add(20 * time.Minute)},
+			ArrivalTime:   UnixTime{now.Add(45 * time.Minute)},
+			WalkingTimeMs: 600000,
+			Fingerprint:   &RouteFingerprint{Transit: []FingerprintLeg{FingerprintLeg{Line: "300"}}},
+		},
+		RouteOption{
+			Name:          "31",
+			DepartureTime: UnixTime{now.Add(30 * time.Minute)},
+			ArrivalTime:   UnixTime{now.Add(55 * time.Minute)},
+			WalkingTimeMs: 120000,
+			Fingerprint: &RouteFingerprint{Transit: []FingerprintLeg{
+				FingerprintLeg{Line: "31"}, FingerprintLeg{Line: "300"},
+			}},
+		},
+		RouteOption{
+			Name:          "300",
+			DepartureTime: UnixTime{now.Add(35 * time.Minute)},
+			ArrivalTime:   UnixTime{now.Add(58 * time.Minute)},
+			WalkingTimeMs: 300000,
+			Fingerprint:   &RouteFingerprint{Transit: []FingerprintLeg{FingerprintLeg{Line: "300"}}},
+			Status:        RouteCancelled,
+		},
+		// arrives after the window
+		RouteOption{
+			Name:          "300",
+			DepartureTime: UnixTime{now.Add(50 * time.Minute)},
+			ArrivalTime:   UnixTime{now.Add(75 * time.Minute)},
+		},
+	}
+}
+
+func TestChooseBestRoute(t *testing.T) {
+	now := time.Now()
+	routes := testWindowRoutes(now)
+	windowStart := now.Add(40 * time.Minute)
+	windowEnd := now.Add(1 * time.Hour)
+	result, err := chooseBestRoute(now, windowStart, windowEnd, RankLatestDeparture, routes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != routes[2] {
+		t.Error("Expected", routes[2], "found", result)
+	}
+	// the default ranking is latest departure
+	result, _ = chooseBestRoute(now, windowStart, windowEnd, "", routes)
+	if result != routes[2] {
+		t.Error("Expected", routes[2], "found", result)
+	}
+	result, _ = chooseBestRoute(now, windowStart, windowEnd, RankFewestTransfers, routes)
+	if result != routes[1] {
+		t.Error("Expected", routes[1], "found", result)
+	}
+	result, _ = chooseBestRoute(now, windowStart, windowEnd, RankLeastWalking, routes)
+	if result != routes[2] {
+		t.Error("Expected", routes[2], "found", result)
+	}
+}
+
+func TestChooseBestRouteWithNoRoutesInWindow(t *testing.T) {
+	now := time.Now()
+	routes := testWindowRoutes(now)
+	windowStart := now.Add(2 * time.Hour)
+	windowEnd := now.Add(3 * time.Hour)
+	_, err := chooseBestRoute(now, windowStart, windowEnd, RankLatestDeparture, routes)
+	if err == nil {
+		t.Error("Expected error when no routes arrive within the window")
+	}
+}
+
+func TestIsValidRanking(t *testing.T) {
+	if !IsValidRanking("") || !IsValidRanking(RankLeastWalking) {
+		t.Error("Expected rankings to be valid")
+	}
+	if IsValidRanking("fastest") {
+		t.Error("Expected", "fastest", "to be invalid")
+	}
+}
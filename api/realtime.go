@@ -0,0 +1,280 @@
+package api
+
+import (
+	"fmt"
+	"github.com/oliveroneill/nxtbus-go"
+	"googlemaps.github.io/maps"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RealTimeThreshold is used so that real-time data will be tracked 90
+// minutes ahead
+const RealTimeThreshold = 90 * time.Minute
+
+// StopTimeThreshold is a threshold to determine whether a stop date from
+// Google Maps is close enough to the real-time date to be the same route
+const StopTimeThreshold = 2 * time.Minute
+
+// trackedVisitExpiry is how long a matched stop visit is remembered after
+// its departure time. This is used to notice when a service disappears from
+// the real-time feed. These are only kept in memory, so this is best-effort:
+// a service that disappears while the process restarts, or that is already
+// missing the first time it's looked up, won't be noticed. Feeds that mark
+// services as cancelled should implement CancellationAPI instead
+const trackedVisitExpiry = 1 * time.Hour
+
+// RealTimeAPI is an interface for finding routes at a specific transit stop
+// Currently this is only used for NXTBUS, and will return nxtbus API
+// types
+type RealTimeAPI interface {
+	GetVisits(stop maps.TransitStop) ([]nxtbus.MonitoredStopVisit, error)
+}
+
+// CancellationAPI can be implemented by a RealTimeAPI whose feed explicitly
+// marks services as cancelled. Routes matching one of these are marked as
+// cancelled straight away, rather than waiting for them to disappear
+type CancellationAPI interface {
+	// GetCancelledVisits will return the cancelled services at the stop
+	GetCancelledVisits(stop maps.TransitStop) ([]nxtbus.MonitoredStopVisit, error)
+}
+
+// RealTimeFinder - an implementation of RouteFinder that uses GoogleMaps
+// and real-time providers for accurate departure times. Providers are
+// registered per transit agency so that each route uses the real-time data
+// for the agency that runs it
+type RealTimeFinder struct {
+	RouteFinder
+	// real-time providers keyed by normalised agency name or URL
+	providers map[string]RealTimeAPI
+	// this should always be a GoogleMapsFinder since we will
+	// use the information that it provides, but for testing
+	// purposes its easiest to use the interface
+	finder RouteFinder
+	// tracked stores the stop visits that have previously been matched to
+	// a route, keyed by trackedVisitKey. If one of these disappears from the
+	// feed then the service has been cancelled
+	tracked map[string]time.Time
+	mux     sync.Mutex
+}
+
+// NewRealTimeFinder will create a RealTimeFinder without any providers.
+// Use RegisterProvider to add real-time data for an agency
+// @param finder - the finder used to search for routes before they're
+// updated with real-time data
+func NewRealTimeFinder(finder RouteFinder) *RealTimeFinder {
+	return &RealTimeFinder{
+		finder:    finder,
+		providers: make(map[string]RealTimeAPI),
+	}
+}
+
+// RegisterProvider will use the input real-time API for any route run by
+// the specified agency
+// @param agency - the agency name, such as "Transport Canberra", or the
+// agency URL
+func (finder *RealTimeFinder) RegisterProvider(agency string, provider RealTimeAPI) {
+	finder.mux.Lock()
+	defer finder.mux.Unlock()
+	if finder.providers == nil {
+		finder.providers = make(map[string]RealTimeAPI)
+	}
+	finder.providers[normaliseAgency(agency)] = provider
+}
+
+// MismatchReport will return the stop mismatches of every provider
+func (finder *RealTimeFinder) MismatchReport() []StopMismatch {
+	finder.mux.Lock()
+	// providers can be registered for more than one agency
+	providers := []RealTimeAPI{}
+	seen := make(map[RealTimeAPI]bool)
+	for _, p := range finder.providers {
+		if !seen[p] {
+			seen[p] = true
+			providers = append(providers, p)
+		}
+	}
+	finder.mux.Unlock()
+	reports := [][]StopMismatch{FinderMismatchReport(finder.finder)}
+	for _, p := range providers {
+		reports = append(reports, FinderMismatchReport(p))
+	}
+	return mergeMismatchReports(reports...)
+}
+
+// providerFor will return the real-time provider for the first agency on
+// the line that has one registered, or nil if there isn't one
+func (finder *RealTimeFinder) providerFor(details *maps.TransitDetails) RealTimeAPI {
+	finder.mux.Lock()
+	defer finder.mux.Unlock()
+	for _, agency := range details.Line.Agencies {
+		if agency == nil {
+			continue
+		}
+		if provider, ok := finder.providers[normaliseAgency(agency.Name)]; ok {
+			return provider
+		}
+		if agency.URL == nil {
+			continue
+		}
+		if provider, ok := finder.providers[normaliseAgency(agency.URL.String())]; ok {
+			return provider
+		}
+	}
+	return nil
+}
+
+func normaliseAgency(agency string) string {
+	return strings.ToLower(strings.TrimSpace(agency))
+}
+
+// FindRoutes will return real-time transit data and fallback to standard
+// Google Maps data when this data is unavailable or irrelevant
+func (finder *RealTimeFinder) FindRoutes(originLat, originLng, destLat,
+	destLng float64, transportType string, arrivalTime time.Time,
+	routeName string) []RouteOption {
+	options, _ := finder.FindRoutesWithError(originLat, originLng, destLat, destLng,
+		transportType, arrivalTime, routeName)
+	return options
+}
+
+// FindRoutesWithError is the same as FindRoutes but returns the underlying
+// finder's error. Real-time data is only used to update the routes, so it
+// can't cause the search to fail
+func (finder *RealTimeFinder) FindRoutesWithError(originLat, originLng, destLat,
+	destLng float64, transportType string, arrivalTime time.Time,
+	routeName string) ([]RouteOption, error) {
+	options, err := FindRoutesWithError(finder.finder, originLat, originLng, destLat, destLng,
+		transportType, arrivalTime, routeName)
+	if err != nil || transportType != "transit" {
+		return options, err
+	}
+	for i, option := range options {
+		now := time.Now()
+		// if its more than 90 minutes then skip
+		if option.DepartureTime.Sub(now) >= RealTimeThreshold {
+			continue
+		}
+		if option.transitDetails == nil {
+			continue
+		}
+		// skip if none of the agencies running this line have real-time data
+		provider := finder.providerFor(option.transitDetails)
+		if provider == nil {
+			continue
+		}
+		finder.updateUsingRealTimeData(provider, &options[i])
+	}
+	return options, nil
+}
+
+// NOTE: This will modify the option passed in without copying
+func (finder *RealTimeFinder) updateUsingRealTimeData(provider RealTimeAPI, option *RouteOption) {
+	visits, err := provider.GetVisits(option.transitDetails.DepartureStop)
+	if err != nil {
+		return
+	}
+	// use the transit details departure time, since there may be other legs
+	// on the trip
+	mapsDeparture := option.transitDetails.DepartureTime
+	key := trackedVisitKey(option.transitDetails.DepartureStop.Name, option.Name, mapsDeparture)
+	bestChoice, closest := closestVisit(visits, option.Name, mapsDeparture)
+	if cancellations, ok := provider.(CancellationAPI); ok {
+		cancelled, err := cancellations.GetCancelledVisits(option.transitDetails.DepartureStop)
+		if err == nil {
+			// a running service that's a closer match takes precedence
+			visit, diff := closestVisit(cancelled, option.Name, mapsDeparture)
+			if visit != nil && (bestChoice == nil || diff < closest) {
+				option.Status = RouteCancelled
+				return
+			}
+		}
+	}
+	if bestChoice == nil {
+		// if we've seen this service before and it's no longer in the feed
+		// before it was due to leave then it's been cancelled
+		if finder.wasTracked(key) && mapsDeparture.After(time.Now()) {
+			option.Status = RouteCancelled
+		}
+		return
+	}
+	expectedDeparture, err := nxtbus.ParseDate(bestChoice.ExpectedDepartureTime)
+	// ensure we aren't missing data
+	if err != nil {
+		// if the service previously had an expected departure and still
+		// expects to arrive then it will no longer stop for passengers here
+		_, arrivalErr := nxtbus.ParseDate(bestChoice.ExpectedArrivalTime)
+		if arrivalErr == nil && finder.wasTracked(key) {
+			option.Status = RouteStopSkipped
+		}
+		return
+	}
+	finder.track(key, mapsDeparture)
+	// Figure out how much time we've gained or lost compared to the schedule.
+	// We use the Google Maps departure time to compensate if it has
+	// an incorrect transit departure time
+	diff := mapsDeparture.Sub(expectedDeparture)
+	// move the trip start and end accordingly
+	option.DepartureTime = UnixTime{option.DepartureTime.Add(-diff)}
+	option.ArrivalTime = UnixTime{option.ArrivalTime.Add(-diff)}
+}
+
+// closestVisit will find the visit on the line with the closest scheduled
+// departure to the route's departure time
+// @returns nil if no visit is within StopTimeThreshold, along with how far
+// apart the times are
+func closestVisit(visits []nxtbus.MonitoredStopVisit, lineName string, departure time.Time) (*nxtbus.MonitoredStopVisit, float64) {
+	var closest float64 = -1
+	var bestChoice *nxtbus.MonitoredStopVisit
+	for i, data := range visits {
+		if data.LineName != lineName {
+			continue
+		}
+		aimedDeparture, err := nxtbus.ParseDate(data.AimedDepartureTime)
+		// some responses seem to be missing data
+		if err != nil {
+			continue
+		}
+		diff := math.Abs(float64(departure.Sub(aimedDeparture)))
+		// make sure the times aren't too far apart
+		if time.Duration(diff) > StopTimeThreshold {
+			continue
+		}
+		if bestChoice == nil || diff < closest {
+			closest = diff
+			bestChoice = &visits[i]
+		}
+	}
+	return bestChoice, closest
+}
+
+// track will remember that a stop visit was matched so that we can tell if
+// it disappears from the feed later on
+func (finder *RealTimeFinder) track(key string, departure time.Time) {
+	finder.mux.Lock()
+	defer finder.mux.Unlock()
+	if finder.tracked == nil {
+		finder.tracked = make(map[string]time.Time)
+	}
+	// clear out visits that have already left
+	now := time.Now()
+	for k, d := range finder.tracked {
+		if now.Sub(d) > trackedVisitExpiry {
+			delete(finder.tracked, k)
+		}
+	}
+	finder.tracked[key] = departure
+}
+
+func (finder *RealTimeFinder) wasTracked(key string) bool {
+	finder.mux.Lock()
+	defer finder.mux.Unlock()
+	_, ok := finder.tracked[key]
+	return ok
+}
+
+func trackedVisitKey(stopName string, lineName string, departure time.Time) string {
+	return fmt.Sprintf("%s/%s/%d", stopName, lineName, departure.Unix())
+}
@@ -0,0 +1,336 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"sync"
+	"time"
+)
+
+// FinderFactory creates a RouteFinder from its config. Finders that adjust
+// the results of another finder, such as caches or real-time providers, are
+// given the next finder in the chain. The last finder in a chain is given nil
+// and should be a base router such as Google Maps
+type FinderFactory func(config ProviderConfig, next RouteFinder) (RouteFinder, error)
+
+var finderTypes = map[string]FinderFactory{
+	"googlemaps": newGoogleMapsFinderFromConfig,
+	"cache":      newCachingFinderFromConfig,
+	"realtime":   newRealTimeFinderFromConfig,
+}
+
+// RealTimeFactory creates a RealTimeAPI from its config
+type RealTimeFactory func(config RealTimeProviderConfig) (RealTimeAPI, error)
+
+var realTimeTypes = map[string]RealTimeFactory{
+	"nxtbus": newNxtBusAPIFromConfig,
+	"gtfsrt": newGTFSRealTimeAPIFromConfig,
+}
+
+// used for both finderTypes and realTimeTypes
+var finderTypesMux sync.Mutex
+
+// RegisterFinderType will allow finders of this type to be used in the
+// finder config file
+func RegisterFinderType(name string, factory FinderFactory) {
+	finderTypesMux.Lock()
+	defer finderTypesMux.Unlock()
+	finderTypes[name] = factory
+}
+
+// RegisterRealTimeType will allow real-time providers of this type to be
+// used by real-time finders in the finder config file
+func RegisterRealTimeType(name string, factory RealTimeFactory) {
+	finderTypesMux.Lock()
+	defer finderTypesMux.Unlock()
+	realTimeTypes[name] = factory
+}
+
+// ProviderConfig is the config for a single finder in a chain. The type
+// decides which FinderFactory is used and the rest of the fields are passed
+// on to it
+type ProviderConfig struct {
+	Type string
+	raw  json.RawMessage
+}
+
+// UnmarshalJSON will store the raw config so that the factory can decode
+// the fields it needs
+func (c *ProviderConfig) UnmarshalJSON(b []byte) error {
+	var typed struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(b, &typed); err != nil {
+		return err
+	}
+	c.Type = typed.Type
+	c.raw = append(json.RawMessage{}, b...)
+	return nil
+}
+
+// Decode will decode this config into v
+func (c ProviderConfig) Decode(v interface{}) error {
+	if c.raw == nil {
+		return nil
+	}
+	return json.Unmarshal(c.raw, v)
+}
+
+// Bounds is a rectangular area
+type Bounds struct {
+	MinLat float64 `json:"min_lat"`
+	MinLng float64 `json:"min_lng"`
+	MaxLat float64 `json:"max_lat"`
+	MaxLng float64 `json:"max_lng"`
+}
+
+// RegionConfig describes which finders should be used for trips starting in
+// an area. If neither bounds nor a polygon is set then the region covers
+// everywhere
+type RegionConfig struct {
+	Name    string  `json:"name"`
+	Bounds  *Bounds `json:"bounds"`
+	Polygon []Point `json:"polygon"`
+	// the transport types this region applies to, if empty then it is
+	// used for all transport types
+	TransportTypes []string `json:"transport_types"`
+	// the finders to use in order, where each finder wraps the next
+	Chain []ProviderConfig `json:"chain"`
+}
+
+// FinderConfig is the format of the finder config file
+type FinderConfig struct {
+	Regions []RegionConfig `json:"regions"`
+}
+
+// FinderRegistry is an implementation of RouteFinder that chooses which
+// finder to use based on where the trip starts and how the user is
+// travelling. The first region that matches is used
+type FinderRegistry struct {
+	RouteFinder
+	regions []region
+}
+
+type region struct {
+	config RegionConfig
+	finder RouteFinder
+}
+
+// LoadFinderRegistry will create a FinderRegistry from a JSON config file
+func LoadFinderRegistry(path string) (*FinderRegistry, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config FinderConfig
+	if err := json.Unmarshal(b, &config); err != nil {
+		return nil, err
+	}
+	return NewFinderRegistry(config)
+}
+
+// NewFinderRegistry will build the finder chains for each region in the
+// config
+func NewFinderRegistry(config FinderConfig) (*FinderRegistry, error) {
+	registry := new(FinderRegistry)
+	for _, r := range config.Regions {
+		finder, err := buildFinderChain(r.Chain)
+		if err != nil {
+			return nil, fmt.Errorf("Region %s: %v", r.Name, err)
+		}
+		registry.regions = append(registry.regions, region{config: r, finder: finder})
+	}
+	return registry, nil
+}
+
+func buildFinderChain(chain []ProviderConfig) (RouteFinder, error) {
+	if len(chain) == 0 {
+		return nil, errors.New("No finders in chain")
+	}
+	var next RouteFinder
+	// build from the base router upwards
+	for i := len(chain) - 1; i >= 0; i-- {
+		finderTypesMux.Lock()
+		factory, ok := finderTypes[chain[i].Type]
+		finderTypesMux.Unlock()
+		if !ok {
+			return nil, fmt.Errorf("Unknown finder type %s", chain[i].Type)
+		}
+		finder, err := factory(chain[i], next)
+		if err != nil {
+			return nil, fmt.Errorf("Finder %s: %v", chain[i].Type, err)
+		}
+		next = finder
+	}
+	return next, nil
+}
+
+// FindRoutes will search for routes using the finder chain for the region
+// that the trip starts in
+func (registry *FinderRegistry) FindRoutes(originLat, originLng, destLat, destLng float64,
+	transportType string, arrivalTime time.Time,
+	routeName string) []RouteOption {
+	finder := registry.finderFor(Point{Lat: originLat, Lng: originLng}, transportType)
+	if finder == nil {
+		log.Printf("No finder configured for %f, %f (%s)\n", originLat, originLng, transportType)
+		return []RouteOption{}
+	}
+	return finder.FindRoutes(originLat, originLng, destLat, destLng,
+		transportType, arrivalTime, routeName)
+}
+
+// MismatchReport will return the stop mismatches of every region
+func (registry *FinderRegistry) MismatchReport() []StopMismatch {
+	reports := [][]StopMismatch{}
+	for _, r := range registry.regions {
+		reports = append(reports, FinderMismatchReport(r.finder))
+	}
+	return mergeMismatchReports(reports...)
+}
+
+func (registry *FinderRegistry) finderFor(origin Point, transportType string) RouteFinder {
+	for _, r := range registry.regions {
+		if regionContains(r.config, origin, transportType) {
+			return r.finder
+		}
+	}
+	return nil
+}
+
+func regionContains(config RegionConfig, p Point, transportType string) bool {
+	if len(config.TransportTypes) > 0 {
+		found := false
+		for _, t := range config.TransportTypes {
+			if t == transportType {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if config.Bounds != nil {
+		b := config.Bounds
+		if p.Lat < b.MinLat || p.Lat > b.MaxLat || p.Lng < b.MinLng || p.Lng > b.MaxLng {
+			return false
+		}
+	}
+	if len(config.Polygon) > 0 && !polygonContains(config.Polygon, p) {
+		return false
+	}
+	return true
+}
+
+// polygonContains uses ray casting to check whether the point is inside
+// the polygon
+func polygonContains(polygon []Point, p Point) bool {
+	inside := false
+	j := len(polygon) - 1
+	for i := range polygon {
+		a := polygon[i]
+		b := polygon[j]
+		if (a.Lat > p.Lat) != (b.Lat > p.Lat) &&
+			p.Lng < (b.Lng-a.Lng)*(p.Lat-a.Lat)/(b.Lat-a.Lat)+a.Lng {
+			inside = !inside
+		}
+		j = i
+	}
+	return inside
+}
+
+func newGoogleMapsFinderFromConfig(config ProviderConfig, next RouteFinder) (RouteFinder, error) {
+	var options struct {
+		APIKey string `json:"api_key"`
+	}
+	if err := config.Decode(&options); err != nil {
+		return nil, err
+	}
+	if len(options.APIKey) == 0 {
+		return nil, errors.New("No api key set")
+	}
+	return NewGoogleMapsFinder(options.APIKey), nil
+}
+
+func newCachingFinderFromConfig(config ProviderConfig, next RouteFinder) (RouteFinder, error) {
+	var options struct {
+		TTL string `json:"ttl"`
+	}
+	if err := config.Decode(&options); err != nil {
+		return nil, err
+	}
+	if next == nil {
+		return nil, errors.New("Cache must come before another finder")
+	}
+	ttl, err := time.ParseDuration(options.TTL)
+	if err != nil {
+		return nil, err
+	}
+	return NewCachingFinder(next, ttl), nil
+}
+
+// RealTimeProviderConfig is the config for a real-time data source
+type RealTimeProviderConfig struct {
+	Type string `json:"type"`
+	// the agency names or URLs that this provider has data for
+	Agencies  []string `json:"agencies"`
+	APIKey    string   `json:"api_key"`
+	StopsFile string   `json:"stops_file"`
+	CacheDir  string   `json:"cache_dir"`
+	// the feed URL, used by GTFS-RT providers
+	URL string `json:"url"`
+	// a GTFS routes.txt file used to find route names for GTFS-RT
+	// providers
+	RoutesFile string `json:"routes_file"`
+	// sent with each request, such as an API key for GTFS-RT feeds
+	Headers map[string]string `json:"headers"`
+}
+
+func newRealTimeFinderFromConfig(config ProviderConfig, next RouteFinder) (RouteFinder, error) {
+	var options struct {
+		Providers []RealTimeProviderConfig `json:"providers"`
+	}
+	if err := config.Decode(&options); err != nil {
+		return nil, err
+	}
+	if next == nil {
+		return nil, errors.New("Real-time finder must come before another finder")
+	}
+	finder := NewRealTimeFinder(next)
+	for _, p := range options.Providers {
+		provider, err := newRealTimeAPIFromConfig(p)
+		if err != nil {
+			return nil, err
+		}
+		agencies := p.Agencies
+		if len(agencies) == 0 && p.Type == "nxtbus" {
+			agencies = []string{TransportCanberraName}
+		}
+		for _, agency := range agencies {
+			finder.RegisterProvider(agency, provider)
+		}
+	}
+	return finder, nil
+}
+
+func newRealTimeAPIFromConfig(config RealTimeProviderConfig) (RealTimeAPI, error) {
+	finderTypesMux.Lock()
+	factory, ok := realTimeTypes[config.Type]
+	finderTypesMux.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("Unknown real-time provider %s", config.Type)
+	}
+	return factory(config)
+}
+
+func newNxtBusAPIFromConfig(config RealTimeProviderConfig) (RealTimeAPI, error) {
+	resolver, err := NewStopResolver(config.StopsFile, config.CacheDir)
+	if err != nil {
+		return nil, err
+	}
+	return NewStopPoller(NewNxtBusAPI(config.APIKey, resolver),
+		StopPollInterval, NxtBusRequestsPerSecond), nil
+}
@@ -0,0 +1,112 @@
+package api
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+type NamedFinder struct {
+	name     string
+	requests int
+}
+
+func (f *NamedFinder) FindRoutes(originLat, originLng, destLat,
+	destLng float64, transportType string, arrivalTime time.Time,
+	routeName string) []RouteOption {
+	f.requests++
+	return []RouteOption{NewRouteOption(arrivalTime, arrivalTime, f.name, "")}
+}
+
+func init() {
+	RegisterFinderType("named", func(config ProviderConfig, next RouteFinder) (RouteFinder, error) {
+		var options struct {
+			Name string `json:"name"`
+		}
+		if err := config.Decode(&options); err != nil {
+			return nil, err
+		}
+		return &NamedFinder{name: options.Name}, nil
+	})
+}
+
+const testFinderConfig = `{
+	"regions": [
+		{
+			"name": "canberra",
+			"bounds": {"min_lat": -35.5, "min_lng": 148.9, "max_lat": -35.1, "max_lng": 149.4},
+			"transport_types": ["transit"],
+			"chain": [{"type": "cache", "ttl": "1m"}, {"type": "named", "name": "canberra"}]
+		},
+		{
+			"name": "triangle",
+			"polygon": [{"lat": 0, "lng": 0}, {"lat": 10, "lng": 0}, {"lat": 0, "lng": 10}],
+			"chain": [{"type": "named", "name": "triangle"}]
+		},
+		{
+			"name": "default",
+			"chain": [{"type": "named", "name": "default"}]
+		}
+	]
+}`
+
+func newTestRegistry(t *testing.T) *FinderRegistry {
+	var config FinderConfig
+	if err := json.Unmarshal([]byte(testFinderConfig), &config); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	registry, err := NewFinderRegistry(config)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	return registry
+}
+
+func TestFinderRegistryChoosesRegion(t *testing.T) {
+	registry := newTestRegistry(t)
+	cases := []struct {
+		lat, lng      float64
+		transportType string
+		expected      string
+	}{
+		{-35.28, 149.13, "transit", "canberra"},
+		// the canberra region is only used for transit
+		{-35.28, 149.13, "driving", "default"},
+		{2, 2, "transit", "triangle"},
+		// outside the triangle's diagonal edge
+		{8, 8, "transit", "default"},
+	}
+	for _, c := range cases {
+		routes := registry.FindRoutes(c.lat, c.lng, 0, 0, c.transportType, time.Now(), "")
+		if len(routes) != 1 || routes[0].Name != c.expected {
+			t.Error("Expected", c.expected, "found", routes)
+		}
+	}
+}
+
+func TestFinderRegistryBuildsChainInOrder(t *testing.T) {
+	registry := newTestRegistry(t)
+	cache, ok := registry.regions[0].finder.(*CachingFinder)
+	if !ok {
+		t.Fatal("Expected the cache to be the first finder in the chain")
+	}
+	named := cache.finder.(*NamedFinder)
+	arrival := time.Now()
+	registry.FindRoutes(-35.28, 149.13, 0, 0, "transit", arrival, "")
+	registry.FindRoutes(-35.28, 149.13, 0, 0, "transit", arrival, "")
+	if named.requests != 1 {
+		t.Error("Expected", 1, "request, found", named.requests)
+	}
+}
+
+func TestFinderRegistryUnknownType(t *testing.T) {
+	config := FinderConfig{
+		Regions: []RegionConfig{
+			RegionConfig{Name: "test", Chain: []ProviderConfig{ProviderConfig{Type: "unknown"}}},
+		},
+	}
+	_, err := NewFinderRegistry(config)
+	if err == nil {
+		t.Error("Expected error for unknown finder type")
+	}
+}
@@ -0,0 +1,74 @@
+package api
+
+import (
+	"errors"
+	"sort"
+)
+
+// ReminderKind is the type of message sent for a reminder
+type ReminderKind string
+
+const (
+	// ReminderGetReady is sent ahead of time so that the user can get ready
+	// to leave
+	ReminderGetReady ReminderKind = "get_ready"
+	// ReminderLeaveNow tells the user it's time to leave
+	ReminderLeaveNow ReminderKind = "leave_now"
+	// ReminderLastChance is sent when the user has to leave straight away
+	// to make the service
+	ReminderLastChance ReminderKind = "last_chance"
+)
+
+// Reminder is a single notification sent for each occurrence of a trip
+type Reminder struct {
+	// the reminder is sent this many milliseconds before departure time
+	OffsetMs int64        `json:"offset_ms"`
+	Kind     ReminderKind `json:"kind"`
+}
+
+// IsValidReminderKind returns true if the kind is known
+func IsValidReminderKind(kind ReminderKind) bool {
+	switch kind {
+	case ReminderGetReady, ReminderLeaveNow, ReminderLastChance:
+		return true
+	}
+	return false
+}
+
+// ValidateReminders will return an error if the reminders can't be used.
+// Each kind can only be used once since it's used to track whether the
+// reminder has been sent
+func ValidateReminders(reminders []Reminder) error {
+	kinds := make(map[ReminderKind]bool)
+	for _, r := range reminders {
+		if !IsValidReminderKind(r.Kind) {
+			return errors.New("Unknown reminder kind")
+		}
+		if r.OffsetMs < 0 {
+			return errors.New("Reminder offset cannot be negative")
+		}
+		if kinds[r.Kind] {
+			return errors.New("Each reminder kind can only be used once")
+		}
+		kinds[r.Kind] = true
+	}
+	return nil
+}
+
+// GetReminders returns the trip's reminders in the order they're sent.
+// Trips without reminders are sent a single leave now reminder based on
+// the waiting window
+func GetReminders(trip *TripSchedule) []Reminder {
+	if len(trip.Reminders) == 0 {
+		return []Reminder{
+			{OffsetMs: trip.WaitingWindowMs, Kind: ReminderLeaveNow},
+		}
+	}
+	reminders := make([]Reminder, len(trip.Reminders))
+	copy(reminders, trip.Reminders)
+	// the largest offset is sent first
+	sort.SliceStable(reminders, func(i, j int) bool {
+		return reminders[i].OffsetMs > reminders[j].OffsetMs
+	})
+	return reminders
+}
@@ -0,0 +1,54 @@
+package api
+
+import "testing"
+
+func TestGetRemindersDefaultsToWaitingWindow(t *testing.T) {
+	trip := &TripSchedule{WaitingWindowMs: 5000}
+	reminders := GetReminders(trip)
+	expected := Reminder{OffsetMs: 5000, Kind: ReminderLeaveNow}
+	if len(reminders) != 1 || reminders[0] != expected {
+		t.Error("Expected", expected, "found", reminders)
+	}
+}
+
+func TestGetRemindersOrdersByOffset(t *testing.T) {
+	trip := &TripSchedule{
+		Reminders: []Reminder{
+			{OffsetMs: 0, Kind: ReminderLastChance},
+			{OffsetMs: 600000, Kind: ReminderGetReady},
+			{OffsetMs: 120000, Kind: ReminderLeaveNow},
+		},
+	}
+	reminders := GetReminders(trip)
+	expected := []ReminderKind{ReminderGetReady, ReminderLeaveNow, ReminderLastChance}
+	for i, kind := range expected {
+		if reminders[i].Kind != kind {
+			t.Error("Expected", kind, "found", reminders[i].Kind)
+		}
+	}
+	// the trip's reminders shouldn't be reordered
+	if trip.Reminders[0].Kind != ReminderLastChance {
+		t.Error("Expected", ReminderLastChance, "found", trip.Reminders[0].Kind)
+	}
+}
+
+func TestValidateReminders(t *testing.T) {
+	valid := []Reminder{
+		{OffsetMs: 600000, Kind: ReminderGetReady},
+		{OffsetMs: 0, Kind: ReminderLeaveNow},
+	}
+	if err := ValidateReminders(valid); err != nil {
+		t.Error("Expected no error, found", err)
+	}
+	duplicate := []Reminder{
+		{OffsetMs: 600000, Kind: ReminderLeaveNow},
+		{OffsetMs: 0, Kind: ReminderLeaveNow},
+	}
+	if ValidateReminders(duplicate) == nil {
+		t.Error("Expected error for duplicate reminder kind")
+	}
+	unknown := []Reminder{{OffsetMs: 0, Kind: "soon"}}
+	if ValidateReminders(unknown) == nil {
+		t.Error("Expected error for unknown reminder kind")
+	}
+}
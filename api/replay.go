@@ -0,0 +1,318 @@
+package api
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"googlemaps.github.io/maps"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RecordingFinder is an implementation of RouteFinder that saves every
+// search and its results to a fixture file so that it can be served back
+// later by ReplayFinder
+type RecordingFinder struct {
+	RouteFinder
+	finder RouteFinder
+	dir    string
+	mux    sync.Mutex
+}
+
+// ReplayFinder is an implementation of RouteFinder that serves back searches
+// recorded by RecordingFinder. The recorded routes are shifted in time to
+// match the requested arrival time so that fixtures stay valid
+type ReplayFinder struct {
+	RouteFinder
+	fixtures map[string][]routeFixture
+}
+
+type fixtureRequest struct {
+	OriginLat     float64 `json:"origin_lat"`
+	OriginLng     float64 `json:"origin_lng"`
+	DestLat       float64 `json:"dest_lat"`
+	DestLng       float64 `json:"dest_lng"`
+	TransportType string  `json:"transport_type"`
+	ArrivalTime   int64   `json:"arrival_time"`
+	RouteName     string  `json:"route_name"`
+}
+
+type fixtureStop struct {
+	Name string  `json:"name"`
+	Lat  float64 `json:"lat"`
+	Lng  float64 `json:"lng"`
+}
+
+type fixtureAgency struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+}
+
+// fixtureTransit stores the parts of the transit details that are used by
+// real-time finders
+type fixtureTransit struct {
+	DepartureStop fixtureStop     `json:"departure_stop"`
+	ArrivalStop   fixtureStop     `json:"arrival_stop"`
+	DepartureTime int64           `json:"departure_time"`
+	ArrivalTime   int64           `json:"arrival_time"`
+	Headsign      string          `json:"headsign"`
+	LineName      string          `json:"line_name"`
+	LineShortName string          `json:"line_short_name"`
+	Agencies      []fixtureAgency `json:"agencies"`
+}
+
+type fixtureRoute struct {
+	Route   RouteOption     `json:"route"`
+	Transit *fixtureTransit `json:"transit,omitempty"`
+}
+
+type routeFixture struct {
+	Request    fixtureRequest `json:"request"`
+	Routes     []fixtureRoute `json:"routes"`
+	RecordedAt int64          `json:"recorded_at"`
+}
+
+// NewRecordingFinder will create a RecordingFinder
+// @param finder - the finder to record
+// @param dir - the directory to store fixture files in
+func NewRecordingFinder(finder RouteFinder, dir string) (*RecordingFinder, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &RecordingFinder{finder: finder, dir: dir}, nil
+}
+
+// FindRoutes will search using the recorded finder and save the results
+func (finder *RecordingFinder) FindRoutes(originLat, originLng, destLat, destLng float64,
+	transportType string, arrivalTime time.Time,
+	routeName string) []RouteOption {
+	routes := finder.finder.FindRoutes(originLat, originLng, destLat, destLng,
+		transportType, arrivalTime, routeName)
+	request := fixtureRequest{
+		OriginLat:     originLat,
+		OriginLng:     originLng,
+		DestLat:       destLat,
+		DestLng:       destLng,
+		TransportType: transportType,
+		ArrivalTime:   arrivalTime.UnixNano() / NanosecondsInAMillisecond,
+		RouteName:     routeName,
+	}
+	fixture := routeFixture{
+		Request:    request,
+		Routes:     []fixtureRoute{},
+		RecordedAt: time.Now().UnixNano() / NanosecondsInAMillisecond,
+	}
+	for _, r := range routes {
+		fixture.Routes = append(fixture.Routes, fixtureRoute{
+			Route:   r,
+			Transit: toFixtureTransit(r.transitDetails),
+		})
+	}
+	if err := finder.save(fixture); err != nil {
+		log.Println("Failed to record routes:", err)
+	}
+	return routes
+}
+
+// MismatchReport will return the stop mismatches of the underlying finder
+func (finder *RecordingFinder) MismatchReport() []StopMismatch {
+	return FinderMismatchReport(finder.finder)
+}
+
+func (finder *RecordingFinder) save(fixture routeFixture) error {
+	b, err := json.MarshalIndent(&fixture, "", "  ")
+	if err != nil {
+		return err
+	}
+	finder.mux.Lock()
+	defer finder.mux.Unlock()
+	name := fmt.Sprintf("%s-%d.json", fixtureKey(fixture.Request), fixture.RecordedAt)
+	return ioutil.WriteFile(filepath.Join(finder.dir, name), b, 0644)
+}
+
+// NewReplayFinder will load every fixture in the directory
+func NewReplayFinder(dir string) (*ReplayFinder, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	finder := &ReplayFinder{fixtures: make(map[string][]routeFixture)}
+	for _, f := range files {
+		b, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		var fixture routeFixture
+		if err := json.Unmarshal(b, &fixture); err != nil {
+			return nil, fmt.Errorf("%s: %v", f, err)
+		}
+		key := fixtureKey(fixture.Request)
+		finder.fixtures[key] = append(finder.fixtures[key], fixture)
+	}
+	return finder, nil
+}
+
+// FindRoutes will return the recorded routes for this search. If there are
+// multiple recordings then the one with the closest arrival time of day is
+// used. Every time is shifted by the difference between the requested and
+// recorded arrival times
+func (finder *ReplayFinder) FindRoutes(originLat, originLng, destLat, destLng float64,
+	transportType string, arrivalTime time.Time,
+	routeName string) []RouteOption {
+	key := fixtureKey(fixtureRequest{
+		OriginLat:     originLat,
+		OriginLng:     originLng,
+		DestLat:       destLat,
+		DestLng:       destLng,
+		TransportType: transportType,
+		RouteName:     routeName,
+	})
+	fixture, err := closestFixture(finder.fixtures[key], arrivalTime)
+	if err != nil {
+		log.Println("No recorded routes for", key)
+		return []RouteOption{}
+	}
+	offset := arrivalTime.Sub(UnixTimestampToTime(fixture.Request.ArrivalTime))
+	routes := []RouteOption{}
+	for _, r := range fixture.Routes {
+		route := r.Route
+		route.DepartureTime = UnixTime{route.DepartureTime.Add(offset)}
+		route.ArrivalTime = UnixTime{route.ArrivalTime.Add(offset)}
+		route.transitDetails = fromFixtureTransit(r.Transit, offset)
+		routes = append(routes, route)
+	}
+	return routes
+}
+
+func closestFixture(fixtures []routeFixture, arrivalTime time.Time) (routeFixture, error) {
+	if len(fixtures) == 0 {
+		return routeFixture{}, errors.New("No fixtures")
+	}
+	closest := math.MaxFloat64
+	var choice routeFixture
+	for _, f := range fixtures {
+		recorded := UnixTimestampToTime(f.Request.ArrivalTime).In(arrivalTime.Location())
+		diff := math.Abs(float64(timeOfDay(recorded) - timeOfDay(arrivalTime)))
+		if diff < closest {
+			closest = diff
+			choice = f
+		}
+	}
+	return choice, nil
+}
+
+func timeOfDay(t time.Time) time.Duration {
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute +
+		time.Duration(t.Second())*time.Second
+}
+
+// fixtureKey identifies a search without its arrival time so that it can
+// be replayed on a different day
+func fixtureKey(r fixtureRequest) string {
+	s := fmt.Sprintf("%.4f,%.4f/%.4f,%.4f/%s/%s", r.OriginLat, r.OriginLng,
+		r.DestLat, r.DestLng, r.TransportType, strings.ToLower(r.RouteName))
+	return fmt.Sprintf("%x", sha1.Sum([]byte(s)))
+}
+
+func toFixtureTransit(details *maps.TransitDetails) *fixtureTransit {
+	if details == nil {
+		return nil
+	}
+	agencies := []fixtureAgency{}
+	for _, a := range details.Line.Agencies {
+		if a == nil {
+			continue
+		}
+		agency := fixtureAgency{Name: a.Name}
+		if a.URL != nil {
+			agency.URL = a.URL.String()
+		}
+		agencies = append(agencies, agency)
+	}
+	return &fixtureTransit{
+		DepartureStop: fixtureStop{
+			Name: details.DepartureStop.Name,
+			Lat:  details.DepartureStop.Location.Lat,
+			Lng:  details.DepartureStop.Location.Lng,
+		},
+		ArrivalStop: fixtureStop{
+			Name: details.ArrivalStop.Name,
+			Lat:  details.ArrivalStop.Location.Lat,
+			Lng:  details.ArrivalStop.Location.Lng,
+		},
+		DepartureTime: details.DepartureTime.UnixNano() / NanosecondsInAMillisecond,
+		ArrivalTime:   details.ArrivalTime.UnixNano() / NanosecondsInAMillisecond,
+		Headsign:      details.Headsign,
+		LineName:      details.Line.Name,
+		LineShortName: details.Line.ShortName,
+		Agencies:      agencies,
+	}
+}
+
+func fromFixtureTransit(transit *fixtureTransit, offset time.Duration) *maps.TransitDetails {
+	if transit == nil {
+		return nil
+	}
+	agencies := []*maps.TransitAgency{}
+	for _, a := range transit.Agencies {
+		agency := &maps.TransitAgency{Name: a.Name}
+		if u, err := url.Parse(a.URL); err == nil && len(a.URL) > 0 {
+			agency.URL = u
+		}
+		agencies = append(agencies, agency)
+	}
+	return &maps.TransitDetails{
+		DepartureStop: maps.TransitStop{
+			Name:     transit.DepartureStop.Name,
+			Location: maps.LatLng{Lat: transit.DepartureStop.Lat, Lng: transit.DepartureStop.Lng},
+		},
+		ArrivalStop: maps.TransitStop{
+			Name:     transit.ArrivalStop.Name,
+			Location: maps.LatLng{Lat: transit.ArrivalStop.Lat, Lng: transit.ArrivalStop.Lng},
+		},
+		DepartureTime: UnixTimestampToTime(transit.DepartureTime).Add(offset),
+		ArrivalTime:   UnixTimestampToTime(transit.ArrivalTime).Add(offset),
+		Headsign:      transit.Headsign,
+		Line: maps.TransitLine{
+			Name:      transit.LineName,
+			ShortName: transit.LineShortName,
+			Agencies:  agencies,
+		},
+	}
+}
+
+func init() {
+	RegisterFinderType("record", newRecordingFinderFromConfig)
+	RegisterFinderType("replay", newReplayFinderFromConfig)
+}
+
+func newRecordingFinderFromConfig(config ProviderConfig, next RouteFinder) (RouteFinder, error) {
+	var options struct {
+		Dir string `json:"dir"`
+	}
+	if err := config.Decode(&options); err != nil {
+		return nil, err
+	}
+	if next == nil {
+		return nil, errors.New("Record must come before another finder")
+	}
+	return NewRecordingFinder(next, options.Dir)
+}
+
+func newReplayFinderFromConfig(config ProviderConfig, next RouteFinder) (RouteFinder, error) {
+	var options struct {
+		Dir string `json:"dir"`
+	}
+	if err := config.Decode(&options); err != nil {
+		return nil, err
+	}
+	return NewReplayFinder(options.Dir)
+}
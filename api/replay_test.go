@@ -0,0 +1,99 @@
+package api
+
+import (
+	"googlemaps.github.io/maps"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+type TransitFinder struct {
+	requests int
+}
+
+func (f *TransitFinder) FindRoutes(originLat, originLng, destLat,
+	destLng float64, transportType string, arrivalTime time.Time,
+	routeName string) []RouteOption {
+	f.requests++
+	departure := arrivalTime.Add(-30 * time.Minute)
+	option := NewRouteOption(departure, arrivalTime, "300", "300 from Civic")
+	option.transitDetails = &maps.TransitDetails{
+		DepartureStop: maps.TransitStop{Name: "Civic"},
+		DepartureTime: departure.Add(5 * time.Minute),
+		ArrivalTime:   arrivalTime,
+		Line: maps.TransitLine{
+			ShortName: "300",
+			Agencies:  []*maps.TransitAgency{&maps.TransitAgency{Name: TransportCanberraName}},
+		},
+	}
+	return []RouteOption{option}
+}
+
+func TestReplayFinderShiftsRecordedRoutes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fixtures")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	recorded := &TransitFinder{}
+	recorder, err := NewRecordingFinder(recorded, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	arrival := time.Date(2017, 6, 1, 9, 0, 0, 0, time.UTC)
+	expected := recorder.FindRoutes(-35.2, 149.1, -35.3, 149.2, "transit", arrival, "")
+	if len(expected) != 1 {
+		t.Fatal("Expected", 1, "route, found", len(expected))
+	}
+	replay, err := NewReplayFinder(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a week later and five minutes earlier
+	newArrival := arrival.Add(7*24*time.Hour - 5*time.Minute)
+	routes := replay.FindRoutes(-35.2, 149.1, -35.3, 149.2, "transit", newArrival, "")
+	if len(routes) != 1 {
+		t.Fatal("Expected", 1, "route, found", len(routes))
+	}
+	if !routes[0].ArrivalTime.Equal(newArrival) {
+		t.Error("Expected", newArrival, "found", routes[0].ArrivalTime)
+	}
+	expectedDeparture := newArrival.Add(-30 * time.Minute)
+	if !routes[0].DepartureTime.Equal(expectedDeparture) {
+		t.Error("Expected", expectedDeparture, "found", routes[0].DepartureTime)
+	}
+	if routes[0].Description != expected[0].Description {
+		t.Error("Expected", expected[0].Description, "found", routes[0].Description)
+	}
+	details := routes[0].transitDetails
+	if details == nil {
+		t.Fatal("Expected transit details to be replayed")
+	}
+	expectedDeparture = newArrival.Add(-25 * time.Minute)
+	if !details.DepartureTime.Equal(expectedDeparture) {
+		t.Error("Expected", expectedDeparture, "found", details.DepartureTime)
+	}
+	if details.Line.Agencies[0].Name != TransportCanberraName {
+		t.Error("Expected", TransportCanberraName, "found", details.Line.Agencies[0].Name)
+	}
+	if recorded.requests != 1 {
+		t.Error("Expected", 1, "request, found", recorded.requests)
+	}
+}
+
+func TestReplayFinderUnknownRequest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fixtures")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	replay, err := NewReplayFinder(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes := replay.FindRoutes(-35.2, 149.1, -35.3, 149.2, "transit", time.Now(), "")
+	if len(routes) != 0 {
+		t.Error("Expected", 0, "routes, found", len(routes))
+	}
+}
@@ -1,6 +1,7 @@
 package api
 
 import (
+	"errors"
 	"fmt"
 	"googlemaps.github.io/maps"
 	"strconv"
@@ -11,6 +12,10 @@ import (
 // NanosecondsInAMillisecond is used for conversion
 const NanosecondsInAMillisecond = 1e6
 
+// ScheduleProvider is the provider name used for routes that come from the
+// stored trip schedule rather than a route search
+const ScheduleProvider = "schedule"
+
 // UnixTime is a wrapper around time.Time for the purpose of
 // encoding and decoding JSON into unix timestamp in milliseconds
 type UnixTime struct {
@@ -44,6 +49,19 @@ func (t *UnixTime) MarshalJSON() ([]byte, error) {
 	return []byte(fmt.Sprintf("%d", ts)), nil
 }
 
+// RouteStatus describes whether a route is still running as timetabled
+type RouteStatus string
+
+const (
+	// RouteScheduled is the default status where the service is running
+	RouteScheduled RouteStatus = ""
+	// RouteCancelled is used when the service will no longer run
+	RouteCancelled RouteStatus = "cancelled"
+	// RouteStopSkipped is used when the service is still running but will
+	// no longer pick up passengers at the boarding stop
+	RouteStopSkipped RouteStatus = "stop_skipped"
+)
+
 // RouteOption is a search result found through RouteFinder
 // This is information useful for the user to determine their trip
 type RouteOption struct {
@@ -51,6 +69,15 @@ type RouteOption struct {
 	ArrivalTime   UnixTime `json:"arrival_time"`
 	Name          string   `json:"name"`
 	Description   string   `json:"description"`
+	// this will be set by real-time finders when the service is no longer
+	// running as expected
+	Status RouteStatus `json:"status,omitempty"`
+	// the name of the provider that found this route
+	Provider string `json:"provider,omitempty"`
+	// the time spent walking in milliseconds
+	WalkingTimeMs int64 `json:"walking_time_ms,omitempty"`
+	// used to find this route again in later searches
+	Fingerprint *RouteFingerprint `json:"fingerprint,omitempty"`
 	// optional transit information
 	// This will only be set by GoogleMapsFinder
 	transitDetails *maps.TransitDetails
@@ -63,6 +90,34 @@ type RouteFinder interface {
 		routeName string) []RouteOption
 }
 
+// FallibleRouteFinder is a RouteFinder that can tell a failed search apart
+// from one that found no routes
+type FallibleRouteFinder interface {
+	RouteFinder
+	FindRoutesWithError(originLat, originLng, destLat, destLng float64,
+		transportType string, arrivalTime time.Time,
+		routeName string) ([]RouteOption, error)
+}
+
+// FindRoutesWithError will search using the finder and return an error if
+// the search failed. Finders that can't report errors are treated as
+// failing when an unfiltered search finds nothing, since a search for a
+// single route name can legitimately find no routes
+func FindRoutesWithError(finder RouteFinder, originLat, originLng, destLat, destLng float64,
+	transportType string, arrivalTime time.Time,
+	routeName string) ([]RouteOption, error) {
+	if f, ok := finder.(FallibleRouteFinder); ok {
+		return f.FindRoutesWithError(originLat, originLng, destLat, destLng,
+			transportType, arrivalTime, routeName)
+	}
+	routes := finder.FindRoutes(originLat, originLng, destLat, destLng,
+		transportType, arrivalTime, routeName)
+	if len(routes) == 0 && len(routeName) == 0 {
+		return routes, errors.New("No routes found")
+	}
+	return routes, nil
+}
+
 // NewRouteOption will create a new RouteOption object using the input data
 // @param departureTime - the time that a user will leave
 // @param arrivalTime - time the user will arrive
@@ -0,0 +1,468 @@
+package api
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/oliveroneill/nxtbus-go"
+	"googlemaps.github.io/maps"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MaxStopDistance is the furthest a stop can be from the coordinates given
+// by Google Maps to be considered the same stop
+const MaxStopDistance = 75.0
+
+// MinStopNameSimilarity is how similar two stop names need to be for fuzzy
+// name matching to consider them the same stop, where 1 is identical
+const MinStopNameSimilarity = 0.8
+
+// UnresolvedStopTTL is how long a stop that couldn't be resolved is
+// remembered for. Resolving it again is skipped until then, so that a stop
+// missing from the provider doesn't cause a name lookup on every poll
+const UnresolvedStopTTL = 30 * time.Minute
+
+// stopCacheFile is the file name that resolved stops are stored in
+const stopCacheFile = "stops-cache.json"
+
+// stopMismatchFile is the file name that the mismatch report is stored in
+const stopMismatchFile = "stop-mismatches.json"
+
+const earthRadiusMeters = 6371000.0
+
+// These are the ways a stop can be resolved, they're used in the
+// mismatch report so that operators can see how a stop was found
+const (
+	StopMatchedByLocation = "location"
+	StopMatchedByName     = "fuzzy_name"
+	StopMatchedByAPI      = "api"
+	StopUnresolved        = "unresolved"
+)
+
+// Stop is a transit stop as known by a real-time provider
+type Stop struct {
+	ID   string  `json:"stop_id"`
+	Name string  `json:"name"`
+	Lat  float64 `json:"lat"`
+	Lng  float64 `json:"lng"`
+}
+
+// StopMismatch records a stop from Google Maps whose name didn't exactly
+// match the real-time provider's stop. These are kept so that operators can
+// check that stops are being resolved correctly
+type StopMismatch struct {
+	GoogleName     string  `json:"google_name"`
+	Lat            float64 `json:"lat"`
+	Lng            float64 `json:"lng"`
+	StopID         string  `json:"stop_id"`
+	StopName       string  `json:"stop_name"`
+	Method         string  `json:"method"`
+	DistanceMeters float64 `json:"distance_meters"`
+}
+
+// StopResolver will find the real-time provider's stop ID for a stop given
+// by Google Maps. Stops are found using the nearest coordinates, falling back
+// to fuzzy name matching. Resolved stops are cached in memory and on disk
+type StopResolver struct {
+	stops []Stop
+	// cache stores the resolved stops keyed by stopCacheKey
+	cache      map[string]Stop
+	mismatches map[string]StopMismatch
+	// when each stop that couldn't be resolved last failed, keyed by
+	// stopCacheKey. These are only kept in memory
+	failures map[string]time.Time
+	// how long failures are cached for, if this is zero then they aren't
+	unresolvedTTL time.Duration
+	// directory to store the cache and mismatch report in. If this is
+	// empty then nothing will be written to disk
+	cacheDir string
+	// used when the stop can't be found in the list of stops
+	lookupByName func(name string) (string, error)
+	mux          sync.Mutex
+	// used so that only one write to disk occurs at a time
+	diskMux sync.Mutex
+}
+
+// NewStopResolver will create a StopResolver
+// @param stopsPath - optional path to a GTFS stops.txt file listing every
+// stop for the provider
+// @param cacheDir - optional directory to store resolved stops and the
+// mismatch report in
+func NewStopResolver(stopsPath string, cacheDir string) (*StopResolver, error) {
+	resolver := &StopResolver{
+		cache:         make(map[string]Stop),
+		mismatches:    make(map[string]StopMismatch),
+		failures:      make(map[string]time.Time),
+		unresolvedTTL: UnresolvedStopTTL,
+		cacheDir:      cacheDir,
+		lookupByName:  nxtbus.StopNameToID,
+	}
+	if len(stopsPath) > 0 {
+		f, err := os.Open(stopsPath)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		resolver.stops, err = loadGTFSStops(f)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(cacheDir) > 0 {
+		resolver.loadFromDisk()
+	}
+	return resolver, nil
+}
+
+// StopMismatchReporter is implemented by anything that resolves stops, or
+// wraps something that does, so that the mismatch report can be shown
+type StopMismatchReporter interface {
+	// MismatchReport will return every stop that could not be matched
+	// exactly by name, sorted by the Google Maps stop name
+	MismatchReport() []StopMismatch
+}
+
+// FinderMismatchReport will return the mismatch report for the finder if
+// it implements StopMismatchReporter, otherwise the report is empty
+func FinderMismatchReport(finder interface{}) []StopMismatch {
+	if reporter, ok := finder.(StopMismatchReporter); ok {
+		return reporter.MismatchReport()
+	}
+	return []StopMismatch{}
+}
+
+// mergeMismatchReports will combine the reports, sorted by the Google Maps
+// stop name
+func mergeMismatchReports(reports ...[]StopMismatch) []StopMismatch {
+	merged := []StopMismatch{}
+	for _, r := range reports {
+		merged = append(merged, r...)
+	}
+	sort.SliceStable(merged, func(i, j int) bool {
+		return merged[i].GoogleName < merged[j].GoogleName
+	})
+	return merged
+}
+
+// loadGTFSStops will read stops from a GTFS stops.txt file
+func loadGTFSStops(r io.Reader) ([]Stop, error) {
+	reader := csv.NewReader(r)
+	header, err := reader.Read()
+	if err != nil {
+		return nil, err
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		// some files start with a byte order mark
+		columns[strings.TrimPrefix(strings.TrimSpace(name), "\ufeff")] = i
+	}
+	required := []string{"stop_id", "stop_name", "stop_lat", "stop_lon"}
+	for _, name := range required {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("Stops file is missing column %s", name)
+		}
+	}
+	stops := []Stop{}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		lat, err := strconv.ParseFloat(record[columns["stop_lat"]], 64)
+		if err != nil {
+			continue
+		}
+		lng, err := strconv.ParseFloat(record[columns["stop_lon"]], 64)
+		if err != nil {
+			continue
+		}
+		stops = append(stops, Stop{
+			ID:   record[columns["stop_id"]],
+			Name: record[columns["stop_name"]],
+			Lat:  lat,
+			Lng:  lng,
+		})
+	}
+	return stops, nil
+}
+
+// Resolve will return the provider's stop that matches the input Google Maps
+// stop. Stops that couldn't be resolved aren't tried again until
+// `UnresolvedStopTTL` has passed
+func (r *StopResolver) Resolve(stop maps.TransitStop) (Stop, error) {
+	key := stopCacheKey(stop)
+	now := time.Now()
+	r.mux.Lock()
+	cached, ok := r.cache[key]
+	failed, hasFailed := r.failures[key]
+	r.mux.Unlock()
+	if ok {
+		return cached, nil
+	}
+	if hasFailed && now.Sub(failed) < r.unresolvedTTL {
+		return Stop{}, errors.New("Could not resolve stop " + stop.Name)
+	}
+	resolved, method, distance, err := r.find(stop)
+	if err != nil {
+		r.mux.Lock()
+		if r.failures != nil {
+			r.failures[key] = now
+		}
+		r.mux.Unlock()
+		r.recordMismatch(key, StopMismatch{
+			GoogleName: stop.Name,
+			Lat:        stop.Location.Lat,
+			Lng:        stop.Location.Lng,
+			Method:     StopUnresolved,
+		})
+		return Stop{}, err
+	}
+	if normaliseStopName(resolved.Name) != normaliseStopName(stop.Name) {
+		r.recordMismatch(key, StopMismatch{
+			GoogleName:     stop.Name,
+			Lat:            stop.Location.Lat,
+			Lng:            stop.Location.Lng,
+			StopID:         resolved.ID,
+			StopName:       resolved.Name,
+			Method:         method,
+			DistanceMeters: distance,
+		})
+	}
+	r.mux.Lock()
+	r.cache[key] = resolved
+	delete(r.failures, key)
+	r.mux.Unlock()
+	r.saveToDisk()
+	return resolved, nil
+}
+
+// MismatchReport will return every stop that could not be matched exactly
+// by name, sorted by the Google Maps stop name
+func (r *StopResolver) MismatchReport() []StopMismatch {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	report := []StopMismatch{}
+	for _, m := range r.mismatches {
+		report = append(report, m)
+	}
+	sort.Slice(report, func(i, j int) bool {
+		return report[i].GoogleName < report[j].GoogleName
+	})
+	return report
+}
+
+func (r *StopResolver) find(stop maps.TransitStop) (Stop, string, float64, error) {
+	// first try the closest stop by location
+	var nearest *Stop
+	closest := math.MaxFloat64
+	for i, s := range r.stops {
+		d := distanceInMeters(stop.Location.Lat, stop.Location.Lng, s.Lat, s.Lng)
+		if d < closest {
+			closest = d
+			nearest = &r.stops[i]
+		}
+	}
+	if nearest != nil && closest <= MaxStopDistance {
+		return *nearest, StopMatchedByLocation, closest, nil
+	}
+	// fall back to the most similar name
+	var bestMatch *Stop
+	bestSimilarity := 0.0
+	for i, s := range r.stops {
+		similarity := stopNameSimilarity(stop.Name, s.Name)
+		if similarity > bestSimilarity {
+			bestSimilarity = similarity
+			bestMatch = &r.stops[i]
+		}
+	}
+	if bestMatch != nil && bestSimilarity >= MinStopNameSimilarity {
+		d := distanceInMeters(stop.Location.Lat, stop.Location.Lng, bestMatch.Lat, bestMatch.Lng)
+		return *bestMatch, StopMatchedByName, d, nil
+	}
+	// finally let the provider try to find it by name
+	if r.lookupByName == nil {
+		return Stop{}, "", 0, errors.New("Could not resolve stop")
+	}
+	id, err := r.lookupByName(stop.Name)
+	if err != nil {
+		return Stop{}, "", 0, err
+	}
+	return Stop{ID: id, Name: stop.Name}, StopMatchedByAPI, 0, nil
+}
+
+func (r *StopResolver) recordMismatch(key string, mismatch StopMismatch) {
+	r.mux.Lock()
+	_, exists := r.mismatches[key]
+	r.mismatches[key] = mismatch
+	r.mux.Unlock()
+	if !exists {
+		log.Printf("Stop mismatch: %q matched to %q (%s)\n",
+			mismatch.GoogleName, mismatch.StopName, mismatch.Method)
+		r.saveToDisk()
+	}
+}
+
+func (r *StopResolver) loadFromDisk() {
+	b, err := ioutil.ReadFile(filepath.Join(r.cacheDir, stopCacheFile))
+	if err != nil {
+		return
+	}
+	var stops map[string]Stop
+	if err := json.Unmarshal(b, &stops); err != nil {
+		log.Println("Failed to read stop cache:", err)
+		return
+	}
+	r.mux.Lock()
+	for k, s := range stops {
+		r.cache[k] = s
+	}
+	r.mux.Unlock()
+	b, err = ioutil.ReadFile(filepath.Join(r.cacheDir, stopMismatchFile))
+	if err != nil {
+		return
+	}
+	var report []StopMismatch
+	if err := json.Unmarshal(b, &report); err != nil {
+		log.Println("Failed to read stop mismatch report:", err)
+		return
+	}
+	r.mux.Lock()
+	for _, m := range report {
+		stop := maps.TransitStop{
+			Name:     m.GoogleName,
+			Location: maps.LatLng{Lat: m.Lat, Lng: m.Lng},
+		}
+		r.mismatches[stopCacheKey(stop)] = m
+	}
+	r.mux.Unlock()
+}
+
+func (r *StopResolver) saveToDisk() {
+	if len(r.cacheDir) == 0 {
+		return
+	}
+	r.diskMux.Lock()
+	defer r.diskMux.Unlock()
+	r.mux.Lock()
+	stops, err := json.MarshalIndent(r.cache, "", "  ")
+	r.mux.Unlock()
+	if err != nil {
+		log.Println("Failed to write stop cache:", err)
+		return
+	}
+	report, err := json.MarshalIndent(r.MismatchReport(), "", "  ")
+	if err != nil {
+		log.Println("Failed to write stop mismatch report:", err)
+		return
+	}
+	err = ioutil.WriteFile(filepath.Join(r.cacheDir, stopCacheFile), stops, 0644)
+	if err != nil {
+		log.Println("Failed to write stop cache:", err)
+	}
+	err = ioutil.WriteFile(filepath.Join(r.cacheDir, stopMismatchFile), report, 0644)
+	if err != nil {
+		log.Println("Failed to write stop mismatch report:", err)
+	}
+}
+
+func stopCacheKey(stop maps.TransitStop) string {
+	return fmt.Sprintf("%s@%.5f,%.5f", stop.Name, stop.Location.Lat, stop.Location.Lng)
+}
+
+// distanceInMeters uses the haversine formula to find the distance between
+// two points
+func distanceInMeters(lat1, lng1, lat2, lng2 float64) float64 {
+	toRadians := func(deg float64) float64 { return deg * math.Pi / 180 }
+	dLat := toRadians(lat2 - lat1)
+	dLng := toRadians(lng2 - lng1)
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(toRadians(lat1))*math.Cos(toRadians(lat2))*
+			math.Sin(dLng/2)*math.Sin(dLng/2)
+	return earthRadiusMeters * 2 * math.Atan2(math.Sqrt(a), math.Sqrt(1-a))
+}
+
+// stopNameAbbreviations are expanded so that names such as "Northbourne Av"
+// and "Northbourne Avenue" are treated the same
+var stopNameAbbreviations = map[string]string{
+	"st":   "street",
+	"av":   "avenue",
+	"ave":  "avenue",
+	"rd":   "road",
+	"dr":   "drive",
+	"pl":   "place",
+	"cct":  "circuit",
+	"cres": "crescent",
+	"plt":  "platform",
+	"opp":  "opposite",
+	"stn":  "station",
+	"ic":   "interchange",
+}
+
+func normaliseStopName(name string) string {
+	name = strings.ToLower(name)
+	words := strings.FieldsFunc(name, func(c rune) bool {
+		return !(c >= 'a' && c <= 'z') && !(c >= '0' && c <= '9')
+	})
+	for i, w := range words {
+		if expanded, ok := stopNameAbbreviations[w]; ok {
+			words[i] = expanded
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+// stopNameSimilarity returns how similar two stop names are where 1 means
+// they are the same and 0 means nothing in common
+func stopNameSimilarity(a, b string) float64 {
+	a = normaliseStopName(a)
+	b = normaliseStopName(b)
+	longest := len(a)
+	if len(b) > longest {
+		longest = len(b)
+	}
+	if longest == 0 {
+		return 0
+	}
+	return 1 - float64(levenshtein(a, b))/float64(longest)
+}
+
+func levenshtein(a, b string) int {
+	prev := make([]int, len(b)+1)
+	curr := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		curr[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			curr[j] = minInt(minInt(prev[j]+1, curr[j-1]+1), prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(b)]
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,198 @@
+package api
+
+import (
+	"errors"
+	"googlemaps.github.io/maps"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testStops = `stop_id,stop_code,stop_name,stop_lat,stop_lon
+3412,3412,Northbourne Ave Plt 2,-35.27792,149.12980
+3413,3413,City Interchange Plt 3,-35.27800,149.13100
+5501,5501,Belconnen Community Bus Station Plt 1,-35.23900,149.06500
+`
+
+func newTestStopResolver(t *testing.T, cacheDir string) *StopResolver {
+	stops, err := loadGTFSStops(strings.NewReader(testStops))
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	return &StopResolver{
+		stops:         stops,
+		cache:         make(map[string]Stop),
+		mismatches:    make(map[string]StopMismatch),
+		failures:      make(map[string]time.Time),
+		unresolvedTTL: UnresolvedStopTTL,
+		cacheDir:      cacheDir,
+		lookupByName: func(name string) (string, error) {
+			return "", errors.New("Not found")
+		},
+	}
+}
+
+func TestLoadGTFSStops(t *testing.T) {
+	stops, err := loadGTFSStops(strings.NewReader(testStops))
+	if err != nil {
+		t.Error("Unexpected error", err)
+	}
+	if len(stops) != 3 {
+		t.Fatal("Expected", 3, "found", len(stops))
+	}
+	expected := Stop{ID: "3412", Name: "Northbourne Ave Plt 2", Lat: -35.27792, Lng: 149.12980}
+	if stops[0] != expected {
+		t.Error("Expected", expected, "found", stops[0])
+	}
+}
+
+func TestResolveStopByLocation(t *testing.T) {
+	resolver := newTestStopResolver(t, "")
+	// the name is completely different but the location is very close
+	stop := maps.TransitStop{
+		Name:     "Northbourne Avenue Light Rail",
+		Location: maps.LatLng{Lat: -35.27795, Lng: 149.12985},
+	}
+	result, err := resolver.Resolve(stop)
+	if err != nil {
+		t.Error("Unexpected error", err)
+	}
+	if result.ID != "3412" {
+		t.Error("Expected", "3412", "found", result.ID)
+	}
+	report := resolver.MismatchReport()
+	if len(report) != 1 || report[0].Method != StopMatchedByLocation {
+		t.Error("Expected a location mismatch, found", report)
+	}
+}
+
+func TestResolveStopFallsBackToFuzzyName(t *testing.T) {
+	resolver := newTestStopResolver(t, "")
+	// the location is wrong so we fall back to the name
+	stop := maps.TransitStop{
+		Name:     "Belconnen Community Bus Stn Platform 1",
+		Location: maps.LatLng{Lat: -35.0, Lng: 149.0},
+	}
+	result, err := resolver.Resolve(stop)
+	if err != nil {
+		t.Error("Unexpected error", err)
+	}
+	if result.ID != "5501" {
+		t.Error("Expected", "5501", "found", result.ID)
+	}
+}
+
+func TestResolveStopFailsWhenNothingMatches(t *testing.T) {
+	resolver := newTestStopResolver(t, "")
+	stop := maps.TransitStop{
+		Name:     "Somewhere else entirely",
+		Location: maps.LatLng{Lat: -35.0, Lng: 149.0},
+	}
+	_, err := resolver.Resolve(stop)
+	if err == nil {
+		t.Error("Expected error when stop can't be resolved")
+	}
+	report := resolver.MismatchReport()
+	if len(report) != 1 || report[0].Method != StopUnresolved {
+		t.Error("Expected an unresolved mismatch, found", report)
+	}
+}
+
+func TestUnresolvedStopsAreCached(t *testing.T) {
+	resolver := newTestStopResolver(t, "")
+	lookups := 0
+	resolver.lookupByName = func(name string) (string, error) {
+		lookups++
+		return "", errors.New("Not found")
+	}
+	stop := maps.TransitStop{
+		Name:     "Somewhere else entirely",
+		Location: maps.LatLng{Lat: -35.0, Lng: 149.0},
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := resolver.Resolve(stop); err == nil {
+			t.Error("Expected error when stop can't be resolved")
+		}
+	}
+	if lookups != 1 {
+		t.Error("Expected", 1, "lookup, found", lookups)
+	}
+	// the stop is tried again once the failure expires
+	resolver.unresolvedTTL = time.Millisecond
+	time.Sleep(2 * time.Millisecond)
+	resolver.lookupByName = func(name string) (string, error) {
+		lookups++
+		return "9999", nil
+	}
+	result, err := resolver.Resolve(stop)
+	if err != nil || result.ID != "9999" || lookups != 2 {
+		t.Error("Expected stop to be resolved after the TTL, found", result, err, lookups)
+	}
+}
+
+func TestFinderMismatchReport(t *testing.T) {
+	resolver, err := NewStopResolver("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolver.lookupByName = nil
+	stop := maps.TransitStop{Name: "Nowhere", Location: maps.LatLng{Lat: 1, Lng: 1}}
+	resolver.Resolve(stop)
+	// the report should be found through every finder wrapping the resolver
+	realTime := NewRealTimeFinder(NewMockMapsFinder([]RouteOption{}))
+	poller := NewStopPoller(NewNxtBusAPI("", resolver), StopPollInterval, NxtBusRequestsPerSecond)
+	realTime.RegisterProvider(TransportCanberraName, poller)
+	realTime.RegisterProvider("https://www.transport.act.gov.au", poller)
+	report := FinderMismatchReport(NewCachingFinder(realTime, time.Minute))
+	if len(report) != 1 || report[0].GoogleName != "Nowhere" || report[0].Method != StopUnresolved {
+		t.Error("Expected mismatch to be in the report, found", report)
+	}
+	if report := FinderMismatchReport(NewMockMapsFinder([]RouteOption{})); len(report) != 0 {
+		t.Error("Expected empty report, found", report)
+	}
+}
+
+func TestResolvedStopsAreCachedOnDisk(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stops")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	resolver := newTestStopResolver(t, dir)
+	stop := maps.TransitStop{
+		Name:     "Northbourne Ave Plt 2",
+		Location: maps.LatLng{Lat: -35.27792, Lng: 149.12980},
+	}
+	_, err = resolver.Resolve(stop)
+	if err != nil {
+		t.Error("Unexpected error", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, stopCacheFile)); err != nil {
+		t.Error("Expected stop cache to be written", err)
+	}
+	// a new resolver without any stops should find it in the cache
+	cached, err := NewStopResolver("", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cached.lookupByName = nil
+	result, err := cached.Resolve(stop)
+	if err != nil {
+		t.Error("Unexpected error", err)
+	}
+	if result.ID != "3412" {
+		t.Error("Expected", "3412", "found", result.ID)
+	}
+}
+
+func TestStopNameSimilarity(t *testing.T) {
+	if stopNameSimilarity("Northbourne Ave Plt 2", "Northbourne Avenue Platform 2") != 1 {
+		t.Error("Expected abbreviations to be treated as equal")
+	}
+	if stopNameSimilarity("City Interchange", "Belconnen") >= MinStopNameSimilarity {
+		t.Error("Expected different names to not be similar")
+	}
+}
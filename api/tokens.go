@@ -0,0 +1,30 @@
+package api
+
+// TokenInterface is used to stop sending notifications to device tokens
+// that the push provider has rejected
+type TokenInterface interface {
+	// InvalidateToken will mark the user's token as invalid, unless they
+	// have since registered a different token. The user's trips are paused
+	// until they register again
+	InvalidateToken(userID string, token string, reason string) error
+}
+
+// InvalidateToken will record that the push provider rejected this user's
+// token so that the device is asked to register again
+// @param reason - the provider's error, such as Unregistered
+func InvalidateToken(db TokenInterface, user *UserInfo, reason string) error {
+	return db.InvalidateToken(user.ID, user.NotificationToken, reason)
+}
+
+// IsPaused returns true if the trip shouldn't be watched because its user
+// needs to register a new device token
+func IsPaused(trip *TripSchedule) bool {
+	return trip.User != nil && trip.User.NeedsReregister
+}
+
+// GetUser returns the user with this ID, including whether their device
+// needs to register again
+// @returns nil if the user doesn't exist
+func GetUser(db DatabaseInterface, userID string) (*UserInfo, error) {
+	return db.GetUser(userID)
+}
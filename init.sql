@@ -1,7 +1,42 @@
 CREATE TABLE users (
     user_id            varchar(240) primary key,     -- unique identifier for device
     notification_token varchar(240),                 -- token used for push notification
-    os                 varchar(240)                  -- operating system of device
+    os                 varchar(240),                 -- operating system of device
+    channel            varchar(240),                 -- notifier chosen by the user, empty to choose by operating system
+    token_invalid      bool default false,           -- set when the push provider rejects the token, trips are paused until it changes
+    token_error        varchar(240),                 -- the provider's reason for rejecting the token
+    locale             varchar(240),                 -- language for notifications, such as 'en' or 'fr-CA'
+    paused_until       date                          -- repeating trips won't run before this local date, NULL if not paused
+);
+
+CREATE TABLE devices (
+    id                 SERIAL UNIQUE,
+    token              varchar(240) primary key,     -- a token can only belong to one user
+    user_id            varchar(240) references users(user_id) on delete cascade,
+    os                 varchar(240),                 -- operating system of device
+    channel            varchar(240),                 -- notifier chosen for this device, empty to use the user's
+    invalid            bool default false,           -- set when the push provider rejects the token
+    token_error        varchar(240),                 -- the provider's reason for rejecting the token
+    registered         timestamptz default now()
+);
+
+CREATE TABLE preferences (
+    user_id                varchar(240) primary key references users(user_id) on delete cascade,
+    quiet_hours_start      varchar(5),               -- local time of day such as '22:00'
+    quiet_hours_end        varchar(5),
+    timezone               varchar(240),             -- the timezone that quiet hours are in
+    default_waiting_window bigint,                   -- used for trips scheduled without a waiting window
+    default_transport_type varchar(240),
+    sound                  varchar(240),             -- empty for the default sound or 'none' for silent
+    warnings_enabled       bool default true,        -- cancellation notifications
+    delay_updates_enabled  bool default true
+);
+
+CREATE TABLE holidays (
+    user_id            varchar(240) references users(user_id) on delete cascade,
+    date               date,                         -- local date that repeating trips won't run on
+    name               varchar(240),
+    primary key (user_id, date)
 );
 
 CREATE TABLE trips (
@@ -20,5 +55,104 @@ CREATE TABLE trips (
     waiting_window           int,                    -- the notification should be sent this many milliseconds before departure tim
     repeat_days              bool[],
     enabled                  bool,
-    last_notification_sent   bigint                  -- timestamp that last notification was sent
+    last_notification_sent   bigint,                 -- timestamp that last notification was sent
+    fingerprint              jsonb,                  -- lines and stops used by the route, NULL for older trips
+    arrival_window           bigint,                 -- any service arriving this many milliseconds before arrival can be used
+    ranking                  varchar(240),           -- how services in the arrival window are chosen
+    reminders                jsonb,                  -- offset and kind of each reminder, NULL for a single alert
+    delay_threshold          bigint,                 -- notify when the departure or arrival moves by this many milliseconds, 0 to disable
+    skip_dates               text[]                  -- local dates such as '2017-07-02' that a repeating trip won't run on
+);
+
+-- tell tripwatchers about changes to trips straight away
+CREATE FUNCTION notify_trip_change() RETURNS trigger AS $$
+DECLARE
+    changed_id int;
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        changed_id := OLD.id;
+    ELSE
+        changed_id := NEW.id;
+    END IF;
+    PERFORM pg_notify('trip_changes',
+        json_build_object('trip_id', changed_id::text, 'operation', TG_OP)::text);
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER trip_changes AFTER INSERT OR UPDATE OR DELETE ON trips
+    FOR EACH ROW EXECUTE PROCEDURE notify_trip_change();
+
+CREATE TABLE watcher_instances (
+    instance_id              varchar(240) primary key, -- unique name for each tripwatcher
+    heartbeat                timestamptz               -- the last time the tripwatcher was running
+);
+
+CREATE TABLE trip_leases (
+    trip_id                  int primary key references trips(id) on delete cascade,
+    instance_id              varchar(240),             -- the tripwatcher watching this trip
+    expires                  timestamptz               -- another tripwatcher can take the trip after this
+);
+
+CREATE TABLE notifications (
+    id                       SERIAL UNIQUE,
+    dedupe_key               varchar(240) UNIQUE,      -- trip, occurrence and kind so that each notification is only queued once
+    trip_id                  int,                      -- not a reference since non-repeating trips are deleted once notified
+    user_id                  varchar(240) references users(user_id) on delete cascade,
+    kind                     varchar(240),             -- such as 'leave' or 'cancellation'
+    occurrence               varchar(240),             -- local date of the trip occurrence
+    message                  text,                     -- the message at the time it was queued
+    created                  timestamptz default now(),
+    attempts                 int default 0,
+    next_attempt             timestamptz default now(), -- NULL once delivery has been given up on
+    sent                     timestamptz,
+    last_error               text,
+    expires                  timestamptz,              -- delivery is given up after this, normally the departure time
+    route                    jsonb,                    -- the route the notification is for
+    scheduled                timestamptz,              -- when the notification should have been sent
+    sent_tokens              text[]                    -- tokens of devices that have received it, retries skip these
+);
+
+CREATE TABLE dead_letters (
+    id                       SERIAL UNIQUE,
+    notification_id          int references notifications(id) on delete cascade,
+    dedupe_key               varchar(240),
+    trip_id                  int,
+    user_id                  varchar(240) references users(user_id) on delete cascade,
+    kind                     varchar(240),
+    occurrence               varchar(240),
+    message                  text,
+    attempts                 int,
+    error                    text,                     -- the provider's error from the last attempt
+    created                  timestamptz default now()
+);
+
+CREATE TABLE notification_log (
+    id                       SERIAL UNIQUE,
+    notification_id          int,                      -- not a reference so that the log is kept if the outbox is cleaned up, NULL for suppressed notifications
+    trip_id                  int,
+    user_id                  varchar(240) references users(user_id) on delete cascade,
+    kind                     varchar(240),
+    occurrence               varchar(240),
+    message                  text,
+    route                    jsonb,                    -- a snapshot of the route at the time
+    provider                 varchar(240),             -- the name of the notifier used
+    result                   varchar(240),             -- 'sent', 'failed', 'rejected', 'expired' or 'suppressed'
+    error                    text,
+    attempt                  int,
+    scheduled                timestamptz,              -- when the notification should have been sent
+    attempted                timestamptz default now(),
+    device_id                int                       -- NULL for users without any devices registered
+);
+
+CREATE TABLE trip_history (
+    id                       SERIAL UNIQUE,
+    trip_id                  int,                      -- not a reference so that history is kept for deleted trips
+    user_id                  varchar(240) references users(user_id) on delete cascade,
+    occurrence               varchar(240),             -- local date of the trip occurrence
+    outcome                  varchar(240)              -- 'notified', 'late', 'missed', 'disabled' or 'skipped'
+        CHECK (outcome IN ('notified', 'late', 'missed', 'disabled', 'skipped')),
+    departure_time           bigint,
+    recorded                 bigint,                   -- timestamp that the occurrence was completed
+    UNIQUE (trip_id, occurrence)
 );
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/subtle"
 	"encoding/json"
 	"github.com/oliveroneill/todserver/api"
 	"gopkg.in/alecthomas/kingpin.v2"
@@ -8,12 +9,26 @@ import (
 	"log"
 	"net/http"
 	"strconv"
+	"time"
 )
 
 // TodServer is used for sharing a RouteFinder between requests
 type TodServer struct {
 	finder api.RouteFinder
 	db     api.DatabaseInterface
+	log    api.NotificationLogInterface
+	// used to register each of a user's devices
+	devices api.DeviceInterface
+	// used for each user's notification settings and trip defaults
+	preferences api.PreferencesInterface
+	// used for skip dates, holidays and pausing trips
+	exceptions api.ExceptionInterface
+	// used to authenticate admin requests, admin requests are rejected if
+	// this isn't set
+	adminKey string
+	// the stops that the finder's real-time providers couldn't match
+	// exactly, this is nil if there aren't any real-time providers
+	stops api.StopMismatchReporter
 }
 
 func (s *TodServer) registerUserHandler(w http.ResponseWriter, r *http.Request) {
@@ -35,6 +50,88 @@ func (s *TodServer) registerUserHandler(w http.ResponseWriter, r *http.Request)
 	}
 }
 
+func (s *TodServer) registerDeviceHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Invalid request method.", 405)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Couldn't read body", 500)
+		return
+	}
+	var device api.Device
+	if err := json.Unmarshal(body, &device); err != nil {
+		http.Error(w, "Invalid json body.", 400)
+		return
+	}
+	if len(device.UserID) == 0 || len(device.NotificationToken) == 0 {
+		http.Error(w, "Missing user ID or notification token.", 400)
+		return
+	}
+	if err := api.RegisterDevice(s.devices, &device); err != nil {
+		http.Error(w, "Failed to register device", 500)
+	}
+}
+
+func (s *TodServer) unregisterDeviceHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "DELETE" {
+		http.Error(w, "Invalid request method.", 405)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Couldn't read body", 500)
+		return
+	}
+	var device api.Device
+	if err := json.Unmarshal(body, &device); err != nil {
+		http.Error(w, "Invalid json body.", 400)
+		return
+	}
+	if err := api.UnregisterDevice(s.devices, device.UserID, device.NotificationToken); err != nil {
+		http.Error(w, "Failed to unregister device", 500)
+	}
+}
+
+func (s *TodServer) preferencesHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		userID := r.URL.Query().Get("user_id")
+		if len(userID) == 0 {
+			http.Error(w, "No user ID set", 400)
+			return
+		}
+		preferences, err := api.GetPreferences(s.preferences, userID)
+		if err != nil {
+			http.Error(w, "Couldn't get preferences.", 500)
+			return
+		}
+		json.NewEncoder(w).Encode(preferences)
+	case "POST":
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Couldn't read body", 500)
+			return
+		}
+		// anything not in the request uses the defaults
+		preferences := api.DefaultPreferences("")
+		if err := json.Unmarshal(body, preferences); err != nil {
+			http.Error(w, "Invalid json body.", 400)
+			return
+		}
+		if err := api.ValidatePreferences(preferences); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		if err := api.SetPreferences(s.preferences, preferences); err != nil {
+			http.Error(w, "Couldn't set preferences.", 500)
+		}
+	default:
+		http.Error(w, "Invalid request method.", 405)
+	}
+}
+
 func (s *TodServer) getTripsHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "GET" {
 		http.Error(w, "Invalid request method.", 405)
@@ -48,14 +145,143 @@ func (s *TodServer) getTripsHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(trips)
 }
 
+func (s *TodServer) getTripHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Invalid request method.", 405)
+		return
+	}
+	params := r.URL.Query()
+	history, err := api.GetTripHistory(s.db, params.Get("trip_id"), params.Get("user_id"))
+	if err != nil {
+		http.Error(w, "Couldn't get trip history.", 500)
+		return
+	}
+	json.NewEncoder(w).Encode(history)
+}
+
+func (s *TodServer) getUserStatusHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Invalid request method.", 405)
+		return
+	}
+	user, err := api.GetUser(s.db, r.URL.Query().Get("user_id"))
+	if err != nil {
+		http.Error(w, "Couldn't get user.", 500)
+		return
+	}
+	if user == nil {
+		http.Error(w, "User not found.", 404)
+		return
+	}
+	json.NewEncoder(w).Encode(user)
+}
+
+func (s *TodServer) getNotificationsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Invalid request method.", 405)
+		return
+	}
+	userID := r.URL.Query().Get("user_id")
+	if len(userID) == 0 {
+		http.Error(w, "No user ID set", 400)
+		return
+	}
+	entries, err := api.GetNotifications(s.log, userID)
+	if err != nil {
+		http.Error(w, "Couldn't get notifications.", 500)
+		return
+	}
+	json.NewEncoder(w).Encode(entries)
+}
+
+func (s *TodServer) adminNotificationsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Invalid request method.", 405)
+		return
+	}
+	if !s.isAdmin(r) {
+		http.Error(w, "Unauthorized.", 401)
+		return
+	}
+	params := r.URL.Query()
+	filter := api.NotificationLogFilter{
+		UserID: params.Get("user_id"),
+		TripID: params.Get("trip_id"),
+	}
+	var err error
+	if from := params.Get("from"); len(from) > 0 {
+		filter.From, err = parseTimestamp(from)
+		if err != nil {
+			http.Error(w, "Invalid from time", 400)
+			return
+		}
+	}
+	if to := params.Get("to"); len(to) > 0 {
+		filter.To, err = parseTimestamp(to)
+		if err != nil {
+			http.Error(w, "Invalid to time", 400)
+			return
+		}
+	}
+	if limit := params.Get("limit"); len(limit) > 0 {
+		filter.Limit, err = strconv.Atoi(limit)
+		if err != nil {
+			http.Error(w, "Invalid limit", 400)
+			return
+		}
+	}
+	entries, err := api.QueryNotificationLog(s.log, filter)
+	if err != nil {
+		http.Error(w, "Couldn't get notifications.", 500)
+		return
+	}
+	json.NewEncoder(w).Encode(entries)
+}
+
+func (s *TodServer) adminStopMismatchesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Invalid request method.", 405)
+		return
+	}
+	if !s.isAdmin(r) {
+		http.Error(w, "Unauthorized.", 401)
+		return
+	}
+	report := []api.StopMismatch{}
+	if s.stops != nil {
+		report = s.stops.MismatchReport()
+	}
+	json.NewEncoder(w).Encode(report)
+}
+
+// isAdmin returns true if the request has the admin key as a bearer token
+func (s *TodServer) isAdmin(r *http.Request) bool {
+	if len(s.adminKey) == 0 {
+		return false
+	}
+	expected := "Bearer " + s.adminKey
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(expected)) == 1
+}
+
+// parseTimestamp will convert a unix timestamp in milliseconds to a time
+func parseTimestamp(value string) (time.Time, error) {
+	timestamp, err := strconv.ParseInt(value, 0, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return api.UnixTimestampToTime(timestamp), nil
+}
+
 func (s *TodServer) scheduleTripHandler(w http.ResponseWriter, r *http.Request) {
 	// Check method type
 	if r.Method != "POST" {
 		http.Error(w, "Invalid request method.", 405)
+		return
 	}
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		http.Error(w, "Couldn't read body", 500)
+		return
 	}
 	route := &api.TripSchedule{
 		Enabled: true,
@@ -63,6 +289,15 @@ func (s *TodServer) scheduleTripHandler(w http.ResponseWriter, r *http.Request)
 	err = json.Unmarshal(body, &route)
 	if err != nil {
 		http.Error(w, "Invalid json body.", 400)
+		return
+	}
+	if route.User != nil {
+		preferences, err := api.GetPreferences(s.preferences, route.User.ID)
+		if err != nil {
+			http.Error(w, "Couldn't get preferences.", 500)
+			return
+		}
+		api.ApplyPreferences(route, preferences)
 	}
 	err = api.ScheduleTrip(s.db, route)
 	if err != nil {
@@ -90,6 +325,110 @@ func (s *TodServer) enableDisableTripHandler(w http.ResponseWriter, r *http.Requ
 	}
 }
 
+func (s *TodServer) skipDatesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Invalid request method.", 405)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Couldn't read body", 500)
+		return
+	}
+	var trip api.TripSchedule
+	if err := json.Unmarshal(body, &trip); err != nil || trip.User == nil {
+		http.Error(w, "Invalid json body.", 400)
+		return
+	}
+	if err := api.SetSkipDates(s.exceptions, trip.ID, trip.User.ID, trip.SkipDates); err != nil {
+		http.Error(w, err.Error(), 400)
+	}
+}
+
+func (s *TodServer) skipNextOccurrenceHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Invalid request method.", 405)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Couldn't read body", 500)
+		return
+	}
+	var request api.TripSchedule
+	if err := json.Unmarshal(body, &request); err != nil || request.User == nil {
+		http.Error(w, "Invalid json body.", 400)
+		return
+	}
+	trip, err := api.GetTrip(s.db, request.ID)
+	if err != nil {
+		http.Error(w, "Couldn't get trip.", 500)
+		return
+	}
+	// users can only skip their own trips
+	if trip == nil || trip.User.ID != request.User.ID {
+		http.Error(w, "Trip not found.", 404)
+		return
+	}
+	date, err := api.SkipNextOccurrence(s.exceptions, trip)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"skipped_date": date})
+}
+
+func (s *TodServer) pauseTripsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Invalid request method.", 405)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Couldn't read body", 500)
+		return
+	}
+	var user api.UserInfo
+	if err := json.Unmarshal(body, &user); err != nil {
+		http.Error(w, "Invalid json body.", 400)
+		return
+	}
+	if err := api.PauseTrips(s.exceptions, user.ID, user.PausedUntil); err != nil {
+		http.Error(w, err.Error(), 400)
+	}
+}
+
+func (s *TodServer) holidaysHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.URL.Query().Get("user_id")
+	if len(userID) == 0 {
+		http.Error(w, "No user ID set", 400)
+		return
+	}
+	switch r.Method {
+	case "GET":
+		holidays, err := api.GetHolidays(s.exceptions, userID)
+		if err != nil {
+			http.Error(w, "Couldn't get holidays.", 500)
+			return
+		}
+		json.NewEncoder(w).Encode(holidays)
+	// the body is an iCalendar file
+	case "POST":
+		holidays, err := api.ParseHolidayCalendar(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		if err := api.SetHolidays(s.exceptions, userID, holidays); err != nil {
+			http.Error(w, "Couldn't import holidays.", 500)
+			return
+		}
+		json.NewEncoder(w).Encode(holidays)
+	default:
+		http.Error(w, "Invalid request method.", 405)
+	}
+}
+
 func (s *TodServer) deleteTripHandler(w http.ResponseWriter, r *http.Request) {
 	// Check method type
 	if r.Method != "DELETE" {
@@ -149,27 +488,60 @@ func (s *TodServer) getRoutesHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func main() {
-	mapsKeyArg := kingpin.Arg("googlemapskey", "Google Maps API key for querying routes").Required().String()
+	mapsKeyArg := kingpin.Arg("googlemapskey", "Google Maps API key for querying routes").String()
+	finderConfigArg := kingpin.Flag("finderconfig", "JSON file configuring which route finders are used in each region").String()
 	nxtBusKeyArg := kingpin.Flag("nxtbuskey", "NXTBUS API key for real time data in Canberra").String()
+	nxtBusStopsArg := kingpin.Flag("nxtbusstops", "GTFS stops.txt file used to find NXTBUS stops by location").String()
+	stopCacheArg := kingpin.Flag("stopcache", "Directory to store resolved stops and the stop mismatch report").String()
+	adminKeyArg := kingpin.Flag("adminkey", "Key used to authenticate admin requests, admin requests are disabled if not set").String()
 	kingpin.Parse()
-	mapsAPIKey := *mapsKeyArg
-	if len(mapsAPIKey) == 0 {
-		log.Fatal("No api key set.")
-	}
-	nxtBusAPIKey := *nxtBusKeyArg
-	mapsFinder := api.NewGoogleMapsFinder(mapsAPIKey)
-	var finder api.RouteFinder = mapsFinder
-	if len(nxtBusAPIKey) > 0 {
-		finder = api.NewNxtBusFinder(nxtBusAPIKey, mapsFinder)
+	var finder api.RouteFinder
+	if len(*finderConfigArg) > 0 {
+		registry, err := api.LoadFinderRegistry(*finderConfigArg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		finder = registry
+	} else {
+		mapsAPIKey := *mapsKeyArg
+		if len(mapsAPIKey) == 0 {
+			log.Fatal("No api key set.")
+		}
+		nxtBusAPIKey := *nxtBusKeyArg
+		mapsFinder := api.NewGoogleMapsFinder(mapsAPIKey)
+		finder = mapsFinder
+		if len(nxtBusAPIKey) > 0 {
+			resolver, err := api.NewStopResolver(*nxtBusStopsArg, *stopCacheArg)
+			if err != nil {
+				log.Fatal(err)
+			}
+			finder = api.NewNxtBusFinder(nxtBusAPIKey, mapsFinder, resolver)
+		}
 	}
 	db := api.NewPostgresInterface()
 	defer db.Close()
-	server := &TodServer{finder: finder, db: db}
+	server := &TodServer{finder: finder, db: db, log: db, devices: db, preferences: db,
+		exceptions: db, adminKey: *adminKeyArg}
+	if reporter, ok := finder.(api.StopMismatchReporter); ok {
+		server.stops = reporter
+	}
 	http.HandleFunc("/api/register-user", server.registerUserHandler)
+	http.HandleFunc("/api/register-device", server.registerDeviceHandler)
+	http.HandleFunc("/api/unregister-device", server.unregisterDeviceHandler)
+	http.HandleFunc("/api/preferences", server.preferencesHandler)
 	http.HandleFunc("/api/get-scheduled-trips", server.getTripsHandler)
+	http.HandleFunc("/api/trip-history", server.getTripHistoryHandler)
+	http.HandleFunc("/api/user-status", server.getUserStatusHandler)
+	http.HandleFunc("/api/notifications", server.getNotificationsHandler)
+	http.HandleFunc("/api/admin/notifications", server.adminNotificationsHandler)
+	http.HandleFunc("/api/admin/stop-mismatches", server.adminStopMismatchesHandler)
 	http.HandleFunc("/api/schedule-trip", server.scheduleTripHandler)
 	http.HandleFunc("/api/enable-disable-trip", server.enableDisableTripHandler)
 	http.HandleFunc("/api/delete-trip", server.deleteTripHandler)
+	http.HandleFunc("/api/skip-dates", server.skipDatesHandler)
+	http.HandleFunc("/api/skip-next-occurrence", server.skipNextOccurrenceHandler)
+	http.HandleFunc("/api/pause-trips", server.pauseTripsHandler)
+	http.HandleFunc("/api/holidays", server.holidaysHandler)
 	http.HandleFunc("/api/get-routes", server.getRoutesHandler)
 	log.Fatal(http.ListenAndServe(":80", nil))
 }
@@ -0,0 +1,2 @@
+-- lines and stops used by each trip's route, NULL for older trips
+ALTER TABLE trips ADD COLUMN IF NOT EXISTS fingerprint jsonb;
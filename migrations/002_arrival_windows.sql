@@ -0,0 +1,3 @@
+-- services arriving within the window can be chosen
+ALTER TABLE trips ADD COLUMN IF NOT EXISTS arrival_window bigint;
+ALTER TABLE trips ADD COLUMN IF NOT EXISTS ranking varchar(240);
@@ -0,0 +1,11 @@
+-- tripwatchers share trips using leases
+CREATE TABLE IF NOT EXISTS watcher_instances (
+    instance_id              varchar(240) primary key,
+    heartbeat                timestamptz
+);
+
+CREATE TABLE IF NOT EXISTS trip_leases (
+    trip_id                  int primary key references trips(id) on delete cascade,
+    instance_id              varchar(240),
+    expires                  timestamptz
+);
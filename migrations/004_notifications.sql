@@ -0,0 +1,15 @@
+-- notifications are queued in an outbox before they're delivered
+CREATE TABLE IF NOT EXISTS notifications (
+    id                       SERIAL UNIQUE,
+    dedupe_key               varchar(240) UNIQUE,
+    trip_id                  int,
+    user_id                  varchar(240) references users(user_id) on delete cascade,
+    kind                     varchar(240),
+    occurrence               varchar(240),
+    message                  text,
+    created                  timestamptz default now(),
+    attempts                 int default 0,
+    next_attempt             timestamptz default now(),
+    sent                     timestamptz,
+    last_error               text
+);
@@ -0,0 +1,18 @@
+-- the outcome of each trip occurrence, used to recover missed alerts
+CREATE TABLE IF NOT EXISTS trip_history (
+    id                       SERIAL UNIQUE,
+    trip_id                  int,
+    user_id                  varchar(240) references users(user_id) on delete cascade,
+    occurrence               varchar(240),
+    outcome                  varchar(240),
+    departure_time           bigint,
+    recorded                 bigint
+);
+
+-- occurrences could be recorded twice before this index existed, keep the
+-- first of each
+DELETE FROM trip_history a USING trip_history b
+    WHERE a.trip_id = b.trip_id AND a.occurrence = b.occurrence AND a.id > b.id;
+-- same name as the constraint created by init.sql so that it isn't added twice
+CREATE UNIQUE INDEX IF NOT EXISTS trip_history_trip_id_occurrence_key
+    ON trip_history (trip_id, occurrence);
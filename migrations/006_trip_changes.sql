@@ -0,0 +1,19 @@
+-- tell tripwatchers about changes to trips straight away
+CREATE OR REPLACE FUNCTION notify_trip_change() RETURNS trigger AS $$
+DECLARE
+    changed_id int;
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        changed_id := OLD.id;
+    ELSE
+        changed_id := NEW.id;
+    END IF;
+    PERFORM pg_notify('trip_changes',
+        json_build_object('trip_id', changed_id::text, 'operation', TG_OP)::text);
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS trip_changes ON trips;
+CREATE TRIGGER trip_changes AFTER INSERT OR UPDATE OR DELETE ON trips
+    FOR EACH ROW EXECUTE PROCEDURE notify_trip_change();
@@ -0,0 +1,2 @@
+-- offset and kind of each reminder, NULL for a single alert
+ALTER TABLE trips ADD COLUMN IF NOT EXISTS reminders jsonb;
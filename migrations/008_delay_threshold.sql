@@ -0,0 +1,2 @@
+-- notify when the departure or arrival moves by this many milliseconds
+ALTER TABLE trips ADD COLUMN IF NOT EXISTS delay_threshold bigint;
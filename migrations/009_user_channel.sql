@@ -0,0 +1,2 @@
+-- notifier chosen by the user, empty to choose by operating system
+ALTER TABLE users ADD COLUMN IF NOT EXISTS channel varchar(240);
@@ -0,0 +1,17 @@
+-- deliveries are retried until they expire and then dead-lettered
+ALTER TABLE notifications ADD COLUMN IF NOT EXISTS expires timestamptz;
+ALTER TABLE notifications ADD COLUMN IF NOT EXISTS sent_tokens text[];
+
+CREATE TABLE IF NOT EXISTS dead_letters (
+    id                       SERIAL UNIQUE,
+    notification_id          int references notifications(id) on delete cascade,
+    dedupe_key               varchar(240),
+    trip_id                  int,
+    user_id                  varchar(240) references users(user_id) on delete cascade,
+    kind                     varchar(240),
+    occurrence               varchar(240),
+    message                  text,
+    attempts                 int,
+    error                    text,
+    created                  timestamptz default now()
+);
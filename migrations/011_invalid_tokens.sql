@@ -0,0 +1,3 @@
+-- tokens rejected by push providers pause the user's trips
+ALTER TABLE users ADD COLUMN IF NOT EXISTS token_invalid bool default false;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS token_error varchar(240);
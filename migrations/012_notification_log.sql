@@ -0,0 +1,20 @@
+-- every delivery attempt is recorded in the notification log
+ALTER TABLE notifications ADD COLUMN IF NOT EXISTS route jsonb;
+ALTER TABLE notifications ADD COLUMN IF NOT EXISTS scheduled timestamptz;
+
+CREATE TABLE IF NOT EXISTS notification_log (
+    id                       SERIAL UNIQUE,
+    notification_id          int,
+    trip_id                  int,
+    user_id                  varchar(240) references users(user_id) on delete cascade,
+    kind                     varchar(240),
+    occurrence               varchar(240),
+    message                  text,
+    route                    jsonb,
+    provider                 varchar(240),
+    result                   varchar(240),
+    error                    text,
+    attempt                  int,
+    scheduled                timestamptz,
+    attempted                timestamptz default now()
+);
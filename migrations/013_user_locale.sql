@@ -0,0 +1,2 @@
+-- language for notifications, such as 'en' or 'fr-CA'
+ALTER TABLE users ADD COLUMN IF NOT EXISTS locale varchar(240);
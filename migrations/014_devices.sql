@@ -0,0 +1,18 @@
+-- users can register more than one device
+CREATE TABLE IF NOT EXISTS devices (
+    id                 SERIAL UNIQUE,
+    token              varchar(240) primary key,
+    user_id            varchar(240) references users(user_id) on delete cascade,
+    os                 varchar(240),
+    channel            varchar(240),
+    invalid            bool default false,
+    token_error        varchar(240),
+    registered         timestamptz default now()
+);
+
+ALTER TABLE notification_log ADD COLUMN IF NOT EXISTS device_id int;
+
+-- copy each user's existing token into the devices table
+INSERT INTO devices (token, user_id, os, channel, invalid, token_error)
+SELECT notification_token, user_id, os, channel, token_invalid, token_error
+FROM users WHERE notification_token <> '' ON CONFLICT DO NOTHING;
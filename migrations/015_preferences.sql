@@ -0,0 +1,12 @@
+-- per-user notification preferences
+CREATE TABLE IF NOT EXISTS preferences (
+    user_id                varchar(240) primary key references users(user_id) on delete cascade,
+    quiet_hours_start      varchar(5),
+    quiet_hours_end        varchar(5),
+    timezone               varchar(240),
+    default_waiting_window bigint,
+    default_transport_type varchar(240),
+    sound                  varchar(240),
+    warnings_enabled       bool default true,
+    delay_updates_enabled  bool default true
+);
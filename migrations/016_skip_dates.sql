@@ -0,0 +1,20 @@
+-- repeating trips can be skipped on some dates or paused
+ALTER TABLE users ADD COLUMN IF NOT EXISTS paused_until date;
+ALTER TABLE trips ADD COLUMN IF NOT EXISTS skip_dates text[];
+
+CREATE TABLE IF NOT EXISTS holidays (
+    user_id            varchar(240) references users(user_id) on delete cascade,
+    date               date,
+    name               varchar(240),
+    primary key (user_id, date)
+);
+
+-- same name as the constraint created by init.sql so that it isn't added twice
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'trip_history_outcome_check') THEN
+        ALTER TABLE trip_history ADD CONSTRAINT trip_history_outcome_check
+            CHECK (outcome IN ('notified', 'late', 'missed', 'disabled', 'skipped'));
+    END IF;
+END
+$$;
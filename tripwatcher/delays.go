@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"github.com/oliveroneill/todserver/api"
+	"sync"
+	"time"
+)
+
+// delayConfirmations is the number of checks in a row that must show the
+// change before the user is notified, so that a single jittery estimate
+// doesn't cause a notification
+const delayConfirmations = 2
+
+// minDelayAlertInterval is the least amount of time between delay
+// notifications for a trip
+const minDelayAlertInterval = 5 * time.Minute
+
+// maxDelayAlerts is the most delay notifications sent for each occurrence
+// of a trip
+const maxDelayAlerts = 3
+
+// delayStateExpiry is how long a trip's state is kept after it was last
+// checked
+const delayStateExpiry = 24 * time.Hour
+
+// DelayTracker notifies users that have opted in when their departure or
+// arrival time changes between checks
+type DelayTracker struct {
+	queue    func(notification *api.Notification)
+	messages *MessageTemplates
+	trips    map[string]*delayState
+	// the last time that expired states were removed
+	pruned time.Time
+	mux    sync.Mutex
+}
+
+// delayState is what the user has been told for a single trip occurrence
+type delayState struct {
+	occurrence string
+	// the times the route was scheduled for
+	scheduledDeparture time.Time
+	// the times that the user was last told about
+	departure time.Time
+	arrival   time.Time
+	// the number of checks in a row that have moved past the threshold
+	confirmations int
+	alerts        int
+	lastAlert     time.Time
+	lastSeen      time.Time
+}
+
+// NewDelayTracker will create a DelayTracker
+// @param queue - used to send delay notifications
+// @param messages - used to create the notification text
+func NewDelayTracker(queue func(notification *api.Notification), messages *MessageTemplates) *DelayTracker {
+	return &DelayTracker{
+		queue:    queue,
+		messages: messages,
+		trips:    make(map[string]*delayState),
+	}
+}
+
+// Observe should be called with each new route found for a trip. This is
+// used as a `RouteFunc` for the `Scheduler`
+func (d *DelayTracker) Observe(trip *api.TripSchedule, route *api.RouteOption) {
+	if notification := d.observe(trip, route, time.Now()); notification != nil {
+		d.queue(notification)
+	}
+}
+
+// observe will compare the route to the times the user was last told about
+// @returns a notification if the user should be told about the change
+func (d *DelayTracker) observe(trip *api.TripSchedule, route *api.RouteOption, now time.Time) *api.Notification {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	d.prune(now)
+	if trip.DelayThresholdMs <= 0 || !trip.Enabled {
+		delete(d.trips, trip.ID)
+		return nil
+	}
+	occurrence := api.GetOccurrence(trip)
+	state, ok := d.trips[trip.ID]
+	if !ok || state.occurrence != occurrence {
+		// the route the user scheduled is used as the starting point
+		scheduled := updateRouteDates(trip.Route, api.GetDepartureTime(trip))
+		state = &delayState{
+			occurrence:         occurrence,
+			scheduledDeparture: scheduled.DepartureTime.Time,
+			departure:          scheduled.DepartureTime.Time,
+			arrival:            scheduled.ArrivalTime.Time,
+		}
+		d.trips[trip.ID] = state
+	}
+	state.lastSeen = now
+	threshold := time.Duration(trip.DelayThresholdMs) * time.Millisecond
+	if !hasShifted(state.departure, route.DepartureTime.Time, threshold) &&
+		!hasShifted(state.arrival, route.ArrivalTime.Time, threshold) {
+		state.confirmations = 0
+		return nil
+	}
+	state.confirmations++
+	if state.confirmations < delayConfirmations {
+		return nil
+	}
+	// keep waiting so that the latest change is sent once the limit is up
+	if state.alerts >= maxDelayAlerts || now.Sub(state.lastAlert) < minDelayAlertInterval {
+		return nil
+	}
+	state.departure = route.DepartureTime.Time
+	state.arrival = route.ArrivalTime.Time
+	state.confirmations = 0
+	state.alerts++
+	state.lastAlert = now
+	message := d.messages.delayMessage(trip, route, state.scheduledDeparture)
+	// the new departure is used so that the same change isn't sent twice
+	detail := fmt.Sprintf("%d", route.DepartureTime.Unix())
+	return routeNotification(trip, route, api.DelayNotification, message, detail)
+}
+
+// prune will remove trips that haven't been checked recently, such as ones
+// that have been deleted
+func (d *DelayTracker) prune(now time.Time) {
+	if now.Sub(d.pruned) < time.Hour {
+		return
+	}
+	d.pruned = now
+	for id, state := range d.trips {
+		if now.Sub(state.lastSeen) > delayStateExpiry {
+			delete(d.trips, id)
+		}
+	}
+}
+
+// hasShifted returns true if the time has moved by more than the threshold
+func hasShifted(previous time.Time, current time.Time, threshold time.Duration) bool {
+	shift := current.Sub(previous)
+	if shift < 0 {
+		shift = -shift
+	}
+	return shift > threshold
+}
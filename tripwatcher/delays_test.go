@@ -0,0 +1,96 @@
+package main
+
+import (
+	"github.com/oliveroneill/todserver/api"
+	"strings"
+	"testing"
+	"time"
+)
+
+func delayTrip(departure time.Time) *api.TripSchedule {
+	trip := testTrip(departure)
+	trip.Enabled = true
+	trip.DelayThresholdMs = 5 * 60 * 1000
+	trip.Route.Name = "300"
+	trip.Route.ArrivalTime = api.UnixTime{departure.Add(30 * time.Minute)}
+	return trip
+}
+
+func shiftedRoute(trip *api.TripSchedule, shift time.Duration) *api.RouteOption {
+	return &api.RouteOption{
+		Name:          trip.Route.Name,
+		DepartureTime: api.UnixTime{trip.Route.DepartureTime.Add(shift)},
+		ArrivalTime:   api.UnixTime{trip.Route.ArrivalTime.Add(shift)},
+	}
+}
+
+func TestDelayTrackerIgnoresTripsThatHaventOptedIn(t *testing.T) {
+	now := time.Now()
+	trip := delayTrip(now.Add(time.Hour))
+	trip.DelayThresholdMs = 0
+	tracker := NewDelayTracker(nil, DefaultMessageTemplates())
+	route := shiftedRoute(trip, 20*time.Minute)
+	for i := 0; i < delayConfirmations+1; i++ {
+		if n := tracker.observe(trip, route, now); n != nil {
+			t.Error("Expected no notification, found", n.Message)
+		}
+	}
+}
+
+func TestDelayTrackerWaitsForConfirmation(t *testing.T) {
+	now := time.Now()
+	trip := delayTrip(now.Add(time.Hour))
+	tracker := NewDelayTracker(nil, DefaultMessageTemplates())
+	late := shiftedRoute(trip, 10*time.Minute)
+	if n := tracker.observe(trip, late, now); n != nil {
+		t.Error("Expected no notification after a single check, found", n.Message)
+	}
+	// the estimate going back to normal should reset the count
+	if n := tracker.observe(trip, shiftedRoute(trip, 0), now); n != nil {
+		t.Error("Expected no notification, found", n.Message)
+	}
+	if n := tracker.observe(trip, late, now); n != nil {
+		t.Error("Expected no notification after a single check, found", n.Message)
+	}
+	n := tracker.observe(trip, late, now)
+	if n == nil {
+		t.Fatal("Expected notification once the delay was confirmed")
+	}
+	if n.Kind != api.DelayNotification {
+		t.Error("Expected", api.DelayNotification, "found", n.Kind)
+	}
+	expected := "Your 300 service is running 10 minutes late"
+	if !strings.HasPrefix(n.Message, expected) {
+		t.Error("Expected", expected, "found", n.Message)
+	}
+	// the user already knows about this delay
+	if n := tracker.observe(trip, late, now); n != nil {
+		t.Error("Expected no notification, found", n.Message)
+	}
+}
+
+func TestDelayTrackerIsRateLimited(t *testing.T) {
+	now := time.Now()
+	trip := delayTrip(now.Add(time.Hour))
+	tracker := NewDelayTracker(nil, DefaultMessageTemplates())
+	first := shiftedRoute(trip, 10*time.Minute)
+	tracker.observe(trip, first, now)
+	firstNotification := tracker.observe(trip, first, now)
+	if firstNotification == nil {
+		t.Fatal("Expected first notification")
+	}
+	second := shiftedRoute(trip, 20*time.Minute)
+	later := now.Add(time.Minute)
+	tracker.observe(trip, second, later)
+	if n := tracker.observe(trip, second, later); n != nil {
+		t.Error("Expected notification to be rate limited, found", n.Message)
+	}
+	later = now.Add(minDelayAlertInterval)
+	n := tracker.observe(trip, second, later)
+	if n == nil {
+		t.Fatal("Expected notification once the interval had passed")
+	}
+	if n.DedupeKey == firstNotification.DedupeKey {
+		t.Error("Expected each change to have its own key, found", n.DedupeKey)
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/oliveroneill/todserver/api"
+	"time"
+)
+
+// dispatchFrequency is how often the outbox is checked for notifications
+// that weren't delivered straight away
+const dispatchFrequency = 5 * time.Second
+
+// dispatchBatchSize is the number of notifications claimed at once. This is
+// kept small since the rest of the batch waits while each one is delivered
+const dispatchBatchSize = 10
+
+// deliveryLease is how long a claimed notification is hidden from other
+// dispatchers while it's being delivered. The lease is renewed before
+// sending to each device, so this only needs to cover a single send
+// including any fallbacks
+const deliveryLease = 2 * time.Minute
+
+// initialRetryDelay is how long to wait before retrying a failed delivery
+// the first time. This doubles after each failed attempt
+const initialRetryDelay = 5 * time.Second
+
+// maxRetryDelay is the longest time to wait between delivery attempts
+const maxRetryDelay = 5 * time.Minute
+
+// maxDeliveryAttempts is the number of times delivery is tried before
+// giving up
+const maxDeliveryAttempts = 10
+
+// Dispatcher delivers notifications from the outbox. Each device is only
+// marked as sent once delivery to it succeeds, so it will be retried after a
+// crash or restart. A crash between sending and marking the device will send
+// it again, so the notification's dedupe key is used as the APNS collapse ID
+// and FCM collapse key, which replace the earlier alert instead of showing a
+// second one. FCM only collapses messages that are still waiting for the
+// device, so an Android device that was online can still see a duplicate
+type Dispatcher struct {
+	outbox   api.OutboxInterface
+	devices  api.DeviceInterface
+	log      api.NotificationLogInterface
+	notifier Notifier
+	wake     chan struct{}
+	quit     chan struct{}
+}
+
+// NewDispatcher will create a Dispatcher
+// @param outbox - where notifications are stored
+// @param devices - used to find each user's devices and record tokens that
+// the push provider rejects
+// @param log - used to record every delivery attempt
+// @param notifier - used to deliver each notification
+func NewDispatcher(outbox api.OutboxInterface, devices api.DeviceInterface, log api.NotificationLogInterface, notifier Notifier) *Dispatcher {
+	return &Dispatcher{
+		outbox:   outbox,
+		devices:  devices,
+		log:      log,
+		notifier: notifier,
+		wake:     make(chan struct{}, 1),
+		quit:     make(chan struct{}),
+	}
+}
+
+// Start will begin delivering notifications in the background
+func (d *Dispatcher) Start() {
+	go d.run()
+}
+
+// Stop will stop delivering notifications
+func (d *Dispatcher) Stop() {
+	close(d.quit)
+}
+
+// Wake will check the outbox straight away. This should be called after
+// queueing a notification so that it isn't delayed
+func (d *Dispatcher) Wake() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (d *Dispatcher) run() {
+	ticker := time.NewTicker(dispatchFrequency)
+	defer ticker.Stop()
+	for {
+		// keep going until the outbox is empty
+		for {
+			if d.dispatch() < dispatchBatchSize {
+				break
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-d.wake:
+		case <-d.quit:
+			return
+		}
+	}
+}
+
+// dispatch will deliver a batch of notifications
+// @returns the number of notifications claimed
+func (d *Dispatcher) dispatch() int {
+	notifications, err := d.outbox.ClaimNotifications(dispatchBatchSize, deliveryLease)
+	if err != nil {
+		fmt.Println(err)
+		return 0
+	}
+	for _, n := range notifications {
+		d.deliver(n)
+	}
+	return len(notifications)
+}
+
+func (d *Dispatcher) deliver(n *api.Notification) {
+	now := time.Now()
+	// there's no point telling the user to leave once the service has gone
+	if hasExpired(n, now) {
+		fmt.Println("Not delivering notification", n.DedupeKey, "since it has expired")
+		err := errors.New("Notification expired before it could be delivered")
+		d.logDelivery(n, api.Device{}, "", api.DeliveryExpired, err, now)
+		d.fail(n, err.Error(), false, now)
+		return
+	}
+	devices, err := api.GetActiveDevices(d.devices, n.User)
+	if err != nil {
+		fmt.Println("Failed to get devices for", n.DedupeKey, err)
+		d.retry(n, err, now)
+		return
+	}
+	if len(devices) == 0 && len(n.SentTokens) == 0 {
+		err := errors.New("User has no devices with a working token")
+		d.logDelivery(n, api.Device{}, "", api.DeliveryRejected, err, now)
+		d.fail(n, err.Error(), false, now)
+		return
+	}
+	sent := make(map[string]bool)
+	for _, token := range n.SentTokens {
+		sent[token] = true
+	}
+	delivered := len(sent) > 0
+	var failed error
+	var rejected error
+	for _, device := range devices {
+		// devices that received an earlier attempt aren't sent it again
+		if sent[device.NotificationToken] {
+			continue
+		}
+		// stop if another dispatcher has taken over the notification
+		if !d.renewLease(n) {
+			return
+		}
+		user := api.DeviceUser(n.User, device)
+		provider, err := d.notify(n, user)
+		if invalid, ok := err.(*InvalidTokenError); ok {
+			d.invalidateToken(user, invalid)
+			// retrying won't help since the token will never work again
+			if !invalid.Delivered {
+				d.logDelivery(n, device, provider, api.DeliveryRejected, err, now)
+				rejected = err
+				continue
+			}
+			err = nil
+		}
+		if err != nil {
+			fmt.Println("Failed to deliver notification", n.DedupeKey, err)
+			d.logDelivery(n, device, provider, api.DeliveryFailed, err, now)
+			failed = err
+			continue
+		}
+		d.logDelivery(n, device, provider, api.DeliverySent, nil, now)
+		if err := d.outbox.MarkDeviceSent(n.ID, device.NotificationToken); err != nil {
+			fmt.Println("Failed to mark", n.DedupeKey, "as sent to device", err)
+		}
+		delivered = true
+	}
+	switch {
+	// retries skip the devices that have already received it
+	case failed != nil:
+		d.retry(n, failed, now)
+	// rejected devices will never work so they aren't waited for
+	case delivered:
+		if err := d.outbox.MarkNotificationSent(n.ID); err != nil {
+			fmt.Println(err)
+		}
+	default:
+		d.fail(n, rejected.Error(), false, now)
+	}
+}
+
+// renewLease will extend the notification's lease so that no other
+// dispatcher claims it while it's being delivered
+// @returns false if the lease has been lost
+func (d *Dispatcher) renewLease(n *api.Notification) bool {
+	renewed, err := d.outbox.RenewNotificationLease(n.ID, n.Attempts, deliveryLease)
+	if err != nil {
+		// sending anyway could deliver the notification twice
+		fmt.Println("Failed to renew lease for", n.DedupeKey, err)
+		return false
+	}
+	if !renewed {
+		fmt.Println("Lost lease for", n.DedupeKey)
+	}
+	return renewed
+}
+
+// retry will try delivering the notification again later unless it has
+// been tried too many times or would arrive after departure
+func (d *Dispatcher) retry(n *api.Notification, err error, now time.Time) {
+	retryAt := now.Add(retryDelay(n.Attempts))
+	retry := n.Attempts < maxDeliveryAttempts && !hasExpired(n, retryAt)
+	d.fail(n, err.Error(), retry, retryAt)
+}
+
+// notify will send the notification to a single device
+// @param user - the user with the device's token
+// @returns the name of the notifier used if it's known
+func (d *Dispatcher) notify(n *api.Notification, user *api.UserInfo) (string, error) {
+	data := api.NotificationData(n)
+	if notifier, ok := d.notifier.(ProviderNotifier); ok {
+		return notifier.NotifyVia(n.Message, data, user)
+	}
+	return "", d.notifier.Notify(n.Message, data, user)
+}
+
+// logDelivery will record the attempt in the notification log. Failing to
+// log doesn't stop the notification from being delivered
+// @param device - the device the notification was sent to, this is empty if
+// it wasn't sent
+func (d *Dispatcher) logDelivery(n *api.Notification, device api.Device, provider string, result api.DeliveryResult, err error, attempted time.Time) {
+	entry := api.NewNotificationLogEntry(n, provider, result, err, attempted)
+	entry.DeviceID = device.ID
+	if err := api.LogDelivery(d.log, entry); err != nil {
+		fmt.Println("Failed to log delivery of", n.DedupeKey, err)
+	}
+}
+
+// invalidateToken will stop notifications being sent to the device. The
+// user's trips are paused once none of their devices have a working token
+// @param user - the user with the rejected device's token
+func (d *Dispatcher) invalidateToken(user *api.UserInfo, invalid *InvalidTokenError) {
+	if user.NeedsReregister {
+		return
+	}
+	fmt.Println("Push provider rejected token for", user.ID, invalid.Reason)
+	if err := api.InvalidateToken(d.devices, user, invalid.Reason); err != nil {
+		fmt.Println(err)
+	}
+}
+
+func (d *Dispatcher) fail(n *api.Notification, reason string, retry bool, retryAt time.Time) {
+	if err := d.outbox.MarkNotificationFailed(n.ID, reason, retry, retryAt); err != nil {
+		fmt.Println(err)
+	}
+}
+
+// hasExpired returns true if the notification shouldn't be delivered at
+// this time
+func hasExpired(n *api.Notification, t time.Time) bool {
+	return !n.Expires.IsZero() && t.After(n.Expires)
+}
+
+// retryDelay returns how long to wait before the next attempt, doubling
+// after each failure
+// @param attempts - the number of attempts made so far
+func retryDelay(attempts int) time.Duration {
+	delay := initialRetryDelay
+	for i := 1; i < attempts && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryDelay {
+		return maxRetryDelay
+	}
+	return delay
+}
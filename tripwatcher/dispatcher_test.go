@@ -0,0 +1,737 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/oliveroneill/todserver/api"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// MockDatabase is an in-memory outbox. Other database methods aren't
+// implemented and will panic if used
+type MockDatabase struct {
+	api.DatabaseInterface
+	enabled       bool
+	notifications []*api.Notification
+	sent          map[string]bool
+	failed        map[string]bool
+	retries       map[string]bool
+	completed     int
+	history       []api.TripOccurrence
+	deliveries    []api.NotificationLogEntry
+	// reasons by user ID
+	invalidTokens map[string]string
+	// devices by user ID
+	devices map[string][]api.Device
+	// users by ID, claimed notifications use the latest version of their
+	// user if it's here
+	users       map[string]*api.UserInfo
+	preferences *api.Preferences
+	trips       map[string]*api.TripSchedule
+	// trips leased by another tripwatcher
+	leased map[string]bool
+	// notifications claimed by another dispatcher
+	lostLeases map[string]bool
+	// tokens that each notification has been delivered to
+	sentTokens map[string][]string
+	mux        sync.Mutex
+}
+
+func NewMockDatabase() *MockDatabase {
+	return &MockDatabase{
+		enabled:       true,
+		sent:          make(map[string]bool),
+		failed:        make(map[string]bool),
+		retries:       make(map[string]bool),
+		trips:         make(map[string]*api.TripSchedule),
+		leased:        make(map[string]bool),
+		lostLeases:    make(map[string]bool),
+		sentTokens:    make(map[string][]string),
+		invalidTokens: make(map[string]string),
+		devices:       make(map[string][]api.Device),
+		users:         make(map[string]*api.UserInfo),
+	}
+}
+
+func (m *MockDatabase) RegisterDevice(device *api.Device) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.devices[device.UserID] = append(m.devices[device.UserID], *device)
+	return nil
+}
+
+func (m *MockDatabase) GetPreferences(userID string) (*api.Preferences, error) {
+	return m.preferences, nil
+}
+
+func (m *MockDatabase) SetPreferences(preferences *api.Preferences) error {
+	m.preferences = preferences
+	return nil
+}
+
+func (m *MockDatabase) UnregisterDevice(userID string, token string) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	devices := []api.Device{}
+	for _, device := range m.devices[userID] {
+		if device.NotificationToken != token {
+			devices = append(devices, device)
+		}
+	}
+	m.devices[userID] = devices
+	if user, ok := m.users[userID]; ok && user.NotificationToken == token {
+		user.NotificationToken = ""
+	}
+	return nil
+}
+
+func (m *MockDatabase) GetDevices(userID string) ([]api.Device, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	return append([]api.Device{}, m.devices[userID]...), nil
+}
+
+func (m *MockDatabase) LogDelivery(entry api.NotificationLogEntry) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.deliveries = append(m.deliveries, entry)
+	return nil
+}
+
+func (m *MockDatabase) GetNotificationLog(filter api.NotificationLogFilter) ([]api.NotificationLogEntry, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	return m.deliveries, nil
+}
+
+func (m *MockDatabase) InvalidateToken(userID string, token string, reason string) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.invalidTokens[userID] = reason
+	for i, device := range m.devices[userID] {
+		if device.NotificationToken == token {
+			m.devices[userID][i].Invalid = true
+		}
+	}
+	return nil
+}
+
+func (m *MockDatabase) GetTrip(tripID string) (*api.TripSchedule, error) {
+	return m.trips[tripID], nil
+}
+
+func (m *MockDatabase) IsEnabled(trip *api.TripSchedule) bool {
+	return m.enabled
+}
+
+func (m *MockDatabase) Heartbeat(instanceID string) error {
+	return nil
+}
+
+func (m *MockDatabase) LiveInstances(expiry time.Duration) (int, error) {
+	return 1, nil
+}
+
+func (m *MockDatabase) ClaimTrips(instanceID string, limit int, ttl time.Duration) ([]string, error) {
+	return []string{}, nil
+}
+
+func (m *MockDatabase) ReleaseTrips(instanceID string, tripIDs []string) error {
+	return nil
+}
+
+func (m *MockDatabase) RenewLease(instanceID string, tripID string, ttl time.Duration) (bool, error) {
+	return true, nil
+}
+
+func (m *MockDatabase) ClaimTrip(instanceID string, tripID string, ttl time.Duration) (bool, error) {
+	return !m.leased[tripID], nil
+}
+
+func (m *MockDatabase) CompleteOccurrence(trip *api.TripSchedule, record api.TripOccurrence, notification *api.Notification) (bool, error) {
+	if notification != nil {
+		queued, err := m.QueueNotification(notification)
+		if !queued || err != nil {
+			return queued, err
+		}
+	}
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	for _, r := range m.history {
+		if r.TripID == record.TripID && r.Occurrence == record.Occurrence {
+			return false, nil
+		}
+	}
+	m.completed++
+	m.history = append(m.history, record)
+	return notification != nil, nil
+}
+
+func (m *MockDatabase) QueueNotification(notification *api.Notification) (bool, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	for _, n := range m.notifications {
+		if n.DedupeKey == notification.DedupeKey {
+			return false, nil
+		}
+	}
+	notification.ID = fmt.Sprintf("%d", len(m.notifications))
+	m.notifications = append(m.notifications, notification)
+	return true, nil
+}
+
+func (m *MockDatabase) ClaimNotifications(limit int, lease time.Duration) ([]*api.Notification, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	claimed := []*api.Notification{}
+	for _, n := range m.notifications {
+		if !m.sent[n.ID] && !m.failed[n.ID] && len(claimed) < limit {
+			n.Attempts++
+			n.SentTokens = append([]string{}, m.sentTokens[n.ID]...)
+			if user, ok := m.users[n.User.ID]; ok {
+				u := *user
+				n.User = &u
+			}
+			claimed = append(claimed, n)
+		}
+	}
+	return claimed, nil
+}
+
+func (m *MockDatabase) RenewNotificationLease(id string, attempt int, lease time.Duration) (bool, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	return !m.sent[id] && !m.failed[id] && !m.lostLeases[id], nil
+}
+
+func (m *MockDatabase) MarkDeviceSent(id string, token string) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.sentTokens[id] = append(m.sentTokens[id], token)
+	return nil
+}
+
+func (m *MockDatabase) MarkNotificationSent(id string) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.sent[id] = true
+	return nil
+}
+
+func (m *MockDatabase) MarkNotificationFailed(id string, reason string, retry bool, retryAt time.Time) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.failed[id] = true
+	m.retries[id] = retry
+	return nil
+}
+
+func testUser() *api.UserInfo {
+	return &api.UserInfo{ID: "user", NotificationToken: "token", DeviceOS: IOS}
+}
+
+func testTrip(departure time.Time) *api.TripSchedule {
+	return &api.TripSchedule{
+		ID:   "1",
+		User: &api.UserInfo{ID: "user"},
+		Route: &api.RouteOption{
+			Description:   "Belconnen Way",
+			DepartureTime: api.UnixTime{departure},
+		},
+		InputArrivalTime: &api.Date{},
+		RepeatDays:       []bool{false, false, false, false, false, false, false},
+	}
+}
+
+func TestDispatcherDeliversNotifications(t *testing.T) {
+	db := NewMockDatabase()
+	db.QueueNotification(&api.Notification{DedupeKey: "1", User: testUser(), Message: "first"})
+	db.QueueNotification(&api.Notification{DedupeKey: "2", User: testUser(), Message: "second"})
+	notifier := &FakeNotifier{}
+	dispatcher := NewDispatcher(db, db, db, notifier)
+	if count := dispatcher.dispatch(); count != 2 {
+		t.Error("Expected", 2, "found", count)
+	}
+	if messages := notifier.Messages(); len(messages) != 2 || messages[0] != "first" {
+		t.Error("Unexpected messages", messages)
+	}
+	if !db.sent["0"] || !db.sent["1"] {
+		t.Error("Expected notifications to be marked as sent", db.sent)
+	}
+	// nothing should be delivered twice
+	if count := dispatcher.dispatch(); count != 0 {
+		t.Error("Expected", 0, "found", count)
+	}
+}
+
+func TestDispatcherSkipsUnregisteredDevices(t *testing.T) {
+	db := NewMockDatabase()
+	user := testUser()
+	db.users[user.ID] = user
+	db.RegisterDevice(&api.Device{ID: "1", UserID: user.ID, NotificationToken: user.NotificationToken, DeviceOS: IOS})
+	db.QueueNotification(&api.Notification{DedupeKey: "1", User: testUser(), Message: "first"})
+	db.UnregisterDevice(user.ID, user.NotificationToken)
+	notifier := &FakeNotifier{}
+	dispatcher := NewDispatcher(db, db, db, notifier)
+	dispatcher.dispatch()
+	if messages := notifier.Messages(); len(messages) != 0 {
+		t.Error("Expected no messages, found", messages)
+	}
+	if !db.failed["0"] || db.retries["0"] {
+		t.Error("Expected notification to fail without retrying")
+	}
+}
+
+func TestDispatcherStopsWhenLeaseIsLost(t *testing.T) {
+	db := NewMockDatabase()
+	db.QueueNotification(&api.Notification{DedupeKey: "1", User: testUser(), Message: "first"})
+	db.lostLeases["0"] = true
+	notifier := &FakeNotifier{}
+	dispatcher := NewDispatcher(db, db, db, notifier)
+	dispatcher.dispatch()
+	if messages := notifier.Messages(); len(messages) != 0 {
+		t.Error("Expected no messages, found", messages)
+	}
+	// the other dispatcher is responsible for it now
+	if db.sent["0"] || db.failed["0"] {
+		t.Error("Expected notification to be left alone")
+	}
+}
+
+func TestDispatcherRetriesFailedDelivery(t *testing.T) {
+	db := NewMockDatabase()
+	db.QueueNotification(&api.Notification{DedupeKey: "1", User: testUser()})
+	db.QueueNotification(&api.Notification{DedupeKey: "2", User: testUser(), Attempts: maxDeliveryAttempts})
+	dispatcher := NewDispatcher(db, db, db, &FakeNotifier{err: errors.New("Push failed")})
+	dispatcher.dispatch()
+	if db.sent["0"] || !db.failed["0"] {
+		t.Error("Expected notification to fail")
+	}
+	if !db.retries["0"] {
+		t.Error("Expected notification to be retried")
+	}
+	// this has now been tried too many times
+	if db.retries["1"] {
+		t.Error("Expected notification to not be retried")
+	}
+}
+
+func TestDispatcherGivesUpAfterDeparture(t *testing.T) {
+	db := NewMockDatabase()
+	now := time.Now()
+	// the departure has already passed
+	db.QueueNotification(&api.Notification{DedupeKey: "1", User: testUser(), Expires: now.Add(-time.Minute)})
+	// the next retry would be after departure
+	db.QueueNotification(&api.Notification{DedupeKey: "2", User: testUser(), Expires: now.Add(time.Second)})
+	notifier := &FakeNotifier{err: errors.New("Push failed")}
+	dispatcher := NewDispatcher(db, db, db, notifier)
+	dispatcher.dispatch()
+	if messages := notifier.Messages(); len(messages) != 1 {
+		t.Error("Expected expired notification to not be sent, found", messages)
+	}
+	if !db.failed["0"] || db.retries["0"] {
+		t.Error("Expected expired notification to be given up on")
+	}
+	if !db.failed["1"] || db.retries["1"] {
+		t.Error("Expected notification to not be retried after departure")
+	}
+}
+
+func TestDispatcherInvalidatesRejectedToken(t *testing.T) {
+	db := NewMockDatabase()
+	user := &api.UserInfo{ID: "user", NotificationToken: "token"}
+	db.QueueNotification(&api.Notification{DedupeKey: "1", User: user})
+	notifier := &FakeNotifier{err: &InvalidTokenError{Token: "token", Reason: "Unregistered"}}
+	dispatcher := NewDispatcher(db, db, db, notifier)
+	dispatcher.dispatch()
+	if db.invalidTokens["user"] != "Unregistered" {
+		t.Error("Expected token to be invalidated, found", db.invalidTokens)
+	}
+	if !db.failed["0"] || db.retries["0"] {
+		t.Error("Expected notification to not be retried")
+	}
+}
+
+func TestDispatcherInvalidatesTokenDeliveredByFallback(t *testing.T) {
+	db := NewMockDatabase()
+	user := &api.UserInfo{ID: "user", NotificationToken: "token"}
+	db.QueueNotification(&api.Notification{DedupeKey: "1", User: user})
+	invalid := &InvalidTokenError{Token: "token", Reason: "NotRegistered", Delivered: true}
+	dispatcher := NewDispatcher(db, db, db, &FakeNotifier{err: invalid})
+	dispatcher.dispatch()
+	if db.invalidTokens["user"] != "NotRegistered" {
+		t.Error("Expected token to be invalidated, found", db.invalidTokens)
+	}
+	if !db.sent["0"] {
+		t.Error("Expected notification to be marked as sent")
+	}
+}
+
+func TestDispatcherLogsDeliveries(t *testing.T) {
+	db := NewMockDatabase()
+	now := time.Now()
+	user := &api.UserInfo{ID: "user", NotificationToken: "token", DeviceOS: IOS}
+	route := &api.RouteOption{Description: "Belconnen Way"}
+	db.QueueNotification(&api.Notification{DedupeKey: "1", TripID: "1", User: user, Route: route, Scheduled: now})
+	db.QueueNotification(&api.Notification{DedupeKey: "2", TripID: "2", User: user, Expires: now.Add(-time.Minute)})
+	router := &NotifierRouter{
+		notifiers: map[string]Notifier{"push": &FakeNotifier{}},
+		os:        map[string]string{IOS: "push"},
+	}
+	dispatcher := NewDispatcher(db, db, db, router)
+	dispatcher.dispatch()
+	if len(db.deliveries) != 2 {
+		t.Fatal("Expected", 2, "found", len(db.deliveries))
+	}
+	sent := db.deliveries[0]
+	if sent.Result != api.DeliverySent || sent.Provider != "push" || sent.UserID != "user" {
+		t.Error("Unexpected log entry", sent)
+	}
+	if sent.Route != route || !sent.Scheduled.Equal(now) || sent.Attempt != 1 {
+		t.Error("Unexpected log entry", sent)
+	}
+	expired := db.deliveries[1]
+	if expired.Result != api.DeliveryExpired || len(expired.Provider) > 0 || len(expired.Error) == 0 {
+		t.Error("Unexpected log entry", expired)
+	}
+}
+
+func TestDispatcherLogsFailedDelivery(t *testing.T) {
+	db := NewMockDatabase()
+	db.QueueNotification(&api.Notification{DedupeKey: "1", User: testUser()})
+	dispatcher := NewDispatcher(db, db, db, &FakeNotifier{err: errors.New("Push failed")})
+	dispatcher.dispatch()
+	if len(db.deliveries) != 1 || db.deliveries[0].Result != api.DeliveryFailed {
+		t.Error("Expected failed delivery to be logged, found", db.deliveries)
+	}
+	if db.deliveries[0].Error != "Push failed" {
+		t.Error("Expected", "Push failed", "found", db.deliveries[0].Error)
+	}
+}
+
+func TestDispatcherSendsNotificationData(t *testing.T) {
+	db := NewMockDatabase()
+	route := &api.RouteOption{Name: "300", DepartureTime: api.UnixTime{time.Unix(1500000000, 0)}}
+	db.QueueNotification(&api.Notification{DedupeKey: "1", User: testUser(), TripID: "1", Kind: api.LeaveNotification, Route: route})
+	notifier := &FakeNotifier{}
+	NewDispatcher(db, db, db, notifier).dispatch()
+	if len(notifier.data) != 1 {
+		t.Fatal("Expected", 1, "found", len(notifier.data))
+	}
+	data := notifier.data[0]
+	if data["trip_id"] != "1" || data["route_name"] != "300" || data["departure_time"] != "1500000000000" {
+		t.Error("Unexpected data", data)
+	}
+}
+
+func TestDispatcherSendsToEveryDevice(t *testing.T) {
+	db := NewMockDatabase()
+	user := &api.UserInfo{ID: "user", NotificationToken: "phone", DeviceOS: IOS}
+	db.RegisterDevice(&api.Device{ID: "1", UserID: "user", NotificationToken: "phone", DeviceOS: IOS})
+	db.RegisterDevice(&api.Device{ID: "2", UserID: "user", NotificationToken: "tablet", DeviceOS: Android})
+	db.RegisterDevice(&api.Device{ID: "3", UserID: "user", NotificationToken: "old", Invalid: true})
+	db.QueueNotification(&api.Notification{DedupeKey: "1", User: user})
+	notifier := &FakeNotifier{}
+	NewDispatcher(db, db, db, notifier).dispatch()
+	if len(notifier.users) != 2 {
+		t.Fatal("Expected", 2, "found", len(notifier.users))
+	}
+	if notifier.users[0].NotificationToken != "phone" || notifier.users[1].DeviceOS != Android {
+		t.Error("Expected each device's token and platform to be used, found", notifier.users)
+	}
+	if !db.sent["0"] {
+		t.Error("Expected notification to be marked as sent")
+	}
+	if len(db.deliveries) != 2 || db.deliveries[1].DeviceID != "2" {
+		t.Error("Expected a log entry for each device, found", db.deliveries)
+	}
+}
+
+func TestDispatcherRetriesOnlyFailedDevices(t *testing.T) {
+	db := NewMockDatabase()
+	user := &api.UserInfo{ID: "user"}
+	db.RegisterDevice(&api.Device{ID: "1", UserID: "user", NotificationToken: "phone"})
+	db.RegisterDevice(&api.Device{ID: "2", UserID: "user", NotificationToken: "tablet", Channel: "webhook"})
+	db.QueueNotification(&api.Notification{DedupeKey: "1", User: user})
+	push := &FakeNotifier{}
+	webhook := &FakeNotifier{err: errors.New("Webhook failed")}
+	router := &NotifierRouter{
+		notifiers: map[string]Notifier{"push": push, "webhook": webhook},
+		fallback:  "push",
+	}
+	dispatcher := NewDispatcher(db, db, db, router)
+	dispatcher.dispatch()
+	if db.sent["0"] || !db.failed["0"] || !db.retries["0"] {
+		t.Fatal("Expected notification to be retried for the failed device")
+	}
+	// the retry is due
+	webhook.err = nil
+	delete(db.failed, "0")
+	dispatcher.dispatch()
+	if len(push.Messages()) != 1 {
+		t.Error("Expected phone to only be sent the notification once, found", push.Messages())
+	}
+	if len(webhook.Messages()) != 2 {
+		t.Error("Expected tablet to be retried, found", webhook.Messages())
+	}
+	if !db.sent["0"] {
+		t.Error("Expected notification to be marked as sent")
+	}
+}
+
+func TestDispatcherDoesNotWaitForRejectedDevices(t *testing.T) {
+	db := NewMockDatabase()
+	user := &api.UserInfo{ID: "user"}
+	db.RegisterDevice(&api.Device{ID: "1", UserID: "user", NotificationToken: "phone"})
+	db.RegisterDevice(&api.Device{ID: "2", UserID: "user", NotificationToken: "tablet"})
+	db.QueueNotification(&api.Notification{DedupeKey: "1", User: user})
+	router := &NotifierRouter{
+		notifiers: map[string]Notifier{
+			"push":    &FakeNotifier{err: &InvalidTokenError{Token: "phone", Reason: "Unregistered"}},
+			"webhook": &FakeNotifier{},
+		},
+		fallback: "push",
+	}
+	db.devices["user"][1].Channel = "webhook"
+	NewDispatcher(db, db, db, router).dispatch()
+	if !db.sent["0"] || db.failed["0"] {
+		t.Error("Expected notification to be marked as sent")
+	}
+	devices, _ := db.GetDevices("user")
+	if !devices[0].Invalid || devices[1].Invalid {
+		t.Error("Expected only the rejected device to be invalidated, found", devices)
+	}
+	// only the tablet is left
+	active, _ := api.GetActiveDevices(db, user)
+	if len(active) != 1 || active[0].NotificationToken != "tablet" {
+		t.Error("Unexpected active devices", active)
+	}
+}
+
+func TestDispatcherGivesUpWithoutWorkingDevices(t *testing.T) {
+	db := NewMockDatabase()
+	user := &api.UserInfo{ID: "user"}
+	db.RegisterDevice(&api.Device{ID: "1", UserID: "user", NotificationToken: "old", Invalid: true})
+	db.QueueNotification(&api.Notification{DedupeKey: "1", User: user})
+	notifier := &FakeNotifier{}
+	NewDispatcher(db, db, db, notifier).dispatch()
+	if len(notifier.Messages()) != 0 {
+		t.Error("Expected nothing to be sent, found", notifier.Messages())
+	}
+	if !db.failed["0"] || db.retries["0"] {
+		t.Error("Expected notification to not be retried")
+	}
+}
+
+func TestAlerterOnlySendsFinalAlertDuringQuietHours(t *testing.T) {
+	db := NewMockDatabase()
+	// quiet hours all day
+	now := time.Now().UTC()
+	db.preferences = api.DefaultPreferences("user")
+	db.preferences.QuietHoursStart = now.Add(-time.Hour).Format("15:04")
+	db.preferences.QuietHoursEnd = now.Add(2 * time.Hour).Format("15:04")
+	db.preferences.Timezone = "UTC"
+	alerter := newTestAlerter(db)
+	trip := testTrip(now.Add(10 * time.Minute))
+	getReady := api.Reminder{OffsetMs: 10 * 60 * 1000, Kind: api.ReminderGetReady}
+	leaveNow := api.Reminder{OffsetMs: 0, Kind: api.ReminderLeaveNow}
+	trip.Reminders = []api.Reminder{getReady, leaveNow}
+	alerter.SendAlert(trip, trip.Route, getReady, false)
+	if len(db.notifications) != 0 {
+		t.Error("Expected reminder to be suppressed, found", len(db.notifications))
+	}
+	if len(db.deliveries) != 1 || db.deliveries[0].Result != api.DeliverySuppressed {
+		t.Error("Expected suppressed reminder to be logged, found", db.deliveries)
+	}
+	alerter.SendAlert(trip, trip.Route, leaveNow, true)
+	if len(db.notifications) != 1 {
+		t.Error("Expected final alert to be sent, found", len(db.notifications))
+	}
+}
+
+func TestAlerterSendsUrgentRemindersDuringQuietHours(t *testing.T) {
+	db := NewMockDatabase()
+	now := time.Now().UTC()
+	db.preferences = api.DefaultPreferences("user")
+	db.preferences.QuietHoursStart = now.Add(-time.Hour).Format("15:04")
+	db.preferences.QuietHoursEnd = now.Add(2 * time.Hour).Format("15:04")
+	db.preferences.Timezone = "UTC"
+	alerter := newTestAlerter(db)
+	trip := testTrip(now.Add(30 * time.Minute))
+	leaveNow := api.Reminder{OffsetMs: 30 * 60 * 1000, Kind: api.ReminderLeaveNow}
+	lastChance := api.Reminder{OffsetMs: 0, Kind: api.ReminderLastChance}
+	trip.Reminders = []api.Reminder{leaveNow, lastChance}
+	alerter.SendAlert(trip, trip.Route, leaveNow, false)
+	if len(db.notifications) != 1 {
+		t.Error("Expected leave now reminder to be sent, found", len(db.notifications))
+	}
+	// only leave now reminders are urgent, even if others are running late
+	getReady := api.Reminder{OffsetMs: 40 * 60 * 1000, Kind: api.ReminderGetReady}
+	trip.Reminders = []api.Reminder{getReady, lastChance}
+	alerter.SendAlert(trip, trip.Route, getReady, false)
+	if len(db.notifications) != 1 {
+		t.Error("Expected late reminder to be suppressed, found", len(db.notifications))
+	}
+	if len(db.deliveries) != 1 || db.deliveries[0].Result != api.DeliverySuppressed {
+		t.Error("Expected late reminder to be logged as suppressed, found", db.deliveries)
+	}
+}
+
+func TestAlerterRespectsDisabledUpdates(t *testing.T) {
+	db := NewMockDatabase()
+	db.preferences = api.DefaultPreferences("user")
+	db.preferences.DelayUpdatesEnabled = false
+	alerter := newTestAlerter(db)
+	trip := testTrip(time.Now().Add(time.Hour))
+	alerter.Queue(api.NewNotification(trip, api.DelayNotification, "Running late", ""))
+	if len(db.notifications) != 0 {
+		t.Error("Expected delay update to be suppressed, found", len(db.notifications))
+	}
+	alerter.Queue(api.NewNotification(trip, api.CancellationNotification, "Cancelled", ""))
+	if len(db.notifications) != 1 {
+		t.Error("Expected cancellation to be sent, found", len(db.notifications))
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	expected := []time.Duration{
+		5 * time.Second, 10 * time.Second, 20 * time.Second, 40 * time.Second,
+	}
+	for i, delay := range expected {
+		if result := retryDelay(i + 1); result != delay {
+			t.Error("Expected", delay, "found", result)
+		}
+	}
+	if result := retryDelay(maxDeliveryAttempts); result != maxRetryDelay {
+		t.Error("Expected", maxRetryDelay, "found", result)
+	}
+}
+
+func TestAlerterQueuesAlertOnce(t *testing.T) {
+	db := NewMockDatabase()
+	alerter := newTestAlerter(db)
+	trip := testTrip(time.Now().Add(1 * time.Minute))
+	alerter.SendAlert(trip, trip.Route, api.GetReminders(trip)[0], true)
+	alerter.SendAlert(trip, trip.Route, api.GetReminders(trip)[0], true)
+	// the replayed occurrence shouldn't be added to the history again
+	if db.completed != 1 || len(db.history) != 1 {
+		t.Error("Expected", 1, "found", db.completed, len(db.history))
+	}
+	if len(db.notifications) != 1 {
+		t.Fatal("Expected", 1, "notification, found", len(db.notifications))
+	}
+	n := db.notifications[0]
+	if n.Kind != api.LeaveNotification || !strings.HasPrefix(n.Message, "Time to leave for Belconnen Way") {
+		t.Error("Unexpected notification", n)
+	}
+	if n.Route != trip.Route || n.Scheduled.IsZero() {
+		t.Error("Expected route and scheduled time to be set, found", n)
+	}
+}
+
+func TestAlerterDoesNotQueueDisabledTrip(t *testing.T) {
+	db := NewMockDatabase()
+	db.enabled = false
+	alerter := newTestAlerter(db)
+	trip := testTrip(time.Now().Add(1 * time.Minute))
+	alerter.SendAlert(trip, trip.Route, api.GetReminders(trip)[0], true)
+	if db.completed != 1 {
+		t.Error("Expected", 1, "found", db.completed)
+	}
+	if len(db.notifications) != 0 {
+		t.Error("Expected", 0, "notifications, found", len(db.notifications))
+	}
+}
+
+func newTestAlerter(db *MockDatabase) *Alerter {
+	return &Alerter{
+		db:          db,
+		leases:      db,
+		outbox:      db,
+		preferences: db,
+		log:         db,
+		dispatcher:  NewDispatcher(db, db, db, &FakeNotifier{}),
+		messages:    DefaultMessageTemplates(),
+		instanceID:  "watcher",
+	}
+}
+
+func TestAlerterSendsLateAlert(t *testing.T) {
+	db := NewMockDatabase()
+	alerter := newTestAlerter(db)
+	// the notification time was five minutes ago but the bus hasn't left
+	trip := testTrip(time.Now().Add(5 * time.Minute))
+	trip.WaitingWindowMs = 10 * 60 * 1000
+	alerter.SendAlert(trip, trip.Route, api.GetReminders(trip)[0], true)
+	if len(db.notifications) != 1 {
+		t.Fatal("Expected", 1, "notification, found", len(db.notifications))
+	}
+	expected := "this alert was delayed"
+	if !strings.HasSuffix(db.notifications[0].Message, expected) {
+		t.Error("Expected", expected, "found", db.notifications[0].Message)
+	}
+	if db.history[0].Outcome != api.OccurrenceLate {
+		t.Error("Expected", api.OccurrenceLate, "found", db.history[0].Outcome)
+	}
+}
+
+func TestAlerterSkipsOccurrence(t *testing.T) {
+	db := NewMockDatabase()
+	alerter := newTestAlerter(db)
+	departure := time.Now().Add(10 * time.Minute)
+	trip := testTrip(departure)
+	trip.RepeatDays = []bool{true, true, true, true, true, true, true}
+	trip.SkipDates = []string{departure.Format("2006-01-02")}
+	getReady := api.Reminder{OffsetMs: 10 * 60 * 1000, Kind: api.ReminderGetReady}
+	alerter.SendAlert(trip, trip.Route, getReady, false)
+	alerter.SendAlert(trip, trip.Route, api.GetReminders(trip)[0], true)
+	if len(db.notifications) != 0 {
+		t.Error("Expected", 0, "notifications, found", len(db.notifications))
+	}
+	if len(db.history) != 1 || db.history[0].Outcome != api.OccurrenceSkipped {
+		t.Error("Expected a skipped occurrence, found", db.history)
+	}
+}
+
+func TestAlerterRecordsMissedOccurrence(t *testing.T) {
+	db := NewMockDatabase()
+	alerter := newTestAlerter(db)
+	trip := testTrip(time.Now().Add(-5 * time.Minute))
+	alerter.SendAlert(trip, trip.Route, api.GetReminders(trip)[0], true)
+	if len(db.notifications) != 0 {
+		t.Error("Expected", 0, "notifications, found", len(db.notifications))
+	}
+	if len(db.history) != 1 || db.history[0].Outcome != api.OccurrenceMissed {
+		t.Error("Expected missed occurrence, found", db.history)
+	}
+}
+
+func TestAlerterQueuesEarlierReminderWithoutCompleting(t *testing.T) {
+	db := NewMockDatabase()
+	alerter := newTestAlerter(db)
+	trip := testTrip(time.Now().Add(10 * time.Minute))
+	getReady := api.Reminder{OffsetMs: 10 * 60 * 1000, Kind: api.ReminderGetReady}
+	leaveNow := api.Reminder{OffsetMs: 0, Kind: api.ReminderLeaveNow}
+	trip.Reminders = []api.Reminder{getReady, leaveNow}
+	alerter.SendAlert(trip, trip.Route, getReady, false)
+	alerter.SendAlert(trip, trip.Route, getReady, false)
+	if db.completed != 0 {
+		t.Error("Expected", 0, "found", db.completed)
+	}
+	alerter.SendAlert(trip, trip.Route, leaveNow, true)
+	if db.completed != 1 {
+		t.Error("Expected", 1, "found", db.completed)
+	}
+	if len(db.notifications) != 2 {
+		t.Fatal("Expected", 2, "notifications, found", len(db.notifications))
+	}
+	if !strings.HasPrefix(db.notifications[0].Message, "Get ready to leave for Belconnen Way") {
+		t.Error("Unexpected message", db.notifications[0].Message)
+	}
+	if db.notifications[0].DedupeKey == db.notifications[1].DedupeKey {
+		t.Error("Expected each reminder to have its own key, found", db.notifications[0].DedupeKey)
+	}
+}
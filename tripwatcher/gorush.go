@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/appleboy/gorush/config"
+	"github.com/appleboy/gorush/gorush"
+	"github.com/oliveroneill/todserver/api"
+	"sync"
+)
+
+// defaultGorushConfig is the gorush configuration file used when one isn't
+// set
+const defaultGorushConfig = "config.yml"
+
+// gorush stores its config globally so only one notifier can be set up
+var gorushConfigured bool
+var gorushMux sync.Mutex
+
+// GorushNotifier is an implementation of Notifier that sends push
+// notifications to iOS and Android devices using gorush
+type GorushNotifier struct {
+	// the APNS topic, this is normally the app's bundle ID
+	topic string
+}
+
+// GorushConfig is the config for a gorush notifier
+type GorushConfig struct {
+	// path to the gorush configuration file
+	Config string `json:"config"`
+	// the iOS app's bundle ID
+	BundleID string `json:"bundle_id"`
+	// the APNS topic, if this isn't set then the bundle ID is used
+	Topic string `json:"topic"`
+}
+
+func newGorushNotifierFromConfig(c api.ProviderConfig) (Notifier, error) {
+	var config GorushConfig
+	if err := c.Decode(&config); err != nil {
+		return nil, err
+	}
+	return NewGorushNotifier(config)
+}
+
+// NewGorushNotifier will load the gorush config and set up the clients for
+// each platform. This is only done once rather than for every notification
+func NewGorushNotifier(c GorushConfig) (*GorushNotifier, error) {
+	gorushMux.Lock()
+	defer gorushMux.Unlock()
+	if gorushConfigured {
+		return nil, errors.New("Only one gorush notifier can be configured")
+	}
+	path := c.Config
+	if len(path) == 0 {
+		path = defaultGorushConfig
+	}
+	var err error
+	// passing in an empty string will load the default
+	gorush.PushConf, err = config.LoadConf("")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load default gorush config: '%v'", err)
+	}
+	gorush.PushConf, err = config.LoadConf(path)
+	if err != nil {
+		return nil, fmt.Errorf("Load yaml config file error: '%v'", err)
+	}
+	if err := gorush.InitLog(); err != nil {
+		return nil, err
+	}
+	if err := gorush.InitAppStatus(); err != nil {
+		return nil, err
+	}
+	if gorush.PushConf.Ios.Enabled {
+		if err := gorush.InitAPNSClient(); err != nil {
+			return nil, err
+		}
+	}
+	gorushConfigured = true
+	topic := c.Topic
+	if len(topic) == 0 {
+		topic = c.BundleID
+	}
+	return &GorushNotifier{topic: topic}, nil
+}
+
+// Notify will send a push notification to the user's device. gorush doesn't
+// return the provider's error so rejected tokens can't be detected, use
+// `GorushServerNotifier` for that
+func (n *GorushNotifier) Notify(message string, data map[string]string, user *api.UserInfo) error {
+	req := gorush.PushNotification{
+		Tokens:      []string{user.NotificationToken},
+		Message:     message,
+		Sound:       notificationSound(user),
+		CollapseID:  collapseID(data),
+		CollapseKey: collapseID(data),
+	}
+	if len(data) > 0 {
+		req.Data = gorush.D{}
+		for key, value := range data {
+			req.Data[key] = value
+		}
+	}
+	if user.DeviceOS == IOS {
+		req.Platform = gorush.PlatFormIos
+		req.Topic = n.topic
+		if err := gorush.CheckMessage(req); err != nil {
+			return err
+		}
+		if isError := gorush.PushToIOS(req); isError {
+			return errors.New("Failed to send iOS notification")
+		}
+		return nil
+	}
+	req.Platform = gorush.PlatFormAndroid
+	// You can specify the notification icon that the client will use here
+	if err := gorush.CheckMessage(req); err != nil {
+		return err
+	}
+	if isError := gorush.PushToAndroid(req); isError {
+		return errors.New("Failed to send Android notification")
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/oliveroneill/todserver/api"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// gorush platform identifiers used by its HTTP API
+const (
+	gorushPlatformIOS     = 1
+	gorushPlatformAndroid = 2
+)
+
+// gorushServerTimeout is how long to wait for gorush to respond. gorush
+// must be running with `core.sync` enabled so that it responds once the
+// notification has been sent
+const gorushServerTimeout = 30 * time.Second
+
+// GorushServerNotifier is an implementation of Notifier that sends push
+// notifications through a gorush server. Unlike `GorushNotifier`, this can
+// read the provider's error for each token, so tokens that have been
+// rejected are reported using `InvalidTokenError`
+type GorushServerNotifier struct {
+	url    string
+	topic  string
+	client *http.Client
+}
+
+// GorushServerConfig is the config for a gorush server notifier
+type GorushServerConfig struct {
+	// the address of the gorush server, such as http://gorush:8088
+	URL string `json:"url"`
+	// the iOS app's bundle ID
+	BundleID string `json:"bundle_id"`
+	// the APNS topic, if this isn't set then the bundle ID is used
+	Topic string `json:"topic"`
+}
+
+type gorushRequest struct {
+	Notifications []gorushNotification `json:"notifications"`
+}
+
+type gorushNotification struct {
+	Tokens   []string `json:"tokens"`
+	Platform int      `json:"platform"`
+	Message  string   `json:"message"`
+	Topic    string   `json:"topic,omitempty"`
+	Sound    string   `json:"sound,omitempty"`
+	// used by the provider to replace duplicates of the same notification,
+	// APNS uses collapse_id and FCM uses collapse_key
+	CollapseID  string `json:"collapse_id,omitempty"`
+	CollapseKey string `json:"collapse_key,omitempty"`
+	// custom data sent with the push, this is given to the app
+	Data map[string]string `json:"data,omitempty"`
+}
+
+type gorushResponse struct {
+	Logs []gorushLog `json:"logs"`
+}
+
+// gorushLog is an entry in the gorush response for each failed push
+type gorushLog struct {
+	Type  string `json:"type"`
+	Token string `json:"token"`
+	Error string `json:"error"`
+}
+
+func newGorushServerNotifierFromConfig(c api.ProviderConfig) (Notifier, error) {
+	var config GorushServerConfig
+	if err := c.Decode(&config); err != nil {
+		return nil, err
+	}
+	return NewGorushServerNotifier(config)
+}
+
+// NewGorushServerNotifier will create a GorushServerNotifier
+func NewGorushServerNotifier(config GorushServerConfig) (*GorushServerNotifier, error) {
+	if len(config.URL) == 0 {
+		return nil, errors.New("No gorush URL set")
+	}
+	topic := config.Topic
+	if len(topic) == 0 {
+		topic = config.BundleID
+	}
+	return &GorushServerNotifier{
+		url:    strings.TrimSuffix(config.URL, "/") + "/api/push",
+		topic:  topic,
+		client: &http.Client{Timeout: gorushServerTimeout},
+	}, nil
+}
+
+// Notify will send a push notification to the user's device
+func (n *GorushServerNotifier) Notify(message string, data map[string]string, user *api.UserInfo) error {
+	// don't keep sending to a token that's already been rejected
+	if user.NeedsReregister {
+		return &InvalidTokenError{Token: user.NotificationToken, Reason: "Token was previously rejected"}
+	}
+	notification := gorushNotification{
+		Tokens:      []string{user.NotificationToken},
+		Platform:    gorushPlatformAndroid,
+		Message:     message,
+		Sound:       notificationSound(user),
+		CollapseID:  collapseID(data),
+		CollapseKey: collapseID(data),
+		Data:        data,
+	}
+	if user.DeviceOS == IOS {
+		notification.Platform = gorushPlatformIOS
+		notification.Topic = n.topic
+	}
+	b, err := json.Marshal(gorushRequest{Notifications: []gorushNotification{notification}})
+	if err != nil {
+		return err
+	}
+	resp, err := n.client.Post(n.url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("gorush returned %s", resp.Status)
+	}
+	var result gorushResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return err
+	}
+	return parseGorushLogs(result.Logs, user.NotificationToken)
+}
+
+// parseGorushLogs will return an error if the push to this token failed
+func parseGorushLogs(logs []gorushLog, token string) error {
+	for _, l := range logs {
+		if l.Type != "failed-push" || l.Token != token {
+			continue
+		}
+		if isInvalidTokenReason(l.Error) {
+			return &InvalidTokenError{Token: token, Reason: l.Error}
+		}
+		return fmt.Errorf("Push failed: %s", l.Error)
+	}
+	return nil
+}
@@ -2,12 +2,11 @@ package main
 
 import (
 	"fmt"
-	"github.com/appleboy/gorush/config"
-	"github.com/appleboy/gorush/gorush"
 	"github.com/oliveroneill/todserver/api"
 	"gopkg.in/alecthomas/kingpin.v2"
 	"log"
-	"sync"
+	"os"
+	"reflect"
 	"time"
 )
 
@@ -19,11 +18,13 @@ const Android = "android"
 
 const dbCheckFrequency = 1 * time.Minute
 
-// allow an extra 30 seconds for safety
-const waitingWindowThreshold = 30 * time.Millisecond
+// reminderSafetyBuffer is added to each reminder's offset since push
+// notifications won't be instant
+const reminderSafetyBuffer = 30 * time.Second
 
-// gorush configuration file
-const configFile = "config.yml"
+// lateAlertThreshold is how long after the notification time an alert is
+// considered late, such as when tripwatcher was restarted
+const lateAlertThreshold = 1 * time.Minute
 
 // RouteGenerator is an interface that will send routes back over a channel
 // This is useful for timing out route search requests
@@ -35,126 +36,423 @@ type RouteGenerator interface {
 // wraps api.RouteFinder
 type DefaultRouteGenerator struct {
 	finder api.RouteFinder
-	db     api.DatabaseInterface
+	// used to tell the user about cancelled services
+	alerter *Alerter
 }
 
 // NewDefaultRouteGenerator will create an instance of DefaultRouteGenerator
+// @param alerter - used to queue cancellation notifications
 // @param finder - the finder used to generate a route
-func NewDefaultRouteGenerator(db api.DatabaseInterface, finder api.RouteFinder) *DefaultRouteGenerator {
-	return &DefaultRouteGenerator{finder: finder, db: db}
+func NewDefaultRouteGenerator(alerter *Alerter, finder api.RouteFinder) *DefaultRouteGenerator {
+	return &DefaultRouteGenerator{
+		finder:  finder,
+		alerter: alerter,
+	}
+}
+
+// Alerter queues notifications in the outbox and wakes the dispatcher to
+// deliver them
+type Alerter struct {
+	db     api.DatabaseInterface
+	leases api.LeaseInterface
+	outbox api.OutboxInterface
+	// used to check quiet hours and which updates the user wants
+	preferences api.PreferencesInterface
+	// records notifications that are dropped due to the user's preferences
+	log        api.NotificationLogInterface
+	dispatcher *Dispatcher
+	messages   *MessageTemplates
+	// unique name for this tripwatcher
+	instanceID string
 }
 
 func main() {
-	mapsKeyArg := kingpin.Arg("googlemapskey", "Google Maps API key for querying routes").Required().String()
+	mapsKeyArg := kingpin.Arg("googlemapskey", "Google Maps API key for querying routes").String()
+	finderConfigArg := kingpin.Flag("finderconfig", "JSON file configuring which route finders are used in each region").String()
 	nxtBusKeyArg := kingpin.Flag("nxtbuskey", "NXTBUS API key for real time data in Canberra").String()
+	nxtBusStopsArg := kingpin.Flag("nxtbusstops", "GTFS stops.txt file used to find NXTBUS stops by location").String()
+	stopCacheArg := kingpin.Flag("stopcache", "Directory to store resolved stops and the stop mismatch report").String()
+	workersArg := kingpin.Flag("workers", "Number of route searches that can run at once").Default("10").Int()
+	instanceArg := kingpin.Flag("instance", "Unique name for this tripwatcher when running more than one").String()
+	notifierConfigArg := kingpin.Flag("notifierconfig", "JSON file configuring how notifications are sent").String()
+	messagesArg := kingpin.Flag("messages", "JSON file with notification message templates for each locale").String()
 	kingpin.Parse()
-	mapsAPIKey := *mapsKeyArg
-	if len(mapsAPIKey) == 0 {
-		log.Fatal("No api key set.")
+	instanceID := *instanceArg
+	if len(instanceID) == 0 {
+		instanceID = defaultInstanceID()
+	}
+	var finder api.RouteFinder
+	if len(*finderConfigArg) > 0 {
+		registry, err := api.LoadFinderRegistry(*finderConfigArg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		finder = registry
+	} else {
+		mapsAPIKey := *mapsKeyArg
+		if len(mapsAPIKey) == 0 {
+			log.Fatal("No api key set.")
+		}
+		nxtBusAPIKey := *nxtBusKeyArg
+		mapsFinder := api.NewGoogleMapsFinder(mapsAPIKey)
+		finder = mapsFinder
+		if len(nxtBusAPIKey) > 0 {
+			resolver, err := api.NewStopResolver(*nxtBusStopsArg, *stopCacheArg)
+			if err != nil {
+				log.Fatal(err)
+			}
+			finder = api.NewNxtBusFinder(nxtBusAPIKey, mapsFinder, resolver)
+		}
+	}
+
+	notifier, err := loadNotifier(*notifierConfigArg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	messages := DefaultMessageTemplates()
+	if len(*messagesArg) > 0 {
+		messages, err = LoadMessageTemplates(*messagesArg)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	db := api.NewPostgresInterface()
+	defer db.Close()
+	// deliver notifications stored in the outbox
+	dispatcher := NewDispatcher(db, db, db, notifier)
+	dispatcher.Start()
+	defer dispatcher.Stop()
+	alerter := &Alerter{
+		db:          db,
+		leases:      db,
+		outbox:      db,
+		preferences: db,
+		log:         db,
+		dispatcher:  dispatcher,
+		messages:    messages,
+		instanceID:  instanceID,
 	}
-	nxtBusAPIKey := *nxtBusKeyArg
-	mapsFinder := api.NewGoogleMapsFinder(mapsAPIKey)
-	var finder api.RouteFinder = mapsFinder
-	if len(nxtBusAPIKey) > 0 {
-		finder = api.NewNxtBusFinder(nxtBusAPIKey, mapsFinder)
+	// create a generator that uses the input finder to get routes
+	generator := NewDefaultRouteGenerator(alerter, finder)
+	scheduler := NewScheduler(generator, *workersArg, alerter.SendAlert)
+	// tell users that have opted in when their trip changes between checks
+	scheduler.SetRouteObserver(NewDelayTracker(alerter.Queue, messages).Observe)
+	scheduler.Start()
+	defer scheduler.Stop()
+	checkTrips(db, db, scheduler, instanceID)
+	// react to trip changes straight away, if this fails then changes will
+	// be picked up by the periodic check
+	changes, err := api.WatchTripChanges(db)
+	if err != nil {
+		fmt.Println("Failed to listen for trip changes:", err)
 	}
+	// check the database for new scheduled trips. This ensures that nothing
+	// is missed if a change notification is lost
+	ticker := time.Tick(dbCheckFrequency)
+	for {
+		select {
+		case <-ticker:
+			checkTrips(db, db, scheduler, instanceID)
+		case change, ok := <-changes:
+			if !ok {
+				changes = nil
+				continue
+			}
+			handleTripChange(change, db, db, scheduler, instanceID)
+		}
+	}
+}
 
-	// set up push notification configuration
-	var err error
-	// passing in an empty string will load the default
-	gorush.PushConf, err = config.LoadConf("")
+// loadNotifier will create the notifiers from the config file. If no file
+// is set then gorush is used for both iOS and Android using config.yml
+func loadNotifier(path string) (Notifier, error) {
+	if len(path) > 0 {
+		return LoadNotifierRouter(path)
+	}
+	gorushNotifier, err := NewGorushNotifier(GorushConfig{})
 	if err != nil {
-		panic(fmt.Sprintf("Failed to load default gorush config: '%v'", err))
+		return nil, err
 	}
-	gorush.PushConf, err = config.LoadConf(configFile)
+	// a router is used so that the notifier's name is logged
+	return &NotifierRouter{
+		notifiers: map[string]Notifier{"gorush": gorushNotifier},
+		fallback:  "gorush",
+	}, nil
+}
+
+// defaultInstanceID uses the hostname and process ID so that tripwatchers
+// running in separate containers get different names
+func defaultInstanceID() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "tripwatcher"
+	}
+	return fmt.Sprintf("%s-%d", hostname, os.Getpid())
+}
+
+// checkTrips will claim this tripwatcher's share of the scheduled trips and
+// watch them. The trips are shared between every running tripwatcher
+// @param instanceID - unique name for this tripwatcher
+func checkTrips(db api.DatabaseInterface, leases api.LeaseInterface, scheduler *Scheduler, instanceID string) {
+	trips, err := api.GetAllScheduledTrips(db)
 	if err != nil {
-		panic(fmt.Sprintf("Load yaml config file error: '%v'", err))
+		fmt.Println(err)
+		return
 	}
-	if err = gorush.InitLog(); err != nil {
+	owned, err := api.ClaimFairShare(leases, instanceID, len(trips), scheduler.Watched())
+	if err != nil {
 		fmt.Println(err)
 		return
 	}
+	watchTrips(ownedTrips(trips, owned), db, scheduler)
+}
+
+// ownedTrips returns the trips that this tripwatcher has leased
+func ownedTrips(trips []*api.TripSchedule, owned map[string]bool) []*api.TripSchedule {
+	filtered := []*api.TripSchedule{}
+	for _, t := range trips {
+		if owned[t.ID] {
+			filtered = append(filtered, t)
+		}
+	}
+	return filtered
+}
+
+// watchTrips will keep the scheduler up to date with the trips stored in
+// the database. Trips that aren't in the list, either because they have been
+// deleted or are now owned by another tripwatcher, will be cancelled
+// @param trips - trips to watch
+// @param scheduler - used to watch the trips and send alerts
+func watchTrips(trips []*api.TripSchedule, db api.DatabaseInterface, scheduler *Scheduler) {
+	found := make(map[string]bool)
+	for _, t := range trips {
+		found[t.ID] = true
+		updateWatch(t, db, scheduler)
+	}
+	// stop watching trips that have been deleted
+	for _, id := range scheduler.WatchedTrips() {
+		if !found[id] {
+			scheduler.Cancel(id)
+		}
+	}
+}
+
+// updateWatch will watch, reschedule or cancel a single trip based on its
+// latest state in the database
+func updateWatch(t *api.TripSchedule, db api.DatabaseInterface, scheduler *Scheduler) {
+	// trips are paused until the user registers a token that works
+	if api.IsPaused(t) {
+		scheduler.Cancel(t.ID)
+		return
+	}
+	// clear out disabled non-repeating trips
+	if !t.Enabled && !api.IsRepeating(t) {
+		scheduler.Cancel(t.ID)
+		// Delete a few hours after the arrival date
+		if tripHasPast(t) {
+			api.DeleteTrip(db, t.ID, t.User.ID)
+		}
+		return
+	}
+	// reschedule trips that have been changed since they were added
+	if watched := scheduler.Trip(t.ID); watched != nil {
+		if tripChanged(watched, t) {
+			scheduler.Reschedule(t)
+		}
+		return
+	}
+	scheduler.Watch(t)
+}
 
-	db := api.NewPostgresInterface()
-	defer db.Close()
-	// watchList will keep track of which trips are already running
-	// so that we don't watch a trip twice
-	watchList := make(map[string]bool)
-	mux := &sync.Mutex{}
-	trips, err := api.GetAllScheduledTrips(db)
-	if err == nil {
-		watchTrips(trips, db, finder, watchList, mux)
+// handleTripChange will update the scheduler as soon as a trip is created,
+// changed or deleted. New trips are claimed straight away, so whichever
+// tripwatcher sees the change first will watch it. The periodic check will
+// even out the number of trips owned by each tripwatcher
+// @param instanceID - unique name for this tripwatcher
+func handleTripChange(change api.TripChange, db api.DatabaseInterface, leases api.LeaseInterface, scheduler *Scheduler, instanceID string) {
+	if change.IsResync() {
+		checkTrips(db, leases, scheduler, instanceID)
+		return
+	}
+	if change.Deleted {
+		scheduler.Cancel(change.TripID)
+		return
+	}
+	trip, err := api.GetTrip(db, change.TripID)
+	if err != nil {
+		fmt.Println(err)
+		return
 	}
-	// check the database for new scheduled trips
-	for _ = range time.Tick(dbCheckFrequency) {
-		trips, err := api.GetAllScheduledTrips(db)
+	if trip == nil {
+		scheduler.Cancel(change.TripID)
+		return
+	}
+	// trips that are already watched are owned by this tripwatcher
+	if scheduler.Trip(trip.ID) == nil {
+		claimed, err := api.ClaimTrip(leases, instanceID, trip.ID)
 		if err != nil {
 			fmt.Println(err)
-			continue
+			return
+		}
+		if !claimed {
+			return
 		}
-		watchTrips(trips, db, finder, watchList, mux)
 	}
+	updateWatch(trip, db, scheduler)
 }
 
-// watchTrips will keep track of the trips and ensure that notifications
-// are sent when necessary
-// @param trips - trips to watch
-// @param finder - used to find routes for these trips
-// @param watchList - this should be updated with the currently watched
-//        trips so that we don't double up on a trip and send an alert twice
-// @param mux - used so that we can safely delete trips from the watch list
-// @return the number of new trips now being watched
-func watchTrips(trips []*api.TripSchedule, db api.DatabaseInterface, finder api.RouteFinder, watchList map[string]bool, mux *sync.Mutex) {
-	// create a generator that uses the input finder to get routes
-	generator := NewDefaultRouteGenerator(db, finder)
-	for _, t := range trips {
-		// ensure that we're not already watching this trip
-		mux.Lock()
-		_, alreadyWatching := watchList[t.ID]
-		mux.Unlock()
-		if alreadyWatching {
-			continue
+// SendAlert is called by the scheduler each time a trip reaches one of its
+// reminders. The alert is only queued if this tripwatcher still owns the
+// trip so that two tripwatchers never notify for the same trip. The final
+// reminder is queued in the same transaction that completes the trip
+// occurrence, so if this fails the trip will be watched again and retried on
+// the next check
+// @param final - true if this is the trip's last reminder
+func (a *Alerter) SendAlert(trip *api.TripSchedule, route *api.RouteOption, reminder api.Reminder, final bool) {
+	owned, err := api.HasLease(a.leases, a.instanceID, trip)
+	if err != nil {
+		fmt.Println("Not sending alert, couldn't check lease:", err)
+		return
+	}
+	if !owned {
+		fmt.Println("Not sending alert, trip", trip.ID, "is owned by another tripwatcher")
+		return
+	}
+	now := time.Now()
+	detail := string(reminder.Kind)
+	if !final {
+		// earlier reminders don't complete the occurrence, each one is
+		// tracked separately using its kind
+		if !api.IsEnabled(a.db, trip) || now.After(route.DepartureTime.Time) ||
+			api.IsSkipped(trip, route.DepartureTime.Time) {
+			return
 		}
-		// clear out disabled non-repeating trips
-		if !t.Enabled && !api.IsRepeating(t) {
-			// Delete a few hours after the arrival date
-			if tripHasPast(t) {
-				api.DeleteTrip(db, t.ID, t.User.ID)
-				// delete the trip from the watch list
-				mux.Lock()
-				delete(watchList, t.ID)
-				mux.Unlock()
-			}
-			continue
+		fmt.Println("Sending", reminder.Kind, "reminder for", route.Description)
+		message := a.messages.reminderMessage(trip, route, reminder, scheduledDeparture(trip))
+		notification := routeNotification(trip, route, api.LeaveNotification, message, detail)
+		notification.Scheduled = route.DepartureTime.Add(-reminderBuffer(reminder))
+		// the user needs to leave now, so this is sent even during quiet
+		// hours
+		notification.Urgent = reminder.Kind == api.ReminderLeaveNow
+		a.Queue(notification)
+		return
+	}
+	notificationTime := route.DepartureTime.Add(-reminderBuffer(reminder))
+	outcome := api.OccurrenceNotified
+	var notification *api.Notification
+	switch {
+	// check that it's still enabled
+	case !api.IsEnabled(a.db, trip):
+		outcome = api.OccurrenceDisabled
+	// skipped occurrences are normally passed over before they're watched,
+	// this catches trips where every occurrence is skipped
+	case api.IsSkipped(trip, route.DepartureTime.Time):
+		fmt.Println("Skipping alert for", route.Description)
+		outcome = api.OccurrenceSkipped
+	// tripwatcher wasn't running in time to send the alert
+	case now.After(route.DepartureTime.Time):
+		fmt.Println("Missed alert for", route.Description)
+		outcome = api.OccurrenceMissed
+	case now.Sub(notificationTime) > lateAlertThreshold:
+		fmt.Println("Sending late alert for", route.Description)
+		outcome = api.OccurrenceLate
+		message := a.messages.lateAlertMessage(trip, route, scheduledDeparture(trip))
+		notification = routeNotification(trip, route, api.LeaveNotification, message, detail)
+	default:
+		fmt.Println("Sending alert for", route.Description)
+		message := a.messages.reminderMessage(trip, route, reminder, scheduledDeparture(trip))
+		notification = routeNotification(trip, route, api.LeaveNotification, message, detail)
+	}
+	if notification != nil {
+		notification.Scheduled = notificationTime
+	}
+	record := api.NewTripOccurrence(trip, outcome, route, api.UnixTime{now})
+	// this will delete the scheduled trip if it's not repeating
+	queued, err := api.CompleteOccurrence(a.outbox, trip, record, notification)
+	if err != nil {
+		fmt.Println("Failed to complete trip", trip.ID, err)
+		return
+	}
+	if queued {
+		a.dispatcher.Wake()
+	}
+}
+
+// Queue will store the notification in the outbox unless it has already
+// been queued. This is used for everything other than the trip's final
+// alert, so notifications that aren't urgent are dropped during the user's
+// quiet hours or if they've turned this kind off. Dropped notifications are
+// recorded in the notification log
+func (a *Alerter) Queue(notification *api.Notification) {
+	now := time.Now()
+	if !a.allowsNotification(notification, now) {
+		fmt.Println("Not queueing notification", notification.DedupeKey, "due to user preferences")
+		entry := api.NewNotificationLogEntry(notification, "", api.DeliverySuppressed, nil, now)
+		if err := api.LogDelivery(a.log, entry); err != nil {
+			fmt.Println("Failed to log notification", notification.DedupeKey, err)
 		}
-		mux.Lock()
-		// add trip to watch list
-		watchList[t.ID] = true
-		mux.Unlock()
-		// in the background wait for the trip to reach notification
-		// time
-		go func(trip *api.TripSchedule) {
-			watchTrip(trip, generator)
-			// check that it's still enabled
-			if api.IsEnabled(db, trip) {
-				// send alert
-				fmt.Println("Sending alert for", trip.Route.Description)
-				sendNotification(trip.Route, trip.User)
-			}
-			// delete scheduled trip if it's not repeating
-			if !api.IsRepeating(trip) {
-				api.DeleteTrip(db, trip.ID, trip.User.ID)
-			} else {
-				api.SetLastNotificationTime(db, trip, time.Now().Unix()*1000)
-			}
-			// delete the trip from the watch list
-			mux.Lock()
-			delete(watchList, trip.ID)
-			mux.Unlock()
-		}(t)
+		return
+	}
+	queued, err := api.QueueNotification(a.outbox, notification)
+	if err != nil {
+		fmt.Println("Failed to queue notification", notification.DedupeKey, err)
+		return
+	}
+	if queued {
+		a.dispatcher.Wake()
 	}
 }
 
+// allowsNotification returns true if the user's preferences allow the
+// notification to be sent at this time. If the preferences can't be loaded
+// then the notification is sent
+func (a *Alerter) allowsNotification(notification *api.Notification, now time.Time) bool {
+	if notification.User == nil {
+		return true
+	}
+	preferences, err := api.GetPreferences(a.preferences, notification.User.ID)
+	if err != nil {
+		fmt.Println("Failed to get preferences for", notification.User.ID, err)
+		return true
+	}
+	return preferences.AllowsNotification(notification, now)
+}
+
+// tripChanged returns true if the trip has changed in a way that affects
+// when the alert is sent
+func tripChanged(a *api.TripSchedule, b *api.TripSchedule) bool {
+	if !a.Route.DepartureTime.Equal(b.Route.DepartureTime.Time) ||
+		a.Route.Description != b.Route.Description ||
+		a.WaitingWindowMs != b.WaitingWindowMs ||
+		a.LastNotificationSent != b.LastNotificationSent ||
+		a.ArrivalWindowMs != b.ArrivalWindowMs ||
+		a.Ranking != b.Ranking ||
+		a.DelayThresholdMs != b.DelayThresholdMs ||
+		len(a.RepeatDays) != len(b.RepeatDays) ||
+		len(a.Reminders) != len(b.Reminders) {
+		return true
+	}
+	if !reflect.DeepEqual(api.TripExceptions(a), api.TripExceptions(b)) {
+		return true
+	}
+	if a.InputArrivalTime != nil && b.InputArrivalTime != nil &&
+		a.InputArrivalTime.Timestamp != b.InputArrivalTime.Timestamp {
+		return true
+	}
+	for i := range a.RepeatDays {
+		if a.RepeatDays[i] != b.RepeatDays[i] {
+			return true
+		}
+	}
+	for i := range a.Reminders {
+		if a.Reminders[i] != b.Reminders[i] {
+			return true
+		}
+	}
+	return false
+}
+
 func roundToNextInterval(timeLeft time.Duration) time.Duration {
 	if timeLeft > 1*time.Hour {
 		// wait until an hour before starting checks
@@ -172,67 +470,6 @@ func roundToNextInterval(timeLeft time.Duration) time.Duration {
 	return time.Duration(rounded) * time.Minute
 }
 
-// watchTrip will watch the trip using the specified generator to generate
-// new routes and will return the latest route when it's reached notification
-// time
-func watchTrip(trip *api.TripSchedule, generator RouteGenerator) *api.RouteOption {
-	now := time.Now()
-	// add some extra time to the waiting window since push notification won't be instant
-	waitingWindow := time.Duration(trip.WaitingWindowMs) * time.Millisecond
-	safetyBuffer := waitingWindow + waitingWindowThreshold
-	// get next departure time
-	departureTime := api.GetDepartureTime(trip)
-	notificationTime := departureTime.Add(-safetyBuffer)
-	// time until notification should be sent
-	timeout := notificationTime.Sub(now)
-	// create a new route with current dates as opposed to the stored ones
-	// from the original schedule
-	// this variable will keep track of the last valid route for this trip
-	prevRoute := updateRouteDates(trip.Route, departureTime)
-	for {
-		// We select on a timeout or until a route has been found so that
-		// we will always send a notification instead of potentially failing
-		// on slow or unresponsive route requests
-		select {
-		case route := <-generator.GenerateRoute(trip):
-			if route == nil {
-				route = prevRoute
-			}
-			// store this route
-			prevRoute = route
-			now = time.Now()
-			// calculate next notification time
-			notificationTime = route.DepartureTime.Add(-safetyBuffer)
-			timeLeft := notificationTime.Sub(now)
-			if timeLeft <= 0 {
-				return prevRoute
-			}
-			// get the next time that we should re-check the route
-			nextCheck := roundToNextInterval(timeLeft)
-			// ensure that we don't overshoot the notification time
-			if now.Add(nextCheck).After(notificationTime) {
-				nextCheck = now.Sub(notificationTime)
-			}
-			// sleep until next check
-			time.Sleep(nextCheck)
-			// if we've reached or passed the notification time then we're done
-			if time.Now().UnixNano() >= notificationTime.UnixNano() {
-				return prevRoute
-			}
-			// update the timeout so that we don't miss the notification
-			// time while waiting for a response
-			now = time.Now()
-			timeout = notificationTime.Sub(now)
-		case <-time.After(timeout):
-			// check whether we should have finished by now
-			now = time.Now()
-			if notificationTime.Sub(now) <= 0 {
-				return prevRoute
-			}
-		}
-	}
-}
-
 // GenerateRoute will send a route back over the returned channel.
 // The returned route will be the most similar route available to that
 // specified in the input trip.
@@ -246,17 +483,72 @@ func (g *DefaultRouteGenerator) GenerateRoute(trip *api.TripSchedule) <-chan *ap
 	// will send a route over the channel
 	go func() {
 		defer close(channel)
-		route, err := api.GetRoute(g.finder, trip)
+		// trips with an arrival window will choose the best service each time
+		route, err := api.GetBestRoute(g.finder, trip)
 		if err != nil {
 			fmt.Println(err)
 			channel <- nil
 			return
 		}
+		if route.Status != api.RouteScheduled {
+			channel <- g.replaceCancelledRoute(trip, route)
+			return
+		}
 		channel <- &route
 	}()
 	return channel
 }
 
+// replaceCancelledRoute will find another service for a trip whose route is
+// no longer running and let the user know which service to catch instead.
+// The user is only notified once per cancelled service
+// @returns the replacement route or nil if there are no other services that
+// arrive in time
+func (g *DefaultRouteGenerator) replaceCancelledRoute(trip *api.TripSchedule, cancelled api.RouteOption) *api.RouteOption {
+	var replacement *api.RouteOption
+	route, err := api.FindReplacementRoute(g.finder, trip, cancelled)
+	if err != nil {
+		fmt.Println(err)
+	} else {
+		replacement = &route
+	}
+	// the outbox ensures this is only sent once per cancelled service
+	detail := fmt.Sprintf("%d", cancelled.DepartureTime.Unix())
+	notification := api.NewNotification(trip, api.CancellationNotification,
+		g.alerter.messages.cancellationMessage(trip, cancelled, replacement), detail)
+	notification.Route = &cancelled
+	g.alerter.Queue(notification)
+	return replacement
+}
+
+// routeNotification creates a notification that won't be delivered after
+// the route has departed
+func routeNotification(trip *api.TripSchedule, route *api.RouteOption, kind api.NotificationKind, message string, detail string) *api.Notification {
+	notification := api.NewNotification(trip, kind, message, detail)
+	notification.Route = route
+	notification.Expires = route.DepartureTime.Time
+	return notification
+}
+
+// localTime converts the time to the trip's timezone so that it can be
+// shown to the user
+func localTime(trip *api.TripSchedule, t time.Time) time.Time {
+	if trip.InputArrivalTime != nil {
+		loc, err := time.LoadLocation(trip.InputArrivalTime.TimezoneLocation)
+		if err == nil {
+			return t.In(loc)
+		}
+	}
+	return t
+}
+
+// reminderBuffer is how long before departure the reminder should be sent.
+// This adds `reminderSafetyBuffer` to the reminder's offset
+func reminderBuffer(reminder api.Reminder) time.Duration {
+	offset := time.Duration(reminder.OffsetMs) * time.Millisecond
+	return offset + reminderSafetyBuffer
+}
+
 func tripHasPast(trip *api.TripSchedule) bool {
 	// check whether it's safe to delete a disabled trip
 	now := time.Now()
@@ -266,10 +558,14 @@ func tripHasPast(trip *api.TripSchedule) bool {
 }
 
 // updateRouteDates returns a new RouteOption that has updated dates based on
-// the input timestamp, so that all dates share the same day
+// the input timestamp, so that all dates share the same day. The stored route
+// is only as good as the schedule it was found with, so it's always labelled
+// as coming from the schedule
 func updateRouteDates(route *api.RouteOption, departureTime time.Time) *api.RouteOption {
 	if route.DepartureTime.Equal(departureTime) {
-		return route
+		scheduled := *route
+		scheduled.Provider = api.ScheduleProvider
+		return &scheduled
 	}
 	// create new dates based on new departure time where the time of
 	// day is left intact
@@ -290,44 +586,8 @@ func updateRouteDates(route *api.RouteOption, departureTime time.Time) *api.Rout
 		ArrivalTime:   api.UnixTime{arrival},
 		Name:          route.Name,
 		Description:   route.Description,
+		Provider:      api.ScheduleProvider,
+		Fingerprint:   route.Fingerprint,
 	}
 	return newRoute
 }
-
-func sendNotification(route *api.RouteOption, user *api.UserInfo) error {
-	// If using with production you must specify a Topic in this struct
-	req := gorush.PushNotification{
-		Tokens:  []string{user.NotificationToken},
-		Message: fmt.Sprintf("Time to leave for route: %s", route.Description),
-		Sound:   "default",
-	}
-	if user.DeviceOS == IOS {
-		req.Platform = gorush.PlatFormIos
-		err := gorush.CheckMessage(req)
-		if err != nil {
-			fmt.Println(err)
-		}
-		if err := gorush.InitAppStatus(); err != nil {
-			fmt.Println(err)
-			return err
-		}
-		if err := gorush.InitAPNSClient(); err != nil {
-			fmt.Println(err)
-			return err
-		}
-		gorush.PushToIOS(req)
-	} else {
-		req.Platform = gorush.PlatFormAndroid
-		// You can specify the notification icon that the client will use here
-		err := gorush.CheckMessage(req)
-		if err != nil {
-			fmt.Println(err)
-		}
-		if err := gorush.InitAppStatus(); err != nil {
-			fmt.Println(err)
-			return err
-		}
-		gorush.PushToAndroid(req)
-	}
-	return nil
-}
@@ -65,9 +65,29 @@ func (g *MockGenerator) GenerateRoute(trip *api.TripSchedule) <-chan *api.RouteO
 	return channel
 }
 
+// watchWithScheduler will watch the trip and return the route that the
+// alert was sent for
+func watchWithScheduler(t *testing.T, trip *api.TripSchedule, generator RouteGenerator) *api.RouteOption {
+	alerts := make(chan *api.RouteOption, 1)
+	scheduler := NewScheduler(generator, 1, func(trip *api.TripSchedule, route *api.RouteOption, reminder api.Reminder, final bool) {
+		alerts <- route
+	})
+	scheduler.Start()
+	defer scheduler.Stop()
+	scheduler.Watch(trip)
+	select {
+	case route := <-alerts:
+		return route
+	case <-time.After(5 * time.Second):
+		t.Fatal("Alert was not sent")
+	}
+	return nil
+}
+
 func TestWatchTrip(t *testing.T) {
 	now := time.Now()
 	trip := &api.TripSchedule{
+		ID: "1",
 		Route: &api.RouteOption{
 			Description:   "Original description",
 			DepartureTime: api.UnixTime{now.Add(2 * time.Hour)},
@@ -78,7 +98,7 @@ func TestWatchTrip(t *testing.T) {
 		Description:   "Test description",
 		DepartureTime: api.UnixTime{now},
 	}
-	result := watchTrip(trip, NewMockGenerator(route, 0))
+	result := watchWithScheduler(t, trip, NewMockGenerator(route, 0))
 	if result != route {
 		t.Error("Expected", result, "to equal", route)
 	}
@@ -86,7 +106,7 @@ func TestWatchTrip(t *testing.T) {
 
 func TestWatchTripTimesOut(t *testing.T) {
 	now := time.Now()
-	originalDepartureTime := now.Add(100 * time.Millisecond)
+	originalDepartureTime := now.Add(reminderSafetyBuffer + 100*time.Millisecond)
 	originalRoute := &api.RouteOption{
 		Description: "Original description",
 		// Truncate to millisecond level since the API will retrieve trips
@@ -94,6 +114,7 @@ func TestWatchTripTimesOut(t *testing.T) {
 		DepartureTime: api.UnixTime{originalDepartureTime.Truncate(time.Millisecond)},
 	}
 	trip := &api.TripSchedule{
+		ID:         "1",
 		Route:      originalRoute,
 		RepeatDays: []bool{false, false, false, false, false, false, false},
 	}
@@ -103,9 +124,84 @@ func TestWatchTripTimesOut(t *testing.T) {
 	}
 	// The route will be returned after 200ms but the watcher will timeout
 	// at 100ms
-	result := watchTrip(trip, NewMockGenerator(route, 200))
-	if result != originalRoute {
-		t.Error("Expected", result, "to equal", originalRoute)
+	result := watchWithScheduler(t, trip, NewMockGenerator(route, 200))
+	// the original route is used but labelled as coming from the schedule
+	if result.Description != originalRoute.Description || result.Provider != api.ScheduleProvider {
+		t.Error("Expected", originalRoute, "found", result)
+	}
+}
+
+func TestSchedulerCancel(t *testing.T) {
+	now := time.Now()
+	trip := &api.TripSchedule{
+		ID: "1",
+		Route: &api.RouteOption{
+			Description:   "Original description",
+			DepartureTime: api.UnixTime{now.Add(reminderSafetyBuffer + 100*time.Millisecond)},
+		},
+		RepeatDays: []bool{false, false, false, false, false, false, false},
+	}
+	alerts := make(chan *api.RouteOption, 1)
+	scheduler := NewScheduler(NewMockGenerator(nil, 0), 1, func(trip *api.TripSchedule, route *api.RouteOption, reminder api.Reminder, final bool) {
+		alerts <- route
+	})
+	scheduler.Start()
+	defer scheduler.Stop()
+	if !scheduler.Watch(trip) {
+		t.Fatal("Expected trip to be watched")
+	}
+	if scheduler.Watch(trip) {
+		t.Error("Expected trip to only be watched once")
+	}
+	if !scheduler.Cancel(trip.ID) {
+		t.Error("Expected trip to be cancelled")
+	}
+	select {
+	case <-alerts:
+		t.Error("Alert sent for cancelled trip")
+	case <-time.After(300 * time.Millisecond):
+	}
+	if len(scheduler.WatchedTrips()) != 0 {
+		t.Error("Expected", 0, "trips, found", scheduler.WatchedTrips())
+	}
+}
+
+func TestSchedulerReschedule(t *testing.T) {
+	now := time.Now()
+	trip := &api.TripSchedule{
+		ID: "1",
+		Route: &api.RouteOption{
+			Description:   "Original description",
+			DepartureTime: api.UnixTime{now.Add(2 * time.Hour)},
+		},
+		RepeatDays: []bool{false, false, false, false, false, false, false},
+	}
+	alerts := make(chan *api.RouteOption, 1)
+	scheduler := NewScheduler(NewMockGenerator(nil, 0), 1, func(trip *api.TripSchedule, route *api.RouteOption, reminder api.Reminder, final bool) {
+		alerts <- route
+	})
+	scheduler.Start()
+	defer scheduler.Stop()
+	scheduler.Watch(trip)
+	// move the trip forward so that it's due
+	rescheduled := &api.TripSchedule{
+		ID: "1",
+		Route: &api.RouteOption{
+			Description:   "Rescheduled description",
+			DepartureTime: api.UnixTime{now.Add(reminderSafetyBuffer + 100*time.Millisecond).Truncate(time.Millisecond)},
+		},
+		RepeatDays: []bool{false, false, false, false, false, false, false},
+	}
+	if !scheduler.Reschedule(rescheduled) {
+		t.Fatal("Expected trip to be rescheduled")
+	}
+	select {
+	case route := <-alerts:
+		if route.Description != rescheduled.Route.Description {
+			t.Error("Expected", rescheduled.Route, "found", route)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Alert was not sent for rescheduled trip")
 	}
 }
 
@@ -157,3 +253,152 @@ func TestUpdateRouteDates(t *testing.T) {
 		t.Error("Expected", resultTimeOfDay, "to equal", expectedTimeOfDay)
 	}
 }
+
+func TestHandleTripChangeWatchesNewTrip(t *testing.T) {
+	db := NewMockDatabase()
+	trip := testTrip(time.Now().Add(time.Hour))
+	trip.Enabled = true
+	db.trips[trip.ID] = trip
+	scheduler := NewScheduler(NewMockGenerator(nil, 0), 1, nil)
+	handleTripChange(api.TripChange{TripID: trip.ID}, db, db, scheduler, "watcher-1")
+	if scheduler.Trip(trip.ID) == nil {
+		t.Error("Expected trip", trip.ID, "to be watched")
+	}
+}
+
+func TestHandleTripChangeIgnoresTripOwnedElsewhere(t *testing.T) {
+	db := NewMockDatabase()
+	trip := testTrip(time.Now().Add(time.Hour))
+	trip.Enabled = true
+	db.trips[trip.ID] = trip
+	db.leased[trip.ID] = true
+	scheduler := NewScheduler(NewMockGenerator(nil, 0), 1, nil)
+	handleTripChange(api.TripChange{TripID: trip.ID}, db, db, scheduler, "watcher-1")
+	if scheduler.Trip(trip.ID) != nil {
+		t.Error("Expected trip owned by another tripwatcher to not be watched")
+	}
+}
+
+func TestHandleTripChangeReschedulesChangedTrip(t *testing.T) {
+	db := NewMockDatabase()
+	trip := testTrip(time.Now().Add(time.Hour))
+	trip.Enabled = true
+	scheduler := NewScheduler(NewMockGenerator(nil, 0), 1, nil)
+	scheduler.Watch(trip)
+	changed := testTrip(time.Now().Add(2 * time.Hour))
+	changed.Enabled = true
+	db.trips[trip.ID] = changed
+	// even if the lease can't be claimed the watched trip is already owned
+	db.leased[trip.ID] = true
+	handleTripChange(api.TripChange{TripID: trip.ID}, db, db, scheduler, "watcher-1")
+	watched := scheduler.Trip(trip.ID)
+	if watched == nil {
+		t.Fatal("Expected trip", trip.ID, "to be watched")
+	}
+	if !watched.Route.DepartureTime.Equal(changed.Route.DepartureTime.Time) {
+		t.Error("Expected", changed.Route.DepartureTime, "found", watched.Route.DepartureTime)
+	}
+}
+
+func TestHandleTripChangeCancelsDeletedTrip(t *testing.T) {
+	db := NewMockDatabase()
+	trip := testTrip(time.Now().Add(time.Hour))
+	trip.Enabled = true
+	scheduler := NewScheduler(NewMockGenerator(nil, 0), 1, nil)
+	scheduler.Watch(trip)
+	handleTripChange(api.TripChange{TripID: trip.ID, Deleted: true}, db, db, scheduler, "watcher-1")
+	if scheduler.Trip(trip.ID) != nil {
+		t.Error("Expected deleted trip to no longer be watched")
+	}
+}
+
+type reminderAlert struct {
+	kind  api.ReminderKind
+	final bool
+}
+
+// watchReminders will watch the trip and return the reminders that were
+// sent until the final one
+func watchReminders(t *testing.T, trip *api.TripSchedule) []reminderAlert {
+	alerts := make(chan reminderAlert, 10)
+	scheduler := NewScheduler(NewMockGenerator(nil, 0), 1, func(trip *api.TripSchedule, route *api.RouteOption, reminder api.Reminder, final bool) {
+		alerts <- reminderAlert{kind: reminder.Kind, final: final}
+	})
+	scheduler.Start()
+	defer scheduler.Stop()
+	scheduler.Watch(trip)
+	sent := []reminderAlert{}
+	for {
+		select {
+		case alert := <-alerts:
+			sent = append(sent, alert)
+			if alert.final {
+				return sent
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("Timed out waiting for reminders, found", sent)
+		}
+	}
+}
+
+func TestSchedulerSendsRemindersInOrder(t *testing.T) {
+	trip := &api.TripSchedule{
+		ID: "1",
+		Route: &api.RouteOption{
+			Description:   "Original description",
+			DepartureTime: api.UnixTime{time.Now().Add(reminderSafetyBuffer + 400*time.Millisecond)},
+		},
+		RepeatDays: []bool{false, false, false, false, false, false, false},
+		Reminders: []api.Reminder{
+			{OffsetMs: 0, Kind: api.ReminderLeaveNow},
+			{OffsetMs: 300, Kind: api.ReminderGetReady},
+		},
+	}
+	sent := watchReminders(t, trip)
+	expected := []reminderAlert{
+		{kind: api.ReminderGetReady, final: false},
+		{kind: api.ReminderLeaveNow, final: true},
+	}
+	if len(sent) != len(expected) {
+		t.Fatal("Expected", expected, "found", sent)
+	}
+	for i := range expected {
+		if sent[i] != expected[i] {
+			t.Error("Expected", expected[i], "found", sent[i])
+		}
+	}
+}
+
+func TestSchedulerSkipsOverdueReminders(t *testing.T) {
+	// both reminders are overdue, such as after tripwatcher was restarted
+	trip := &api.TripSchedule{
+		ID: "1",
+		Route: &api.RouteOption{
+			Description:   "Original description",
+			DepartureTime: api.UnixTime{time.Now().Add(5 * time.Second)},
+		},
+		RepeatDays: []bool{false, false, false, false, false, false, false},
+		Reminders: []api.Reminder{
+			{OffsetMs: 10 * 60 * 1000, Kind: api.ReminderGetReady},
+			{OffsetMs: 60 * 1000, Kind: api.ReminderLeaveNow},
+		},
+	}
+	sent := watchReminders(t, trip)
+	if len(sent) != 1 || sent[0].kind != api.ReminderLeaveNow {
+		t.Error("Expected only", api.ReminderLeaveNow, "found", sent)
+	}
+}
+
+func TestHandleTripChangePausesTripWithInvalidToken(t *testing.T) {
+	db := NewMockDatabase()
+	trip := testTrip(time.Now().Add(time.Hour))
+	trip.Enabled = true
+	trip.User.NeedsReregister = true
+	db.trips[trip.ID] = trip
+	scheduler := NewScheduler(NewMockGenerator(nil, 0), 1, nil)
+	scheduler.Watch(trip)
+	handleTripChange(api.TripChange{TripID: trip.ID}, db, db, scheduler, "watcher-1")
+	if scheduler.Trip(trip.ID) != nil {
+		t.Error("Expected trip to be paused")
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/oliveroneill/todserver/api"
+	"io/ioutil"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// the kinds of message that can be templated. Reminders use their
+// `ReminderKind` as the message kind
+const (
+	lateAlertMessageKind    = "late_alert"
+	cancellationMessageKind = "cancellation"
+	delayMessageKind        = "delay"
+	// included by other templates to describe how late the service is
+	delayNoteMessageKind = "delay_note"
+)
+
+// defaultLocale is used for users that haven't set a locale or whose locale
+// has no templates
+const defaultLocale = "en"
+
+// defaultMessages are the English templates. Locales that only set some
+// messages will use these for the rest
+var defaultMessages = map[string]string{
+	delayNoteMessageKind: `{{if .Late}} ({{.DelayMinutes}} min late){{else if .Early}} ({{.DelayMinutes}} min early){{end}}`,
+	string(api.ReminderGetReady): `Get ready to leave for {{.Service}}{{if .BoardingStop}} from {{.BoardingStop}}{{end}}, ` +
+		`departing at {{.Departure.Format "3:04pm"}}{{template "delay_note" .}}`,
+	string(api.ReminderLeaveNow): `Time to leave for {{.Service}}{{if .BoardingStop}} from {{.BoardingStop}}{{end}}, ` +
+		`departing at {{.Departure.Format "3:04pm"}}{{template "delay_note" .}} and arriving at {{.Arrival.Format "3:04pm"}}`,
+	string(api.ReminderLastChance): `Last chance to leave for {{.Service}}, ` +
+		`departing at {{.Departure.Format "3:04pm"}}{{template "delay_note" .}}`,
+	lateAlertMessageKind: `Leave now for {{.Service}}, departing at {{.Departure.Format "3:04pm"}}{{template "delay_note" .}}, ` +
+		`this alert was delayed`,
+	cancellationMessageKind: `Your {{.Cancelled}} service {{if .StopSkipped}}will not stop for you{{else}}was cancelled{{end}}` +
+		`{{if .HasReplacement}}, leave for {{.Line}}{{if .BoardingStop}} from {{.BoardingStop}}{{end}} ` +
+		`at {{.Departure.Format "3:04pm"}} instead{{else}} and no other services arrive in time{{end}}`,
+	delayMessageKind: `{{if .Late}}Your {{.Line}} service is running {{.DelayMinutes}} minutes late, ` +
+		`{{else if .Early}}Your {{.Line}} service is running {{.DelayMinutes}} minutes early, ` +
+		`{{else}}Your trip has changed, {{end}}` +
+		`it now departs at {{.Departure.Format "3:04pm"}} and arrives at {{.Arrival.Format "3:04pm"}}`,
+}
+
+// MessageData is what's available to message templates. Times are in the
+// trip's timezone
+type MessageData struct {
+	Description string
+	// the line for trips with an arrival window, since the service can
+	// change each day, otherwise the route's description
+	Service string
+	// the line of the first transit leg, or the route's name
+	Line string
+	// the stop where the user boards their first transit leg, this is
+	// empty if it isn't known
+	BoardingStop string
+	Departure    time.Time
+	Arrival      time.Time
+	// how far the departure is from the timetable, in whole minutes
+	DelayMinutes int
+	Late         bool
+	Early        bool
+	// the line that's no longer running, for cancellations
+	Cancelled   string
+	StopSkipped bool
+	// false if a cancelled service has nothing to replace it
+	HasReplacement bool
+}
+
+// MessageTemplates creates notification text for each user's locale
+type MessageTemplates struct {
+	locales map[string]*template.Template
+}
+
+// DefaultMessageTemplates will create MessageTemplates that only use the
+// English messages
+func DefaultMessageTemplates() *MessageTemplates {
+	templates, err := NewMessageTemplates(nil)
+	if err != nil {
+		// the default messages are tested so this should never happen
+		panic(err)
+	}
+	return templates
+}
+
+// LoadMessageTemplates will read templates from a JSON file mapping each
+// locale to its messages by kind
+func LoadMessageTemplates(path string) (*MessageTemplates, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var locales map[string]map[string]string
+	if err := json.Unmarshal(b, &locales); err != nil {
+		return nil, err
+	}
+	return NewMessageTemplates(locales)
+}
+
+// NewMessageTemplates will parse the templates for each locale. Each
+// template is run against sample data so that mistakes are found on start
+// up rather than when sending a notification
+// @param locales - messages by kind for each locale, such as "en" or "fr-CA"
+func NewMessageTemplates(locales map[string]map[string]string) (*MessageTemplates, error) {
+	m := &MessageTemplates{locales: make(map[string]*template.Template)}
+	if _, ok := locales[defaultLocale]; !ok {
+		locales = copyLocales(locales)
+		locales[defaultLocale] = map[string]string{}
+	}
+	for locale, messages := range locales {
+		t := template.New(locale)
+		for kind, text := range defaultMessages {
+			if _, ok := messages[kind]; ok {
+				continue
+			}
+			if _, err := t.New(kind).Parse(text); err != nil {
+				return nil, err
+			}
+		}
+		for kind, text := range messages {
+			if _, ok := defaultMessages[kind]; !ok {
+				return nil, fmt.Errorf("Unknown message kind %s for %s", kind, locale)
+			}
+			if _, err := t.New(kind).Parse(text); err != nil {
+				return nil, fmt.Errorf("Invalid %s message for %s: %v", kind, locale, err)
+			}
+		}
+		for kind := range defaultMessages {
+			if err := t.ExecuteTemplate(ioutil.Discard, kind, sampleMessageData()); err != nil {
+				return nil, fmt.Errorf("Invalid %s message for %s: %v", kind, locale, err)
+			}
+		}
+		m.locales[normaliseLocale(locale)] = t
+	}
+	return m, nil
+}
+
+// Render will create the message for the user's locale
+// @param kind - the reminder kind or one of the other message kinds
+func (m *MessageTemplates) Render(kind string, locale string, data MessageData) string {
+	var b bytes.Buffer
+	err := m.templateFor(locale).ExecuteTemplate(&b, kind, data)
+	if err == nil {
+		return b.String()
+	}
+	fmt.Println("Failed to render", kind, "message for", locale, err)
+	b.Reset()
+	if err := m.locales[defaultLocale].ExecuteTemplate(&b, kind, data); err != nil {
+		fmt.Println(err)
+		return data.Description
+	}
+	return b.String()
+}
+
+// templateFor returns the templates for the locale. If there are none then
+// the language without its region is tried and then the default locale
+func (m *MessageTemplates) templateFor(locale string) *template.Template {
+	locale = normaliseLocale(locale)
+	if t, ok := m.locales[locale]; ok {
+		return t
+	}
+	if i := strings.Index(locale, "-"); i > 0 {
+		if t, ok := m.locales[locale[:i]]; ok {
+			return t
+		}
+	}
+	return m.locales[defaultLocale]
+}
+
+// reminderMessage returns the notification text for the reminder
+// @param scheduledDeparture - the timetabled departure, used to work out
+// how late the service is. If this is zero then no delay is shown
+func (m *MessageTemplates) reminderMessage(trip *api.TripSchedule, route *api.RouteOption, reminder api.Reminder, scheduledDeparture time.Time) string {
+	data := newMessageData(trip, route, scheduledDeparture)
+	return m.Render(string(reminder.Kind), userLocale(trip), data)
+}
+
+// lateAlertMessage is used when the alert couldn't be sent at notification
+// time but there's still time to leave
+func (m *MessageTemplates) lateAlertMessage(trip *api.TripSchedule, route *api.RouteOption, scheduledDeparture time.Time) string {
+	data := newMessageData(trip, route, scheduledDeparture)
+	return m.Render(lateAlertMessageKind, userLocale(trip), data)
+}
+
+// cancellationMessage returns the notification text used to tell the user
+// that their service is no longer running
+// @param replacement - the service to catch instead, this can be nil
+func (m *MessageTemplates) cancellationMessage(trip *api.TripSchedule, cancelled api.RouteOption, replacement *api.RouteOption) string {
+	data := MessageData{Description: cancelled.Description}
+	if replacement != nil {
+		data = newMessageData(trip, replacement, time.Time{})
+		data.HasReplacement = true
+	}
+	data.Cancelled = lineName(&cancelled)
+	data.StopSkipped = cancelled.Status == api.RouteStopSkipped
+	return m.Render(cancellationMessageKind, userLocale(trip), data)
+}
+
+// delayMessage returns the notification text used to tell the user that
+// their trip has changed
+// @param scheduledDeparture - used to work out how late or early the
+// service is
+func (m *MessageTemplates) delayMessage(trip *api.TripSchedule, route *api.RouteOption, scheduledDeparture time.Time) string {
+	data := newMessageData(trip, route, scheduledDeparture)
+	return m.Render(delayMessageKind, userLocale(trip), data)
+}
+
+// newMessageData returns the template data for the route
+// @param scheduledDeparture - if this isn't zero then it's used to work out
+// the delay
+func newMessageData(trip *api.TripSchedule, route *api.RouteOption, scheduledDeparture time.Time) MessageData {
+	data := MessageData{
+		Description: route.Description,
+		Service:     route.Description,
+		Line:        lineName(route),
+		Departure:   localTime(trip, route.DepartureTime.Time),
+		Arrival:     localTime(trip, route.ArrivalTime.Time),
+	}
+	// trips with an arrival window could be using a different service each
+	// day, so the chosen service is named
+	if api.HasArrivalWindow(trip) {
+		data.Service = data.Line
+	}
+	if route.Fingerprint != nil && len(route.Fingerprint.Transit) > 0 {
+		data.BoardingStop = route.Fingerprint.Transit[0].BoardingStop
+	}
+	if scheduledDeparture.IsZero() {
+		return data
+	}
+	delay := route.DepartureTime.Sub(scheduledDeparture)
+	switch {
+	case delay >= time.Minute:
+		data.Late = true
+		data.DelayMinutes = int(delay.Minutes())
+	case delay <= -time.Minute:
+		data.Early = true
+		data.DelayMinutes = int(-delay.Minutes())
+	}
+	return data
+}
+
+// lineName returns the line of the route's first transit leg, or its name if
+// that isn't known
+func lineName(route *api.RouteOption) string {
+	if route.Fingerprint != nil && len(route.Fingerprint.Transit) > 0 &&
+		len(route.Fingerprint.Transit[0].Line) > 0 {
+		return route.Fingerprint.Transit[0].Line
+	}
+	return route.Name
+}
+
+// scheduledDeparture returns the timetabled departure for the trip's next
+// occurrence. This is zero for trips with an arrival window since there's
+// no single service to compare against
+func scheduledDeparture(trip *api.TripSchedule) time.Time {
+	if api.HasArrivalWindow(trip) {
+		return time.Time{}
+	}
+	return updateRouteDates(trip.Route, api.GetDepartureTime(trip)).DepartureTime.Time
+}
+
+func userLocale(trip *api.TripSchedule) string {
+	if trip.User == nil {
+		return defaultLocale
+	}
+	return trip.User.Locale
+}
+
+// normaliseLocale converts locales such as "fr_CA" to "fr-ca"
+func normaliseLocale(locale string) string {
+	return strings.ToLower(strings.Replace(locale, "_", "-", -1))
+}
+
+func copyLocales(locales map[string]map[string]string) map[string]map[string]string {
+	c := make(map[string]map[string]string)
+	for locale, messages := range locales {
+		c[locale] = messages
+	}
+	return c
+}
+
+// sampleMessageData is used to check that templates can be run
+func sampleMessageData() MessageData {
+	now := time.Now()
+	return MessageData{
+		Description:    "Belconnen Way",
+		Service:        "300",
+		Line:           "300",
+		BoardingStop:   "City Interchange",
+		Departure:      now,
+		Arrival:        now.Add(30 * time.Minute),
+		DelayMinutes:   5,
+		Late:           true,
+		Cancelled:      "300",
+		HasReplacement: true,
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"github.com/oliveroneill/todserver/api"
+	"testing"
+	"time"
+)
+
+func messageTrip() (*api.TripSchedule, *api.RouteOption) {
+	departure := time.Date(2017, 7, 15, 8, 25, 0, 0, time.UTC)
+	route := &api.RouteOption{
+		Name:          "300",
+		Description:   "Belconnen Way",
+		DepartureTime: api.UnixTime{departure},
+		ArrivalTime:   api.UnixTime{departure.Add(30 * time.Minute)},
+	}
+	trip := &api.TripSchedule{
+		User:             &api.UserInfo{ID: "user"},
+		InputArrivalTime: &api.Date{TimezoneLocation: "Australia/Sydney"},
+	}
+	return trip, route
+}
+
+func TestReminderMessageIncludesRouteDetails(t *testing.T) {
+	trip, route := messageTrip()
+	messages := DefaultMessageTemplates()
+	leaveNow := api.Reminder{Kind: api.ReminderLeaveNow}
+	expected := "Time to leave for Belconnen Way, departing at 6:25pm and arriving at 6:55pm"
+	if message := messages.reminderMessage(trip, route, leaveNow, time.Time{}); message != expected {
+		t.Error("Expected", expected, "found", message)
+	}
+	route.Fingerprint = &api.RouteFingerprint{
+		Transit: []api.FingerprintLeg{{Line: "R4", BoardingStop: "City Interchange"}},
+	}
+	// trips with an arrival window name the chosen service
+	trip.ArrivalWindowMs = 20 * 60 * 1000
+	scheduled := route.DepartureTime.Add(-4 * time.Minute)
+	expected = "Time to leave for R4 from City Interchange, departing at 6:25pm (4 min late) and arriving at 6:55pm"
+	if message := messages.reminderMessage(trip, route, leaveNow, scheduled); message != expected {
+		t.Error("Expected", expected, "found", message)
+	}
+}
+
+func TestCancellationMessage(t *testing.T) {
+	trip, route := messageTrip()
+	messages := DefaultMessageTemplates()
+	cancelled := api.RouteOption{Name: "200", Status: api.RouteCancelled}
+	expected := "Your 200 service was cancelled, leave for 300 at 6:25pm instead"
+	if message := messages.cancellationMessage(trip, cancelled, route); message != expected {
+		t.Error("Expected", expected, "found", message)
+	}
+	cancelled.Status = api.RouteStopSkipped
+	expected = "Your 200 service will not stop for you and no other services arrive in time"
+	if message := messages.cancellationMessage(trip, cancelled, nil); message != expected {
+		t.Error("Expected", expected, "found", message)
+	}
+}
+
+func TestMessageTemplatesUseUserLocale(t *testing.T) {
+	trip, route := messageTrip()
+	messages, err := NewMessageTemplates(map[string]map[string]string{
+		"fr": {"leave_now": `Partez pour {{.Service}} à {{.Departure.Format "15:04"}}{{template "delay_note" .}}`},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaveNow := api.Reminder{Kind: api.ReminderLeaveNow}
+	trip.User.Locale = "fr_CA"
+	expected := "Partez pour Belconnen Way à 18:25"
+	if message := messages.reminderMessage(trip, route, leaveNow, time.Time{}); message != expected {
+		t.Error("Expected", expected, "found", message)
+	}
+	// messages that aren't translated use the default
+	lastChance := api.Reminder{Kind: api.ReminderLastChance}
+	expected = "Last chance to leave for Belconnen Way, departing at 6:25pm"
+	if message := messages.reminderMessage(trip, route, lastChance, time.Time{}); message != expected {
+		t.Error("Expected", expected, "found", message)
+	}
+	trip.User.Locale = "de"
+	expected = "Time to leave for Belconnen Way, departing at 6:25pm and arriving at 6:55pm"
+	if message := messages.reminderMessage(trip, route, leaveNow, time.Time{}); message != expected {
+		t.Error("Expected", expected, "found", message)
+	}
+}
+
+func TestNewMessageTemplatesRejectsInvalidTemplates(t *testing.T) {
+	invalid := []map[string]map[string]string{
+		{"fr": {"leave_now": "{{.Service"}},
+		{"fr": {"leave_now": "{{.Unknown}}"}},
+		{"fr": {"unknown": "Partez"}},
+	}
+	for _, locales := range invalid {
+		if _, err := NewMessageTemplates(locales); err == nil {
+			t.Error("Expected error for", locales)
+		}
+	}
+}
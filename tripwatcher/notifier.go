@@ -0,0 +1,214 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/oliveroneill/todserver/api"
+	"io/ioutil"
+	"log"
+	"sync"
+)
+
+// maxCollapseIDLength is the longest collapse ID that APNS accepts
+const maxCollapseIDLength = 64
+
+// Notifier delivers a message to a user
+type Notifier interface {
+	// Notify will send the message along with the structured data, which is
+	// used by the app to open the trip. The data can be nil
+	Notify(message string, data map[string]string, user *api.UserInfo) error
+}
+
+// ProviderNotifier is a Notifier that can report which provider delivered
+// the message, this is recorded in the notification log
+type ProviderNotifier interface {
+	Notifier
+	// NotifyVia will send the message and return the name of the notifier
+	// that was used
+	NotifyVia(message string, data map[string]string, user *api.UserInfo) (string, error)
+}
+
+// NotifierFactory creates a Notifier from its config
+type NotifierFactory func(config api.ProviderConfig) (Notifier, error)
+
+var notifierTypes = map[string]NotifierFactory{
+	"gorush":        newGorushNotifierFromConfig,
+	"gorush-server": newGorushServerNotifierFromConfig,
+	"webhook":       newWebhookNotifierFromConfig,
+	"log":           newLogNotifierFromConfig,
+}
+
+var notifierTypesMux sync.Mutex
+
+// RegisterNotifierType will allow notifiers of this type to be used in the
+// notifier config file
+func RegisterNotifierType(name string, factory NotifierFactory) {
+	notifierTypesMux.Lock()
+	defer notifierTypesMux.Unlock()
+	notifierTypes[name] = factory
+}
+
+// NotifierConfig is the format of the notifier config file
+type NotifierConfig struct {
+	// each notifier by name, the type decides which NotifierFactory is
+	// used and the rest of the fields are passed on to it
+	Notifiers map[string]api.ProviderConfig `json:"notifiers"`
+	// the name of the notifier to use for each device operating system
+	OS map[string]string `json:"os"`
+	// the notifier to try when another one fails, by name
+	Fallbacks map[string]string `json:"fallbacks"`
+	// the notifier used when no other notifier matches the user
+	Default string `json:"default"`
+}
+
+// NotifierRouter is an implementation of Notifier that chooses which
+// notifier to use for each user. The user's chosen channel is used first,
+// then their device operating system and then the default. If the notifier
+// fails then its fallback is tried
+type NotifierRouter struct {
+	notifiers map[string]Notifier
+	os        map[string]string
+	fallbacks map[string]string
+	fallback  string
+}
+
+// LoadNotifierRouter will create a NotifierRouter from a JSON config file
+func LoadNotifierRouter(path string) (*NotifierRouter, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config NotifierConfig
+	if err := json.Unmarshal(b, &config); err != nil {
+		return nil, err
+	}
+	return NewNotifierRouter(config)
+}
+
+// NewNotifierRouter will create every notifier in the config
+func NewNotifierRouter(config NotifierConfig) (*NotifierRouter, error) {
+	router := &NotifierRouter{
+		notifiers: make(map[string]Notifier),
+		os:        config.OS,
+		fallbacks: config.Fallbacks,
+		fallback:  config.Default,
+	}
+	for name, c := range config.Notifiers {
+		notifierTypesMux.Lock()
+		factory, ok := notifierTypes[c.Type]
+		notifierTypesMux.Unlock()
+		if !ok {
+			return nil, fmt.Errorf("Unknown notifier type %s", c.Type)
+		}
+		notifier, err := factory(c)
+		if err != nil {
+			return nil, fmt.Errorf("Notifier %s: %v", name, err)
+		}
+		router.notifiers[name] = notifier
+	}
+	for os, name := range router.os {
+		if _, ok := router.notifiers[name]; !ok {
+			return nil, fmt.Errorf("Unknown notifier %s for %s", name, os)
+		}
+	}
+	for primary, name := range router.fallbacks {
+		if _, ok := router.notifiers[name]; !ok {
+			return nil, fmt.Errorf("Unknown fallback notifier %s for %s", name, primary)
+		}
+	}
+	if _, ok := router.notifiers[router.fallback]; len(router.fallback) > 0 && !ok {
+		return nil, fmt.Errorf("Unknown default notifier %s", router.fallback)
+	}
+	return router, nil
+}
+
+// Notify will send the message using the notifier chosen for this user. If
+// that fails then the notifier's fallback is used
+func (r *NotifierRouter) Notify(message string, data map[string]string, user *api.UserInfo) error {
+	_, err := r.NotifyVia(message, data, user)
+	return err
+}
+
+// NotifyVia will send the message in the same way as `Notify`
+// @returns the name of the notifier that delivered the message, or the
+// chosen notifier if delivery failed
+func (r *NotifierRouter) NotifyVia(message string, data map[string]string, user *api.UserInfo) (string, error) {
+	name := r.notifierFor(user)
+	notifier, ok := r.notifiers[name]
+	if !ok {
+		return "", fmt.Errorf("No notifier configured for %s", user.DeviceOS)
+	}
+	err := notifier.Notify(message, data, user)
+	if err == nil {
+		return name, nil
+	}
+	fallbackName := r.fallbacks[name]
+	fallback, ok := r.notifiers[fallbackName]
+	if !ok || fallbackName == name {
+		return name, err
+	}
+	fmt.Println("Notifier", name, "failed, falling back to", fallbackName, err)
+	if fallbackErr := fallback.Notify(message, data, user); fallbackErr != nil {
+		return name, fmt.Errorf("%s: %v, %s: %v", name, err, fallbackName, fallbackErr)
+	}
+	// the token still needs to be invalidated even though the message was
+	// delivered
+	if invalid, ok := err.(*InvalidTokenError); ok {
+		return fallbackName, &InvalidTokenError{Token: invalid.Token, Reason: invalid.Reason, Delivered: true}
+	}
+	return fallbackName, nil
+}
+
+// notifierFor returns the name of the notifier to use for this user
+func (r *NotifierRouter) notifierFor(user *api.UserInfo) string {
+	if _, ok := r.notifiers[user.Channel]; ok {
+		return user.Channel
+	}
+	if name, ok := r.os[user.DeviceOS]; ok {
+		return name
+	}
+	return r.fallback
+}
+
+// notificationSound returns the sound to play for the user's notifications
+// @returns an empty string if the notification should be silent
+func notificationSound(user *api.UserInfo) string {
+	switch user.Sound {
+	case "":
+		return "default"
+	case api.SilentSound:
+		return ""
+	}
+	return user.Sound
+}
+
+// collapseID returns the key that providers use to drop duplicate
+// deliveries of the same notification. APNS limits this to 64 bytes, so
+// longer keys are hashed
+// @returns an empty string if the notification has no dedupe key
+func collapseID(data map[string]string) string {
+	key := data["dedupe_key"]
+	if len(key) <= maxCollapseIDLength {
+		return key
+	}
+	return fmt.Sprintf("%x", sha1.Sum([]byte(key)))
+}
+
+// LogNotifier is an implementation of Notifier that prints each message.
+// This is useful for development
+type LogNotifier struct{}
+
+func newLogNotifierFromConfig(config api.ProviderConfig) (Notifier, error) {
+	return &LogNotifier{}, nil
+}
+
+// Notify will print the message
+func (n *LogNotifier) Notify(message string, data map[string]string, user *api.UserInfo) error {
+	if user == nil {
+		return errors.New("No user to notify")
+	}
+	log.Printf("Notification for %s (%s): %s\n", user.ID, user.DeviceOS, message)
+	return nil
+}
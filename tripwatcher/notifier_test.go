@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/oliveroneill/todserver/api"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// FakeNotifier records every message instead of sending it
+type FakeNotifier struct {
+	messages []string
+	data     []map[string]string
+	users    []*api.UserInfo
+	// returned from every call to Notify
+	err error
+	mux sync.Mutex
+}
+
+func (n *FakeNotifier) Notify(message string, data map[string]string, user *api.UserInfo) error {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	n.messages = append(n.messages, message)
+	n.data = append(n.data, data)
+	n.users = append(n.users, user)
+	return n.err
+}
+
+func (n *FakeNotifier) Messages() []string {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	return append([]string{}, n.messages...)
+}
+
+func TestNotifierRouter(t *testing.T) {
+	apns := &FakeNotifier{}
+	webhook := &FakeNotifier{}
+	logger := &FakeNotifier{}
+	router := &NotifierRouter{
+		notifiers: map[string]Notifier{"apns": apns, "webhook": webhook, "log": logger},
+		os:        map[string]string{IOS: "apns"},
+		fallback:  "log",
+	}
+	router.Notify("ios", nil, &api.UserInfo{DeviceOS: IOS})
+	router.Notify("chosen", nil, &api.UserInfo{DeviceOS: IOS, Channel: "webhook"})
+	router.Notify("other", nil, &api.UserInfo{DeviceOS: "windows"})
+	if messages := apns.Messages(); len(messages) != 1 || messages[0] != "ios" {
+		t.Error("Expected ios message to be sent by apns, found", messages)
+	}
+	if messages := webhook.Messages(); len(messages) != 1 || messages[0] != "chosen" {
+		t.Error("Expected user's chosen channel to be used, found", messages)
+	}
+	if messages := logger.Messages(); len(messages) != 1 || messages[0] != "other" {
+		t.Error("Expected default notifier to be used, found", messages)
+	}
+}
+
+func TestNotifierRouterFallsBack(t *testing.T) {
+	push := &FakeNotifier{err: errors.New("Push failed")}
+	webhook := &FakeNotifier{}
+	router := &NotifierRouter{
+		notifiers: map[string]Notifier{"push": push, "webhook": webhook},
+		os:        map[string]string{Android: "push"},
+		fallbacks: map[string]string{"push": "webhook"},
+	}
+	if err := router.Notify("message", nil, &api.UserInfo{DeviceOS: Android}); err != nil {
+		t.Error("Expected fallback to succeed, found", err)
+	}
+	if messages := webhook.Messages(); len(messages) != 1 {
+		t.Error("Expected message to be sent by fallback, found", messages)
+	}
+	webhook.err = errors.New("Webhook failed")
+	if err := router.Notify("message", nil, &api.UserInfo{DeviceOS: Android}); err == nil {
+		t.Error("Expected error when both notifiers fail")
+	}
+}
+
+func TestNotifierRouterWithoutDefault(t *testing.T) {
+	router := &NotifierRouter{notifiers: map[string]Notifier{}}
+	if err := router.Notify("message", nil, &api.UserInfo{DeviceOS: Android}); err == nil {
+		t.Error("Expected error when no notifier matches")
+	}
+}
+
+func TestNewNotifierRouterChecksNames(t *testing.T) {
+	var config NotifierConfig
+	b := []byte(`{"notifiers": {"log": {"type": "log"}}, "os": {"ios": "apns"}}`)
+	if err := json.Unmarshal(b, &config); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewNotifierRouter(config); err == nil {
+		t.Error("Expected error for unknown notifier")
+	}
+	config.OS = map[string]string{IOS: "log"}
+	if _, err := NewNotifierRouter(config); err != nil {
+		t.Error("Expected no error, found", err)
+	}
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	var payload webhookPayload
+	var auth string
+	var idempotencyKey string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		idempotencyKey = r.Header.Get("Idempotency-Key")
+		b, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(b, &payload)
+	}))
+	defer server.Close()
+	notifier, err := NewWebhookNotifier(WebhookConfig{
+		URL:     server.URL,
+		Headers: map[string]string{"Authorization": "Bearer token"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := map[string]string{"dedupe_key": "1/2017-07-15/leave"}
+	user := &api.UserInfo{ID: "user", NotificationToken: "device", DeviceOS: Android}
+	err = notifier.Notify("Time to leave", data, user)
+	if err != nil {
+		t.Error("Expected no error, found", err)
+	}
+	if payload.Message != "Time to leave" || payload.UserID != "user" {
+		t.Error("Unexpected payload", payload)
+	}
+	if auth != "Bearer token" {
+		t.Error("Expected", "Bearer token", "found", auth)
+	}
+	if idempotencyKey != "1/2017-07-15/leave/device" {
+		t.Error("Expected", "1/2017-07-15/leave/device", "found", idempotencyKey)
+	}
+}
+
+func TestWebhookNotifierFails(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+	notifier, _ := NewWebhookNotifier(WebhookConfig{URL: server.URL})
+	err := notifier.Notify("Time to leave", nil, &api.UserInfo{ID: "user"})
+	if err == nil {
+		t.Error("Expected error for failed response")
+	}
+	if _, err := NewWebhookNotifier(WebhookConfig{}); err == nil {
+		t.Error("Expected error when URL isn't set")
+	}
+}
+
+func TestWebhookNotifierReportsInvalidToken(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusGone)
+		w.Write([]byte(`{"error": "Unregistered"}`))
+	}))
+	defer server.Close()
+	notifier, _ := NewWebhookNotifier(WebhookConfig{URL: server.URL})
+	err := notifier.Notify("Time to leave", nil, &api.UserInfo{ID: "user", NotificationToken: "token"})
+	invalid, ok := err.(*InvalidTokenError)
+	if !ok {
+		t.Fatal("Expected invalid token error, found", err)
+	}
+	if invalid.Reason != "Unregistered" || invalid.Token != "token" {
+		t.Error("Unexpected error", invalid)
+	}
+}
+
+func TestGorushServerNotifier(t *testing.T) {
+	var request gorushRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/push" {
+			t.Error("Expected", "/api/push", "found", r.URL.Path)
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(b, &request)
+		w.Write([]byte(`{"counts": 1, "logs": [{"type": "failed-push", "platform": "ios",
+			"token": "bad", "message": "Time to leave", "error": "BadDeviceToken"}], "success": "ok"}`))
+	}))
+	defer server.Close()
+	notifier, err := NewGorushServerNotifier(GorushServerConfig{URL: server.URL, BundleID: "com.example.tod"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := map[string]string{"dedupe_key": "1/2017-07-15/leave"}
+	err = notifier.Notify("Time to leave", data, &api.UserInfo{NotificationToken: "good", DeviceOS: IOS})
+	if err != nil {
+		t.Error("Expected no error, found", err)
+	}
+	n := request.Notifications[0]
+	if n.Platform != gorushPlatformIOS || n.Topic != "com.example.tod" {
+		t.Error("Unexpected request", n)
+	}
+	if n.CollapseID != "1/2017-07-15/leave" {
+		t.Error("Expected", "1/2017-07-15/leave", "found", n.CollapseID)
+	}
+	err = notifier.Notify("Time to leave", nil, &api.UserInfo{NotificationToken: "bad", DeviceOS: IOS})
+	if invalid, ok := err.(*InvalidTokenError); !ok || invalid.Reason != "BadDeviceToken" {
+		t.Error("Expected invalid token error, found", err)
+	}
+}
+
+func TestParseGorushLogs(t *testing.T) {
+	logs := []gorushLog{{Type: "failed-push", Token: "token", Error: "InternalServerError"}}
+	err := parseGorushLogs(logs, "token")
+	if err == nil {
+		t.Fatal("Expected error for failed push")
+	}
+	if _, ok := err.(*InvalidTokenError); ok {
+		t.Error("Expected temporary errors to not invalidate the token")
+	}
+	if err := parseGorushLogs(logs, "other"); err != nil {
+		t.Error("Expected no error for other tokens, found", err)
+	}
+}
+
+func TestNotifierRouterReportsInvalidTokenAfterFallback(t *testing.T) {
+	push := &FakeNotifier{err: &InvalidTokenError{Token: "token", Reason: "Unregistered"}}
+	router := &NotifierRouter{
+		notifiers: map[string]Notifier{"push": push, "webhook": &FakeNotifier{}},
+		os:        map[string]string{IOS: "push"},
+		fallbacks: map[string]string{"push": "webhook"},
+	}
+	err := router.Notify("message", nil, &api.UserInfo{DeviceOS: IOS})
+	invalid, ok := err.(*InvalidTokenError)
+	if !ok || !invalid.Delivered {
+		t.Error("Expected delivered invalid token error, found", err)
+	}
+}
+
+func TestNotifierRouterReportsProvider(t *testing.T) {
+	router := &NotifierRouter{
+		notifiers: map[string]Notifier{
+			"push":    &FakeNotifier{err: errors.New("Push failed")},
+			"webhook": &FakeNotifier{},
+		},
+		os:        map[string]string{IOS: "push", Android: "webhook"},
+		fallbacks: map[string]string{"push": "webhook"},
+	}
+	provider, err := router.NotifyVia("message", nil, &api.UserInfo{DeviceOS: Android})
+	if err != nil || provider != "webhook" {
+		t.Error("Expected", "webhook", "found", provider, err)
+	}
+	// the fallback delivered the message
+	provider, err = router.NotifyVia("message", nil, &api.UserInfo{DeviceOS: IOS})
+	if err != nil || provider != "webhook" {
+		t.Error("Expected", "webhook", "found", provider, err)
+	}
+}
+
+func TestNotificationSound(t *testing.T) {
+	tests := map[string]string{"": "default", api.SilentSound: "", "chime": "chime"}
+	for sound, expected := range tests {
+		result := notificationSound(&api.UserInfo{Sound: sound})
+		if result != expected {
+			t.Error("Expected", expected, "found", result)
+		}
+	}
+}
+
+func TestCollapseID(t *testing.T) {
+	if id := collapseID(nil); id != "" {
+		t.Error("Expected no collapse ID, found", id)
+	}
+	key := "1/2017-07-15/cancellation/" + strings.Repeat("300", 30)
+	id := collapseID(map[string]string{"dedupe_key": key})
+	if len(id) > maxCollapseIDLength || id != collapseID(map[string]string{"dedupe_key": key}) {
+		t.Error("Expected a stable ID under", maxCollapseIDLength, "bytes, found", id)
+	}
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"container/heap"
+	"fmt"
+	"github.com/oliveroneill/todserver/api"
+	"sync"
+	"time"
+)
+
+// defaultRouteWorkers is the number of route searches that can run at once
+const defaultRouteWorkers = 10
+
+// workerRetryDelay is how long to wait before trying again when every
+// worker is busy
+const workerRetryDelay = 5 * time.Second
+
+// idleWait is how long the scheduler sleeps when there are no trips
+const idleWait = 1 * time.Hour
+
+// AlertFunc is called each time a trip reaches one of its reminders with the
+// latest route found for it
+// @param final - true for the trip's last reminder, which completes the
+// occurrence
+type AlertFunc func(trip *api.TripSchedule, route *api.RouteOption, reminder api.Reminder, final bool)
+
+// RouteFunc is called each time a new route is found for a trip
+type RouteFunc func(trip *api.TripSchedule, route *api.RouteOption)
+
+// Scheduler watches every trip from a single goroutine using a priority
+// queue of the next time each trip should be checked. Route searches are
+// run on a fixed number of workers so that the number of requests made at
+// once doesn't grow with the number of trips
+type Scheduler struct {
+	generator RouteGenerator
+	alert     AlertFunc
+	observe   RouteFunc
+	workers   int
+	queue     scheduleQueue
+	// every trip being watched, including trips that are being alerted
+	entries map[string]*scheduledTrip
+	jobs    chan routeJob
+	wake    chan struct{}
+	quit    chan struct{}
+	mux     sync.Mutex
+}
+
+// scheduledTrip is the scheduler's state for a single trip
+type scheduledTrip struct {
+	trip *api.TripSchedule
+	// the last valid route for this trip
+	route *api.RouteOption
+	// the trip's reminders in the order they're sent
+	reminders []api.Reminder
+	// the index of the next reminder to be sent
+	next int
+	// when the next reminder should be sent
+	notificationTime time.Time
+	nextCheck        time.Time
+	// position in the queue or -1 if it's not queued
+	index int
+	// set once the alert has started so that the trip isn't watched again
+	// until it has finished
+	alerting bool
+}
+
+type routeJob struct {
+	entry            *scheduledTrip
+	trip             *api.TripSchedule
+	notificationTime time.Time
+}
+
+// NewScheduler will create a Scheduler, Start must be called before any
+// trips are checked
+// @param generator - used to find routes for trips
+// @param workers - the number of route searches that can run at once
+// @param alert - called when a trip reaches notification time
+func NewScheduler(generator RouteGenerator, workers int, alert AlertFunc) *Scheduler {
+	if workers <= 0 {
+		workers = defaultRouteWorkers
+	}
+	return &Scheduler{
+		generator: generator,
+		alert:     alert,
+		workers:   workers,
+		queue:     scheduleQueue{},
+		entries:   make(map[string]*scheduledTrip),
+		// buffered so that checks can be queued while workers are starting
+		// or finishing a search
+		jobs: make(chan routeJob, workers),
+		wake: make(chan struct{}, 1),
+		quit: make(chan struct{}),
+	}
+}
+
+// SetRouteObserver will call observe with every new route found. This must
+// be called before Start
+func (s *Scheduler) SetRouteObserver(observe RouteFunc) {
+	s.observe = observe
+}
+
+// Start will begin checking trips in the background
+func (s *Scheduler) Start() {
+	for i := 0; i < s.workers; i++ {
+		go s.work()
+	}
+	go s.run()
+}
+
+// Stop will stop checking trips. Alerts that have already started will
+// still be sent
+func (s *Scheduler) Stop() {
+	close(s.quit)
+}
+
+// Watch will start watching this trip. The trip will be checked straight
+// away and then regularly until it reaches notification time
+// @returns false if the trip is already being watched
+func (s *Scheduler) Watch(trip *api.TripSchedule) bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if _, ok := s.entries[trip.ID]; ok {
+		return false
+	}
+	s.add(trip)
+	return true
+}
+
+// Cancel will stop watching the trip
+// @returns false if the trip isn't being watched or its alert has already
+// started
+func (s *Scheduler) Cancel(tripID string) bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.remove(tripID)
+}
+
+// Reschedule will replace the watched trip with this one, such as when the
+// route or times have been changed. If the trip isn't being watched then it
+// will be added
+// @returns false if the trip's alert has already started
+func (s *Scheduler) Reschedule(trip *api.TripSchedule) bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if entry, ok := s.entries[trip.ID]; ok && entry.alerting {
+		return false
+	}
+	s.remove(trip.ID)
+	s.add(trip)
+	return true
+}
+
+// Trip returns the watched trip with this ID or nil if it isn't being
+// watched
+func (s *Scheduler) Trip(tripID string) *api.TripSchedule {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if entry, ok := s.entries[tripID]; ok {
+		return entry.trip
+	}
+	return nil
+}
+
+// WatchedTrips returns the IDs of every trip being watched
+func (s *Scheduler) WatchedTrips() []string {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	ids := []string{}
+	for id := range s.entries {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// Watched returns the state of every trip being watched
+func (s *Scheduler) Watched() []api.WatchedTrip {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	watched := []api.WatchedTrip{}
+	for id, entry := range s.entries {
+		watched = append(watched, api.WatchedTrip{
+			ID:               id,
+			NotificationTime: entry.notificationTime,
+			Alerting:         entry.alerting,
+		})
+	}
+	return watched
+}
+
+func (s *Scheduler) add(trip *api.TripSchedule) {
+	// get next departure time
+	departureTime := api.GetDepartureTime(trip)
+	// if the notification time has already passed, such as when tripwatcher
+	// was restarted, then this will be sent straight away and the alerter
+	// decides whether it's late or missed
+	entry := &scheduledTrip{
+		trip: trip,
+		// create a new route with current dates as opposed to the stored
+		// ones from the original schedule
+		route:     updateRouteDates(trip.Route, departureTime),
+		reminders: api.GetReminders(trip),
+		nextCheck: time.Now(),
+	}
+	entry.notificationTime = entry.reminderTime(0)
+	s.entries[trip.ID] = entry
+	heap.Push(&s.queue, entry)
+	s.wakeUp()
+}
+
+func (s *Scheduler) remove(tripID string) bool {
+	entry, ok := s.entries[tripID]
+	if !ok || entry.alerting {
+		return false
+	}
+	if entry.index >= 0 {
+		heap.Remove(&s.queue, entry.index)
+	}
+	delete(s.entries, tripID)
+	s.wakeUp()
+	return true
+}
+
+func (s *Scheduler) wakeUp() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Scheduler) run() {
+	timer := time.NewTimer(idleWait)
+	for {
+		s.mux.Lock()
+		wait := s.dispatch(time.Now())
+		s.mux.Unlock()
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+		select {
+		case <-timer.C:
+		case <-s.wake:
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+// dispatch will handle every trip that is due and return how long until
+// the next one is due
+func (s *Scheduler) dispatch(now time.Time) time.Duration {
+	for s.queue.Len() > 0 {
+		entry := s.queue[0]
+		if entry.nextCheck.After(now) {
+			return entry.nextCheck.Sub(now)
+		}
+		heap.Pop(&s.queue)
+		if !now.Before(entry.notificationTime) {
+			s.fire(entry, now)
+			continue
+		}
+		select {
+		case s.jobs <- routeJob{entry: entry, trip: entry.trip, notificationTime: entry.notificationTime}:
+			// the alert shouldn't be missed while waiting for the route
+			entry.nextCheck = entry.notificationTime
+		default:
+			// every worker is busy
+			entry.nextCheck = now.Add(workerRetryDelay)
+			if entry.nextCheck.After(entry.notificationTime) {
+				entry.nextCheck = entry.notificationTime
+			}
+		}
+		heap.Push(&s.queue, entry)
+	}
+	return idleWait
+}
+
+// fire will send the next reminder for this trip in the background. Once
+// the last reminder is sent the trip stays in the watch list until the alert
+// has finished
+func (s *Scheduler) fire(entry *scheduledTrip, now time.Time) {
+	// skip reminders that are overdue when a later one is already due, such
+	// as when tripwatcher was restarted
+	for !entry.isFinal() && !now.Before(entry.reminderTime(entry.next+1)) {
+		entry.next++
+	}
+	reminder := entry.reminders[entry.next]
+	if !entry.isFinal() {
+		go s.alert(entry.trip, entry.route, reminder, false)
+		// check the route straight away so that the next reminder uses
+		// the latest departure time
+		entry.next++
+		entry.notificationTime = entry.reminderTime(entry.next)
+		entry.nextCheck = now
+		heap.Push(&s.queue, entry)
+		return
+	}
+	entry.alerting = true
+	go func() {
+		s.alert(entry.trip, entry.route, reminder, true)
+		s.mux.Lock()
+		if s.entries[entry.trip.ID] == entry {
+			delete(s.entries, entry.trip.ID)
+		}
+		s.mux.Unlock()
+	}()
+}
+
+func (s *Scheduler) work() {
+	for {
+		select {
+		case job := <-s.jobs:
+			route := s.findRoute(job)
+			if s.update(job, route) && s.observe != nil {
+				s.observe(job.trip, route)
+			}
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+// findRoute will wait for a route until the notification time so that slow
+// or unresponsive route requests don't hold up a worker forever
+func (s *Scheduler) findRoute(job routeJob) *api.RouteOption {
+	select {
+	case route := <-s.generator.GenerateRoute(job.trip):
+		return route
+	case <-time.After(job.notificationTime.Sub(time.Now())):
+		return nil
+	}
+}
+
+// update will store the route and work out when the trip should next be
+// checked
+// @returns true if a new route was found for a trip that's still watched
+func (s *Scheduler) update(job routeJob, route *api.RouteOption) bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	entry := job.entry
+	// the trip may have been cancelled, rescheduled or alerted while we
+	// were waiting
+	if s.entries[entry.trip.ID] != entry || entry.alerting {
+		return false
+	}
+	found := route != nil
+	if !found {
+		fmt.Println("No route found, using", entry.route.Provider, "route for", entry.trip.ID)
+		// the last known route is only as good as the schedule it was
+		// found with, so it's labelled as such
+		scheduled := *entry.route
+		scheduled.Provider = api.ScheduleProvider
+		route = &scheduled
+	}
+	entry.route = route
+	now := time.Now()
+	// calculate next notification time
+	entry.notificationTime = entry.reminderTime(entry.next)
+	timeLeft := entry.notificationTime.Sub(now)
+	if timeLeft <= 0 {
+		entry.nextCheck = now
+	} else {
+		// get the next time that we should re-check the route
+		entry.nextCheck = now.Add(roundToNextInterval(timeLeft))
+		// ensure that we don't overshoot the notification time
+		if entry.nextCheck.After(entry.notificationTime) {
+			entry.nextCheck = entry.notificationTime
+		}
+	}
+	heap.Fix(&s.queue, entry.index)
+	s.wakeUp()
+	return found
+}
+
+// reminderTime returns when the reminder at this index should be sent based
+// on the latest route
+func (e *scheduledTrip) reminderTime(i int) time.Time {
+	return e.route.DepartureTime.Add(-reminderBuffer(e.reminders[i]))
+}
+
+// isFinal returns true if the next reminder is the trip's last one
+func (e *scheduledTrip) isFinal() bool {
+	return e.next == len(e.reminders)-1
+}
+
+// scheduleQueue is a heap of trips ordered by their next check time
+type scheduleQueue []*scheduledTrip
+
+func (q scheduleQueue) Len() int { return len(q) }
+
+func (q scheduleQueue) Less(i, j int) bool {
+	return q[i].nextCheck.Before(q[j].nextCheck)
+}
+
+func (q scheduleQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *scheduleQueue) Push(x interface{}) {
+	entry := x.(*scheduledTrip)
+	entry.index = len(*q)
+	*q = append(*q, entry)
+}
+
+func (q *scheduleQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	entry := old[n-1]
+	old[n-1] = nil
+	entry.index = -1
+	*q = old[:n-1]
+	return entry
+}
@@ -0,0 +1,35 @@
+package main
+
+import "fmt"
+
+// invalidTokenReasons are the errors that APNS and FCM return when a device
+// token will never work again, such as when the app has been uninstalled
+var invalidTokenReasons = map[string]bool{
+	// APNS
+	"BadDeviceToken":         true,
+	"DeviceTokenNotForTopic": true,
+	"Unregistered":           true,
+	// FCM
+	"InvalidRegistration": true,
+	"NotRegistered":       true,
+	"UNREGISTERED":        true,
+}
+
+// isInvalidTokenReason returns true if the provider's error means that the
+// token should no longer be used
+func isInvalidTokenReason(reason string) bool {
+	return invalidTokenReasons[reason]
+}
+
+// InvalidTokenError is returned by a Notifier when the push provider has
+// rejected the user's token
+type InvalidTokenError struct {
+	Token  string
+	Reason string
+	// true if the message was still delivered using a fallback notifier
+	Delivered bool
+}
+
+func (e *InvalidTokenError) Error() string {
+	return fmt.Sprintf("Invalid device token: %s", e.Reason)
+}
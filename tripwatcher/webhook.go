@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/oliveroneill/todserver/api"
+	"net/http"
+	"time"
+)
+
+// webhookTimeout is how long to wait for the webhook to respond
+const webhookTimeout = 10 * time.Second
+
+// WebhookNotifier is an implementation of Notifier that posts each message
+// as JSON to a URL
+type WebhookNotifier struct {
+	url     string
+	headers map[string]string
+	client  *http.Client
+}
+
+// WebhookConfig is the config for a webhook notifier
+type WebhookConfig struct {
+	URL string `json:"url"`
+	// extra headers sent with each request, such as for authentication
+	Headers map[string]string `json:"headers"`
+}
+
+// webhookPayload is the body sent to the webhook
+type webhookPayload struct {
+	UserID            string            `json:"user_id"`
+	NotificationToken string            `json:"notification_token"`
+	DeviceOS          string            `json:"device_os"`
+	Message           string            `json:"message"`
+	Sound             string            `json:"sound,omitempty"`
+	Data              map[string]string `json:"data,omitempty"`
+}
+
+func newWebhookNotifierFromConfig(c api.ProviderConfig) (Notifier, error) {
+	var config WebhookConfig
+	if err := c.Decode(&config); err != nil {
+		return nil, err
+	}
+	return NewWebhookNotifier(config)
+}
+
+// NewWebhookNotifier will create a WebhookNotifier
+func NewWebhookNotifier(config WebhookConfig) (*WebhookNotifier, error) {
+	if len(config.URL) == 0 {
+		return nil, errors.New("No webhook URL set")
+	}
+	return &WebhookNotifier{
+		url:     config.URL,
+		headers: config.Headers,
+		client:  &http.Client{Timeout: webhookTimeout},
+	}, nil
+}
+
+// webhookError is the optional body of a failed webhook response
+type webhookError struct {
+	Error string `json:"error"`
+}
+
+// Notify will post the message to the webhook. Any response other than a
+// 2xx status is treated as an error. A 410 Gone response means that the
+// user's token is no longer valid
+func (n *WebhookNotifier) Notify(message string, data map[string]string, user *api.UserInfo) error {
+	b, err := json.Marshal(webhookPayload{
+		UserID:            user.ID,
+		NotificationToken: user.NotificationToken,
+		DeviceOS:          user.DeviceOS,
+		Message:           message,
+		Sound:             notificationSound(user),
+		Data:              data,
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", n.url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	// the same for every attempt to send this notification to this device
+	if key := collapseID(data); len(key) > 0 {
+		req.Header.Set("Idempotency-Key", key+"/"+user.NotificationToken)
+	}
+	for key, value := range n.headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusGone {
+		reason := resp.Status
+		var body webhookError
+		if json.NewDecoder(resp.Body).Decode(&body) == nil && len(body.Error) > 0 {
+			reason = body.Error
+		}
+		return &InvalidTokenError{Token: user.NotificationToken, Reason: reason}
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("Webhook returned %s", resp.Status)
+	}
+	return nil
+}